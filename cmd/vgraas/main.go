@@ -1,35 +1,389 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/nsmith5/vgraas/pkg/certs"
+	"github.com/nsmith5/vgraas/pkg/config"
+	"github.com/nsmith5/vgraas/pkg/health"
+	"github.com/nsmith5/vgraas/pkg/logging"
 	"github.com/nsmith5/vgraas/pkg/middleware"
+	"github.com/nsmith5/vgraas/pkg/resp"
+	"github.com/nsmith5/vgraas/pkg/tracing"
 	"github.com/nsmith5/vgraas/pkg/vgraas"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
-	var (
-		addr = flag.String("api", ":8080", "API listen address")
+	loader, err := config.NewLoader(os.Args[0], os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+	cfg, err := loader.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if loader.Print {
+		cfg.Write(os.Stdout)
+		return
+	}
+
+	level, _ := logging.ParseLevel(cfg.Log.Level)
+	logger := logging.New(os.Stdout, level)
+	if loader.File != "" {
+		logger.Info("Loaded configuration", "file", loader.File)
+	}
+
+	tracer, closeTraces, err := newTracer(cfg.Tracing.Exporter, cfg.Tracing.File)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeTraces()
+
+	repo := vgraas.Adapt(vgraas.NewRAMRepo())
+	prometheus.MustRegister(vgraas.RepoCollector(repo))
+
+	// Events for every change are published on the bus and
+	// delivered to webhook subscribers
+	bus := vgraas.NewBus()
+	hooks := vgraas.NewWebhooks(bus, vgraas.WebhookConfig{
+		AllowPrivate: cfg.Webhooks.AllowPrivate,
+		Logger:       logger,
+	})
+
+	// Deleted reviews and comments are kept in the repo for a while to
+	// be restored, see below
+	var trash *vgraas.Trash
+
+	// The latest versions of reviews and comments are kept to be
+	// compared and reverted
+	var revisions *vgraas.Revisions
+	if cfg.Revisions.Enabled {
+		revisions = vgraas.NewRevisions(vgraas.RevisionsConfig{
+			Max: int(cfg.Revisions.Max),
+		})
+	}
+
+	// Readiness checks. shuttingDown is set once shutdown begins so
+	// that /readyz starts failing
+	var shuttingDown int32
+	checks := health.New()
+	checks.AddReadiness("repo", vgraas.PingRepo(repo))
+	checks.AddReadiness("webhook-queue", hooks.QueueChecker(900))
+	checks.AddReadiness("shutdown", health.CheckerFunc(func(context.Context) error {
+		if atomic.LoadInt32(&shuttingDown) == 1 {
+			return errors.New("Shutting down")
+		}
+		return nil
+	}))
+
+	// Rate limit requests per user, or client address for anonymous
+	// requests, with policies by route and method. The configuration
+	// has been validated already
+	policies, _ := cfg.RateLimit.ParsePolicies()
+	clientIP, _ := middleware.NewClientIP(cfg.RateLimit.TrustedProxies)
+	allowNets, allowUsers, _ := cfg.RateLimit.AllowList()
+	store := newLimiterStore(cfg.RateLimit.Redis, "vgraas:ratelimit:")
+	limiter := middleware.NewStoreRateLimiter(store, policies, middleware.Allowlist(
+		middleware.UserKey(middleware.IPKey(clientIP)),
+		clientIP, allowNets, allowUsers...,
+	))
+
+	// Every client address also gets a coarse budget before API keys
+	// are checked, so that guessing them is throttled too
+	perIPPolicies, _ := cfg.RateLimit.ParsePerIP()
+	perIP := middleware.NewStoreRateLimiter(
+		newLimiterStore(cfg.RateLimit.Redis, "vgraas:ratelimit:perip:"),
+		perIPPolicies, middleware.Allowlist(middleware.IPKey(clientIP), clientIP, allowNets),
 	)
-	flag.Parse()
+
+	// Who changed what is recorded in the audit log, from the same
+	// client addresses the rate limits go by
+	var audit *vgraas.Audit
+	if cfg.Audit.Enabled {
+		audit, err = vgraas.NewAudit(vgraas.AuditConfig{
+			File:       cfg.Audit.File,
+			MaxEntries: int(cfg.Audit.MaxEntries),
+			ClientIP:   clientIP,
+			Logger:     logger,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	bodies := middleware.NewBodyLimiter(cfg.Server.BodyLimit)
+	imports := middleware.NewBodyLimiter(cfg.Server.ImportLimit)
+	cors := middleware.NewCORS(cfg.CORS.Policy())
+
+	// Reload the configuration on SIGHUP or when the file changes
+	reload := &reloader{
+		loader:  loader,
+		logger:  logger,
+		limiter: limiter,
+		perIP:   perIP,
+		bodies:  bodies,
+		imports: imports,
+		cors:    cors,
+		cfg:     cfg,
+	}
+	stopReloads := make(chan struct{})
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-stopReloads:
+				return
+			case <-hup:
+				reload.reload("SIGHUP")
+			}
+		}
+	}()
+	if loader.File != "" && loader.WatchInterval > 0 {
+		go config.Watch(loader.File, loader.WatchInterval, stopReloads, func() {
+			reload.reload("file changed")
+		})
+	}
 
 	var api http.Handler
 	{
-		repo := vgraas.NewRAMRepo()
-		api = vgraas.NewAPI(repo)
+		// Popular reviews are kept in memory. The cache goes in front
+		// of the metrics and spans so that they are about storage
+		backend := vgraas.Instrument(vgraas.Trace(repo))
+		if cfg.Storage.Cached() {
+			backend = vgraas.Cache(backend, cfg.Storage.CacheOptions())
+		}
+		if cfg.Trash.Retention.Duration > 0 {
+			trash = vgraas.NewTrash(backend, vgraas.TrashConfig{
+				Retention:     cfg.Trash.Retention.Duration,
+				PurgeInterval: cfg.Trash.PurgeInterval.Duration,
+				Logger:        logger,
+			})
+		}
+
+		api = vgraas.NewAPI(backend,
+			vgraas.WithBus(bus),
+			vgraas.WithWebhooks(hooks),
+			vgraas.WithTrash(trash),
+			vgraas.WithRevisions(revisions),
+			vgraas.WithAudit(audit),
+			vgraas.WithAdmins(cfg.Auth.Admins...),
+			vgraas.WithHealth(checks),
+			vgraas.WithTimeout(cfg.Server.RequestTimeout.Duration),
+			vgraas.WithCache(cfg.Cache.MaxAge.Duration, int(cfg.Cache.Size)),
+
+			// Rate limiting by route, once we know who is calling
+			vgraas.WithRouteMiddleware(limiter.Route),
+		)
+
+		// Identify callers by API key, or else by client certificate
+		api = middleware.Authenticate(api, cfg.Auth.Keys())
+		api = middleware.ClientCert(api, cfg.TLS.Users())
+
+		// Coarse rate limiting by client address, unknown API keys
+		// included
+		api = perIP.Handler(api)
+
+		// Limit request size, 500 KiB by default and 256 MiB for imports
+		api = limitBodies(api, bodies, imports)
+
+		// Let browsers call the API from other origins. Errors from
+		// further in, rejected API keys for instance, are readable too
+		api = cors.Handler(api)
+
+		// Request counts and latencies by route
+		api = middleware.Metrics(api)
 
-		// Limit request size to 500 KiB
-		api = middleware.LimitBody(api, 1<<19)
+		// Compress responses for clients that accept it. Request logs
+		// record the compressed size
+		api = middleware.Compress(api)
 
-		// Rate limit requests to 5Hz per remote address with bursts of 2
-		api = middleware.RateLimit(api, 5, 2, middleware.XForwardedFor)
+		// A span per request, joining the caller's trace if there is one
+		api = middleware.Tracing(api, tracer)
 
 		// Logging
-		api = middleware.Logging(api, os.Stdout)
+		api = middleware.LogRequests(api, logger)
+
+		// Tag requests with an ID for logs and error reports
+		api = middleware.RequestID(api)
+	}
+
+	// Metrics are served next to the API rather than through it, so
+	// scrapes aren't rate limited or counted as API requests
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/", api)
+
+	srv := &http.Server{
+		Addr:              cfg.Server.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout.Duration,
+		ReadTimeout:       cfg.Server.ReadTimeout.Duration,
+		WriteTimeout:      cfg.Server.WriteTimeout.Duration,
+		IdleTimeout:       cfg.Server.IdleTimeout.Duration,
 	}
 
-	log.Println(http.ListenAndServe(*addr, api))
+	// Serve HTTPS when there is a certificate, reloading it as it is
+	// renewed on disk
+	errs := make(chan error, 2)
+	var redirect *http.Server
+	if cfg.TLS.CertFile == "" {
+		go func() {
+			errs <- srv.ListenAndServe()
+		}()
+	} else {
+		certFile := cfg.TLS.CertFile
+		certReloader, err := certs.NewReloader(certFile, cfg.TLS.KeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if srv.TLSConfig, err = certs.ServerConfig(certReloader, cfg.TLS.Options()); err != nil {
+			log.Fatal(err)
+		}
+		if interval := cfg.TLS.ReloadInterval.Duration; interval > 0 {
+			go certReloader.Watch(interval, stopReloads, func(err error) {
+				if err != nil {
+					logger.Error("Failed to reload certificate, keeping the current one", "file", certFile, "err", err)
+					return
+				}
+				logger.Info("Reloaded certificate", "file", certFile)
+			})
+		}
+		go func() {
+			errs <- srv.ListenAndServeTLS("", "")
+		}()
+
+		// Send plain HTTP requests over to HTTPS
+		if cfg.TLS.RedirectAddr != "" {
+			_, port, _ := net.SplitHostPort(cfg.Server.Addr)
+			redirect = &http.Server{
+				Addr:              cfg.TLS.RedirectAddr,
+				Handler:           middleware.RedirectHTTPS(port),
+				ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout.Duration,
+				IdleTimeout:       cfg.Server.IdleTimeout.Duration,
+			}
+			go func() {
+				errs <- redirect.ListenAndServe()
+			}()
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-errs:
+		logger.Error("Server failed", "err", err)
+		os.Exit(1)
+	case sig := <-signals:
+		logger.Info("Shutting down", "signal", sig.String())
+	}
+
+	// Stop reloading, shutdown uses the configuration as it is now
+	signal.Stop(hup)
+	close(stopReloads)
+	cfg = reload.config()
+
+	// Fail readiness first and give load balancers a moment to notice
+	atomic.StoreInt32(&shuttingDown, 1)
+	time.Sleep(cfg.Server.ShutdownDelay.Duration)
+
+	// Hang up on event streams and live connections, which would
+	// otherwise hold up the drain until it times out
+	bus.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.DrainTimeout.Duration)
+	defer cancel()
+	if redirect != nil {
+		redirect.Shutdown(ctx)
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn("Failed to drain connections", "err", err)
+	}
+
+	hooks.Close()
+	if trash != nil {
+		trash.Close()
+	}
+	if audit != nil {
+		if err := audit.Close(); err != nil {
+			logger.Error("Failed to close audit log", "err", err)
+		}
+	}
+	limiter.Close()
+	perIP.Close()
+	if closer, ok := repo.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Error("Failed to close repository", "err", err)
+		}
+	}
+	logger.Info("Shut down")
+}
+
+// newTracer returns a tracer for the named exporter, writing to file or
+// stdout, and a function to close the file with.
+func newTracer(exporter, file string) (*tracing.Tracer, func(), error) {
+	var out io.Writer = os.Stdout
+	closer := func() {}
+	if exporter != "" && file != "" {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		out = f
+		closer = func() { f.Close() }
+	}
+
+	switch exporter {
+	case "":
+		return tracing.NewTracer(nil), closer, nil
+	case "stdout":
+		return tracing.NewTracer(tracing.NewJSONExporter(out)), closer, nil
+	case "otlp":
+		return tracing.NewTracer(tracing.NewOTLPExporter(out, "vgraas")), closer, nil
+	default:
+		closer()
+		return nil, nil, fmt.Errorf("Unknown trace exporter '%s'", exporter)
+	}
+}
+
+// limitBodies limits the size of imports with imports and of every
+// other request body with bodies.
+func limitBodies(next http.Handler, bodies, imports *middleware.BodyLimiter) http.Handler {
+	limited, imported := bodies.Handler(next), imports.Handler(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/admin/import" {
+			imported.ServeHTTP(w, r)
+			return
+		}
+		limited.ServeHTTP(w, r)
+	})
+}
+
+// newLimiterStore returns a store for rate limits on the Redis server at
+// url, under keys starting with prefix, or in memory if url is empty. The
+// url must have been validated.
+func newLimiterStore(url, prefix string) middleware.Store {
+	if url == "" {
+		return middleware.NewMemoryStore()
+	}
+	cfg, _ := resp.ParseURL(url)
+	return middleware.NewRedisStore(resp.New(cfg), prefix)
 }
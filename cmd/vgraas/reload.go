@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/nsmith5/vgraas/pkg/config"
+	"github.com/nsmith5/vgraas/pkg/logging"
+	"github.com/nsmith5/vgraas/pkg/middleware"
+)
+
+// live lists the settings that take effect without a restart.
+var live = map[string]bool{
+	"cors.origins":         true,
+	"cors.methods":         true,
+	"cors.headers":         true,
+	"cors.exposeHeaders":   true,
+	"cors.credentials":     true,
+	"cors.maxAge":          true,
+	"log.level":            true,
+	"rateLimit.policies":   true,
+	"rateLimit.perIP":      true,
+	"server.bodyLimit":     true,
+	"server.importLimit":   true,
+	"server.shutdownDelay": true,
+	"server.drainTimeout":  true,
+}
+
+// reloader applies configuration changes to the running server. Changes
+// apply to requests that start afterwards, requests in flight and open
+// connections are left alone.
+type reloader struct {
+	loader  *config.Loader
+	logger  *logging.Logger
+	limiter *middleware.RateLimiter
+	perIP   *middleware.RateLimiter
+	bodies  *middleware.BodyLimiter
+	imports *middleware.BodyLimiter
+	cors    *middleware.CORS
+
+	mtx sync.Mutex
+	cfg *config.Config
+}
+
+// config returns the current configuration.
+func (r *reloader) config() *config.Config {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.cfg
+}
+
+// reload loads the configuration again and applies what changed. An
+// invalid configuration is rejected as a whole and the current one kept.
+func (r *reloader) reload(reason string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	next, err := r.loader.Load()
+	if err != nil {
+		r.logger.Error("Rejected new configuration, keeping the current one", "reason", reason, "err", err)
+		return
+	}
+	changes := config.Diff(r.cfg, next)
+	if len(changes) == 0 {
+		r.logger.Info("Configuration unchanged", "reason", reason)
+		return
+	}
+
+	// Validated by Load
+	level, _ := logging.ParseLevel(next.Log.Level)
+	policies, _ := next.RateLimit.ParsePolicies()
+	perIP, _ := next.RateLimit.ParsePerIP()
+	r.logger.SetLevel(level)
+	r.limiter.SetPolicies(policies)
+	r.perIP.SetPolicies(perIP)
+	r.bodies.SetLimit(next.Server.BodyLimit)
+	r.imports.SetLimit(next.Server.ImportLimit)
+	r.cors.SetPolicy(next.CORS.Policy())
+
+	for _, c := range changes {
+		if live[c.Name] {
+			r.logger.Info("Configuration changed", "reason", reason, "setting", c.Name, "old", c.Old, "new", c.New)
+		} else {
+			r.logger.Warn("Configuration changed, restart to apply", "reason", reason, "setting", c.Name, "old", c.Old, "new", c.New)
+		}
+	}
+	r.cfg = next
+}
@@ -3,7 +3,10 @@ module github.com/nsmith5/vgraas
 go 1.12
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/gorilla/context v1.1.1 // indirect
 	github.com/gorilla/mux v1.6.2
-	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
+	github.com/gorilla/websocket v1.4.0
+	github.com/prometheus/client_golang v1.0.0
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,224 @@
+// Package certs serves TLS certificates from files, reloading them as
+// they are rotated on disk, and builds server TLS configurations from
+// settings written as strings.
+package certs
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reloader serves a certificate and key pair read from files. The files
+// are read again by Reload, or periodically by Watch, so certificates
+// can be rotated without a restart.
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mtx  sync.RWMutex
+	cert *tls.Certificate
+	sum  [sha256.Size]byte
+}
+
+// NewReloader loads the pair in certFile and keyFile.
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, it fits
+// tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.cert, nil
+}
+
+// Reload reads the files and swaps in the pair if either changed. It
+// reports whether it did. A pair that doesn't load, for instance because
+// the certificate has been replaced and the key not yet, is an error
+// and the current pair is kept.
+func (r *Reloader) Reload() (bool, error) {
+	certPEM, err := ioutil.ReadFile(r.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := ioutil.ReadFile(r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(append(certPEM, keyPEM...))
+
+	r.mtx.RLock()
+	unchanged := r.cert != nil && sum == r.sum
+	r.mtx.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("Failed to load %s and %s: %s", r.certFile, r.keyFile, err)
+	}
+
+	r.mtx.Lock()
+	r.cert, r.sum = &cert, sum
+	r.mtx.Unlock()
+	return true, nil
+}
+
+// Watch calls Reload every interval until quit is closed. reloaded is
+// called with nil when a new pair was swapped in, and with the error
+// when the files changed but couldn't be loaded.
+func (r *Reloader) Watch(interval time.Duration, quit <-chan struct{}, reloaded func(err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			changed, err := r.Reload()
+			if changed || err != nil {
+				reloaded(err)
+			}
+		}
+	}
+}
+
+// Options are the settings of a server TLS configuration.
+type Options struct {
+	// MinVersion is "1.0", "1.1", "1.2" or "1.3", "1.2" if empty.
+	MinVersion string
+
+	// CipherSuites are the names of the suites allowed for TLS 1.2
+	// and older, like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. The
+	// defaults of crypto/tls if empty. TLS 1.3 suites can't be
+	// configured.
+	CipherSuites []string
+
+	// ClientAuth is "none", "optional" to verify client certificates
+	// when given or "require" to insist on them.
+	ClientAuth string
+
+	// ClientCAFile holds the PEM encoded certificates client
+	// certificates are verified against.
+	ClientCAFile string
+}
+
+// ServerConfig returns a TLS configuration serving certificates from r.
+func ServerConfig(r *Reloader, opts Options) (*tls.Config, error) {
+	min, err := ParseVersion(opts.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := ParseCipherSuites(opts.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := ParseClientAuth(opts.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		GetCertificate: r.GetCertificate,
+		MinVersion:     min,
+		CipherSuites:   suites,
+		ClientAuth:     auth,
+	}
+	if auth != tls.NoClientCert {
+		if cfg.ClientCAs, err = LoadCAs(opts.ClientCAFile); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// LoadCAs reads a pool of PEM encoded certificates from file.
+func LoadCAs(file string) (*x509.CertPool, error) {
+	if file == "" {
+		return nil, fmt.Errorf("Client certificates need a CA file to be verified against")
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("No certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseVersion parses a TLS version like "1.2". Empty is 1.2.
+func ParseVersion(s string) (uint16, error) {
+	if s == "" {
+		return tls.VersionTLS12, nil
+	}
+	v, ok := versions[s]
+	if !ok {
+		return 0, fmt.Errorf("Unknown TLS version '%s', expected 1.0, 1.1, 1.2 or 1.3", s)
+	}
+	return v, nil
+}
+
+var suites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// ParseCipherSuites parses cipher suite names. Empty is nil, the
+// defaults of crypto/tls.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		id, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown cipher suite '%s'", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ParseClientAuth parses "none", "optional" or "require". Empty is none.
+func ParseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch s {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("Unknown client auth '%s', expected none, optional or require", s)
+}
@@ -0,0 +1,205 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsmith5/vgraas/pkg/middleware"
+)
+
+// issue returns a new PEM encoded certificate and key for name, signed
+// by parent or self-signed if parent is nil.
+func issue(t *testing.T, name string, parent *tls.Certificate) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, _ = x509.ParseCertificate(parent.Certificate[0])
+		signerKey = parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "vgraas-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func write(t *testing.T, path string, b []byte) {
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func commonName(t *testing.T, r *Reloader) string {
+	cert, _ := r.GetCertificate(nil)
+	x, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x.Subject.CommonName
+}
+
+func TestReloader(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	certA, keyA := issue(t, "a", nil)
+	write(t, certFile, certA)
+	write(t, keyFile, keyA)
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := r.Reload(); changed || err != nil {
+		t.Errorf("Expected nothing to reload, got %v, %v", changed, err)
+	}
+
+	// Half way through a rotation the pair doesn't match
+	certB, keyB := issue(t, "b", nil)
+	write(t, certFile, certB)
+	if _, err := r.Reload(); err == nil {
+		t.Error("Expected a mismatched pair to be rejected")
+	}
+	if name := commonName(t, r); name != "a" {
+		t.Errorf("Expected to keep serving a, got %s", name)
+	}
+
+	write(t, keyFile, keyB)
+	if changed, err := r.Reload(); !changed || err != nil {
+		t.Fatalf("Expected the new pair to load, got %v, %v", changed, err)
+	}
+	if name := commonName(t, r); name != "b" {
+		t.Errorf("Expected to serve b, got %s", name)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	caPEM, caKeyPEM := issue(t, "ca", nil)
+	ca, err := tls.X509KeyPair(caPEM, caKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, path("ca.crt"), caPEM)
+	serverPEM, serverKeyPEM := issue(t, "server", &ca)
+	write(t, path("tls.crt"), serverPEM)
+	write(t, path("tls.key"), serverKeyPEM)
+
+	r, err := NewReloader(path("tls.crt"), path("tls.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ServerConfig(r, Options{ClientAuth: "optional", ClientCAFile: path("ca.crt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// httptest.Server.StartTLS would serve its own certificate
+	srv := httptest.NewUnstartedServer(middleware.ClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(middleware.User(r)))
+	}), nil))
+	srv.Listener = tls.NewListener(srv.Listener, cfg)
+	srv.Start()
+	defer srv.Close()
+	url := strings.Replace(srv.URL, "http:", "https:", 1)
+
+	get := func(client ...tls.Certificate) string {
+		roots, _ := LoadCAs(path("ca.crt"))
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: client,
+		}}}
+		resp, err := c.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	alicePEM, aliceKeyPEM := issue(t, "alice", &ca)
+	alice, _ := tls.X509KeyPair(alicePEM, aliceKeyPEM)
+	if user := get(alice); user != "alice" {
+		t.Errorf("Expected the client certificate to identify alice, got %q", user)
+	}
+	if user := get(); user != "" {
+		t.Errorf("Expected no certificate to be anonymous, got %q", user)
+	}
+}
+
+func TestParse(t *testing.T) {
+	if v, err := ParseVersion(""); err != nil || v != tls.VersionTLS12 {
+		t.Errorf("Expected TLS 1.2 by default, got %x, %v", v, err)
+	}
+	if v, err := ParseVersion("1.3"); err != nil || v != tls.VersionTLS13 {
+		t.Errorf("Expected TLS 1.3, got %x, %v", v, err)
+	}
+	if _, err := ParseVersion("1.4"); err == nil {
+		t.Error("Expected 1.4 to be rejected")
+	}
+
+	ids, err := ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"})
+	if err != nil || len(ids) != 1 || ids[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("Unexpected suites %v, %v", ids, err)
+	}
+	if _, err := ParseCipherSuites([]string{"TLS_NULL"}); err == nil {
+		t.Error("Expected unknown suites to be rejected")
+	}
+
+	if _, err := ParseClientAuth("sometimes"); err == nil {
+		t.Error("Expected unknown client auth to be rejected")
+	}
+	if _, err := ServerConfig(&Reloader{}, Options{ClientAuth: "require"}); err == nil {
+		t.Error("Expected client auth without a CA file to be rejected")
+	}
+}
@@ -0,0 +1,536 @@
+// Package config holds the settings of the vgraas server.
+//
+// Settings come from, in increasing order of precedence: defaults, a
+// YAML or TOML file, VGRAAS_* environment variables and command line
+// flags. See Loader.
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nsmith5/vgraas/pkg/certs"
+	"github.com/nsmith5/vgraas/pkg/logging"
+	"github.com/nsmith5/vgraas/pkg/middleware"
+	"github.com/nsmith5/vgraas/pkg/resp"
+	"github.com/nsmith5/vgraas/pkg/vgraas"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the configuration of the vgraas server. Field names in files
+// are the lower camel case yaml tags.
+type Config struct {
+	Server    Server    `yaml:"server" toml:"server"`
+	TLS       TLS       `yaml:"tls" toml:"tls"`
+	CORS      CORS      `yaml:"cors" toml:"cors"`
+	Cache     Cache     `yaml:"cache" toml:"cache"`
+	Log       Log       `yaml:"log" toml:"log"`
+	Tracing   Tracing   `yaml:"tracing" toml:"tracing"`
+	RateLimit RateLimit `yaml:"rateLimit" toml:"rateLimit"`
+	Auth      Auth      `yaml:"auth" toml:"auth"`
+	Storage   Storage   `yaml:"storage" toml:"storage"`
+	Webhooks  Webhooks  `yaml:"webhooks" toml:"webhooks"`
+	Trash     Trash     `yaml:"trash" toml:"trash"`
+	Revisions Revisions `yaml:"revisions" toml:"revisions"`
+	Audit     Audit     `yaml:"audit" toml:"audit"`
+}
+
+// Server configures the HTTP server.
+type Server struct {
+	Addr              string   `yaml:"addr" toml:"addr"`
+	ReadHeaderTimeout Duration `yaml:"readHeaderTimeout" toml:"readHeaderTimeout"`
+	ReadTimeout       Duration `yaml:"readTimeout" toml:"readTimeout"`
+	WriteTimeout      Duration `yaml:"writeTimeout" toml:"writeTimeout"`
+	IdleTimeout       Duration `yaml:"idleTimeout" toml:"idleTimeout"`
+	RequestTimeout    Duration `yaml:"requestTimeout" toml:"requestTimeout"`
+	ShutdownDelay     Duration `yaml:"shutdownDelay" toml:"shutdownDelay"`
+	DrainTimeout      Duration `yaml:"drainTimeout" toml:"drainTimeout"`
+
+	// BodyLimit is the largest request body accepted, in bytes.
+	BodyLimit int64 `yaml:"bodyLimit" toml:"bodyLimit"`
+
+	// ImportLimit is the largest import accepted, in bytes. Imports
+	// are whole exports so they get a limit of their own.
+	ImportLimit int64 `yaml:"importLimit" toml:"importLimit"`
+}
+
+// TLS configures HTTPS. The server speaks plain HTTP if CertFile is
+// empty. See certs.Options for the meaning of the other settings.
+type TLS struct {
+	CertFile     string   `yaml:"certFile" toml:"certFile"`
+	KeyFile      string   `yaml:"keyFile" toml:"keyFile"`
+	MinVersion   string   `yaml:"minVersion" toml:"minVersion"`
+	CipherSuites []string `yaml:"cipherSuites" toml:"cipherSuites"`
+	ClientAuth   string   `yaml:"clientAuth" toml:"clientAuth"`
+	ClientCAFile string   `yaml:"clientCAFile" toml:"clientCAFile"`
+
+	// ClientUsers are name:user pairs mapping client certificate
+	// names to users, see middleware.ClientCert.
+	ClientUsers []string `yaml:"clientUsers" toml:"clientUsers"`
+
+	// RedirectAddr is where HTTP requests are redirected to HTTPS
+	// from, nowhere if empty.
+	RedirectAddr string `yaml:"redirectAddr" toml:"redirectAddr"`
+
+	// ReloadInterval is how often the certificate and key are checked
+	// for changes, never if 0.
+	ReloadInterval Duration `yaml:"reloadInterval" toml:"reloadInterval"`
+}
+
+// CORS configures cross-origin requests from browsers, see
+// middleware.CORSPolicy.
+type CORS struct {
+	Origins       []string `yaml:"origins" toml:"origins"`
+	Methods       []string `yaml:"methods" toml:"methods"`
+	Headers       []string `yaml:"headers" toml:"headers"`
+	ExposeHeaders []string `yaml:"exposeHeaders" toml:"exposeHeaders"`
+	Credentials   bool     `yaml:"credentials" toml:"credentials"`
+	MaxAge        Duration `yaml:"maxAge" toml:"maxAge"`
+}
+
+// Cache configures HTTP caching of reviews and comments, see
+// vgraas.WithCache.
+type Cache struct {
+	MaxAge Duration `yaml:"maxAge" toml:"maxAge"`
+
+	// Size is the number of responses kept in memory, none if 0.
+	Size int64 `yaml:"size" toml:"size"`
+}
+
+// Log configures logging.
+type Log struct {
+	Level string `yaml:"level" toml:"level"`
+}
+
+// Tracing configures the export of trace spans.
+type Tracing struct {
+	Exporter string `yaml:"exporter" toml:"exporter"`
+	File     string `yaml:"file" toml:"file"`
+}
+
+// RateLimit configures rate limiting, see middleware.RateLimiter.
+type RateLimit struct {
+	TrustedProxies []string `yaml:"trustedProxies" toml:"trustedProxies"`
+	Allow          []string `yaml:"allow" toml:"allow"`
+	Policies       []string `yaml:"policies" toml:"policies"`
+	Redis          string   `yaml:"redis" toml:"redis"`
+
+	// PerIP is a rate:burst policy, or "unlimited", for every client
+	// address. It applies before callers are authenticated, so that
+	// rejected API keys count too, on top of Policies.
+	PerIP string `yaml:"perIP" toml:"perIP"`
+}
+
+// Auth configures authentication.
+type Auth struct {
+	// APIKeys are key:user pairs.
+	APIKeys []string `yaml:"apiKeys" toml:"apiKeys"`
+
+	// Admins are the users allowed to use the admin endpoints, any
+	// authenticated user if empty.
+	Admins []string `yaml:"admins" toml:"admins"`
+}
+
+// Storage configures where reviews and comments are kept.
+type Storage struct {
+	// Type is the kind of repository, only "memory" for now.
+	Type string `yaml:"type" toml:"type"`
+
+	// Reviews are cached in front of the repository when either limit
+	// is set, see vgraas.Cache.
+	CacheEntries int64    `yaml:"cacheEntries" toml:"cacheEntries"`
+	CacheBytes   int64    `yaml:"cacheBytes" toml:"cacheBytes"`
+	CacheTTL     Duration `yaml:"cacheTTL" toml:"cacheTTL"`
+}
+
+// Webhooks configures event deliveries, see vgraas.Webhooks.
+type Webhooks struct {
+	// AllowPrivate lets webhooks deliver to loopback and private
+	// network addresses
+	AllowPrivate bool `yaml:"allowPrivate" toml:"allowPrivate"`
+}
+
+// Trash configures soft deletes, see vgraas.Trash.
+type Trash struct {
+	// Retention is how long deleted reviews and comments can be
+	// restored. Deletes are permanent straight away if 0.
+	Retention     Duration `yaml:"retention" toml:"retention"`
+	PurgeInterval Duration `yaml:"purgeInterval" toml:"purgeInterval"`
+}
+
+// Revisions configures the history of reviews and comments, see
+// vgraas.Revisions.
+type Revisions struct {
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+
+	// Max is how many of the latest revisions of each review and
+	// comment are kept
+	Max int64 `yaml:"max" toml:"max"`
+}
+
+// Audit configures the log of changes, see vgraas.Audit.
+type Audit struct {
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+
+	// File the log is kept in, it is only kept in memory if empty
+	File string `yaml:"file" toml:"file"`
+
+	// MaxEntries is how many of the latest entries are kept in memory
+	MaxEntries int64 `yaml:"maxEntries" toml:"maxEntries"`
+}
+
+// Duration is a time.Duration written like "1m30s" in files.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText parses a duration with time.ParseDuration.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// MarshalText formats the duration with time.Duration.String.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Default returns the configuration used when nothing is set.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Addr:              ":8080",
+			ReadHeaderTimeout: Duration{10 * time.Second},
+			IdleTimeout:       Duration{2 * time.Minute},
+			RequestTimeout:    Duration{10 * time.Second},
+			DrainTimeout:      Duration{30 * time.Second},
+			BodyLimit:         1 << 19,
+			ImportLimit:       1 << 28,
+		},
+		TLS: TLS{
+			MinVersion:     "1.2",
+			ClientAuth:     "none",
+			ReloadInterval: Duration{time.Minute},
+		},
+		CORS: CORS{
+			Methods:       []string{"GET", "POST", "PUT", "DELETE"},
+			Headers:       []string{"Authorization", "Content-Type", "X-API-Key", "X-Request-ID", "traceparent", "If-None-Match", "If-Modified-Since"},
+			ExposeHeaders: []string{"RateLimit-Limit", "RateLimit-Remaining", "Retry-After", "X-Request-ID", "ETag"},
+			MaxAge:        Duration{10 * time.Minute},
+		},
+		Log: Log{Level: "info"},
+		RateLimit: RateLimit{
+			// Generous with reads and strict with comments. Health
+			// probes and CORS preflights are never limited.
+			Policies: []string{
+				"*=5:2",
+				"GET=20:40",
+				"POST CreateComment=1:3",
+				"Health=unlimited",
+				"Live=unlimited",
+				"Ready=unlimited",
+				"Preflight=unlimited",
+			},
+			PerIP: "50:100",
+		},
+		Storage: Storage{
+			Type:     "memory",
+			CacheTTL: Duration{time.Minute},
+		},
+		Trash: Trash{
+			Retention:     Duration{30 * 24 * time.Hour},
+			PurgeInterval: Duration{time.Hour},
+		},
+		Revisions: Revisions{Enabled: true, Max: 100},
+		Audit:     Audit{Enabled: true, MaxEntries: 10000},
+	}
+}
+
+// Validate checks every setting and reports all the problems found.
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(name string, err error) {
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(c.Server.Addr); err != nil {
+		check("server.addr", err)
+	}
+	durations := []struct {
+		name string
+		d    Duration
+	}{
+		{"server.readHeaderTimeout", c.Server.ReadHeaderTimeout},
+		{"server.readTimeout", c.Server.ReadTimeout},
+		{"server.writeTimeout", c.Server.WriteTimeout},
+		{"server.idleTimeout", c.Server.IdleTimeout},
+		{"server.requestTimeout", c.Server.RequestTimeout},
+		{"server.shutdownDelay", c.Server.ShutdownDelay},
+		{"server.drainTimeout", c.Server.DrainTimeout},
+		{"tls.reloadInterval", c.TLS.ReloadInterval},
+		{"cors.maxAge", c.CORS.MaxAge},
+		{"cache.maxAge", c.Cache.MaxAge},
+		{"storage.cacheTTL", c.Storage.CacheTTL},
+		{"trash.retention", c.Trash.Retention},
+	}
+	for _, d := range durations {
+		if d.d.Duration < 0 {
+			check(d.name, fmt.Errorf("must not be negative"))
+		}
+	}
+	if c.Server.BodyLimit <= 0 {
+		check("server.bodyLimit", fmt.Errorf("must be positive"))
+	}
+	if c.Server.ImportLimit <= 0 {
+		check("server.importLimit", fmt.Errorf("must be positive"))
+	}
+	if c.Cache.Size < 0 {
+		check("cache.size", fmt.Errorf("must not be negative"))
+	}
+	if c.Trash.Retention.Duration > 0 && c.Trash.PurgeInterval.Duration <= 0 {
+		check("trash.purgeInterval", fmt.Errorf("must be positive"))
+	}
+	if c.Storage.CacheEntries < 0 {
+		check("storage.cacheEntries", fmt.Errorf("must not be negative"))
+	}
+	if c.Storage.CacheBytes < 0 {
+		check("storage.cacheBytes", fmt.Errorf("must not be negative"))
+	}
+	if c.Revisions.Max <= 0 {
+		check("revisions.max", fmt.Errorf("must be positive"))
+	}
+	if c.Audit.MaxEntries <= 0 {
+		check("audit.maxEntries", fmt.Errorf("must be positive"))
+	}
+
+	c.TLS.validate(check)
+	check("cors.origins", c.CORS.checkOrigins())
+
+	_, err := logging.ParseLevel(c.Log.Level)
+	check("log.level", err)
+
+	switch c.Tracing.Exporter {
+	case "", "stdout", "otlp":
+	default:
+		check("tracing.exporter", fmt.Errorf("unknown exporter '%s'", c.Tracing.Exporter))
+	}
+
+	_, err = middleware.ParseCIDRs(c.RateLimit.TrustedProxies)
+	check("rateLimit.trustedProxies", err)
+	_, _, err = c.RateLimit.AllowList()
+	check("rateLimit.allow", err)
+	_, err = c.RateLimit.ParsePolicies()
+	check("rateLimit.policies", err)
+	_, err = c.RateLimit.ParsePerIP()
+	check("rateLimit.perIP", err)
+	if c.RateLimit.Redis != "" {
+		_, err = resp.ParseURL(c.RateLimit.Redis)
+		check("rateLimit.redis", err)
+	}
+
+	check("auth.apiKeys", checkPairs(c.Auth.APIKeys, "key:user"))
+
+	if c.Storage.Type != "memory" {
+		check("storage.type", fmt.Errorf("unknown storage '%s', only 'memory' is supported", c.Storage.Type))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validate checks the TLS settings, the files included.
+func (t TLS) validate(check func(name string, err error)) {
+	enabled := t.CertFile != ""
+	if enabled != (t.KeyFile != "") {
+		check("tls", fmt.Errorf("certFile and keyFile must be set together"))
+	} else if enabled {
+		_, err := certs.NewReloader(t.CertFile, t.KeyFile)
+		check("tls.certFile", err)
+	}
+
+	_, err := certs.ParseVersion(t.MinVersion)
+	check("tls.minVersion", err)
+	_, err = certs.ParseCipherSuites(t.CipherSuites)
+	check("tls.cipherSuites", err)
+	auth, err := certs.ParseClientAuth(t.ClientAuth)
+	check("tls.clientAuth", err)
+	if auth != tls.NoClientCert {
+		if !enabled {
+			check("tls.clientAuth", fmt.Errorf("client certificates need tls.certFile"))
+		}
+		_, err = certs.LoadCAs(t.ClientCAFile)
+		check("tls.clientCAFile", err)
+	}
+	check("tls.clientUsers", checkPairs(t.ClientUsers, "name:user"))
+
+	if t.RedirectAddr != "" {
+		if !enabled {
+			check("tls.redirectAddr", fmt.Errorf("redirecting to HTTPS needs tls.certFile"))
+		}
+		if _, _, err := net.SplitHostPort(t.RedirectAddr); err != nil {
+			check("tls.redirectAddr", err)
+		}
+	}
+}
+
+// Options returns the options of the server TLS configuration.
+func (t TLS) Options() certs.Options {
+	return certs.Options{
+		MinVersion:   t.MinVersion,
+		CipherSuites: t.CipherSuites,
+		ClientAuth:   t.ClientAuth,
+		ClientCAFile: t.ClientCAFile,
+	}
+}
+
+// Users returns the client certificate users as a map of name to user.
+func (t TLS) Users() map[string]string {
+	return pairs(t.ClientUsers)
+}
+
+// checkOrigins checks that origins are "*" or a scheme and host, with
+// an optional "*." in front of the host.
+func (c CORS) checkOrigins() error {
+	for _, origin := range c.Origins {
+		if origin == "*" {
+			if c.Credentials {
+				return fmt.Errorf("'*' can't be combined with credentials, list the origins instead")
+			}
+			continue
+		}
+		u, err := url.Parse(strings.Replace(origin, "://*.", "://", 1))
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+			return fmt.Errorf("expected origins like https://example.com or https://*.example.com, got '%s'", origin)
+		}
+	}
+	return nil
+}
+
+// Policy returns the CORS policy.
+func (c CORS) Policy() middleware.CORSPolicy {
+	return middleware.CORSPolicy{
+		Origins:       c.Origins,
+		Methods:       c.Methods,
+		Headers:       c.Headers,
+		ExposeHeaders: c.ExposeHeaders,
+		Credentials:   c.Credentials,
+		MaxAge:        c.MaxAge.Duration,
+	}
+}
+
+// ParsePolicies parses the rate limit policies.
+func (r RateLimit) ParsePolicies() (middleware.Policies, error) {
+	return middleware.ParsePolicies(strings.Join(r.Policies, ","))
+}
+
+// ParsePerIP returns PerIP as the default of otherwise empty Policies.
+func (r RateLimit) ParsePerIP() (middleware.Policies, error) {
+	return middleware.ParsePolicies("*=" + r.PerIP)
+}
+
+// AllowList splits the entries of Allow into networks and user names.
+// Anything that isn't an address is taken for a user.
+func (r RateLimit) AllowList() ([]*net.IPNet, []string, error) {
+	var cidrs, users []string
+	for _, item := range r.Allow {
+		item = strings.TrimSpace(item)
+		switch {
+		case item == "":
+		case strings.Contains(item, "/") || net.ParseIP(item) != nil:
+			cidrs = append(cidrs, item)
+		default:
+			users = append(users, item)
+		}
+	}
+	nets, err := middleware.ParseCIDRs(cidrs)
+	return nets, users, err
+}
+
+// Cached reports whether reviews are cached in front of the repository.
+func (s Storage) Cached() bool {
+	return s.CacheEntries > 0 || s.CacheBytes > 0
+}
+
+// CacheOptions returns the limits of the review cache.
+func (s Storage) CacheOptions() vgraas.CacheOptions {
+	return vgraas.CacheOptions{
+		MaxEntries: int(s.CacheEntries),
+		MaxBytes:   s.CacheBytes,
+		TTL:        s.CacheTTL.Duration,
+	}
+}
+
+// Keys returns the API keys as a map of key to user.
+func (a Auth) Keys() map[string]string {
+	return pairs(a.APIKeys)
+}
+
+// pairs turns a:b pairs into a map, skipping malformed ones.
+func pairs(list []string) map[string]string {
+	m := make(map[string]string)
+	for _, pair := range list {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		m[parts[0]] = parts[1]
+	}
+	return m
+}
+
+// checkPairs checks that every entry of list is a pair like format.
+func checkPairs(list []string, format string) error {
+	for _, pair := range list {
+		if parts := strings.SplitN(pair, ":", 2); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("expected %s pairs", format)
+		}
+	}
+	return nil
+}
+
+// redacted is what secrets are replaced with.
+const redacted = "REDACTED"
+
+// Redacted returns a copy of c with secrets replaced, safe to print or
+// log. API keys keep their user and the Redis URL its address.
+func (c *Config) Redacted() *Config {
+	out := *c
+	out.Auth.APIKeys = nil
+	for _, pair := range c.Auth.APIKeys {
+		user := ""
+		if i := strings.Index(pair, ":"); i >= 0 {
+			user = pair[i+1:]
+		}
+		out.Auth.APIKeys = append(out.Auth.APIKeys, redacted+":"+user)
+	}
+	if u, err := url.Parse(c.RateLimit.Redis); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+		out.RateLimit.Redis = u.String()
+	}
+	return &out
+}
+
+// Write writes c to w as YAML, with secrets redacted.
+func (c *Config) Write(w io.Writer) error {
+	b, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
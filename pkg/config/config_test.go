@@ -0,0 +1,226 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile writes content to a file called name in a new temporary
+// directory and returns its path.
+func writeFile(t *testing.T, name, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "vgraas-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func env(vars map[string]string) func(string) string {
+	return func(key string) string { return vars[key] }
+}
+
+func TestPrecedence(t *testing.T) {
+	path, cleanup := writeFile(t, "vgraas.yaml", `
+server:
+  addr: ":9000"
+  idleTimeout: 1m
+  bodyLimit: 1024
+log:
+  level: debug
+rateLimit:
+  policies: ["*=1:1"]
+`)
+	defer cleanup()
+
+	l, err := NewLoader("vgraas", []string{"-config", path, "-log-level", "error"}, env(map[string]string{
+		"VGRAAS_SERVER_BODY_LIMIT": "2048",
+		"VGRAAS_LOG_LEVEL":         "warn",
+		"VGRAAS_API_KEYS":          "k1:alice, k2:bob",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := l.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Server.Addr != ":9000" || cfg.Server.IdleTimeout.Duration != time.Minute {
+		t.Errorf("Expected the file to override defaults, got %+v", cfg.Server)
+	}
+	if cfg.Server.DrainTimeout.Duration != 30*time.Second {
+		t.Errorf("Expected defaults for what isn't set, got %s", cfg.Server.DrainTimeout)
+	}
+	if cfg.Server.BodyLimit != 2048 {
+		t.Errorf("Expected the environment to override the file, got %d", cfg.Server.BodyLimit)
+	}
+	if cfg.Log.Level != "error" {
+		t.Errorf("Expected flags to override the environment, got %s", cfg.Log.Level)
+	}
+	if want := map[string]string{"k1": "alice", "k2": "bob"}; !reflect.DeepEqual(cfg.Auth.Keys(), want) {
+		t.Errorf("Expected API keys from VGRAAS_API_KEYS, got %v", cfg.Auth.Keys())
+	}
+}
+
+func TestTOML(t *testing.T) {
+	path, cleanup := writeFile(t, "vgraas.toml", `
+[server]
+requestTimeout = "3s"
+
+[rateLimit]
+trustedProxies = ["10.0.0.0/8"]
+`)
+	defer cleanup()
+
+	l, err := NewLoader("vgraas", nil, env(map[string]string{"VGRAAS_CONFIG": path}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := l.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.RequestTimeout.Duration != 3*time.Second {
+		t.Errorf("Expected a request timeout of 3s, got %s", cfg.Server.RequestTimeout)
+	}
+	if !reflect.DeepEqual(cfg.RateLimit.TrustedProxies, []string{"10.0.0.0/8"}) {
+		t.Errorf("Unexpected trusted proxies %v", cfg.RateLimit.TrustedProxies)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	tests := []struct {
+		name, content string
+		env           map[string]string
+		want          string
+	}{
+		{"typo.yaml", "server:\n  adr: ':80'\n", nil, "adr"},
+		{"typo.toml", "[server]\nadr = ':80'\n", nil, "adr"},
+		{"vgraas.json", "{}", nil, "format"},
+		{"bad.yaml", "log:\n  level: loud\n", nil, "log.level"},
+		{"bad.yaml", "", map[string]string{"VGRAAS_RATE_LIMIT_POLICIES": "GET=1:1"}, "rateLimit.policies"},
+		{"bad.yaml", "", map[string]string{"VGRAAS_SERVER_IDLE_TIMEOUT": "soon"}, "VGRAAS_SERVER_IDLE_TIMEOUT"},
+		{"bad.yaml", "server:\n  bodyLimit: -1\n  drainTimeout: -1s\n", nil, "server.drainTimeout"},
+		{"bad.yaml", "server:\n  importLimit: 0\n", nil, "server.importLimit"},
+		{"bad.yaml", "rateLimit:\n  perIP: '5'\n", nil, "rateLimit.perIP"},
+		{"bad.yaml", "storage:\n  type: postgres\n", nil, "storage.type"},
+		{"bad.yaml", "tls:\n  certFile: tls.crt\n", nil, "keyFile"},
+		{"bad.yaml", "tls:\n  certFile: missing.crt\n  keyFile: missing.key\n", nil, "tls.certFile"},
+		{"bad.yaml", "tls:\n  minVersion: '1.1.1'\n", nil, "tls.minVersion"},
+		{"bad.yaml", "tls:\n  clientAuth: require\n", nil, "tls.clientCAFile"},
+		{"bad.yaml", "", map[string]string{"VGRAAS_TLS_REDIRECT_ADDR": ":80"}, "tls.redirectAddr"},
+		{"bad.yaml", "cors:\n  origins: [example.com]\n", nil, "cors.origins"},
+		{"bad.yaml", "cors:\n  origins: ['*']\n  credentials: true\n", nil, "cors.origins"},
+		{"bad.yaml", "", map[string]string{"VGRAAS_CORS_CREDENTIALS": "maybe"}, "VGRAAS_CORS_CREDENTIALS"},
+		{"bad.yaml", "", map[string]string{"VGRAAS_CACHE_SIZE": "-1"}, "cache.size"},
+		{"bad.yaml", "storage:\n  cacheTTL: -1m\n", nil, "storage.cacheTTL"},
+		{"bad.yaml", "trash:\n  purgeInterval: 0s\n", nil, "trash.purgeInterval"},
+		{"bad.yaml", "revisions:\n  max: 0\n", nil, "revisions.max"},
+		{"bad.yaml", "audit:\n  maxEntries: 0\n", nil, "audit.maxEntries"},
+	}
+	for _, test := range tests {
+		path, cleanup := writeFile(t, test.name, test.content)
+		vars := map[string]string{"VGRAAS_CONFIG": path}
+		for k, v := range test.env {
+			vars[k] = v
+		}
+		l, err := NewLoader("vgraas", nil, env(vars))
+		if err == nil {
+			_, err = l.Load()
+		}
+		cleanup()
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: expected an error about %s, got %v", test.name, test.want, err)
+		}
+	}
+}
+
+func TestWriteRedacts(t *testing.T) {
+	cfg := Default()
+	cfg.Auth.APIKeys = []string{"s3cret:alice"}
+	cfg.RateLimit.Redis = "redis://:hunter2@redis:6379/1"
+
+	var buf bytes.Buffer
+	if err := cfg.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, secret := range []string{"s3cret", "hunter2"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("Expected %s to be redacted:\n%s", secret, out)
+		}
+	}
+	for _, want := range []string{"REDACTED:alice", "redis:6379/1", "idleTimeout: 2m0s"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %s in the output:\n%s", want, out)
+		}
+	}
+	if cfg.Auth.APIKeys[0] != "s3cret:alice" {
+		t.Error("Expected the config itself to be left alone")
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	for _, s := range settings {
+		if s.name == "rateLimit.trustedProxies" {
+			if got := s.envName(); got != "VGRAAS_RATE_LIMIT_TRUSTED_PROXIES" {
+				t.Errorf("got %s", got)
+			}
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old, new := Default(), Default()
+	new.Log.Level = "debug"
+	new.Auth.APIKeys = []string{"s3cret:alice"}
+
+	changes := Diff(old, new)
+	want := []Change{
+		{"log.level", "info", "debug"},
+		{"auth.apiKeys", "", "REDACTED:alice"},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("got %+v, want %+v", changes, want)
+	}
+	if len(Diff(old, Default())) != 0 {
+		t.Error("Expected no changes between equal configurations")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path, cleanup := writeFile(t, "vgraas.yaml", "log:\n  level: info\n")
+	defer cleanup()
+
+	changed := make(chan struct{}, 10)
+	quit := make(chan struct{})
+	defer close(quit)
+	go Watch(path, 10*time.Millisecond, quit, func() { changed <- struct{}{} })
+
+	// Touching the file without changing it isn't a change
+	time.Sleep(30 * time.Millisecond)
+	ioutil.WriteFile(path, []byte("log:\n  level: info\n"), 0644)
+	time.Sleep(30 * time.Millisecond)
+	select {
+	case <-changed:
+		t.Fatal("Expected rewriting the same contents not to count")
+	default:
+	}
+
+	ioutil.WriteFile(path, []byte("log:\n  level: debug\n"), 0644)
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a change to be noticed")
+	}
+}
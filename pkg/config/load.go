@@ -0,0 +1,372 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// setting is a single value that can be set from the environment and
+// the command line.
+type setting struct {
+	// name is the path of the setting in files, env is derived from
+	// it unless set
+	name string
+	env  string
+
+	// flag is the command line flag, none if empty, and kind the
+	// type it is shown as
+	flag  string
+	usage string
+	kind  string
+
+	get func(c *Config) string
+	set func(c *Config, s string) error
+}
+
+// envName turns "rateLimit.trustedProxies" into
+// "VGRAAS_RATE_LIMIT_TRUSTED_PROXIES".
+func (s setting) envName() string {
+	if s.env != "" {
+		return s.env
+	}
+	var b strings.Builder
+	b.WriteString("VGRAAS_")
+	prev := rune(0)
+	for _, r := range s.name {
+		switch {
+		case r == '.':
+			b.WriteRune('_')
+		case unicode.IsUpper(r) && unicode.IsLower(prev):
+			b.WriteRune('_')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(unicode.ToUpper(r))
+		}
+		prev = r
+	}
+	return b.String()
+}
+
+func stringSetting(name, flag, usage string, field func(c *Config) *string) setting {
+	return setting{
+		name: name, flag: flag, usage: usage, kind: "string",
+		get: func(c *Config) string { return *field(c) },
+		set: func(c *Config, s string) error {
+			*field(c) = s
+			return nil
+		},
+	}
+}
+
+func durationSetting(name, flag, usage string, field func(c *Config) *Duration) setting {
+	return setting{
+		name: name, flag: flag, usage: usage, kind: "duration",
+		get: func(c *Config) string { return field(c).String() },
+		set: func(c *Config, s string) error {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return err
+			}
+			field(c).Duration = d
+			return nil
+		},
+	}
+}
+
+func intSetting(name, flag, usage string, field func(c *Config) *int64) setting {
+	return setting{
+		name: name, flag: flag, usage: usage, kind: "int",
+		get: func(c *Config) string { return strconv.FormatInt(*field(c), 10) },
+		set: func(c *Config, s string) error {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return err
+			}
+			*field(c) = n
+			return nil
+		},
+	}
+}
+
+func boolSetting(name, flag, usage string, field func(c *Config) *bool) setting {
+	return setting{
+		name: name, flag: flag, usage: usage, kind: "bool",
+		get: func(c *Config) string { return strconv.FormatBool(*field(c)) },
+		set: func(c *Config, s string) error {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return err
+			}
+			*field(c) = b
+			return nil
+		},
+	}
+}
+
+// listSetting is set from comma separated values.
+func listSetting(name, flag, usage string, field func(c *Config) *[]string) setting {
+	return setting{
+		name: name, flag: flag, usage: usage, kind: "list",
+		get: func(c *Config) string { return strings.Join(*field(c), ",") },
+		set: func(c *Config, s string) error {
+			var items []string
+			for _, item := range strings.Split(s, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			*field(c) = items
+			return nil
+		},
+	}
+}
+
+// settings lists everything that can be set from the environment or the
+// command line. Flags keep the names they had before there were config
+// files.
+var settings = []setting{
+	stringSetting("server.addr", "api", "API listen address",
+		func(c *Config) *string { return &c.Server.Addr }),
+	durationSetting("server.readHeaderTimeout", "read-header-timeout", "Maximum time to read request headers",
+		func(c *Config) *Duration { return &c.Server.ReadHeaderTimeout }),
+	durationSetting("server.readTimeout", "read-timeout", "Maximum time to read a whole request, 0 for none. Must be 0 to serve long lived /events streams",
+		func(c *Config) *Duration { return &c.Server.ReadTimeout }),
+	durationSetting("server.writeTimeout", "write-timeout", "Maximum time to write a response, 0 for none. Must be 0 to serve long lived /events streams",
+		func(c *Config) *Duration { return &c.Server.WriteTimeout }),
+	durationSetting("server.idleTimeout", "idle-timeout", "Maximum time to keep idle connections open",
+		func(c *Config) *Duration { return &c.Server.IdleTimeout }),
+	durationSetting("server.requestTimeout", "request-timeout", "Maximum time for storage operations made by a request, 0 for none",
+		func(c *Config) *Duration { return &c.Server.RequestTimeout }),
+	durationSetting("server.shutdownDelay", "shutdown-delay", "Time to keep serving after readiness starts failing, to let load balancers catch up",
+		func(c *Config) *Duration { return &c.Server.ShutdownDelay }),
+	durationSetting("server.drainTimeout", "drain-timeout", "Maximum time to wait for in-flight requests on shutdown",
+		func(c *Config) *Duration { return &c.Server.DrainTimeout }),
+	intSetting("server.bodyLimit", "body-limit", "Largest request body accepted, in bytes",
+		func(c *Config) *int64 { return &c.Server.BodyLimit }),
+	intSetting("server.importLimit", "import-limit", "Largest import accepted by POST /admin/import, in bytes",
+		func(c *Config) *int64 { return &c.Server.ImportLimit }),
+
+	stringSetting("tls.certFile", "tls-cert", "PEM encoded certificate to serve HTTPS with, plain HTTP if empty. Reloaded when it changes",
+		func(c *Config) *string { return &c.TLS.CertFile }),
+	stringSetting("tls.keyFile", "tls-key", "PEM encoded private key of the certificate",
+		func(c *Config) *string { return &c.TLS.KeyFile }),
+	stringSetting("tls.minVersion", "tls-min-version", "Minimum TLS version: '1.0', '1.1', '1.2' or '1.3'",
+		func(c *Config) *string { return &c.TLS.MinVersion }),
+	listSetting("tls.cipherSuites", "tls-cipher-suites", "Comma separated cipher suites allowed up to TLS 1.2, like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Go's defaults if empty",
+		func(c *Config) *[]string { return &c.TLS.CipherSuites }),
+	stringSetting("tls.clientAuth", "tls-client-auth", "Client certificates: 'none', 'optional' to verify them when given or 'require'",
+		func(c *Config) *string { return &c.TLS.ClientAuth }),
+	stringSetting("tls.clientCAFile", "tls-client-ca", "PEM encoded CA certificates that client certificates are verified against",
+		func(c *Config) *string { return &c.TLS.ClientCAFile }),
+	listSetting("tls.clientUsers", "tls-client-users", "Comma separated name:user pairs mapping client certificate names to users. Users are the certificate common names if empty",
+		func(c *Config) *[]string { return &c.TLS.ClientUsers }),
+	stringSetting("tls.redirectAddr", "tls-redirect", "Address to redirect plain HTTP requests to HTTPS from, none if empty",
+		func(c *Config) *string { return &c.TLS.RedirectAddr }),
+	durationSetting("tls.reloadInterval", "tls-reload-interval", "How often to check the certificate and key for changes, 0 for never",
+		func(c *Config) *Duration { return &c.TLS.ReloadInterval }),
+
+	listSetting("cors.origins", "cors-origins", "Comma separated origins browsers may call the API from, like https://example.com or https://*.example.com for its subdomains. '*' for any, none if empty",
+		func(c *Config) *[]string { return &c.CORS.Origins }),
+	listSetting("cors.methods", "cors-methods", "Comma separated methods allowed from other origins",
+		func(c *Config) *[]string { return &c.CORS.Methods }),
+	listSetting("cors.headers", "cors-headers", "Comma separated request headers allowed from other origins",
+		func(c *Config) *[]string { return &c.CORS.Headers }),
+	listSetting("cors.exposeHeaders", "cors-expose-headers", "Comma separated response headers scripts from other origins may read",
+		func(c *Config) *[]string { return &c.CORS.ExposeHeaders }),
+	boolSetting("cors.credentials", "cors-credentials", "Allow requests from other origins to carry credentials such as cookies and Authorization headers",
+		func(c *Config) *bool { return &c.CORS.Credentials }),
+	durationSetting("cors.maxAge", "cors-max-age", "How long browsers may cache preflight responses",
+		func(c *Config) *Duration { return &c.CORS.MaxAge }),
+
+	durationSetting("cache.maxAge", "cache-max-age", "How long clients may use reviews and comments without checking for changes, 0 to always check",
+		func(c *Config) *Duration { return &c.Cache.MaxAge }),
+	intSetting("cache.size", "cache-size", "Number of responses about reviews and comments kept in memory, 0 for none",
+		func(c *Config) *int64 { return &c.Cache.Size }),
+
+	stringSetting("log.level", "log-level", "Minimum level of log lines: 'debug', 'info', 'warn' or 'error'",
+		func(c *Config) *string { return &c.Log.Level }),
+
+	stringSetting("tracing.exporter", "trace-exporter", "Where to export trace spans: 'stdout', 'otlp' or '' for nowhere",
+		func(c *Config) *string { return &c.Tracing.Exporter }),
+	stringSetting("tracing.file", "trace-file", "File to append exported spans to instead of stdout",
+		func(c *Config) *string { return &c.Tracing.File }),
+
+	listSetting("rateLimit.trustedProxies", "trusted-proxies", "Comma separated CIDRs of proxies whose X-Forwarded-For headers are trusted",
+		func(c *Config) *[]string { return &c.RateLimit.TrustedProxies }),
+	listSetting("rateLimit.allow", "ratelimit-allow", "Comma separated CIDRs and users exempt from rate limiting",
+		func(c *Config) *[]string { return &c.RateLimit.Allow }),
+	listSetting("rateLimit.policies", "ratelimit-policies", "Comma separated rate limit policies, selector=rate:burst or selector=unlimited. Selectors are '*', a method, a route name or both",
+		func(c *Config) *[]string { return &c.RateLimit.Policies }),
+	stringSetting("rateLimit.perIP", "ratelimit-per-ip", "Rate limit policy, rate:burst or unlimited, for every client address. It applies before API keys are checked, on top of -ratelimit-policies",
+		func(c *Config) *string { return &c.RateLimit.PerIP }),
+	stringSetting("rateLimit.redis", "ratelimit-redis", "URL of a Redis server to share rate limits between replicas, redis://[:password@]host[:port][/db]. Limits are kept in memory if empty",
+		func(c *Config) *string { return &c.RateLimit.Redis }),
+
+	// Secrets don't belong on the command line, where anyone can
+	// read them with ps
+	withEnv(listSetting("auth.apiKeys", "", "",
+		func(c *Config) *[]string { return &c.Auth.APIKeys }), "VGRAAS_API_KEYS"),
+	listSetting("auth.admins", "admins", "Comma separated users allowed to use the admin endpoints, nobody if empty",
+		func(c *Config) *[]string { return &c.Auth.Admins }),
+
+	stringSetting("storage.type", "storage", "Where to keep reviews and comments, only 'memory' for now",
+		func(c *Config) *string { return &c.Storage.Type }),
+	intSetting("storage.cacheEntries", "storage-cache-entries", "Number of reviews cached in front of storage. Reviews are cached if this or -storage-cache-bytes is set",
+		func(c *Config) *int64 { return &c.Storage.CacheEntries }),
+	intSetting("storage.cacheBytes", "storage-cache-bytes", "Approximate size in bytes of the reviews cached in front of storage",
+		func(c *Config) *int64 { return &c.Storage.CacheBytes }),
+	durationSetting("storage.cacheTTL", "storage-cache-ttl", "How long reviews are cached before they are read from storage again, 0 for as long as they fit",
+		func(c *Config) *Duration { return &c.Storage.CacheTTL }),
+
+	boolSetting("webhooks.allowPrivate", "webhooks-allow-private", "Allow webhooks to deliver to loopback and private network addresses",
+		func(c *Config) *bool { return &c.Webhooks.AllowPrivate }),
+
+	durationSetting("trash.retention", "trash-retention", "How long deleted reviews and comments can be restored before they are purged, 0 to delete them for good straight away",
+		func(c *Config) *Duration { return &c.Trash.Retention }),
+	durationSetting("trash.purgeInterval", "trash-purge-interval", "How often the trash is purged",
+		func(c *Config) *Duration { return &c.Trash.PurgeInterval }),
+
+	boolSetting("revisions.enabled", "revisions", "Keep the latest versions of reviews and comments so that they can be compared and reverted",
+		func(c *Config) *bool { return &c.Revisions.Enabled }),
+	intSetting("revisions.max", "revisions-max", "Number of the latest revisions of each review and comment kept",
+		func(c *Config) *int64 { return &c.Revisions.Max }),
+
+	boolSetting("audit.enabled", "audit", "Record who created, updated or deleted what in the audit log",
+		func(c *Config) *bool { return &c.Audit.Enabled }),
+	stringSetting("audit.file", "audit-file", "File the audit log is appended to and read back from on start. It is only kept in memory if empty",
+		func(c *Config) *string { return &c.Audit.File }),
+	intSetting("audit.maxEntries", "audit-max-entries", "Number of the latest audit log entries kept in memory. Older ones are read from -audit-file, or dropped without one",
+		func(c *Config) *int64 { return &c.Audit.MaxEntries }),
+}
+
+func withEnv(s setting, env string) setting {
+	s.env = env
+	return s
+}
+
+// Loader loads the configuration. The file and flags are taken from the
+// command line once, Load can then be called again to pick up changes
+// to the file and environment.
+type Loader struct {
+	// File is the configuration file, if any.
+	File string
+
+	// Print asks for the effective configuration to be printed.
+	Print bool
+
+	// WatchInterval is how often File is checked for changes, never
+	// if 0. See Watch.
+	WatchInterval time.Duration
+
+	getenv func(string) string
+	flags  map[string]string
+}
+
+// NewLoader parses the command line in args with a flag set called
+// name. Settings are looked up in the environment with getenv, os.Getenv
+// for instance. The configuration file is given with -config, or
+// VGRAAS_CONFIG.
+func NewLoader(name string, args []string, getenv func(string) string) (*Loader, error) {
+	l := &Loader{getenv: getenv, flags: make(map[string]string)}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&l.File, "config", getenv("VGRAAS_CONFIG"), "YAML or TOML configuration file. Environment variables and flags take precedence over it")
+	fs.BoolVar(&l.Print, "print-config", false, "Print the effective configuration, with secrets redacted, and exit")
+	fs.DurationVar(&l.WatchInterval, "config-watch", 10*time.Second, "How often to check the configuration file for changes, 0 for never. Send SIGHUP to reload it right away")
+
+	defaults := Default()
+	for _, s := range settings {
+		switch def := s.get(defaults); s.kind {
+		case "duration":
+			d, _ := time.ParseDuration(def)
+			fs.Duration(s.flag, d, s.usage)
+		case "int":
+			n, _ := strconv.ParseInt(def, 10, 64)
+			fs.Int64(s.flag, n, s.usage)
+		case "bool":
+			b, _ := strconv.ParseBool(def)
+			fs.Bool(s.flag, b, s.usage)
+		default:
+			if s.flag != "" {
+				fs.String(s.flag, def, s.usage)
+			}
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Only flags given on the command line override the file and the
+	// environment, they are set again on every Load
+	fs.Visit(func(f *flag.Flag) {
+		l.flags[f.Name] = f.Value.String()
+	})
+	return l, nil
+}
+
+// Load reads the file and environment, applies the flags and validates
+// the result.
+func (l *Loader) Load() (*Config, error) {
+	cfg := Default()
+	if l.File != "" {
+		if err := readFile(l.File, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if v := l.getenv(s.envName()); v != "" {
+			if err := s.set(cfg, v); err != nil {
+				return nil, fmt.Errorf("Invalid %s: %s", s.envName(), err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if v, ok := l.flags[s.flag]; ok && s.flag != "" {
+			if err := s.set(cfg, v); err != nil {
+				return nil, fmt.Errorf("Invalid -%s: %s", s.flag, err)
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readFile decodes the YAML or TOML file at path, by extension, over
+// cfg. Unknown keys are an error, they are most likely typos.
+func readFile(path string, cfg *Config) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(b, cfg)
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.DecodeReader(bytes.NewReader(b), cfg)
+		if err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown keys %v", md.Undecoded())
+		}
+	default:
+		return fmt.Errorf("Unknown configuration format '%s', use .yaml, .yml or .toml", filepath.Ext(path))
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %s", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"time"
+)
+
+// Change is a setting that differs between two configurations. Values
+// are formatted like environment variables, with secrets redacted.
+type Change struct {
+	Name string
+	Old  string
+	New  string
+}
+
+// Diff returns the settings that differ between old and new.
+func Diff(old, new *Config) []Change {
+	var changes []Change
+	oldRedacted, newRedacted := old.Redacted(), new.Redacted()
+	for _, s := range settings {
+		if s.get(old) == s.get(new) {
+			continue
+		}
+		changes = append(changes, Change{
+			Name: s.name,
+			Old:  s.get(oldRedacted),
+			New:  s.get(newRedacted),
+		})
+	}
+	return changes
+}
+
+// Watch checks the file at path every interval and calls changed when
+// its contents change, until quit is closed. Polling works the same
+// everywhere, including for Kubernetes ConfigMap volumes which are
+// updated by swapping a symlink. Files that can't be read are ignored
+// until they can.
+func Watch(path string, interval time.Duration, quit <-chan struct{}, changed func()) {
+	last, _ := hashFile(path)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			sum, err := hashFile(path)
+			if err != nil || sum == last {
+				continue
+			}
+			last = sum
+			changed()
+		}
+	}
+}
+
+func hashFile(path string) ([sha256.Size]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(b), nil
+}
@@ -0,0 +1,22 @@
+package health
+
+import (
+	"context"
+	"fmt"
+)
+
+// DiskSpace returns a Checker that fails when the file system holding
+// path has less than minFree bytes available. Use it for file backed
+// stores.
+func DiskSpace(path string, minFree uint64) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		free, err := diskFree(path)
+		if err != nil {
+			return err
+		}
+		if free < minFree {
+			return fmt.Errorf("%d bytes free on %s, need %d", free, path, minFree)
+		}
+		return nil
+	})
+}
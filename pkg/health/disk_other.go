@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package health
+
+import "errors"
+
+func diskFree(path string) (uint64, error) {
+	return 0, errors.New("Disk space checks are not supported on this platform")
+}
@@ -0,0 +1,206 @@
+// Package health implements liveness and readiness checks.
+//
+// A Health holds two sets of named checks. Liveness checks should only
+// fail when the process is wedged and needs restarting. Readiness checks
+// fail whenever the process shouldn't be sent traffic, for example while
+// a dependency is down or during shutdown. Readiness includes liveness.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout bounds how long a single check may take.
+const DefaultTimeout = 2 * time.Second
+
+// Status values reported for checks and overall.
+const (
+	StatusOK     = "ok"
+	StatusFailed = "failed"
+)
+
+// Checker checks a single aspect of the service, returning an error if
+// it is unhealthy.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckerFunc adapts a function to the Checker interface.
+type CheckerFunc func(ctx context.Context) error
+
+// Check calls f(ctx).
+func (f CheckerFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Result is the outcome of a single check. Latency is in seconds.
+type Result struct {
+	Name    string  `json:"name"`
+	Status  string  `json:"status"`
+	Err     string  `json:"err,omitempty"`
+	Latency float64 `json:"latency"`
+}
+
+// Report is the outcome of a set of checks.
+type Report struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks,omitempty"`
+}
+
+// Health is a registry of liveness and readiness checks.
+type Health struct {
+	// Timeout bounds each check, DefaultTimeout if zero.
+	Timeout time.Duration
+
+	mtx   sync.RWMutex
+	live  map[string]Checker
+	ready map[string]Checker
+}
+
+// New returns a Health without any checks, which always passes.
+func New() *Health {
+	return &Health{
+		live:  make(map[string]Checker),
+		ready: make(map[string]Checker),
+	}
+}
+
+// AddLiveness registers a liveness check, replacing any check with the
+// same name.
+func (h *Health) AddLiveness(name string, c Checker) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.live[name] = c
+}
+
+// AddReadiness registers a readiness check, replacing any check with
+// the same name.
+func (h *Health) AddReadiness(name string, c Checker) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.ready[name] = c
+}
+
+// Live runs the liveness checks.
+func (h *Health) Live(ctx context.Context) Report {
+	h.mtx.RLock()
+	checks := make(map[string]Checker, len(h.live))
+	for name, c := range h.live {
+		checks[name] = c
+	}
+	h.mtx.RUnlock()
+
+	return h.run(ctx, checks)
+}
+
+// Ready runs the liveness and readiness checks.
+func (h *Health) Ready(ctx context.Context) Report {
+	h.mtx.RLock()
+	checks := make(map[string]Checker, len(h.live)+len(h.ready))
+	for name, c := range h.live {
+		checks[name] = c
+	}
+	for name, c := range h.ready {
+		checks[name] = c
+	}
+	h.mtx.RUnlock()
+
+	return h.run(ctx, checks)
+}
+
+// run runs checks concurrently, each bounded by the timeout.
+func (h *Health) run(ctx context.Context, checks map[string]Checker) Report {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	results := make([]Result, 0, len(checks))
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	for name, c := range checks {
+		wg.Add(1)
+		go func(name string, c Checker) {
+			defer wg.Done()
+			result := check(ctx, name, c, timeout)
+			mtx.Lock()
+			results = append(results, result)
+			mtx.Unlock()
+		}(name, c)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+
+	report := Report{Status: StatusOK, Checks: results}
+	for _, result := range results {
+		if result.Status != StatusOK {
+			report.Status = StatusFailed
+		}
+	}
+	return report
+}
+
+func check(ctx context.Context, name string, c Checker, timeout time.Duration) Result {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := Result{Name: name, Status: StatusOK, Latency: time.Since(start).Seconds()}
+	if err != nil {
+		result.Status = StatusFailed
+		result.Err = err.Error()
+	}
+	return result
+}
+
+// LiveHandler serves the liveness checks. See Handler.
+func (h *Health) LiveHandler() http.Handler {
+	return handler(h.Live)
+}
+
+// ReadyHandler serves the readiness checks. See Handler.
+func (h *Health) ReadyHandler() http.Handler {
+	return handler(h.Ready)
+}
+
+// handler responds 200 OK if every check passed and 503 Service
+// Unavailable otherwise. Only the overall status is reported unless the
+// 'verbose' query parameter is present, in which case every check is
+// listed with its status, error and latency.
+func handler(run func(context.Context) Report) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := run(r.Context())
+
+		if _, verbose := r.URL.Query()["verbose"]; !verbose {
+			report.Checks = nil
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if report.Status != StatusOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		enc.Encode(report)
+	})
+}
@@ -0,0 +1,79 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func serve(t *testing.T, h http.Handler, target string) (int, Report) {
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	var report Report
+	if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return rr.Code, report
+}
+
+func TestHealth(t *testing.T) {
+	ok := CheckerFunc(func(context.Context) error { return nil })
+	broken := CheckerFunc(func(context.Context) error { return errors.New("broken") })
+	slow := CheckerFunc(func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+
+	h := New()
+	h.Timeout = 10 * time.Millisecond
+	h.AddLiveness("alive", ok)
+	h.AddReadiness("db", broken)
+	h.AddReadiness("slow", slow)
+
+	code, report := serve(t, h.LiveHandler(), "/livez")
+	if code != http.StatusOK || report.Status != StatusOK || report.Checks != nil {
+		t.Errorf("Unexpected liveness report %d %+v", code, report)
+	}
+
+	code, report = serve(t, h.ReadyHandler(), "/readyz?verbose")
+	if code != http.StatusServiceUnavailable || report.Status != StatusFailed {
+		t.Errorf("Unexpected readiness report %d %+v", code, report)
+	}
+	if len(report.Checks) != 3 {
+		t.Fatalf("Expected readiness to include liveness checks, got %+v", report.Checks)
+	}
+
+	// Checks are sorted by name
+	if c := report.Checks[1]; c.Name != "db" || c.Status != StatusFailed || c.Err != "broken" {
+		t.Errorf("Unexpected db check %+v", c)
+	}
+	if c := report.Checks[2]; c.Name != "slow" || c.Status != StatusFailed || c.Err != context.DeadlineExceeded.Error() {
+		t.Errorf("Expected slow check to time out, got %+v", c)
+	}
+}
+
+func TestDiskSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := DiskSpace(dir, 1).Check(context.Background()); err != nil {
+		t.Errorf("Expected at least a byte free: %s", err)
+	}
+	if err := DiskSpace(dir, 1<<62).Check(context.Background()); err == nil {
+		t.Error("Expected check to fail with an absurd minimum")
+	}
+}
@@ -0,0 +1,162 @@
+// Package logging implements a leveled, structured logger writing newline
+// delimited JSON.
+//
+// Loggers carry fields that are added to every line they write, and
+// travel in a context.Context so handlers can log with the request ID
+// and other request scoped fields already attached:
+//
+//	logging.FromContext(r.Context()).Error("Failed to read review", "id", id, "err", err)
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log line.
+type Level int
+
+// Log levels, from most to least verbose.
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// String returns the lower case name of the level.
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name as returned by Level.String.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("Unknown log level '%s'", s)
+}
+
+// output is shared by a Logger and all the loggers derived from it.
+type output struct {
+	mtx   sync.Mutex
+	enc   *json.Encoder
+	level Level
+}
+
+// Logger writes log lines at or above its level.
+type Logger struct {
+	out    *output
+	fields []interface{}
+}
+
+// New returns a Logger writing lines at or above level to w.
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{out: &output{enc: json.NewEncoder(w), level: level}}
+}
+
+// Discard is a Logger that writes nothing.
+var Discard = New(ioutil.Discard, Error+1)
+
+// SetLevel changes the level of the logger and every logger derived from
+// it with With.
+func (l *Logger) SetLevel(level Level) {
+	l.out.mtx.Lock()
+	l.out.level = level
+	l.out.mtx.Unlock()
+}
+
+// Enabled reports whether lines at level are written.
+func (l *Logger) Enabled(level Level) bool {
+	l.out.mtx.Lock()
+	defer l.out.mtx.Unlock()
+	return level >= l.out.level
+}
+
+// With returns a Logger that adds the key value pairs in kv to every
+// line. Keys must be strings.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Log writes msg at level along with the logger's fields and the key
+// value pairs in kv. Errors are logged by their message.
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	line := map[string]interface{}{
+		"time":  time.Now(),
+		"level": level.String(),
+		"msg":   msg,
+	}
+	for _, pairs := range [][]interface{}{l.fields, kv} {
+		for i := 0; i+1 < len(pairs); i += 2 {
+			key, ok := pairs[i].(string)
+			if !ok {
+				key = fmt.Sprint(pairs[i])
+			}
+			value := pairs[i+1]
+			if err, ok := value.(error); ok {
+				value = err.Error()
+			}
+			line[key] = value
+		}
+	}
+
+	l.out.mtx.Lock()
+	defer l.out.mtx.Unlock()
+	l.out.enc.Encode(line)
+}
+
+// Debug logs at the Debug level.
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.Log(Debug, msg, kv...)
+}
+
+// Info logs at the Info level.
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.Log(Info, msg, kv...)
+}
+
+// Warn logs at the Warn level.
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.Log(Warn, msg, kv...)
+}
+
+// Error logs at the Error level.
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.Log(Error, msg, kv...)
+}
+
+type loggerKey struct{}
+
+// NewContext returns a copy of ctx carrying l.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext returns the Logger in ctx, or Discard if there is none.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return Discard
+}
@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, Info)
+
+	logger.Debug("hidden")
+	logger.With("requestId", "abc").Error("Failed", "err", errors.New("boom"), "n", 3)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 line, got %d: %s", len(lines), buf.String())
+	}
+
+	var line map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]interface{}{
+		"level":     "error",
+		"msg":       "Failed",
+		"requestId": "abc",
+		"err":       "boom",
+		"n":         3.0,
+	} {
+		if line[key] != want {
+			t.Errorf("Expected %s=%v, got %v", key, want, line[key])
+		}
+	}
+
+	buf.Reset()
+	logger.SetLevel(Debug)
+	logger.Debug("shown")
+	if !strings.Contains(buf.String(), `"level":"debug"`) {
+		t.Errorf("Debug line missing after lowering the level: %s", buf.String())
+	}
+}
+
+func TestContext(t *testing.T) {
+	if FromContext(context.Background()) != Discard {
+		t.Error("Expected Discard without a logger in the context")
+	}
+	logger := New(&bytes.Buffer{}, Info)
+	if FromContext(NewContext(context.Background(), logger)) != logger {
+		t.Error("Logger didn't round trip through the context")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, l := range []Level{Debug, Info, Warn, Error} {
+		got, err := ParseLevel(strings.ToUpper(l.String()))
+		if err != nil || got != l {
+			t.Errorf("ParseLevel(%s) = %v, %v", l, got, err)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("Expected an error for an unknown level")
+	}
+}
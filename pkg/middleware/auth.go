@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type userKey struct{}
+
+// Authenticate is a middleware that identifies callers by API key.
+//
+// The key is read from an 'Authorization: Bearer <key>' header, an
+// 'X-API-Key' header or, for clients like browser WebSockets that can't
+// set headers, an 'access_token' query parameter. keys maps API keys to
+// user names. Requests without a key carry on anonymously, requests with
+// an unknown key are rejected with 401 Unauthorized.
+func Authenticate(next http.Handler, keys map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := APIKey(r)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, ok := keys[key]
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="vgraas"`)
+			WriteError(w, r, http.StatusUnauthorized, "Invalid API key")
+			return
+		}
+
+		next.ServeHTTP(w, WithUser(r, user))
+	})
+}
+
+// APIKey returns the API key presented with r, if any.
+func APIKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// WithUser returns a shallow copy of r authenticated as user.
+func WithUser(r *http.Request, user string) *http.Request {
+	trackUser(r, user)
+	return r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+}
+
+// User returns the user r is authenticated as, or "" for anonymous
+// requests.
+func User(r *http.Request) string {
+	return ContextUser(r.Context())
+}
+
+// ContextUser returns the user the request ctx belongs to is
+// authenticated as, or "" for anonymous requests.
+func ContextUser(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// RequireUser is a middleware that only lets authenticated requests
+// through. Anonymous requests are rejected with 401 Unauthorized.
+func RequireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if User(r) == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="vgraas"`)
+			WriteError(w, r, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireAdmin is a middleware that only lets requests by one of admins
+// through. With no admins nobody is one. Anonymous requests are
+// rejected with 401 Unauthorized and everyone else with 403 Forbidden.
+func RequireAdmin(next http.Handler, admins ...string) http.Handler {
+	allowed := make(map[string]bool, len(admins))
+	for _, admin := range admins {
+		allowed[admin] = true
+	}
+	return RequireUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowed[User(r)] {
+			WriteError(w, r, http.StatusForbidden, "Only admins are allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		handler http.Handler
+		user    string
+		want    int
+	}{
+		{RequireUser(ok), "", http.StatusUnauthorized},
+		{RequireUser(ok), "alice", http.StatusOK},
+		{RequireAdmin(ok), "", http.StatusUnauthorized},
+		{RequireAdmin(ok), "alice", http.StatusForbidden},
+		{RequireAdmin(ok, "root"), "", http.StatusUnauthorized},
+		{RequireAdmin(ok, "root"), "alice", http.StatusForbidden},
+		{RequireAdmin(ok, "root"), "root", http.StatusOK},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", "/admin/audit", nil)
+		if test.user != "" {
+			r = WithUser(r, test.user)
+		}
+		rr := httptest.NewRecorder()
+		test.handler.ServeHTTP(rr, r)
+		if rr.Code != test.want {
+			t.Errorf("%d: expected %d for '%s', got %d", i, test.want, test.user, rr.Code)
+		}
+	}
+}
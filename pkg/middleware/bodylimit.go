@@ -1,12 +1,37 @@
 package middleware
 
-import "net/http"
+import (
+	"net/http"
+	"sync/atomic"
+)
 
 // LimitBody is used to limit the amount of bytes in an http request that
 // are read. This prevents malicious actors from uploaded massive requests.
 func LimitBody(next http.Handler, bytes int64) http.Handler {
+	return NewBodyLimiter(bytes).Handler(next)
+}
+
+// BodyLimiter limits request bodies like LimitBody, with a limit that
+// can be changed while serving.
+type BodyLimiter struct {
+	bytes int64
+}
+
+// NewBodyLimiter returns a BodyLimiter allowing bodies of up to bytes.
+func NewBodyLimiter(bytes int64) *BodyLimiter {
+	return &BodyLimiter{bytes: bytes}
+}
+
+// SetLimit changes the limit for requests that haven't started yet.
+func (bl *BodyLimiter) SetLimit(bytes int64) {
+	atomic.StoreInt64(&bl.bytes, bytes)
+}
+
+// Handler wraps next with the body limit.
+func (bl *BodyLimiter) Handler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		r.Body = http.MaxBytesReader(w, r.Body, bytes)
+		bytes := atomic.LoadInt64(&bl.bytes)
+		r.Body = &limitedReader{ReadCloser: http.MaxBytesReader(w, r.Body, bytes), left: bytes}
 		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,173 @@
+package middleware
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// compressMin is the smallest response worth compressing, below it the
+// headers and framing eat up most of the savings.
+const compressMin = 1024
+
+var (
+	gzipPool = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	zlibPool = sync.Pool{New: func() interface{} { return zlib.NewWriter(nil) }}
+)
+
+// Compress is a middleware that compresses responses with gzip or
+// deflate, whichever the client prefers according to its Accept-Encoding
+// header.
+//
+// Responses smaller than a kilobyte, without a body or already encoded
+// are left alone. Streaming responses are compressed as they are
+// flushed, and connections taken over with Hijack, such as WebSockets,
+// aren't touched.
+func Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := Negotiate(r.Header.Get("Accept-Encoding"), "gzip", "deflate", "identity")
+		if r.Header.Get("Accept-Encoding") == "" || encoding == "identity" || encoding == "" || r.Method == "HEAD" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, status: http.StatusOK}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter holds on to the start of a response until it knows
+// whether it is worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	status      int
+	wroteHeader bool
+	buf         []byte
+
+	// decided is set once the headers are out, w is the compressor
+	// if the response is compressed
+	decided bool
+	w       io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.status, cw.wroteHeader = status, true
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	cw.wroteHeader = true
+	if cw.decided {
+		if cw.w != nil {
+			return cw.w.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= compressMin {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide sends the headers, compressing from now on if compress is set
+// and the response isn't encoded already, and writes out what was held
+// back.
+func (cw *compressWriter) decide(compress bool) error {
+	if cw.decided {
+		return nil
+	}
+	cw.decided = true
+
+	h := cw.ResponseWriter.Header()
+	if compress && h.Get("Content-Encoding") == "" {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		switch cw.encoding {
+		case "gzip":
+			zw := gzipPool.Get().(*gzip.Writer)
+			zw.Reset(cw.ResponseWriter)
+			cw.w = zw
+		case "deflate":
+			zw := zlibPool.Get().(*zlib.Writer)
+			zw.Reset(cw.ResponseWriter)
+			cw.w = zw
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	buf := cw.buf
+	cw.buf = nil
+	if cw.w != nil {
+		_, err := cw.w.Write(buf)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+// close finishes the response, sending what was held back as is if it
+// never got big enough to compress.
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if !cw.wroteHeader {
+			return
+		}
+		cw.decide(false)
+	}
+	if cw.w == nil {
+		return
+	}
+	cw.w.Close()
+	switch zw := cw.w.(type) {
+	case *gzip.Writer:
+		gzipPool.Put(zw)
+	case *zlib.Writer:
+		zlibPool.Put(zw)
+	}
+	cw.w = nil
+}
+
+// Flush sends what has been written so far, compressed, for streaming
+// handlers such as /events.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(true)
+	}
+	if zw, ok := cw.w.(interface{ Flush() error }); ok {
+		zw.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands the connection over uncompressed.
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Hijacking not supported")
+	}
+	cw.decided = true
+	return h.Hijack()
+}
@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		header string
+		offers []string
+		want   string
+	}{
+		{"", []string{"application/json", "application/x-ndjson"}, "application/json"},
+		{"*/*", []string{"application/json", "application/x-ndjson"}, "application/json"},
+		{"application/x-ndjson", []string{"application/json", "application/x-ndjson"}, "application/x-ndjson"},
+		{"application/*;q=0.5, application/x-ndjson", []string{"application/json", "application/x-ndjson"}, "application/x-ndjson"},
+		{"text/html, application/json;q=0.9", []string{"application/json"}, "application/json"},
+		{"text/html", []string{"application/json"}, ""},
+		{"*/*, application/json;q=0", []string{"application/json", "application/x-ndjson"}, "application/x-ndjson"},
+		{"deflate, gzip", []string{"gzip", "deflate"}, "gzip"},
+		{"gzip;q=0.5, deflate", []string{"gzip", "deflate"}, "deflate"},
+		{"br", []string{"gzip", "deflate"}, ""},
+		{"*", []string{"gzip", "deflate"}, "gzip"},
+	}
+	for _, test := range tests {
+		if got := Negotiate(test.header, test.offers...); got != test.want {
+			t.Errorf("%q: expected %q, got %q", test.header, test.want, got)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	big := strings.Repeat("all work and no play ", 100)
+	h := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Query().Get("small")))
+		if r.URL.Query().Get("small") == "" {
+			w.Write([]byte(big))
+		}
+	}))
+	do := func(path, encoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept-Encoding", encoding)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("/", "gzip, deflate")
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Expected gzip, got %q", got)
+	}
+	if w.Body.Len() >= len(big) {
+		t.Errorf("Expected the body to shrink, got %d bytes", w.Body.Len())
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(zr); string(b) != big {
+		t.Error("Expected the body to round trip")
+	}
+	if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("Expected Vary: Accept-Encoding, got %q", got)
+	}
+
+	if w := do("/?small=hi", "gzip"); w.Header().Get("Content-Encoding") != "" || w.Body.String() != "hi" {
+		t.Errorf("Expected small responses to be left alone, got %q", w.Body.String())
+	}
+	if w := do("/", "br"); w.Header().Get("Content-Encoding") != "" || w.Body.String() != big {
+		t.Error("Expected unsupported encodings to get the identity")
+	}
+	if w := do("/", ""); w.Header().Get("Content-Encoding") != "" {
+		t.Error("Expected no compression without Accept-Encoding")
+	}
+}
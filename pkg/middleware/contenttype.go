@@ -1,13 +1,58 @@
 package middleware
 
-import "net/http"
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
 
 // ContentType is used to set the Content-Type header for http handlers.
+// Handlers that set a Content-Type of their own replace it.
 //
 // This can be useful to set the Content-Type for an entire mux.Router, for example.
 func ContentType(next http.Handler, header string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Content-Type", header)
+		w.Header().Set("Content-Type", header)
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequireContentType is a middleware that rejects request bodies that
+// aren't one of the media types in types with 415 Unsupported Media
+// Type. A body without a Content-Type is taken to be of the first type,
+// and text types must be UTF-8. Requests without a body pass.
+func RequireContentType(next http.Handler, types ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Content-Type")
+		if r.ContentLength == 0 || header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		mediaType, params, err := mime.ParseMediaType(header)
+		if err != nil {
+			WriteError(w, r, http.StatusUnsupportedMediaType, fmt.Sprintf("Invalid Content-Type '%s': %s", header, err))
+			return
+		}
+		if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") {
+			WriteError(w, r, http.StatusUnsupportedMediaType, fmt.Sprintf("Unsupported charset '%s', use utf-8", charset))
+			return
+		}
+		for _, t := range types {
+			if mediaType == t {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		WriteError(w, r, http.StatusUnsupportedMediaType, fmt.Sprintf("Unsupported Content-Type '%s', use %s", mediaType, strings.Join(types, " or ")))
+	})
+}
+
+// MediaType returns the media type of the body of r, without parameters,
+// or "" if it doesn't say.
+func MediaType(r *http.Request) string {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType
+}
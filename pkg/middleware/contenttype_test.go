@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestContentType(t *testing.T) {
+	h := ContentType(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			w.Header().Set("Content-Type", "text/event-stream")
+		}
+	}), "application/json; charset=utf-8")
+
+	for path, want := range map[string]string{
+		"/":       "application/json; charset=utf-8",
+		"/stream": "text/event-stream",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if got := w.Header()["Content-Type"]; len(got) != 1 || got[0] != want {
+			t.Errorf("%s: expected a single %s, got %v", path, want, got)
+		}
+	}
+}
+
+func TestRequireContentType(t *testing.T) {
+	h := RequireContentType(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		"application/json", "application/x-www-form-urlencoded")
+
+	tests := []struct {
+		method, contentType, body string
+		want                      int
+	}{
+		{"POST", "application/json", "{}", http.StatusOK},
+		{"POST", "application/json; charset=UTF-8", "{}", http.StatusOK},
+		{"POST", "application/x-www-form-urlencoded", "a=b", http.StatusOK},
+		{"POST", "", "{}", http.StatusOK},
+		{"DELETE", "text/plain", "", http.StatusOK},
+		{"POST", "text/plain", "hi", http.StatusUnsupportedMediaType},
+		{"POST", "application/json; charset=latin1", "{}", http.StatusUnsupportedMediaType},
+		{"POST", "application/json; charset=UTF=8", "{}", http.StatusUnsupportedMediaType},
+		{"PUT", "multipart/form-data; boundary=x", "--x--", http.StatusUnsupportedMediaType},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/", strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s %q: expected %d, got %d", test.method, test.contentType, test.want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CORSPolicy says which cross-origin browser requests are allowed.
+type CORSPolicy struct {
+	// Origins are allowed origins like "https://blog.example.com".
+	// "https://*.example.com" allows every subdomain of example.com
+	// and "*" every origin. No origins turns CORS off.
+	Origins []string
+
+	// Methods and Headers are the methods and request headers
+	// preflights are told are allowed.
+	Methods []string
+	Headers []string
+
+	// ExposeHeaders are the response headers scripts may read, on top
+	// of the few that are always readable.
+	ExposeHeaders []string
+
+	// Credentials allows requests carrying cookies, TLS client
+	// certificates or Authorization headers.
+	Credentials bool
+
+	// MaxAge is how long browsers may cache preflight responses.
+	MaxAge time.Duration
+}
+
+// allows reports whether origin is allowed.
+func (p CORSPolicy) allows(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range p.Origins {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		// https://*.example.com matches subdomains of example.com, at
+		// any depth, but not example.com itself
+		i := strings.Index(pattern, "://*.")
+		if i < 0 {
+			continue
+		}
+		scheme, domain := pattern[:i+3], pattern[i+4:]
+		if strings.HasPrefix(origin, scheme) && strings.HasSuffix(origin, domain) {
+			sub := origin[len(scheme) : len(origin)-len(domain)]
+			if sub != "" && !strings.ContainsAny(sub, "/:") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CORS is a middleware that lets browsers call the API from other
+// origins, following a policy that can be changed while serving.
+//
+// Responses to allowed origins carry Access-Control-Allow-Origin and
+// friends. Preflights, OPTIONS requests with an
+// Access-Control-Request-Method header, additionally get the allowed
+// methods, headers and max age and are passed on, so that the router
+// answers them for routes that exist and 404s the rest.
+type CORS struct {
+	mtx    sync.RWMutex
+	policy CORSPolicy
+}
+
+// NewCORS returns a CORS middleware following p.
+func NewCORS(p CORSPolicy) *CORS {
+	return &CORS{policy: p}
+}
+
+// SetPolicy changes the policy for requests that haven't started yet.
+func (c *CORS) SetPolicy(p CORSPolicy) {
+	c.mtx.Lock()
+	c.policy = p
+	c.mtx.Unlock()
+}
+
+// Handler wraps next with CORS headers.
+func (c *CORS) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mtx.RLock()
+		p := c.policy
+		c.mtx.RUnlock()
+
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(p.Origins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if !p.allows(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Browsers refuse a wildcard for requests with credentials
+		if len(p.Origins) == 1 && p.Origins[0] == "*" && !p.Credentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if p.Credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			if len(p.Methods) > 0 {
+				h.Set("Access-Control-Allow-Methods", strings.Join(p.Methods, ", "))
+			}
+			if len(p.Headers) > 0 {
+				h.Set("Access-Control-Allow-Headers", strings.Join(p.Headers, ", "))
+			}
+			if p.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge/time.Second)))
+			}
+		} else if len(p.ExposeHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(p.ExposeHeaders, ", "))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
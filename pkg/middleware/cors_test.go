@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSOrigins(t *testing.T) {
+	p := CORSPolicy{Origins: []string{"https://app.example.com", "https://*.example.org"}}
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"https://APP.example.com", true},
+		{"http://app.example.com", false},
+		{"https://other.example.com", false},
+		{"https://blog.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://evil.com/.example.org", false},
+		{"https://evilexample.org", false},
+	}
+	for _, test := range tests {
+		if got := p.allows(test.origin); got != test.want {
+			t.Errorf("%s: expected %v, got %v", test.origin, test.want, got)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	cors := NewCORS(CORSPolicy{
+		Origins:       []string{"*"},
+		ExposeHeaders: []string{"X-Request-ID"},
+	})
+	h := cors.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(origin string) http.Header {
+		r := httptest.NewRequest("GET", "/", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Header()
+	}
+
+	headers := do("https://anywhere.com")
+	if got := headers.Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Expected any origin, got %s", got)
+	}
+	if got := headers.Get("Access-Control-Expose-Headers"); got != "X-Request-ID" {
+		t.Errorf("Expected exposed headers, got %s", got)
+	}
+	if got := do("").Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Expected no CORS headers without an Origin, got %s", got)
+	}
+
+	// With credentials the origin is echoed instead
+	cors.SetPolicy(CORSPolicy{Origins: []string{"https://app.example.com"}, Credentials: true})
+	headers = do("https://app.example.com")
+	if got := headers.Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Expected the origin to be echoed, got %s", got)
+	}
+	if got := headers.Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Expected credentials to be allowed, got %s", got)
+	}
+	if got := do("https://evil.com").Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Expected other origins to be refused, got %s", got)
+	}
+}
@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// errorBody is the JSON body of error responses.
+type errorBody struct {
+	Err       string `json:"err"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// WriteError replies to r with status and a JSON object holding the
+// error message and, if the request has one, its ID.
+func WriteError(w http.ResponseWriter, r *http.Request, status int, err string) {
+	body, _ := json.Marshal(errorBody{err, RequestIDFromContext(r.Context())})
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,159 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// KeyFunc returns the key a request is rate limited by. Requests sharing
+// a key share a bucket. An empty key exempts the request from limiting.
+type KeyFunc func(r *http.Request) string
+
+// ClientIP works out which address a request really came from.
+//
+// Without trusted proxies that is the address of the peer. When the peer
+// is a trusted proxy the X-Forwarded-For chain is walked from the right,
+// skipping trusted proxies, and the first untrusted address is the
+// client. Everything left of it could have been made up by the client.
+type ClientIP struct {
+	trusted []*net.IPNet
+}
+
+// NewClientIP returns a ClientIP trusting proxies in the given CIDRs.
+// Bare addresses are taken as single hosts.
+func NewClientIP(trusted []string) (*ClientIP, error) {
+	nets, err := ParseCIDRs(trusted)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientIP{trusted: nets}, nil
+}
+
+// ParseCIDRs parses a list of CIDRs or bare addresses. Blank entries are
+// skipped.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range cidrs {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid address '%s'", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR '%s'", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IP returns the client address of r, or nil if it can't be parsed.
+func (c *ClientIP) IP(r *http.Request) net.IP {
+	ip := net.ParseIP(remoteIP(r))
+	if ip == nil || !contains(c.trusted, ip) {
+		return ip
+	}
+
+	hops := forwardedFor(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(hops[i])
+		if hop == nil {
+			// Garbage in the chain, nothing left of it can be trusted
+			return ip
+		}
+		ip = hop
+		if !contains(c.trusted, ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+// forwardedFor returns the addresses in all X-Forwarded-For headers of r,
+// leftmost first.
+func forwardedFor(r *http.Request) []string {
+	var hops []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// NormalizeIP formats ip for use as a rate limit key. IPv6 addresses are
+// grouped by /64, the smallest block usually handed to a single
+// customer, so clients can't dodge limits by hopping around their
+// prefix.
+func NormalizeIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// IPKey keys requests by their client address as resolved by c.
+func IPKey(c *ClientIP) KeyFunc {
+	return func(r *http.Request) string {
+		ip := c.IP(r)
+		if ip == nil {
+			return "addr:" + r.RemoteAddr
+		}
+		return "ip:" + NormalizeIP(ip)
+	}
+}
+
+// UserKey keys authenticated requests by user, so all API keys of a user
+// share a bucket wherever they are used from, and the rest by fallback.
+// It has to run behind Authenticate.
+func UserKey(fallback KeyFunc) KeyFunc {
+	return func(r *http.Request) string {
+		if user := User(r); user != "" {
+			return "user:" + user
+		}
+		return fallback(r)
+	}
+}
+
+// Allowlist exempts requests from clients in nets, as resolved by c, and
+// requests by the given users from limiting. Others are keyed by key.
+func Allowlist(key KeyFunc, c *ClientIP, nets []*net.IPNet, users ...string) KeyFunc {
+	allowed := make(map[string]bool, len(users))
+	for _, user := range users {
+		allowed[user] = true
+	}
+	return func(r *http.Request) string {
+		if user := User(r); user != "" && allowed[user] {
+			return ""
+		}
+		if ip := c.IP(r); ip != nil && contains(nets, ip) {
+			return ""
+		}
+		return key(r)
+	}
+}
@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	c, err := NewClientIP([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remote string
+		xff    []string
+		want   string
+	}{
+		// Untrusted peers are the client, whatever they claim
+		{"1.2.3.4:5678", []string{"9.9.9.9"}, "1.2.3.4"},
+		// Trusted proxies are skipped from the right
+		{"10.0.0.1:80", []string{"6.6.6.6, 7.7.7.7"}, "7.7.7.7"},
+		{"10.0.0.1:80", []string{"6.6.6.6, 7.7.7.7, 192.168.1.1"}, "7.7.7.7"},
+		// Multiple headers form one chain
+		{"10.0.0.1:80", []string{"6.6.6.6", "7.7.7.7, 10.1.1.1"}, "7.7.7.7"},
+		// Garbage stops the walk at the last good hop
+		{"10.0.0.1:80", []string{"7.7.7.7, nonsense"}, "10.0.0.1"},
+		// All trusted, the leftmost is as good as it gets
+		{"10.0.0.1:80", []string{"10.0.0.2"}, "10.0.0.2"},
+		{"10.0.0.1:80", nil, "10.0.0.1"},
+		{"[2001:db8::1]:443", nil, "2001:db8::1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		for _, h := range test.xff {
+			r.Header.Add("X-Forwarded-For", h)
+		}
+		if got := c.IP(r); got.String() != test.want {
+			t.Errorf("%s via %v: got %s, want %s", test.remote, test.xff, got, test.want)
+		}
+	}
+
+	if _, err := NewClientIP([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("Expected an invalid CIDR to be rejected")
+	}
+}
+
+func TestKeys(t *testing.T) {
+	c, _ := NewClientIP(nil)
+	nets, _ := ParseCIDRs([]string{"127.0.0.1"})
+	key := Allowlist(UserKey(IPKey(c)), c, nets, "admin")
+
+	req := func(remote, user string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remote
+		if user != "" {
+			r = WithUser(r, user)
+		}
+		return r
+	}
+
+	tests := []struct {
+		r    *http.Request
+		want string
+	}{
+		{req("1.2.3.4:1000", ""), "ip:1.2.3.4"},
+		{req("1.2.3.4:2000", ""), "ip:1.2.3.4"},
+		{req("[2001:db8:1:2:3::1]:1000", ""), "ip:2001:db8:1:2::/64"},
+		{req("[2001:db8:1:2:ffff::9]:1000", ""), "ip:2001:db8:1:2::/64"},
+		{req("1.2.3.4:1000", "alice"), "user:alice"},
+		{req("1.2.3.4:1000", "admin"), ""},
+		{req("127.0.0.1:1000", ""), ""},
+	}
+	for _, test := range tests {
+		if got := key(test.r); got != test.want {
+			t.Errorf("%s as %q: got %q, want %q", test.r.RemoteAddr, User(test.r), got, test.want)
+		}
+	}
+}
+
+func TestRateLimiterExempt(t *testing.T) {
+	rl := NewKeyedRateLimiter(1, 1, func(r *http.Request) string {
+		return r.Header.Get("Key")
+	})
+	defer rl.Close()
+	h := rl.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	codes := func(key string) []int {
+		var out []int
+		for i := 0; i < 3; i++ {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Key", key)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			out = append(out, w.Code)
+		}
+		return out
+	}
+
+	if got := codes("a"); got[0] != 200 || got[2] != http.StatusTooManyRequests {
+		t.Errorf("Expected key 'a' to be limited, got %v", got)
+	}
+	if got := codes(""); got[2] != 200 {
+		t.Errorf("Expected an empty key to be exempt, got %v", got)
+	}
+}
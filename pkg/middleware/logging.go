@@ -1,10 +1,14 @@
 package middleware
 
 import (
-	"encoding/json"
+	"bufio"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"time"
+
+	"github.com/nsmith5/vgraas/pkg/logging"
 )
 
 // The interceptingWriter is stolen from the very clever Peter Bourgon.
@@ -30,26 +34,91 @@ func (iw *interceptingWriter) Write(p []byte) (int, error) {
 	return iw.ResponseWriter.Write(p)
 }
 
+// Flush lets streaming handlers behind the logger flush their output.
+func (iw *interceptingWriter) Flush() {
+	if f, ok := iw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets handlers behind the logger take over the connection, for
+// instance to upgrade to a WebSocket.
+func (iw *interceptingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := iw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Hijacking not supported")
+	}
+	iw.code = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
 // Logging is a middleware that adds structured logging (JSON) to an
 // http.Handler.
 //
 // Time, method, path, status, response size and duration are recorded
-// in newline delimited JSON documents in the supplied io.Writer.
+// in newline delimited JSON documents in the supplied io.Writer. See
+// LogRequests for more.
 func Logging(next http.Handler, out io.Writer) http.Handler {
-	enc := json.NewEncoder(out)
+	return LogRequests(next, logging.New(out, logging.Info))
+}
+
+// LogRequests is a middleware that logs a line for every request with
+// logger and makes logger available to handlers through
+// logging.FromContext, with the request ID attached.
+//
+// Along with what Logging records, lines include the request ID, remote
+// address, user agent, route name and authenticated user. Requests are
+// logged at the info level, or warn and error for 4xx and 5xx responses.
+// Place it inside RequestID and outside Authenticate and the router.
+func LogRequests(next http.Handler, logger *logging.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		iw := &interceptingWriter{0, http.StatusOK, w}
 		now := time.Now()
 
+		id := RequestIDFromContext(r.Context())
+		reqLogger := logger
+		if id != "" {
+			reqLogger = logger.With("requestId", id)
+		}
+		r = TrackRoute(r.WithContext(logging.NewContext(r.Context(), reqLogger)))
+
 		next.ServeHTTP(iw, r)
 
-		enc.Encode(map[string]interface{}{
-			"time":     now,
-			"method":   r.Method,
-			"path":     r.URL.Path,
-			"status":   iw.code,
-			"respSize": iw.count,
-			"duration": time.Since(now).Seconds(),
-		})
+		level := logging.Info
+		switch {
+		case iw.code >= 500:
+			level = logging.Error
+		case iw.code >= 400:
+			level = logging.Warn
+		}
+
+		kv := []interface{}{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", iw.code,
+			"respSize", iw.count,
+			"duration", time.Since(now).Seconds(),
+			"remoteIp", remoteIP(r),
+			"userAgent", r.UserAgent(),
+		}
+		if route := RouteName(r); route != "" {
+			kv = append(kv, "route", route)
+		}
+		if user := trackedUser(r); user != "" {
+			kv = append(kv, "user", user)
+		}
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			kv = append(kv, "forwardedFor", fwd)
+		}
+		reqLogger.Log(level, "request", kv...)
 	})
 }
+
+// remoteIP returns the address of the peer r came from, without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
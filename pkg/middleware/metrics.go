@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Requests served, by route name, method and status code.",
+		},
+		[]string{"route", "method", "code"},
+	)
+	httpDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "http_request_duration_seconds",
+			Help: "Time taken to serve requests, by route name and method.",
+		},
+		[]string{"route", "method"},
+	)
+	rateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_rate_limited_total",
+			Help: "Requests rejected by the rate limiter, by route name.",
+		},
+		[]string{"route"},
+	)
+	rateLimitErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_rate_limit_errors_total",
+			Help: "Requests let through because the rate limit store failed, by route name.",
+		},
+		[]string{"route"},
+	)
+	bodyLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "http_body_limit_exceeded_total",
+		Help: "Requests whose body was larger than allowed.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpDuration, rateLimited, rateLimitErrors, bodyLimited)
+}
+
+// unknownRoute labels requests that never reached the router, for
+// instance because they were rate limited.
+const unknownRoute = "unknown"
+
+// Metrics is a middleware that counts requests and records how long they
+// take, labeled by the name of the route that served them. The router
+// behind it has to report route names with SetRouteName.
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		iw := &interceptingWriter{0, http.StatusOK, w}
+		r = TrackRoute(r)
+		now := time.Now()
+
+		next.ServeHTTP(iw, r)
+
+		route := RouteName(r)
+		if route == "" {
+			route = unknownRoute
+		}
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(now).Seconds())
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(iw.code)).Inc()
+	})
+}
+
+// limitedReader counts a body limit rejection the first time a request
+// body turns out to be too large.
+type limitedReader struct {
+	io.ReadCloser
+	left    int64
+	counted bool
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.ReadCloser.Read(p)
+	lr.left -= int64(n)
+	if err != nil && err != io.EOF && lr.left <= 0 && !lr.counted {
+		lr.counted = true
+		bodyLimited.Inc()
+	}
+	return n, err
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Negotiate picks the offer a client prefers according to header, an
+// Accept or Accept-Encoding header. Wildcards like "*/*", "text/*" and
+// "*" are understood, the most specific entry matching an offer gives
+// its quality and ties go to the earlier offer. The first offer is
+// picked if header is empty, "" if the client accepts none of them.
+func Negotiate(header string, offers ...string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	if strings.TrimSpace(header) == "" {
+		return offers[0]
+	}
+
+	type entry struct {
+		value string
+		q     float64
+	}
+	var entries []entry
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		e := entry{value: strings.ToLower(strings.TrimSpace(params[0])), q: 1}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					e.q = q
+				}
+			}
+		}
+		if e.value != "" {
+			entries = append(entries, e)
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, o := range offers {
+		offer := strings.ToLower(o)
+		q, specificity := 0.0, -1
+		for _, e := range entries {
+			s := -1
+			switch {
+			case e.value == offer:
+				s = 2
+			case strings.HasSuffix(e.value, "/*") && strings.HasPrefix(offer, e.value[:len(e.value)-1]):
+				s = 1
+			case e.value == "*" || e.value == "*/*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = e.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = o, q
+		}
+	}
+	return best
+}
@@ -0,0 +1,174 @@
+package middleware
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Policy is the rate and burst of a token bucket. Buckets hold up to
+// Burst tokens and are refilled at Rate tokens a second, every request
+// takes one. Unlimited policies don't limit at all.
+type Policy struct {
+	Rate      float64
+	Burst     int
+	Unlimited bool
+}
+
+// String formats p the way ParsePolicies reads it.
+func (p Policy) String() string {
+	if p.Unlimited {
+		return "unlimited"
+	}
+	return strconv.FormatFloat(p.Rate, 'g', -1, 64) + ":" + strconv.Itoa(p.Burst)
+}
+
+// PolicyRule applies a Policy to requests for a route name, an HTTP
+// method or both. Empty fields match anything.
+type PolicyRule struct {
+	Route  string
+	Method string
+	Policy
+}
+
+// selector returns the part of the rule left of '=' in ParsePolicies
+// syntax. It also names the rule's buckets.
+func (pr PolicyRule) selector() string {
+	switch {
+	case pr.Route == "" && pr.Method == "":
+		return "*"
+	case pr.Route == "":
+		return pr.Method
+	case pr.Method == "":
+		return pr.Route
+	}
+	return pr.Method + " " + pr.Route
+}
+
+// specificity ranks rules matching a request, route beats method.
+func (pr PolicyRule) specificity() int {
+	n := 0
+	if pr.Route != "" {
+		n += 2
+	}
+	if pr.Method != "" {
+		n++
+	}
+	return n
+}
+
+// Policies picks the Policy for a request by route name and method.
+type Policies struct {
+	Default Policy
+	Rules   []PolicyRule
+}
+
+// For returns the rule for requests to route with method. The most
+// specific matching rule wins: route and method, then route, then
+// method. Requests matching no rule get the default policy.
+func (p Policies) For(route, method string) PolicyRule {
+	best := PolicyRule{Policy: p.Default}
+	for _, rule := range p.Rules {
+		if rule.Route != "" && rule.Route != route {
+			continue
+		}
+		if rule.Method != "" && !strings.EqualFold(rule.Method, method) {
+			continue
+		}
+		if rule.specificity() > best.specificity() {
+			best = rule
+		}
+	}
+	return best
+}
+
+// String formats p the way ParsePolicies reads it.
+func (p Policies) String() string {
+	entries := []string{"*=" + p.Default.String()}
+	for _, rule := range p.Rules {
+		entries = append(entries, rule.selector()+"="+rule.Policy.String())
+	}
+	return strings.Join(entries, ",")
+}
+
+// ParsePolicies parses a comma separated list of rules of the form
+// 'selector=rate:burst' or 'selector=unlimited'. The selector is '*' for
+// the default policy, an upper case HTTP method, a route name, or a
+// method and route name separated by a space. For example
+//
+//	*=5:2,GET=20:40,POST CreateComment=0.5:3,Ready=unlimited
+//
+// The default policy is required.
+func ParsePolicies(s string) (Policies, error) {
+	var (
+		p          Policies
+		hasDefault bool
+	)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		eq := strings.LastIndex(entry, "=")
+		if eq < 0 {
+			return Policies{}, fmt.Errorf("Invalid rate limit policy '%s', expected selector=rate:burst", entry)
+		}
+		policy, err := parsePolicy(strings.TrimSpace(entry[eq+1:]))
+		if err != nil {
+			return Policies{}, fmt.Errorf("Invalid rate limit policy '%s': %s", entry, err)
+		}
+
+		selector := strings.TrimSpace(entry[:eq])
+		if selector == "*" {
+			p.Default, hasDefault = policy, true
+			continue
+		}
+		rule := PolicyRule{Policy: policy}
+		for _, field := range strings.Fields(selector) {
+			if isMethod(field) && rule.Method == "" {
+				rule.Method = field
+			} else if !isMethod(field) && rule.Route == "" {
+				rule.Route = field
+			} else {
+				return Policies{}, fmt.Errorf("Invalid rate limit selector '%s'", selector)
+			}
+		}
+		if rule.Route == "" && rule.Method == "" {
+			return Policies{}, fmt.Errorf("Invalid rate limit policy '%s', missing selector", entry)
+		}
+		p.Rules = append(p.Rules, rule)
+	}
+	if !hasDefault {
+		return Policies{}, fmt.Errorf("No default rate limit policy, add '*=rate:burst'")
+	}
+	return p, nil
+}
+
+func parsePolicy(s string) (Policy, error) {
+	if s == "unlimited" {
+		return Policy{Unlimited: true}, nil
+	}
+	colon := strings.Index(s, ":")
+	if colon < 0 {
+		return Policy{}, fmt.Errorf("expected rate:burst or unlimited")
+	}
+	rate, err := strconv.ParseFloat(s[:colon], 64)
+	if err != nil || rate <= 0 {
+		return Policy{}, fmt.Errorf("rate must be a positive number")
+	}
+	burst, err := strconv.Atoi(s[colon+1:])
+	if err != nil || burst < 1 {
+		return Policy{}, fmt.Errorf("burst must be a positive integer")
+	}
+	return Policy{Rate: rate, Burst: burst}, nil
+}
+
+// isMethod tells HTTP methods from route names, which are camel case.
+func isMethod(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 'A' || s[i] > 'Z' {
+			return false
+		}
+	}
+	return s != ""
+}
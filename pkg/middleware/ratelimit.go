@@ -3,20 +3,22 @@
 package middleware
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"strconv"
 	"sync"
-	"time"
 
-	"golang.org/x/time/rate"
+	"github.com/nsmith5/vgraas/pkg/logging"
 )
 
-type visitor struct {
-	limiter  *rate.Limiter
-	lastSeen time.Time
-}
-
 // Options for find the address to use for IP address based
 // rate limiting.
+//
+// The header based options trust whatever the client sends, use
+// NewKeyedRateLimiter with IPKey and a list of trusted proxies instead.
 const (
 	// XForwardedFor uses the 'X-Forwarded-For' header to get the
 	// ip address. This is useful behind reverse proxies.
@@ -26,76 +28,186 @@ const (
 	// useful if behind a reverse proxy.
 	XRealIP
 
-	// RemoteAddr uses the requests raw remote address. Useful
-	// if the API is exposes to direct connections.
+	// RemoteAddr uses the requests remote address, without the port.
+	// Useful if the API is exposes to direct connections.
 	RemoteAddr
 )
 
-// RateLimit is a middleware that implements rate limiting based on
-// IP address.
+// methodKey returns the KeyFunc for one of the address options above.
+func methodKey(method int) KeyFunc {
+	switch method {
+	case XForwardedFor:
+		return func(r *http.Request) string { return "xff:" + r.Header.Get("X-Forwarded-For") }
+	case XRealIP:
+		return func(r *http.Request) string { return "xrealip:" + r.Header.Get("X-Real-IP") }
+	case RemoteAddr:
+		return IPKey(&ClientIP{})
+	}
+	return nil
+}
+
+// RateLimiter implements rate limiting based on IP address, or any
+// other key.
 //
-// It uses token-bucket algorithm with 'r' as rate and 'b' as burst.
-// 'method' is used to specify the method for collecting the IP address.
-func RateLimit(next http.Handler, r, b, method int) http.Handler {
-	var visitors = make(map[string]*visitor)
-	var mtx sync.Mutex
-
-	// Periodically clean out stale entries forever
-	// TODO: This is mildly irresponsible. We should have
-	// clean shutdown on this thing.
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-			mtx.Lock()
-			for ip, v := range visitors {
-				if time.Now().Sub(v.lastSeen) > 10*time.Minute {
-					delete(visitors, ip)
-				}
-			}
-			mtx.Unlock()
-		}
-	}()
-
-	addVisitor := func(ip string) *rate.Limiter {
-		limiter := rate.NewLimiter(rate.Limit(r), b)
-		mtx.Lock()
-		visitors[ip] = &visitor{limiter, time.Now()}
-		mtx.Unlock()
-		return limiter
+// Requests are matched to a PolicyRule by route name and method, and
+// each key is limited per rule by a Store. Call Close to release the
+// Store.
+//
+// Responses carry RateLimit-Limit and RateLimit-Remaining headers, and
+// rejected requests get 429 Too Many Requests with a Retry-After header.
+// If the Store fails requests are let through, a broken Store shouldn't
+// take the API down with it.
+type RateLimiter struct {
+	key   KeyFunc
+	store Store
+
+	mtx      sync.Mutex
+	policies Policies
+}
+
+// NewRateLimiter returns a RateLimiter using the token-bucket algorithm
+// with 'r' as rate and 'b' as burst. 'method' is used to specify the
+// method for collecting the IP address.
+func NewRateLimiter(r, b, method int) *RateLimiter {
+	return NewKeyedRateLimiter(r, b, methodKey(method))
+}
+
+// NewKeyedRateLimiter returns a RateLimiter with 'r' as rate and 'b' as
+// burst, giving each key returned by key its own bucket.
+func NewKeyedRateLimiter(r, b int, key KeyFunc) *RateLimiter {
+	return NewPolicyRateLimiter(Policies{Default: Policy{Rate: float64(r), Burst: b}}, key)
+}
+
+// NewPolicyRateLimiter returns a RateLimiter applying policies to the
+// keys returned by key, keeping its buckets in a MemoryStore.
+func NewPolicyRateLimiter(policies Policies, key KeyFunc) *RateLimiter {
+	return NewStoreRateLimiter(NewMemoryStore(), policies, key)
+}
+
+// NewStoreRateLimiter returns a RateLimiter applying policies to the keys
+// returned by key, keeping its state in store.
+func NewStoreRateLimiter(store Store, policies Policies, key KeyFunc) *RateLimiter {
+	return &RateLimiter{
+		key:      key,
+		store:    store,
+		policies: policies,
 	}
+}
 
-	getVisitor := func(ip string) *rate.Limiter {
-		mtx.Lock()
-		v, exists := visitors[ip]
-		if !exists {
-			mtx.Unlock()
-			return addVisitor(ip)
-		}
+// SetPolicies replaces the policies for requests that haven't been
+// counted yet. Buckets of rules that are still there keep their state.
+func (rl *RateLimiter) SetPolicies(policies Policies) {
+	rl.mtx.Lock()
+	rl.policies = policies
+	rl.mtx.Unlock()
+}
 
-		v.lastSeen = time.Now()
-		mtx.Unlock()
-		return v.limiter
+// Close closes the Store, if it can be closed.
+func (rl *RateLimiter) Close() {
+	if c, ok := rl.store.(io.Closer); ok {
+		c.Close()
 	}
+}
+
+// limitedKey holds the limiters that counted a request already.
+type limitedKey struct{}
+
+type limiters map[*RateLimiter]bool
+
+// SubRequest returns ctx for a request made on behalf of the request ctx
+// belongs to, like an operation in a batch. Sub-requests are counted as
+// requests of their own.
+func SubRequest(ctx context.Context) context.Context {
+	return context.WithValue(ctx, limitedKey{}, limiters(nil))
+}
 
+// limit applies the policy for route to requests and hands the ones
+// that are allowed to next.
+func (rl *RateLimiter) limit(route string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var limiter *rate.Limiter
-		switch method {
-		case XForwardedFor:
-			limiter = getVisitor(r.Header.Get("X-Forwarded-For"))
-		case XRealIP:
-			limiter = getVisitor(r.Header.Get("X-Real-IP"))
-		case RemoteAddr:
-			limiter = getVisitor(r.RemoteAddr)
-		default:
-			http.Error(w, http.StatusText(500), http.StatusInternalServerError)
+		if rl.key == nil {
+			WriteError(w, r, http.StatusInternalServerError, http.StatusText(500))
+			return
+		}
+
+		// Requests are limited once by each limiter, wherever it is
+		// in front of them
+		counted, _ := r.Context().Value(limitedKey{}).(limiters)
+		if counted[rl] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := rl.key(r)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rl.mtx.Lock()
+		rule := rl.policies.For(route, r.Method)
+		rl.mtx.Unlock()
+		if rule.Unlimited {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if route == "" {
+			route = unknownRoute
+		}
+
+		// Buckets are per rule, so each rule has its own budget
+		d, err := rl.store.Take(r.Context(), rule.selector()+"|"+key, rule.Policy)
+		if err != nil {
+			rateLimitErrors.WithLabelValues(route).Inc()
+			logging.FromContext(r.Context()).Warn("Rate limit store failed, request let through", "err", err)
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		if limiter.Allow() == false {
-			http.Error(w, http.StatusText(429), http.StatusTooManyRequests)
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+		if !d.Allowed {
+			rateLimited.WithLabelValues(route).Inc()
+
+			retry := int(math.Ceil(d.RetryAfter.Seconds()))
+			if retry < 1 {
+				retry = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+			WriteError(w, r, http.StatusTooManyRequests,
+				fmt.Sprintf("Rate limit exceeded, retry in %d seconds", retry))
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		marked := limiters{rl: true}
+		for other := range counted {
+			marked[other] = true
+		}
+		ctx := context.WithValue(r.Context(), limitedKey{}, marked)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// Handler wraps next with the rate limiter. The route name isn't known
+// yet, so only the default policy and rules for methods apply. Use Route
+// inside the router for per route policies.
+func (rl *RateLimiter) Handler(next http.Handler) http.Handler {
+	return rl.limit("", next)
+}
+
+// Route wraps the handler of the route called name with the rate
+// limiter. It fits vgraas.WithRouteMiddleware.
+func (rl *RateLimiter) Route(name string, next http.Handler) http.Handler {
+	return rl.limit(name, next)
+}
+
+// RateLimit is a middleware that implements rate limiting based on
+// IP address.
+//
+// It uses token-bucket algorithm with 'r' as rate and 'b' as burst.
+// 'method' is used to specify the method for collecting the IP address.
+// The limiter can't be stopped, use NewRateLimiter if that matters.
+func RateLimit(next http.Handler, r, b, method int) http.Handler {
+	return NewRateLimiter(r, b, method).Handler(next)
+}
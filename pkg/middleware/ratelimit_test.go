@@ -0,0 +1,205 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePolicies(t *testing.T) {
+	p, err := ParsePolicies("*=5:2, GET=20:40,POST CreateComment=0.5:3,Ready=unlimited")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		route, method string
+		want          string
+	}{
+		{"ReadReview", "GET", "20:40"},
+		{"CreateComment", "POST", "0.5:3"},
+		{"CreateComment", "GET", "20:40"},
+		{"CreateReview", "POST", "5:2"},
+		{"Ready", "GET", "unlimited"},
+		{"", "DELETE", "5:2"},
+	}
+	for _, test := range tests {
+		if got := p.For(test.route, test.method).Policy.String(); got != test.want {
+			t.Errorf("%s %s: got %s, want %s", test.method, test.route, got, test.want)
+		}
+	}
+
+	if got, want := p.String(), "*=5:2,GET=20:40,POST CreateComment=0.5:3,Ready=unlimited"; got != want {
+		t.Errorf("Expected policies to round trip, got %s", got)
+	}
+
+	for _, bad := range []string{
+		"GET=20:40",
+		"*=5",
+		"*=0:2",
+		"*=5:0",
+		"*=5:2,GET POST=1:1",
+		"*=5:2,=1:1",
+	} {
+		if _, err := ParsePolicies(bad); err == nil {
+			t.Errorf("Expected '%s' to be rejected", bad)
+		}
+	}
+}
+
+func TestRateLimiterPolicies(t *testing.T) {
+	p, _ := ParsePolicies("*=1:1,GET=1:3")
+	rl := NewPolicyRateLimiter(p, func(r *http.Request) string { return "k" })
+	defer rl.Close()
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	do := func(h http.Handler, method string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, "/", nil))
+		return w
+	}
+
+	read := rl.Route("ReadReview", ok)
+	for i, remaining := range []string{"2", "1", "0"} {
+		w := do(read, "GET")
+		if w.Code != 200 {
+			t.Fatalf("Request %d: expected 200, got %d", i, w.Code)
+		}
+		if got := w.Header().Get("RateLimit-Limit"); got != "3" {
+			t.Errorf("Expected RateLimit-Limit 3, got %s", got)
+		}
+		if got := w.Header().Get("RateLimit-Remaining"); got != remaining {
+			t.Errorf("Request %d: expected RateLimit-Remaining %s, got %s", i, remaining, got)
+		}
+	}
+
+	w := do(read, "GET")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Expected Retry-After 1, got %s", got)
+	}
+	var body struct{ Err string }
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Err == "" {
+		t.Errorf("Expected a JSON error body, got %q", w.Body.String())
+	}
+
+	// Other rules have their own buckets
+	if w := do(rl.Route("CreateReview", ok), "POST"); w.Code != 200 {
+		t.Errorf("Expected POST to have its own bucket, got %d", w.Code)
+	}
+}
+
+func TestRateLimiterOnce(t *testing.T) {
+	rl := NewKeyedRateLimiter(1, 1, func(r *http.Request) string { return "k" })
+	defer rl.Close()
+
+	// A limiter in front of a request twice only counts it once
+	inner := rl.Route("Inner", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h := rl.Handler(inner)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 200 {
+		t.Errorf("Expected nested limiters to take one token, got %d", w.Code)
+	}
+
+	// Sub-requests count on their own
+	rl = NewKeyedRateLimiter(1, 2, func(r *http.Request) string { return "k" })
+	defer rl.Close()
+	inner = rl.Route("Inner", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	var codes []int
+	h = rl.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 2; i++ {
+			sub := httptest.NewRecorder()
+			inner.ServeHTTP(sub, r.WithContext(SubRequest(r.Context())))
+			codes = append(codes, sub.Code)
+		}
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if len(codes) != 2 || codes[0] != 200 || codes[1] != http.StatusTooManyRequests {
+		t.Errorf("Expected sub-requests to take a token each, got %v", codes)
+	}
+}
+
+func TestRateLimiterStacked(t *testing.T) {
+	coarse := NewKeyedRateLimiter(1, 3, func(r *http.Request) string { return "ip" })
+	defer coarse.Close()
+	routes := NewKeyedRateLimiter(1, 1, func(r *http.Request) string { return "user" })
+	defer routes.Close()
+
+	// Limiters in front of each other both apply
+	h := coarse.Handler(routes.Route("Inner", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	for i, want := range []int{200, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != want {
+			t.Errorf("Request %d: expected %d, got %d", i, want, w.Code)
+		}
+	}
+}
+
+func TestBucketRefill(t *testing.T) {
+	now := time.Now()
+	b := &bucket{policy: Policy{Rate: 2, Burst: 4}, tokens: 0, last: now}
+
+	b.refill(now.Add(time.Second))
+	if b.tokens != 2 {
+		t.Errorf("Expected 2 tokens after a second, got %v", b.tokens)
+	}
+	if b.full(now.Add(time.Second)) || !b.full(now.Add(2*time.Second)) {
+		t.Error("Expected the bucket to be full after two seconds")
+	}
+	b.refill(now.Add(time.Hour))
+	if b.tokens != 4 {
+		t.Errorf("Expected tokens to be capped at the burst, got %v", b.tokens)
+	}
+}
+
+func TestSetPolicies(t *testing.T) {
+	rl := NewKeyedRateLimiter(1, 1, func(r *http.Request) string { return "k" })
+	defer rl.Close()
+	h := rl.Route("ReadReview", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	do := func() int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w.Code
+	}
+	if do() != 200 || do() != http.StatusTooManyRequests {
+		t.Fatal("Expected the second request to be limited")
+	}
+
+	p, _ := ParsePolicies("*=1:1,ReadReview=unlimited")
+	rl.SetPolicies(p)
+	if code := do(); code != 200 {
+		t.Errorf("Expected new policies to apply straight away, got %d", code)
+	}
+}
+
+func TestBodyLimiter(t *testing.T) {
+	bl := NewBodyLimiter(4)
+	h := bl.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	}))
+	do := func() int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("too long")))
+		return w.Code
+	}
+
+	if code := do(); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected the body to be too large, got %d", code)
+	}
+	bl.SetLimit(100)
+	if code := do(); code != 200 {
+		t.Errorf("Expected the new limit to apply, got %d", code)
+	}
+}
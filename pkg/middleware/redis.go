@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nsmith5/vgraas/pkg/resp"
+)
+
+// RedisStore is a Store keeping counters on a server speaking the Redis
+// protocol, so every replica talking to it shares the same limits.
+//
+// It uses a sliding window: a Policy with rate r and burst b allows b
+// requests in any b/r seconds. The count for the window is estimated
+// from the counters of the current and previous fixed windows, the
+// previous one weighted by how much of it the sliding window still
+// covers. Each request is decided and counted by a script on the server,
+// in one atomic round trip. Windows are cut by the clock of the replica,
+// so replicas' clocks should be kept in sync.
+type RedisStore struct {
+	client *resp.Client
+	prefix string
+	now    func() time.Time
+}
+
+// takeScript counts a request in the window KEYS[1] unless that takes
+// the estimate over the burst ARGV[1], the previous window KEYS[2]
+// weighing in by 1 - ARGV[2]. Rejected requests aren't counted, or a
+// client hammering away would never get through. The reply is whether
+// the request was allowed, the count of the window with it and the
+// count of the previous window.
+const takeScript = `
+local count = tonumber(redis.call('GET', KEYS[1]) or '0') + 1
+local before = tonumber(redis.call('GET', KEYS[2]) or '0')
+if before * (1 - tonumber(ARGV[2])) + count > tonumber(ARGV[1]) then
+	return {0, count, before}
+end
+redis.call('INCR', KEYS[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return {1, count, before}
+`
+
+// takeSHA is the digest the server knows takeScript by once it has
+// seen it.
+var takeSHA = func() string {
+	sum := sha1.Sum([]byte(takeScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// NewRedisStore returns a RedisStore using client, with keys starting
+// with prefix.
+func NewRedisStore(client *resp.Client, prefix string) *RedisStore {
+	return &RedisStore{client: client, prefix: prefix, now: time.Now}
+}
+
+// Close closes the client.
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
+
+// Take counts a request against the window for key.
+func (s *RedisStore) Take(ctx context.Context, key string, p Policy) (Decision, error) {
+	window := time.Duration(float64(p.Burst) / p.Rate * float64(time.Second))
+	if window < time.Millisecond {
+		window = time.Millisecond
+	}
+	now := s.now().UnixNano()
+	n := now / int64(window)
+	elapsed := float64(now%int64(window)) / float64(window)
+
+	cur := s.prefix + key + ":" + strconv.FormatInt(n, 10)
+	prev := s.prefix + key + ":" + strconv.FormatInt(n-1, 10)
+	args := []string{"2", cur, prev,
+		strconv.Itoa(p.Burst),
+		strconv.FormatFloat(elapsed, 'g', -1, 64),
+		strconv.FormatInt(int64(2*window/time.Millisecond), 10),
+	}
+	reply, err := s.client.Do(ctx, append([]string{"EVALSHA", takeSHA}, args...)...)
+	if e, ok := err.(resp.Error); ok && strings.HasPrefix(string(e), "NOSCRIPT") {
+		// The server hasn't seen the script yet, or has been restarted
+		reply, err = s.client.Do(ctx, append([]string{"EVAL", takeScript}, args...)...)
+	}
+	if err != nil {
+		return Decision{}, err
+	}
+	results, ok := reply.([]interface{})
+	if !ok || len(results) != 3 {
+		return Decision{}, fmt.Errorf("Unexpected reply to the rate limit script: %v", reply)
+	}
+	var counts [3]int64
+	for i, result := range results {
+		if counts[i], ok = result.(int64); !ok {
+			return Decision{}, fmt.Errorf("Unexpected reply to the rate limit script: %v", reply)
+		}
+	}
+	allowed, count, before := counts[0] == 1, counts[1], counts[2]
+
+	burst := float64(p.Burst)
+	estimate := float64(before)*(1-elapsed) + float64(count)
+	d := Decision{Limit: p.Burst}
+	if allowed {
+		d.Allowed = true
+		d.Remaining = int(burst - estimate)
+		return d, nil
+	}
+
+	// Wait for enough of the previous window to slide out, or for the
+	// next window if the current one is full on its own
+	left := (1 - elapsed) * float64(window)
+	d.RetryAfter = time.Duration(left)
+	if before > 0 && float64(count) <= burst {
+		wait := (estimate - burst) / float64(before) * float64(window)
+		if wait < left {
+			d.RetryAfter = time.Duration(wait)
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,184 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nsmith5/vgraas/pkg/resp"
+	"github.com/nsmith5/vgraas/pkg/resp/resptest"
+)
+
+// newRedisServer returns a fake Redis server that runs takeScript.
+func newRedisServer() *resptest.Server {
+	srv := resptest.NewServer()
+	srv.Script(takeScript, func(call func(args ...string) interface{}, keys, args []string) interface{} {
+		get := func(key string) int64 {
+			v, _ := call("GET", key).(string)
+			n, _ := strconv.ParseInt(v, 10, 64)
+			return n
+		}
+		count, before := get(keys[0])+1, get(keys[1])
+		burst, _ := strconv.ParseFloat(args[0], 64)
+		elapsed, _ := strconv.ParseFloat(args[1], 64)
+		if float64(before)*(1-elapsed)+float64(count) > burst {
+			return []interface{}{int64(0), count, before}
+		}
+		call("INCR", keys[0])
+		call("PEXPIRE", keys[0], args[2])
+		return []interface{}{int64(1), count, before}
+	})
+	return srv
+}
+
+func TestRedisStore(t *testing.T) {
+	srv := newRedisServer()
+	defer srv.Close()
+
+	store := NewRedisStore(resp.New(resp.Config{Addr: srv.Addr}), "test:")
+	defer store.Close()
+
+	// 4 requests per second: windows of a second, starting on the second
+	start := time.Unix(1000, 0)
+	now := start
+	store.now = func() time.Time { return now }
+	policy := Policy{Rate: 4, Burst: 4}
+	ctx := context.Background()
+
+	take := func() Decision {
+		d, err := store.Take(ctx, "k", policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	for i, remaining := range []int{3, 2, 1, 0} {
+		if d := take(); !d.Allowed || d.Remaining != remaining || d.Limit != 4 {
+			t.Errorf("Request %d: got %+v", i, d)
+		}
+	}
+	d := take()
+	if d.Allowed || d.RetryAfter != time.Second {
+		t.Errorf("Expected a full window to reject for a second, got %+v", d)
+	}
+	if got, _ := srv.Get("test:k:1000"); got != "4" {
+		t.Errorf("Expected rejected requests not to be counted, got %s", got)
+	}
+
+	// Halfway into the next window half of the previous one still
+	// counts
+	now = start.Add(1500 * time.Millisecond)
+	for i, remaining := range []int{1, 0} {
+		if d := take(); !d.Allowed || d.Remaining != remaining {
+			t.Errorf("Request %d halfway through: got %+v", i, d)
+		}
+	}
+	d = take()
+	if d.Allowed || d.RetryAfter != 250*time.Millisecond {
+		t.Errorf("Expected to wait a quarter second, got %+v", d)
+	}
+
+	// Different keys don't share
+	if d, _ := store.Take(ctx, "other", policy); !d.Allowed {
+		t.Errorf("Expected another key to have its own window, got %+v", d)
+	}
+}
+
+func TestRedisStoreShared(t *testing.T) {
+	srv := newRedisServer()
+	defer srv.Close()
+
+	// Two replicas with their own clients
+	policies := Policies{Default: Policy{Rate: 1, Burst: 2}}
+	key := func(r *http.Request) string { return "k" }
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	var replicas []http.Handler
+	for i := 0; i < 2; i++ {
+		rl := NewStoreRateLimiter(NewRedisStore(resp.New(resp.Config{Addr: srv.Addr}), "vgraas:"), policies, key)
+		defer rl.Close()
+		replicas = append(replicas, rl.Handler(ok))
+	}
+
+	var codes []int
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		replicas[i%2].ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		codes = append(codes, w.Code)
+	}
+	// The window might roll over between requests, but never twice
+	allowed := 0
+	for _, code := range codes {
+		if code == 200 {
+			allowed++
+		}
+	}
+	if allowed > 3 || codes[0] != 200 {
+		t.Errorf("Expected replicas to share a limit, got %v", codes)
+	}
+}
+
+func TestRedisStoreAtomic(t *testing.T) {
+	srv := newRedisServer()
+	defer srv.Close()
+	store := NewRedisStore(resp.New(resp.Config{Addr: srv.Addr}), "test:")
+	defer store.Close()
+	now := time.Unix(1000, 0)
+	store.now = func() time.Time { return now }
+
+	// The script is sent once, and known by its digest after that
+	store.Take(context.Background(), "k", Policy{Rate: 1, Burst: 1})
+	before := srv.Commands()
+	store.Take(context.Background(), "k", Policy{Rate: 1, Burst: 1})
+	if n := srv.Commands() - before; n != 1 {
+		t.Errorf("Expected a request to take one command, took %d", n)
+	}
+
+	// Concurrent requests never get more than the burst through
+	var (
+		wg      sync.WaitGroup
+		mtx     sync.Mutex
+		allowed int
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d, err := store.Take(context.Background(), "busy", Policy{Rate: 10, Burst: 10})
+			if err != nil {
+				t.Error(err)
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			if d.Allowed {
+				allowed++
+			}
+		}()
+	}
+	wg.Wait()
+	if got, _ := srv.Get("test:busy:1000"); allowed != 10 || got != "10" {
+		t.Errorf("Expected exactly 10 requests to be counted and let through, got %d and %s", allowed, got)
+	}
+}
+
+func TestRateLimiterStoreDown(t *testing.T) {
+	srv := resptest.NewServer()
+	srv.Close()
+
+	store := NewRedisStore(resp.New(resp.Config{Addr: srv.Addr, Timeout: 100 * time.Millisecond}), "")
+	rl := NewStoreRateLimiter(store, Policies{Default: Policy{Rate: 1, Burst: 1}}, func(r *http.Request) string { return "k" })
+	defer rl.Close()
+	h := rl.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != 200 {
+			t.Errorf("Expected requests to be let through while the store is down, got %d", w.Code)
+		}
+	}
+}
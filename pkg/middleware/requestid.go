@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+type requestIDKey struct{}
+
+// RequestIDHeader is the header request IDs are read from and echoed in.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestID is the longest request ID accepted from a client.
+const maxRequestID = 128
+
+// RequestID is a middleware that gives every request an ID, so that log
+// lines and error reports can be matched up.
+//
+// An X-Request-ID header set by the client or a proxy in front of us is
+// honoured if it is reasonable, otherwise a random ID is generated. The
+// ID is echoed in the X-Request-ID response header and is available to
+// handlers through RequestIDFromContext.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestIDFromContext returns the ID of the request ctx belongs to, or
+// "" if it has none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID only lets through IDs that are safe to log and echo:
+// short and made of printable ASCII.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestID {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
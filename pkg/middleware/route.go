@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+type routeKey struct{}
+
+// routeName carries the name of the matched route from the router back
+// out to the middlewares wrapping it. The authenticated user travels
+// back the same way, see WithUser.
+type routeName struct {
+	mtx  sync.Mutex
+	name string
+	user string
+}
+
+// TrackRoute returns r with room for the router to record the name of
+// the route it dispatches to, which can be read back with RouteName once
+// the request has been served. Requests already tracking are returned
+// as is.
+func TrackRoute(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(routeKey{}).(*routeName); ok {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), routeKey{}, &routeName{}))
+}
+
+// SetRouteName records the name of the route r was dispatched to. It
+// does nothing unless a middleware called TrackRoute. Only the first
+// name is kept, so handlers that dispatch sub-requests through the same
+// router, like /batch, don't hide their own route.
+func SetRouteName(r *http.Request, name string) {
+	if rn, ok := r.Context().Value(routeKey{}).(*routeName); ok {
+		rn.mtx.Lock()
+		if rn.name == "" {
+			rn.name = name
+		}
+		rn.mtx.Unlock()
+	}
+}
+
+// RouteName returns the name of the route r was dispatched to, or the
+// empty string if it wasn't routed or isn't tracked.
+func RouteName(r *http.Request) string {
+	if rn, ok := r.Context().Value(routeKey{}).(*routeName); ok {
+		rn.mtx.Lock()
+		defer rn.mtx.Unlock()
+		return rn.name
+	}
+	return ""
+}
+
+// trackUser records the user a tracked request was authenticated as.
+func trackUser(r *http.Request, user string) {
+	if rn, ok := r.Context().Value(routeKey{}).(*routeName); ok {
+		rn.mtx.Lock()
+		rn.user = user
+		rn.mtx.Unlock()
+	}
+}
+
+// trackedUser returns the user a tracked request was authenticated as
+// further down the chain.
+func trackedUser(r *http.Request) string {
+	if rn, ok := r.Context().Value(routeKey{}).(*routeName); ok {
+		rn.mtx.Lock()
+		defer rn.mtx.Unlock()
+		return rn.user
+	}
+	return ""
+}
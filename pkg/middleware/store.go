@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Decision is the outcome of counting a request against a limit.
+type Decision struct {
+	Allowed bool
+
+	// Limit is the burst of the policy and Remaining the number of
+	// requests that could be made right now.
+	Limit     int
+	Remaining int
+
+	// RetryAfter is how long a rejected request should wait.
+	RetryAfter time.Duration
+}
+
+// Store keeps the state of rate limits. Replicas sharing a Store share
+// their limits.
+type Store interface {
+	// Take counts a request against the limit p for key.
+	Take(ctx context.Context, key string, p Policy) (Decision, error)
+}
+
+// MemoryStore is a Store keeping a token bucket per key in memory. Full
+// buckets are no different from new ones and are periodically
+// forgotten, call Close to stop the clean up.
+type MemoryStore struct {
+	mtx     sync.Mutex
+	buckets map[string]*bucket
+
+	quit chan struct{}
+	once sync.Once
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{
+		buckets: make(map[string]*bucket),
+		quit:    make(chan struct{}),
+	}
+	go s.cleanup()
+	return s
+}
+
+// Close stops the background clean up of full buckets.
+func (s *MemoryStore) Close() error {
+	s.once.Do(func() { close(s.quit) })
+	return nil
+}
+
+// Periodically clean out full buckets until closed
+func (s *MemoryStore) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case now := <-ticker.C:
+			s.mtx.Lock()
+			for key, b := range s.buckets {
+				if b.full(now) {
+					delete(s.buckets, key)
+				}
+			}
+			s.mtx.Unlock()
+		}
+	}
+}
+
+// Take takes a token from the bucket for key.
+func (s *MemoryStore) Take(ctx context.Context, key string, p Policy) (Decision, error) {
+	return s.take(key, p, time.Now()), nil
+}
+
+func (s *MemoryStore) take(key string, p Policy, now time.Time) Decision {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	b, exists := s.buckets[key]
+	if !exists {
+		b = &bucket{policy: p, tokens: float64(p.Burst), last: now}
+		s.buckets[key] = b
+	}
+	// Policies may have changed since the bucket was made
+	b.policy = p
+	b.refill(now)
+
+	d := Decision{Limit: p.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = time.Duration((1 - b.tokens) / p.Rate * float64(time.Second))
+	}
+	d.Remaining = int(b.tokens)
+	return d
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	policy Policy
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the bucket was last used.
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.policy.Rate
+	if max := float64(b.policy.Burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+}
+
+func (b *bucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.policy.Rate >= float64(b.policy.Burst)
+}
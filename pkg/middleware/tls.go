@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"crypto/x509"
+	"net"
+	"net/http"
+)
+
+// ClientCert is a middleware that identifies callers by TLS client
+// certificate.
+//
+// Only certificates the server verified count. With no users, callers
+// are known by the common name of their certificate. Otherwise users
+// maps certificate names, the common name, email addresses or DNS names,
+// to user names and certificates matching none of them carry on
+// anonymously. Put Authenticate inside ClientCert so that an API key,
+// when given, takes precedence.
+func ClientCert(next http.Handler, users map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if user := certUser(r.TLS.VerifiedChains[0][0], users); user != "" {
+			r = WithUser(r, user)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// certUser returns the user cert identifies, or "" for none.
+func certUser(cert *x509.Certificate, users map[string]string) string {
+	if len(users) == 0 {
+		return cert.Subject.CommonName
+	}
+	names := append([]string{cert.Subject.CommonName}, cert.EmailAddresses...)
+	names = append(names, cert.DNSNames...)
+	for _, name := range names {
+		if user, ok := users[name]; ok && name != "" {
+			return user
+		}
+	}
+	return ""
+}
+
+// RedirectHTTPS is a handler that redirects every request to the same
+// URL over HTTPS on port. The port is left out of the URL if it is 443.
+// The redirect is permanent and keeps the method and body.
+func RedirectHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else if len(host) > 1 && host[0] == '[' && host[len(host)-1] == ']' {
+			host = host[1 : len(host)-1]
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if net.ParseIP(host) != nil && net.ParseIP(host).To4() == nil {
+			host = "[" + host + "]"
+		}
+
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+	})
+}
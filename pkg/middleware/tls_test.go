@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientCert(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "billing"},
+		EmailAddresses: []string{"ops@example.com"},
+	}
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+
+	tests := []struct {
+		users map[string]string
+		state *tls.ConnectionState
+		want  string
+	}{
+		{nil, verified, "billing"},
+		{map[string]string{"ops@example.com": "ops"}, verified, "ops"},
+		{map[string]string{"someone-else": "x"}, verified, ""},
+		{nil, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, ""},
+		{nil, nil, ""},
+	}
+	for i, test := range tests {
+		var got string
+		h := ClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = User(r)
+		}), test.users)
+		r := httptest.NewRequest("GET", "/", nil)
+		r.TLS = test.state
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if got != test.want {
+			t.Errorf("Test %d: expected user %q, got %q", i, test.want, got)
+		}
+	}
+
+	// API keys take precedence
+	h := ClientCert(Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := User(r); got != "alice" {
+			t.Errorf("Expected the API key to win, got %q", got)
+		}
+	}), map[string]string{"k": "alice"}), nil)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.TLS = verified
+	r.Header.Set("X-API-Key", "k")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	tests := []struct {
+		port, host, want string
+	}{
+		{"443", "example.com", "https://example.com/reviews?page=2"},
+		{"443", "example.com:80", "https://example.com/reviews?page=2"},
+		{"8443", "example.com:8080", "https://example.com:8443/reviews?page=2"},
+		{"8443", "[::1]:8080", "https://[::1]:8443/reviews?page=2"},
+		{"443", "[::1]", "https://[::1]/reviews?page=2"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/reviews?page=2", nil)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		RedirectHTTPS(test.port).ServeHTTP(w, r)
+		if w.Code != http.StatusPermanentRedirect {
+			t.Errorf("Expected 308, got %d", w.Code)
+		}
+		if got := w.Header().Get("Location"); got != test.want {
+			t.Errorf("%s: expected %s, got %s", test.host, test.want, got)
+		}
+	}
+}
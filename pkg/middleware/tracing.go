@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/nsmith5/vgraas/pkg/tracing"
+)
+
+// Tracing is a middleware that starts a span for every request with
+// tracer. Incoming W3C traceparent and tracestate headers make the span
+// part of the caller's trace, and the span travels in the request
+// context for handlers to start child spans from.
+//
+// Spans are named after the route that served the request, which the
+// router behind it has to report with SetRouteName.
+func Tracing(next http.Handler, tracer *tracing.Tracer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if tp := r.Header.Get("traceparent"); tp != "" {
+			sc, err := tracing.ParseTraceparent(tp, r.Header.Get("tracestate"))
+			if err == nil {
+				ctx = tracing.WithRemote(ctx, sc)
+			}
+		}
+
+		ctx, span := tracer.Start(ctx, "HTTP "+r.Method)
+		defer span.End()
+
+		r = TrackRoute(r.WithContext(ctx))
+		iw := &interceptingWriter{0, http.StatusOK, w}
+
+		next.ServeHTTP(iw, r)
+
+		if route := RouteName(r); route != "" {
+			span.SetName(route)
+			span.SetAttribute("http.route", route)
+		}
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", target(r.URL))
+		span.SetAttribute("http.status_code", iw.code)
+		if iw.code >= 500 {
+			span.SetError(errorStatus(iw.code))
+		}
+	})
+}
+
+// target returns the request target of u without an access_token query
+// parameter. API keys are secrets and don't belong in traces.
+func target(u *url.URL) string {
+	query := u.Query()
+	if _, ok := query["access_token"]; !ok {
+		return u.RequestURI()
+	}
+	query.Del("access_token")
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.RequestURI()
+}
+
+// errorStatus reports an HTTP status code as an error.
+type errorStatus int
+
+func (code errorStatus) Error() string {
+	return http.StatusText(int(code))
+}
@@ -0,0 +1,316 @@
+// Package resp is a minimal client for servers speaking the Redis
+// serialization protocol (RESP), such as Redis, KeyDB or Dragonfly.
+//
+// It only does what vgraas needs: send commands, one at a time or
+// pipelined, over a small pool of connections.
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error is an error reply from the server.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// ErrClosed is returned by a Client that has been closed.
+var ErrClosed = errors.New("resp: client closed")
+
+// Config says where and how to connect.
+type Config struct {
+	// Addr is the host:port of the server.
+	Addr string
+
+	// Password, if not empty, is sent with AUTH on every new
+	// connection.
+	Password string
+
+	// DB, if not 0, is selected on every new connection.
+	DB int
+
+	// PoolSize is the number of idle connections kept, 4 if 0.
+	PoolSize int
+
+	// Timeout bounds dialing and every command, 1s if 0. Deadlines
+	// of the command's context also apply.
+	Timeout time.Duration
+}
+
+// ParseURL parses a URL of the form redis://[:password@]host[:port][/db]
+// into a Config. The port defaults to 6379.
+func ParseURL(s string) (Config, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return Config{}, err
+	}
+	if u.Scheme != "redis" {
+		return Config{}, fmt.Errorf("Unsupported scheme '%s', expected redis://", u.Scheme)
+	}
+	if u.Host == "" {
+		return Config{}, fmt.Errorf("Missing host in '%s'", s)
+	}
+
+	cfg := Config{Addr: u.Host}
+	if u.Port() == "" {
+		cfg.Addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		cfg.Password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		cfg.DB, err = strconv.Atoi(db)
+		if err != nil {
+			return Config{}, fmt.Errorf("Invalid database '%s'", db)
+		}
+	}
+	return cfg, nil
+}
+
+// Client sends commands to a server. It is safe for concurrent use.
+type Client struct {
+	cfg Config
+
+	mtx    sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+// New returns a Client for cfg. Connections are made when needed.
+func New(cfg Config) *Client {
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = 4
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+	return &Client{cfg: cfg}
+}
+
+// Do sends a command and returns its reply. Replies are a string for
+// simple and bulk strings, nil for null bulk strings and arrays, an
+// int64 for integers and a []interface{} for arrays. Error replies are
+// returned as an Error.
+func (c *Client) Do(ctx context.Context, args ...string) (interface{}, error) {
+	replies, err := c.Pipeline(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := replies[0].(Error); ok {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// Pipeline sends several commands at once and returns their replies in
+// order. Error replies are left in the slice as an Error, the error
+// returned is for failures to talk to the server.
+func (c *Client) Pipeline(ctx context.Context, cmds ...[]string) ([]interface{}, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := cn.roundTrip(ctx, c.cfg.Timeout, cmds)
+	if err != nil {
+		// The connection is in an unknown state
+		cn.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return replies, nil
+}
+
+// Ping checks the server is answering.
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.Do(ctx, "PING")
+	return err
+}
+
+// Close closes idle connections. Connections in use are closed when
+// their command completes.
+func (c *Client) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.closed = true
+	for _, cn := range c.idle {
+		cn.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	c.mtx.Lock()
+	if c.closed {
+		c.mtx.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mtx.Unlock()
+		return cn, nil
+	}
+	c.mtx.Unlock()
+	return c.dial(ctx)
+}
+
+func (c *Client) put(cn *conn) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.closed || len(c.idle) >= c.cfg.PoolSize {
+		cn.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	d := net.Dialer{Timeout: c.cfg.Timeout}
+	nc, err := d.DialContext(ctx, "tcp", c.cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+
+	var setup [][]string
+	if c.cfg.Password != "" {
+		setup = append(setup, []string{"AUTH", c.cfg.Password})
+	}
+	if c.cfg.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.cfg.DB)})
+	}
+	if len(setup) > 0 {
+		replies, err := cn.roundTrip(ctx, c.cfg.Timeout, setup)
+		if err == nil {
+			for _, reply := range replies {
+				if e, ok := reply.(Error); ok {
+					err = e
+					break
+				}
+			}
+		}
+		if err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// conn is a connection to the server.
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func (cn *conn) roundTrip(ctx context.Context, timeout time.Duration, cmds [][]string) ([]interface{}, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	cn.SetDeadline(deadline)
+
+	for _, cmd := range cmds {
+		WriteCommand(cn.w, cmd...)
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]interface{}, len(cmds))
+	for i := range replies {
+		reply, err := ReadReply(cn.r)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// WriteCommand writes args as an array of bulk strings, the way clients
+// send commands.
+func WriteCommand(w io.Writer, args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ReadReply reads one reply, see Client.Do for how replies are
+// represented. Servers can use it to read commands too, they arrive as
+// arrays of strings.
+func ReadReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, errors.New("resp: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("resp: invalid bulk length '%s'", line[1:])
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("resp: invalid array length '%s'", line[1:])
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			if arr[i], err = ReadReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	}
+	return nil, fmt.Errorf("resp: unexpected reply type '%c'", line[0])
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", errors.New("resp: line not terminated by CRLF")
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,129 @@
+package resp_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/nsmith5/vgraas/pkg/resp"
+	"github.com/nsmith5/vgraas/pkg/resp/resptest"
+)
+
+func TestClient(t *testing.T) {
+	srv := resptest.NewServer()
+	defer srv.Close()
+	srv.Password = "secret"
+
+	c := resp.New(resp.Config{Addr: srv.Addr, Password: "secret", DB: 2})
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Do(ctx, "SET", "greeting", "hello\r\nworld"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Do(ctx, "GET", "greeting"); err != nil || got != "hello\r\nworld" {
+		t.Errorf("GET: got %q, %v", got, err)
+	}
+	if got, err := c.Do(ctx, "GET", "missing"); err != nil || got != nil {
+		t.Errorf("GET missing: got %v, %v", got, err)
+	}
+	if _, ok := srv.Get("greeting"); ok {
+		t.Error("Expected the key to be set in the selected database, not 0")
+	}
+
+	replies, err := c.Pipeline(ctx,
+		[]string{"MULTI"},
+		[]string{"INCR", "n"},
+		[]string{"INCRBY", "n", "5"},
+		[]string{"EXEC"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{"OK", "QUEUED", "QUEUED", []interface{}{int64(1), int64(6)}}
+	if !reflect.DeepEqual(replies, want) {
+		t.Errorf("Pipeline: got %#v, want %#v", replies, want)
+	}
+
+	if _, err := c.Do(ctx, "NONSENSE"); err == nil {
+		t.Error("Expected an error reply")
+	} else if _, ok := err.(resp.Error); !ok {
+		t.Errorf("Expected a resp.Error, got %T", err)
+	}
+
+	c.Close()
+	if err := c.Ping(ctx); err != resp.ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	srv := resptest.NewServer()
+	defer srv.Close()
+	srv.Password = "secret"
+
+	c := resp.New(resp.Config{Addr: srv.Addr, Password: "wrong"})
+	defer c.Close()
+	if err := c.Ping(context.Background()); err == nil {
+		t.Error("Expected a wrong password to fail")
+	}
+}
+
+func TestClientServerGone(t *testing.T) {
+	srv := resptest.NewServer()
+	c := resp.New(resp.Config{Addr: srv.Addr})
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+	if err := c.Ping(ctx); err == nil {
+		t.Error("Expected an error once the server is gone")
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want resp.Config
+	}{
+		{"redis://localhost", resp.Config{Addr: "localhost:6379"}},
+		{"redis://:pw@redis:6380/3", resp.Config{Addr: "redis:6380", Password: "pw", DB: 3}},
+	}
+	for _, test := range tests {
+		got, err := resp.ParseURL(test.url)
+		if err != nil || got != test.want {
+			t.Errorf("%s: got %+v, %v, want %+v", test.url, got, err, test.want)
+		}
+	}
+	for _, bad := range []string{"http://localhost", "redis://", "redis://host/zero"} {
+		if _, err := resp.ParseURL(bad); err == nil {
+			t.Errorf("Expected '%s' to be rejected", bad)
+		}
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	var buf bytes.Buffer
+	resp.WriteCommand(&buf, "SET", "k", "")
+	got, err := resp.ReadReply(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{"SET", "k", ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+
+	for _, bad := range []string{"", "?\r\n", "$5\r\nab\r\n", ":12\n", "$-2\r\n"} {
+		if _, err := resp.ReadReply(bufio.NewReader(bytes.NewBufferString(bad))); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+// Package resptest provides an in-process server speaking enough of the
+// Redis protocol to test code built on package resp.
+//
+// It keeps string keys in memory and understands PING, AUTH, SELECT,
+// GET, SET, DEL, INCR, INCRBY, DECR, PEXPIRE, PTTL, MULTI, EXEC and
+// DISCARD. EVAL and EVALSHA run Go stand-ins for scripts, see Script.
+package resptest
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsmith5/vgraas/pkg/resp"
+)
+
+// Server is a fake Redis server listening on a loopback address.
+type Server struct {
+	// Addr is the host:port the server listens on.
+	Addr string
+
+	// Password, if set before the first command, is required with
+	// AUTH.
+	Password string
+
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mtx      sync.Mutex
+	dbs      map[int]map[string]*entry
+	commands int
+	conns    map[net.Conn]bool
+	scripts  map[string]ScriptFunc
+	loaded   map[string]bool
+}
+
+// ScriptFunc stands in for a Lua script, see Server.Script. call runs a
+// command and returns its reply, like redis.call.
+type ScriptFunc func(call func(args ...string) interface{}, keys, args []string) interface{}
+
+type entry struct {
+	value   string
+	expires time.Time
+}
+
+// NewServer starts a Server. Close it when done.
+func NewServer() *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("resptest: failed to listen: %v", err))
+	}
+	s := &Server{
+		Addr:    ln.Addr().String(),
+		ln:      ln,
+		dbs:     make(map[int]map[string]*entry),
+		conns:   make(map[net.Conn]bool),
+		scripts: make(map[string]ScriptFunc),
+		loaded:  make(map[string]bool),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Close stops the server and hangs up on its clients.
+func (s *Server) Close() {
+	s.ln.Close()
+	s.mtx.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mtx.Unlock()
+	s.wg.Wait()
+}
+
+// Script makes EVAL of the Lua script src run fn instead, the server
+// can't run Lua itself. Like on a real server, EVALSHA of the SHA1 digest
+// of src fails with NOSCRIPT until src has been sent with EVAL once, and
+// nothing else runs while fn does.
+func (s *Server) Script(src string, fn ScriptFunc) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.scripts[digest(src)] = fn
+}
+
+func digest(src string) string {
+	sum := sha1.Sum([]byte(src))
+	return hex.EncodeToString(sum[:])
+}
+
+// Commands returns the number of commands served so far.
+func (s *Server) Commands() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.commands
+}
+
+// Get returns the value of key in database 0 and whether it exists.
+func (s *Server) Get(key string) (string, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	e := s.lookup(0, key)
+	if e == nil {
+		return "", false
+	}
+	return e.value, true
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mtx.Lock()
+		s.conns[c] = true
+		s.mtx.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(c)
+	}
+}
+
+// session is the state of one client connection.
+type session struct {
+	db     int
+	authed bool
+	queue  [][]string
+	multi  bool
+}
+
+func (s *Server) handle(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mtx.Lock()
+		delete(s.conns, c)
+		s.mtx.Unlock()
+		c.Close()
+	}()
+
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	var sess session
+	for {
+		cmd, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		writeReply(w, s.exec(&sess, cmd))
+		// Flush once the pipeline has been drained
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	reply, err := resp.ReadReply(r)
+	if err != nil {
+		return nil, err
+	}
+	arr, ok := reply.([]interface{})
+	if !ok || len(arr) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	cmd := make([]string, len(arr))
+	for i, arg := range arr {
+		if cmd[i], ok = arg.(string); !ok {
+			return nil, io.ErrUnexpectedEOF
+		}
+	}
+	return cmd, nil
+}
+
+// status is a simple string reply.
+type status string
+
+const ok status = "OK"
+
+func (s *Server) exec(sess *session, cmd []string) interface{} {
+	name := strings.ToUpper(cmd[0])
+
+	s.mtx.Lock()
+	s.commands++
+	password := s.Password
+	s.mtx.Unlock()
+
+	if name == "AUTH" {
+		if len(cmd) != 2 || cmd[1] != password {
+			return resp.Error("WRONGPASS invalid password")
+		}
+		sess.authed = true
+		return ok
+	}
+	if password != "" && !sess.authed {
+		return resp.Error("NOAUTH Authentication required.")
+	}
+
+	switch name {
+	case "MULTI":
+		if sess.multi {
+			return resp.Error("ERR MULTI calls can not be nested")
+		}
+		sess.multi = true
+		return ok
+	case "DISCARD":
+		sess.multi, sess.queue = false, nil
+		return ok
+	case "EXEC":
+		if !sess.multi {
+			return resp.Error("ERR EXEC without MULTI")
+		}
+		queue := sess.queue
+		sess.multi, sess.queue = false, nil
+
+		// Run the transaction without letting anyone in between
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		replies := make([]interface{}, len(queue))
+		for i, queued := range queue {
+			replies[i] = s.run(sess, queued)
+		}
+		return replies
+	}
+
+	if sess.multi {
+		sess.queue = append(sess.queue, cmd)
+		return status("QUEUED")
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.run(sess, cmd)
+}
+
+// run executes a single command, s.mtx must be held.
+func (s *Server) run(sess *session, cmd []string) interface{} {
+	name, args := strings.ToUpper(cmd[0]), cmd[1:]
+	arity := func(n int) bool { return len(args) == n }
+	wrongArgs := resp.Error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+
+	switch name {
+	case "PING":
+		return status("PONG")
+	case "SELECT":
+		if !arity(1) {
+			return wrongArgs
+		}
+		db, err := strconv.Atoi(args[0])
+		if err != nil || db < 0 || db > 15 {
+			return resp.Error("ERR DB index is out of range")
+		}
+		sess.db = db
+		return ok
+	case "GET":
+		if !arity(1) {
+			return wrongArgs
+		}
+		if e := s.lookup(sess.db, args[0]); e != nil {
+			return e.value
+		}
+		return nil
+	case "SET":
+		if !arity(2) {
+			return wrongArgs
+		}
+		s.db(sess.db)[args[0]] = &entry{value: args[1]}
+		return ok
+	case "DEL":
+		n := int64(0)
+		for _, key := range args {
+			if s.lookup(sess.db, key) != nil {
+				delete(s.db(sess.db), key)
+				n++
+			}
+		}
+		return n
+	case "INCR", "DECR", "INCRBY":
+		by := int64(1)
+		switch {
+		case name == "INCRBY" && arity(2):
+			var err error
+			if by, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+				return resp.Error("ERR value is not an integer or out of range")
+			}
+		case name != "INCRBY" && arity(1):
+		default:
+			return wrongArgs
+		}
+		if name == "DECR" {
+			by = -1
+		}
+		e := s.lookup(sess.db, args[0])
+		if e == nil {
+			e = &entry{value: "0"}
+			s.db(sess.db)[args[0]] = e
+		}
+		n, err := strconv.ParseInt(e.value, 10, 64)
+		if err != nil {
+			return resp.Error("ERR value is not an integer or out of range")
+		}
+		n += by
+		e.value = strconv.FormatInt(n, 10)
+		return n
+	case "PEXPIRE":
+		if !arity(2) {
+			return wrongArgs
+		}
+		ms, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return resp.Error("ERR value is not an integer or out of range")
+		}
+		e := s.lookup(sess.db, args[0])
+		if e == nil {
+			return int64(0)
+		}
+		e.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return int64(1)
+	case "PTTL":
+		if !arity(1) {
+			return wrongArgs
+		}
+		e := s.lookup(sess.db, args[0])
+		switch {
+		case e == nil:
+			return int64(-2)
+		case e.expires.IsZero():
+			return int64(-1)
+		}
+		return int64(time.Until(e.expires) / time.Millisecond)
+	case "EVAL", "EVALSHA":
+		if len(args) < 2 {
+			return wrongArgs
+		}
+		sha := strings.ToLower(args[0])
+		if name == "EVAL" {
+			sha = digest(args[0])
+		}
+		fn, exists := s.scripts[sha]
+		switch {
+		case name == "EVALSHA" && (!exists || !s.loaded[sha]):
+			return resp.Error("NOSCRIPT No matching script. Please use EVAL.")
+		case !exists:
+			return resp.Error("ERR resptest can't run Lua, see Server.Script")
+		}
+		s.loaded[sha] = true
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 || n > len(args)-2 {
+			return resp.Error("ERR Number of keys can't be greater than number of args")
+		}
+		call := func(cmd ...string) interface{} { return s.run(sess, cmd) }
+		return fn(call, args[2:2+n], args[2+n:])
+	}
+	return resp.Error(fmt.Sprintf("ERR unknown command '%s'", cmd[0]))
+}
+
+func (s *Server) db(n int) map[string]*entry {
+	db, exists := s.dbs[n]
+	if !exists {
+		db = make(map[string]*entry)
+		s.dbs[n] = db
+	}
+	return db
+}
+
+// lookup returns the live entry for key, s.mtx must be held.
+func (s *Server) lookup(db int, key string) *entry {
+	e := s.db(db)[key]
+	if e != nil && !e.expires.IsZero() && !time.Now().Before(e.expires) {
+		delete(s.db(db), key)
+		return nil
+	}
+	return e
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case status:
+		w.WriteString("+" + string(v) + "\r\n")
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case resp.Error:
+		w.WriteString("-" + string(v) + "\r\n")
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeReply(w, item)
+		}
+	}
+}
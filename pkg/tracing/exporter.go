@@ -0,0 +1,147 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// JSONExporter writes spans as newline delimited JSON documents, handy
+// for reading traces on stdout during development.
+type JSONExporter struct {
+	mtx sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONExporter returns an Exporter writing to w.
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{enc: json.NewEncoder(w)}
+}
+
+// Export implements Exporter.
+func (je *JSONExporter) Export(s SpanData) {
+	doc := map[string]interface{}{
+		"name":     s.Name,
+		"traceId":  s.Context.TraceID.String(),
+		"spanId":   s.Context.SpanID.String(),
+		"start":    s.Start,
+		"duration": s.End.Sub(s.Start).Seconds(),
+	}
+	if s.Parent != (SpanID{}) {
+		doc["parentId"] = s.Parent.String()
+	}
+	if len(s.Attributes) > 0 {
+		doc["attributes"] = s.Attributes
+	}
+	if s.Err != "" {
+		doc["err"] = s.Err
+	}
+
+	je.mtx.Lock()
+	defer je.mtx.Unlock()
+	je.enc.Encode(doc)
+}
+
+// OTLPExporter writes spans in the OTLP/JSON encoding, one export request
+// per line. This is the format read and written by the OpenTelemetry
+// Collector's file receiver and exporter, so traces written to a file
+// can be replayed into a collector later.
+type OTLPExporter struct {
+	service string
+
+	mtx sync.Mutex
+	enc *json.Encoder
+}
+
+// NewOTLPExporter returns an Exporter writing to w, with spans attributed
+// to service.
+func NewOTLPExporter(w io.Writer, service string) *OTLPExporter {
+	return &OTLPExporter{service: service, enc: json.NewEncoder(w)}
+}
+
+// OTLP span kinds and status codes
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+
+	otlpStatusError = 2
+)
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	out := make([]otlpAttribute, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": fmt.Sprint(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": fmt.Sprint(v)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, otlpAttribute{k, value})
+	}
+	return out
+}
+
+func unixNano(t time.Time) string {
+	return fmt.Sprint(t.UnixNano())
+}
+
+// Export implements Exporter.
+func (oe *OTLPExporter) Export(s SpanData) {
+	span := map[string]interface{}{
+		"traceId":           s.Context.TraceID.String(),
+		"spanId":            s.Context.SpanID.String(),
+		"name":              s.Name,
+		"kind":              otlpKindInternal,
+		"startTimeUnixNano": unixNano(s.Start),
+		"endTimeUnixNano":   unixNano(s.End),
+		"attributes":        otlpAttributes(s.Attributes),
+	}
+	if s.Context.State != "" {
+		span["traceState"] = s.Context.State
+	}
+	if s.Parent != (SpanID{}) {
+		span["parentSpanId"] = s.Parent.String()
+	}
+	if s.Parent == (SpanID{}) || s.Remote {
+		span["kind"] = otlpKindServer
+	}
+	if s.Err != "" {
+		span["status"] = map[string]interface{}{"code": otlpStatusError, "message": s.Err}
+	}
+
+	req := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": oe.service}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/nsmith5/vgraas/pkg/tracing"},
+						"spans": []interface{}{span},
+					},
+				},
+			},
+		},
+	}
+
+	oe.mtx.Lock()
+	defer oe.mtx.Unlock()
+	oe.enc.Encode(req)
+}
@@ -0,0 +1,285 @@
+// Package tracing implements distributed tracing compatible with the W3C
+// Trace Context recommendation and OpenTelemetry.
+//
+// A Tracer starts spans and hands them to an Exporter once they end.
+// Spans travel in a context.Context, so code further down the call
+// stack can start child spans with Start without knowing about the
+// Tracer:
+//
+//	ctx, span := tracing.Start(ctx, "repo.ReadReview")
+//	defer span.End()
+//
+// Start returns a span that records nothing if ctx doesn't carry one,
+// and all Span methods are safe to call on a nil Span.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// String returns the id in lower case hex.
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+// String returns the id in lower case hex.
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// FlagSampled is set in SpanContext.Flags for traces that are recorded.
+const FlagSampled byte = 0x01
+
+// SpanContext is the part of a span that is propagated between services.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+
+	// State is the vendor specific tracestate header, passed on as is.
+	State string
+}
+
+// Sampled reports whether spans in this trace are recorded.
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&FlagSampled != 0
+}
+
+// Valid reports whether both the trace and span ids are set.
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats the span context as a traceparent header.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ErrInvalidTraceparent is returned for malformed traceparent headers.
+var ErrInvalidTraceparent = errors.New("Invalid traceparent header")
+
+// ParseTraceparent parses a traceparent header, along with the optional
+// tracestate header that accompanies it.
+func ParseTraceparent(traceparent, tracestate string) (SpanContext, error) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 {
+		return sc, ErrInvalidTraceparent
+	}
+	version, trace, span, flags := parts[0], parts[1], parts[2], parts[3]
+
+	// Version 00 has exactly four fields. Later versions may add more,
+	// which we're asked to ignore, but ff is forbidden.
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		return sc, ErrInvalidTraceparent
+	}
+	if len(trace) != 32 || len(span) != 16 || len(flags) != 2 {
+		return sc, ErrInvalidTraceparent
+	}
+	if trace != strings.ToLower(trace) || span != strings.ToLower(span) {
+		return sc, ErrInvalidTraceparent
+	}
+
+	if _, err := hex.Decode(sc.TraceID[:], []byte(trace)); err != nil {
+		return sc, ErrInvalidTraceparent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(span)); err != nil {
+		return sc, ErrInvalidTraceparent
+	}
+	var f [1]byte
+	if _, err := hex.Decode(f[:], []byte(flags)); err != nil {
+		return sc, ErrInvalidTraceparent
+	}
+	sc.Flags = f[0]
+	if !sc.Valid() {
+		return sc, ErrInvalidTraceparent
+	}
+
+	sc.State = strings.TrimSpace(tracestate)
+	return sc, nil
+}
+
+// Span is a single timed operation in a trace.
+type Span struct {
+	tracer *Tracer
+
+	mtx        sync.Mutex
+	name       string
+	context    SpanContext
+	parent     SpanID
+	remote     bool
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        string
+	ended      bool
+}
+
+// SpanData is a snapshot of an ended span, as handed to Exporters.
+type SpanData struct {
+	Name       string
+	Context    SpanContext
+	Parent     SpanID
+	Remote     bool // Parent is in another service
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Err        string
+}
+
+// Context returns the span's SpanContext.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetName renames the span, for instance once the route of a request is
+// known.
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	s.name = name
+	s.mtx.Unlock()
+}
+
+// SetAttribute records a key value pair on the span. Values should be
+// strings, bools or numbers.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	s.attributes[key] = value
+	s.mtx.Unlock()
+}
+
+// SetError marks the span as failed. A nil err is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mtx.Lock()
+	s.err = err.Error()
+	s.mtx.Unlock()
+}
+
+// End ends the span and exports it if it is sampled. Only the first
+// call has any effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	if s.ended {
+		s.mtx.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+
+	data := SpanData{
+		Name:       s.name,
+		Context:    s.context,
+		Parent:     s.parent,
+		Remote:     s.remote,
+		Start:      s.start,
+		End:        s.end,
+		Attributes: make(map[string]interface{}, len(s.attributes)),
+		Err:        s.err,
+	}
+	for k, v := range s.attributes {
+		data.Attributes[k] = v
+	}
+	s.mtx.Unlock()
+
+	if s.context.Sampled() && s.tracer.exporter != nil {
+		s.tracer.exporter.Export(data)
+	}
+}
+
+// Exporter sends ended spans somewhere. Export is called synchronously
+// as spans end, so it should be quick.
+type Exporter interface {
+	Export(span SpanData)
+}
+
+// Tracer starts spans and exports them with its Exporter.
+type Tracer struct {
+	exporter Exporter
+}
+
+// NewTracer returns a Tracer exporting to exp. A nil exporter propagates
+// trace context without recording anything.
+func NewTracer(exp Exporter) *Tracer {
+	return &Tracer{exporter: exp}
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// WithRemote returns a context carrying a span context received from
+// another service, which the next span started becomes a child of.
+func WithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// FromContext returns the current span in ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start starts a span. It becomes a child of the current span in ctx,
+// or of a remote span added with WithRemote, and otherwise begins a new
+// sampled trace.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	s := &Span{
+		tracer:     t,
+		name:       name,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+
+	if parent := FromContext(ctx); parent != nil {
+		s.context = parent.context
+		s.parent = parent.context.SpanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok && remote.Valid() {
+		s.context = remote
+		s.parent = remote.SpanID
+		s.remote = true
+	} else {
+		rand.Read(s.context.TraceID[:])
+		s.context.Flags = FlagSampled
+	}
+	rand.Read(s.context.SpanID[:])
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Start starts a child of the current span in ctx using the same Tracer.
+// If ctx has no span the returned span is nil, which is safe to use.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name)
+}
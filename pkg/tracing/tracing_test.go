@@ -0,0 +1,136 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// recorder is an Exporter keeping spans in memory.
+type recorder struct {
+	spans []SpanData
+}
+
+func (r *recorder) Export(s SpanData) {
+	r.spans = append(r.spans, s)
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "congo=t61rcWkgMzE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Unexpected trace id %s", sc.TraceID)
+	}
+	if sc.SpanID.String() != "00f067aa0ba902b7" {
+		t.Errorf("Unexpected span id %s", sc.SpanID)
+	}
+	if !sc.Sampled() || sc.State != "congo=t61rcWkgMzE" {
+		t.Errorf("Unexpected span context %+v", sc)
+	}
+	if sc.Traceparent() != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("Traceparent didn't round trip: %s", sc.Traceparent())
+	}
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		if _, err := ParseTraceparent(bad, ""); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+
+	// Future versions may carry more fields
+	if _, err := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", ""); err != nil {
+		t.Errorf("Expected future version to parse: %s", err)
+	}
+}
+
+func TestSpans(t *testing.T) {
+	rec := &recorder{}
+	tracer := NewTracer(rec)
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "")
+	ctx, root := tracer.Start(WithRemote(context.Background(), remote), "root")
+	_, child := Start(ctx, "child")
+	child.SetAttribute("n", 1)
+	child.SetError(errors.New("boom"))
+	child.End()
+	child.End()
+	root.End()
+
+	if len(rec.spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(rec.spans))
+	}
+	c, r := rec.spans[0], rec.spans[1]
+	if r.Context.TraceID != remote.TraceID || c.Context.TraceID != remote.TraceID {
+		t.Error("Spans didn't join the remote trace")
+	}
+	if r.Parent != remote.SpanID || !r.Remote {
+		t.Error("Root span isn't a child of the remote span")
+	}
+	if c.Parent != r.Context.SpanID || c.Remote {
+		t.Error("Child span isn't a child of the root span")
+	}
+	if c.Err != "boom" || c.Attributes["n"] != 1 {
+		t.Errorf("Unexpected child span %+v", c)
+	}
+
+	// Unsampled traces propagate but aren't exported
+	remote.Flags = 0
+	_, span := tracer.Start(WithRemote(context.Background(), remote), "unsampled")
+	span.End()
+	if len(rec.spans) != 2 {
+		t.Error("Unsampled span was exported")
+	}
+
+	// Without a span in the context nothing is recorded
+	_, none := Start(context.Background(), "orphan")
+	if none != nil {
+		t.Error("Expected a nil span without a parent")
+	}
+	none.SetAttribute("a", "b")
+	none.End()
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewTracer(NewOTLPExporter(&buf, "test"))
+
+	_, span := tracer.Start(context.Background(), "ReadReview")
+	span.SetAttribute("http.status_code", 200)
+	span.End()
+
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID string `json:"traceId"`
+					SpanID  string `json:"spanId"`
+					Name    string `json:"name"`
+					Kind    int    `json:"kind"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &req); err != nil {
+		t.Fatal(err)
+	}
+	got := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if got.Name != "ReadReview" || got.Kind != otlpKindServer {
+		t.Errorf("Unexpected span %+v", got)
+	}
+	if got.TraceID != span.Context().TraceID.String() || got.SpanID != span.Context().SpanID.String() {
+		t.Errorf("Unexpected ids %+v", got)
+	}
+}
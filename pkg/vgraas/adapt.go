@@ -0,0 +1,191 @@
+package vgraas
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Adapt returns a ContextRepo backed by the old-style Repo r. As r can't
+// be interrupted, the context is only checked before each call: work
+// that has started runs to completion, but nothing new is started once
+// the context is done.
+func Adapt(r Repo) ContextRepo {
+	return adapter{r}
+}
+
+type adapter struct {
+	repo Repo
+}
+
+func (a adapter) ReadReviews(ctx context.Context) ([]Review, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.repo.ReadReviews()
+}
+
+func (a adapter) CreateReview(ctx context.Context, r Review) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return a.repo.CreateReview(r)
+}
+
+func (a adapter) ReadReview(ctx context.Context, id int) (Review, error) {
+	if err := ctx.Err(); err != nil {
+		return Review{}, err
+	}
+	return a.repo.ReadReview(id)
+}
+
+func (a adapter) UpdateReview(ctx context.Context, id int, r Review) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.repo.UpdateReview(id, r)
+}
+
+func (a adapter) DeleteReview(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.repo.DeleteReview(id)
+}
+
+func (a adapter) ReadComments(ctx context.Context, reviewID int) ([]Comment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.repo.ReadComments(reviewID)
+}
+
+func (a adapter) CreateComment(ctx context.Context, reviewID int, c Comment) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return a.repo.CreateComment(reviewID, c)
+}
+
+func (a adapter) ReadComment(ctx context.Context, reviewID, id int) (Comment, error) {
+	if err := ctx.Err(); err != nil {
+		return Comment{}, err
+	}
+	return a.repo.ReadComment(reviewID, id)
+}
+
+func (a adapter) UpdateComment(ctx context.Context, reviewID, id int, c Comment) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.repo.UpdateComment(reviewID, id, c)
+}
+
+func (a adapter) DeleteComment(ctx context.Context, reviewID, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.repo.DeleteComment(reviewID, id)
+}
+
+func (a adapter) PutReview(ctx context.Context, id int, r Review) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.repo.PutReview(id, r)
+}
+
+func (a adapter) PutComment(ctx context.Context, reviewID, id int, c Comment) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.repo.PutComment(reviewID, id, c)
+}
+
+// Batch also rolls back if ctx is done by the time fn returns, so a
+// batch cut short by a deadline is never half applied. Repos that
+// aren't a Batcher have fn run straight against them.
+func (a adapter) Batch(ctx context.Context, fn func(ctx context.Context, tx ContextRepo) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b, ok := a.repo.(Batcher)
+	if !ok {
+		return fn(ctx, a)
+	}
+	return b.Batch(func(tx Repo) error {
+		if err := fn(ctx, adapter{tx}); err != nil {
+			return err
+		}
+		return ctx.Err()
+	})
+}
+
+// trasher returns the underlying Repo if it is a Trasher.
+func (a adapter) trasher(ctx context.Context) (Trasher, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	t, ok := a.repo.(Trasher)
+	if !ok {
+		return nil, NoTrash
+	}
+	return t, nil
+}
+
+func (a adapter) TrashReview(ctx context.Context, id int, at time.Time, by string) error {
+	t, err := a.trasher(ctx)
+	if err != nil {
+		return err
+	}
+	return t.TrashReview(id, at, by)
+}
+
+func (a adapter) TrashComment(ctx context.Context, reviewID, id int, at time.Time, by string) error {
+	t, err := a.trasher(ctx)
+	if err != nil {
+		return err
+	}
+	return t.TrashComment(reviewID, id, at, by)
+}
+
+func (a adapter) ReadTrash(ctx context.Context) ([]Deleted, error) {
+	t, err := a.trasher(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return t.ReadTrash()
+}
+
+func (a adapter) PurgeTrash(ctx context.Context, cutoff time.Time) ([]Deleted, error) {
+	t, err := a.trasher(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return t.PurgeTrash(cutoff)
+}
+
+// Close closes the underlying Repo if it is an io.Closer.
+func (a adapter) Close() error {
+	if closer, ok := a.repo.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Count counts with the underlying Repo if it is a Counter.
+func (a adapter) Count(ctx context.Context) (reviews, comments int, err error) {
+	c, ok := a.repo.(Counter)
+	if !ok {
+		return 0, 0, errNoCount
+	}
+	return c.Count(ctx)
+}
+
+// Ping pings the underlying Repo if it is a Pinger.
+func (a adapter) Ping(ctx context.Context) error {
+	if p, ok := a.repo.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package vgraas
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdaptCancelled(t *testing.T) {
+	repo := Adapt(NewRAMRepo())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := repo.CreateReview(ctx, Review{Title: "t"}); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	reviews, _ := repo.ReadReviews(context.Background())
+	if len(reviews) != 0 {
+		t.Error("Review created with a cancelled context")
+	}
+
+	// A batch whose context ends while it runs is rolled back
+	ctx, cancel = context.WithCancel(context.Background())
+	err := repo.Batch(ctx, func(ctx context.Context, tx ContextRepo) error {
+		if _, err := tx.CreateReview(ctx, Review{Title: "t"}); err != nil {
+			return err
+		}
+		cancel()
+		return nil
+	})
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	reviews, _ = repo.ReadReviews(context.Background())
+	if len(reviews) != 0 {
+		t.Error("Cancelled batch wasn't rolled back")
+	}
+}
+
+// slowRepo blocks reads until their context is done.
+type slowRepo struct {
+	ContextRepo
+}
+
+func (slowRepo) ReadReview(ctx context.Context, id int) (Review, error) {
+	<-ctx.Done()
+	return Review{}, ctx.Err()
+}
+
+func TestRequestTimeout(t *testing.T) {
+	api := NewAPI(slowRepo{Adapt(NewRAMRepo())}, WithTimeout(10*time.Millisecond))
+
+	rr := httptest.NewRecorder()
+	api.ServeHTTP(rr, httptest.NewRequest("GET", "/reviews/0", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d, got %d: %s", http.StatusServiceUnavailable, rr.Code, rr.Body.String())
+	}
+}
+
+// plainRepo is a Repo that isn't a Batcher.
+type plainRepo struct {
+	Repo
+}
+
+func TestAdaptWithoutBatcher(t *testing.T) {
+	inner := NewRAMRepo()
+	repo := Adapt(plainRepo{inner})
+
+	// Batches still run, write by write
+	err := repo.Batch(context.Background(), func(ctx context.Context, tx ContextRepo) error {
+		_, err := tx.CreateReview(ctx, Review{Title: "t"})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reviews, _ := inner.ReadReviews(); len(reviews) != 1 {
+		t.Errorf("Expected the batch to be applied, got %v", reviews)
+	}
+}
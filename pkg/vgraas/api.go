@@ -1,18 +1,96 @@
 package vgraas
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/nsmith5/vgraas/pkg/health"
+	"github.com/nsmith5/vgraas/pkg/logging"
 	"github.com/nsmith5/vgraas/pkg/middleware"
 )
 
 // API implements the OpenAPI specification of vgraas.
 type API struct {
-	Repo
+	ContextRepo
 	*mux.Router
+
+	bus       *Bus
+	webhooks  *Webhooks
+	trash     *Trash
+	revisions *Revisions
+	audit     *Audit
+	admins    []string
+	health    *health.Health
+	timeout   time.Duration
+	wrap      func(name string, h http.Handler) http.Handler
+	encoders  []Encoder
+
+	maxAge    time.Duration
+	cacheSize int
+	cache     *responseCache
+
+	// handlers are the bare route handlers by route name, see Batch
+	handlers map[string]http.Handler
+}
+
+// Option configures optional parts of the API.
+type Option func(*API)
+
+// WithBus publishes events for every change made through the API on bus.
+// Without this option events are published on a private bus.
+func WithBus(bus *Bus) Option {
+	return func(a *API) {
+		a.bus = bus
+	}
+}
+
+// WithWebhooks enables the /webhooks endpoints for managing wh. The
+// webhooks should be fed from the same bus as the API.
+func WithWebhooks(wh *Webhooks) Option {
+	return func(a *API) {
+		a.webhooks = wh
+	}
+}
+
+// WithHealth serves the checks in h at /livez and /readyz. Without this
+// option only the repo is checked, see PingRepo.
+func WithHealth(h *health.Health) Option {
+	return func(a *API) {
+		a.health = h
+	}
+}
+
+// WithTimeout gives every repo operation made on behalf of a request d
+// to complete before it is abandoned and the request is answered with
+// 503 Service Unavailable. Without this option operations only stop
+// when the client goes away. Long lived requests such as /events and
+// live comments apply the timeout to each operation they make.
+func WithTimeout(d time.Duration) Option {
+	return func(a *API) {
+		a.timeout = d
+	}
+}
+
+// WithAdmins lets only users use the admin endpoints under /admin,
+// manage webhooks and restore from the trash. Without it nobody can.
+func WithAdmins(users ...string) Option {
+	return func(a *API) {
+		a.admins = users
+	}
+}
+
+// WithRouteMiddleware wraps the handler of every route, and the not
+// found handler, with mw. mw is told the route name, so it can treat
+// routes differently, see middleware.RateLimiter.Route.
+func WithRouteMiddleware(mw func(name string, h http.Handler) http.Handler) Option {
+	return func(a *API) {
+		a.wrap = mw
+	}
 }
 
 type Route struct {
@@ -23,11 +101,62 @@ type Route struct {
 }
 
 // NewAPI returns an http.Handler that implements
-// the OpenAPI specification for vgraas.
-func NewAPI(r Repo) http.Handler {
-	var a API
-	a.Repo = r
+// the OpenAPI specification for vgraas. Use Adapt to serve a Repo.
+func NewAPI(r ContextRepo, opts ...Option) http.Handler {
+	a := API{encoders: []Encoder{JSON{}, NDJSON{}}}
+	for _, opt := range opts {
+		opt(&a)
+	}
+	if a.bus == nil {
+		a.bus = NewBus()
+	}
+	if a.health == nil {
+		a.health = health.New()
+		a.health.AddReadiness("repo", PingRepo(r))
+	}
+	if a.trash != nil {
+		r = a.trash.Wrap(r)
+	}
+	switch {
+	case a.revisions != nil && a.trash != nil:
+		r = a.revisions.wrapTrashed(r, a.trash)
+	case a.revisions != nil:
+		r = a.revisions.Wrap(r)
+	}
+	if a.audit != nil {
+		r = a.audit.Wrap(r)
+	}
+	a.ContextRepo = Publish(r, a.bus)
+	a.cache = newResponseCache(a.bus, a.cacheSize)
+
+	return middleware.ContentType(a.router(), "application/json; charset=utf-8")
+}
+
+// withRepo returns a copy of the API backed by r instead. Nothing read
+// from r is cached, it may never be committed. Nothing can be restored
+// from the trash and revisions can't be looked up either, neither can
+// be rolled back.
+func (a API) withRepo(r ContextRepo) *API {
+	a.ContextRepo = r
+	a.cache = nil
+	a.trash = nil
+	a.revisions = nil
+	return a.router()
+}
+
+// context returns the context for repo operations made on behalf of r,
+// see WithTimeout.
+func (a API) context(r *http.Request) (context.Context, context.CancelFunc) {
+	if a.timeout > 0 {
+		return context.WithTimeout(r.Context(), a.timeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// router builds the router for the API.
+func (a API) router() *API {
 	a.Router = mux.NewRouter().StrictSlash(true)
+	a.handlers = make(map[string]http.Handler)
 
 	routes := []Route{
 		/* All Reviews */
@@ -39,6 +168,9 @@ func NewAPI(r Repo) http.Handler {
 		Route{"UpdateReview", "PUT", "/reviews/{id}", a.UpdateReview},
 		Route{"DeleteReview", "DELETE", "/reviews/{id}", a.DeleteReview},
 
+		/* Live comments, before the comment CRUD so "live" isn't taken for an id */
+		Route{"LiveComments", "GET", "/reviews/{rid}/comments/live", a.LiveComments},
+
 		/* All Comments */
 		Route{"ReadComments", "GET", "/reviews/{rid}/comments", a.ReadComments},
 
@@ -48,50 +180,211 @@ func NewAPI(r Repo) http.Handler {
 		Route{"UpdateComment", "PUT", "/reviews/{rid}/comments/{id}", a.UpdateComment},
 		Route{"DeleteComment", "DELETE", "/reviews/{rid}/comments/{id}", a.DeleteComment},
 
+		/* Change stream */
+		Route{"Events", "GET", "/events", a.Events},
+
+		/* Batch operations */
+		Route{"Batch", "POST", "/batch", a.Batch},
+
+		/* Bulk import and export */
+		Route{"Import", "POST", "/admin/import", a.Import},
+		Route{"Export", "GET", "/admin/export", a.Export},
+
+		/* Health checks */
 		Route{"Health", "GET", "/healthz", a.Health},
+		Route{"Live", "GET", "/livez", a.Health},
+		Route{"Ready", "GET", "/readyz", a.Ready},
+	}
+
+	if a.webhooks != nil {
+		routes = append(routes,
+			Route{"CreateWebhook", "POST", "/webhooks", a.CreateWebhook},
+			Route{"ReadWebhooks", "GET", "/webhooks", a.ReadWebhooks},
+			Route{"ReadWebhook", "GET", "/webhooks/{id}", a.ReadWebhook},
+			Route{"DeleteWebhook", "DELETE", "/webhooks/{id}", a.DeleteWebhook},
+			Route{"EnableWebhook", "POST", "/webhooks/{id}/enable", a.EnableWebhook},
+			Route{"ReadDeliveries", "GET", "/webhooks/{id}/deliveries", a.ReadDeliveries},
+		)
+	}
+
+	if a.trash != nil {
+		routes = append(routes,
+			Route{"ReadTrash", "GET", "/admin/trash", a.ReadTrash},
+			Route{"RestoreReview", "POST", "/reviews/{id}/restore", a.RestoreReview},
+			Route{"RestoreComment", "POST", "/reviews/{rid}/comments/{id}/restore", a.RestoreComment},
+		)
+	}
+
+	if a.revisions != nil {
+		routes = append(routes,
+			Route{"ReadReviewRevisions", "GET", "/reviews/{id}/revisions", a.ReadRevisions},
+			Route{"ReadReviewRevision", "GET", "/reviews/{id}/revisions/{n}", a.ReadRevision},
+			Route{"DiffReviewRevisions", "GET", "/reviews/{id}/revisions/{n}/diff", a.DiffRevisions},
+			Route{"RevertReview", "POST", "/reviews/{id}/revisions/{n}/revert", a.RevertRevision},
+			Route{"ReadCommentRevisions", "GET", "/reviews/{rid}/comments/{id}/revisions", a.ReadRevisions},
+			Route{"ReadCommentRevision", "GET", "/reviews/{rid}/comments/{id}/revisions/{n}", a.ReadRevision},
+			Route{"DiffCommentRevisions", "GET", "/reviews/{rid}/comments/{id}/revisions/{n}/diff", a.DiffRevisions},
+			Route{"RevertComment", "POST", "/reviews/{rid}/comments/{id}/revisions/{n}/revert", a.RevertRevision},
+		)
+	}
+
+	if a.audit != nil {
+		routes = append(routes,
+			Route{"ReadAudit", "GET", "/admin/audit", a.ReadAudit},
+		)
 	}
 
+	// Streams, health checks and diffs have representations of their
+	// own, everything else is encoded as the client asks
+	fixed := map[string]bool{
+		"LiveComments":         true,
+		"Events":               true,
+		"Export":               true,
+		"Health":               true,
+		"Live":                 true,
+		"Ready":                true,
+		"DiffReviewRevisions":  true,
+		"DiffCommentRevisions": true,
+	}
+	// Reads of reviews and comments can be cached, see WithCache
+	cacheable := map[string]bool{
+		"ReadReviews":  true,
+		"ReadReview":   true,
+		"ReadComments": true,
+		"ReadComment":  true,
+	}
+	// Request bodies are JSON, except where listed
+	bodies := map[string][]string{
+		"CreateComment": {"application/json", "application/x-www-form-urlencoded"},
+		"Import":        {"application/x-ndjson", "application/json"},
+	}
 	for _, route := range routes {
+		a.handlers[route.Name] = route.HandlerFunc
+
+		var h http.Handler = route.HandlerFunc
+		if cacheable[route.Name] {
+			h = a.cached(h)
+		}
+		h = held(route.Name, h)
+		if !fixed[route.Name] {
+			h = a.negotiated(h)
+		}
+		if a.audit != nil && route.Methods != "GET" {
+			h = a.audited(route.Name, h)
+		}
+		if route.Methods == "POST" || route.Methods == "PUT" {
+			types, ok := bodies[route.Name]
+			if !ok {
+				types = []string{"application/json"}
+			}
+			h = middleware.RequireContentType(h, types...)
+		}
+		if adminOnly(route) {
+			h = middleware.RequireAdmin(h, a.admins...)
+		}
 		a.Router.
 			Methods(route.Methods).
 			Path(route.Pattern).
 			Name(route.Name).
-			Handler(route.HandlerFunc)
+			Handler(a.named(route.Name, h))
+	}
+
+	// Answer OPTIONS requests, CORS preflights among them, for every
+	// path with the methods it allows. See middleware.CORS
+	var patterns []string
+	allowed := make(map[string][]string)
+	for _, route := range routes {
+		if _, ok := allowed[route.Pattern]; !ok {
+			patterns = append(patterns, route.Pattern)
+		}
+		allowed[route.Pattern] = append(allowed[route.Pattern], route.Methods)
+	}
+	for _, pattern := range patterns {
+		a.Router.
+			Methods("OPTIONS").
+			Path(pattern).
+			Handler(a.named("Preflight", allow(allowed[pattern])))
 	}
 
 	// Fall back for non-existant routers
-	a.Router.NotFoundHandler = http.HandlerFunc(NotFound)
+	a.Router.NotFoundHandler = a.named("NotFound", http.HandlerFunc(NotFound))
+
+	return &a
+}
+
+// named reports the route name of requests to h, for the benefit of
+// middlewares such as middleware.Metrics, and applies the route
+// middleware if there is one.
+func (a API) named(name string, h http.Handler) http.Handler {
+	if a.wrap != nil {
+		h = a.wrap(name, h)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware.SetRouteName(r, name)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// adminRoutes are the admin endpoints outside of /admin, by route name.
+// Restores bring back what someone deleted from the trash.
+var adminRoutes = map[string]bool{
+	"RestoreReview":  true,
+	"RestoreComment": true,
+}
 
-	return middleware.ContentType(a, "application/json; charset=UTF=8")
+// adminOnly reports whether route is one of the admin endpoints, see
+// WithAdmins. Webhooks send data out of the deployment so only admins
+// manage them.
+func adminOnly(route Route) bool {
+	return strings.HasPrefix(route.Pattern, "/admin/") || strings.HasPrefix(route.Pattern, "/webhooks") ||
+		adminRoutes[route.Name]
+}
+
+// allow answers OPTIONS requests for a path serving methods.
+func allow(methods []string) http.HandlerFunc {
+	allow := strings.Join(append(methods, "OPTIONS"), ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(http.StatusNoContent)
+	}
 }
 
 // HandleError sets the status code and writes a JSON object with
 // error message for requests that have fallen on troubled times.
+// The request ID is included so users can quote it in bug reports.
 func HandleError(w http.ResponseWriter, r *http.Request, status int, err string) {
-	w.WriteHeader(status)
-	fmt.Fprintf(w, `{"err": "%s"}`, err)
+	middleware.WriteError(w, r, status, err)
+}
+
+// handleRepoError is HandleError for errors returned by the repo.
+// Operations that ran out of time are reported as 503 Service
+// Unavailable rather than status.
+func handleRepoError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if err == context.DeadlineExceeded {
+		status = http.StatusServiceUnavailable
+	}
+	if status >= 500 {
+		logging.FromContext(r.Context()).Error("Repo operation failed", "err", err)
+	}
+	HandleError(w, r, status, err.Error())
 }
 
 // NotFound is a handy request handler for routes that don't exist.
 func NotFound(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusNotFound)
-	fmt.Fprintf(w, `{"err": "Route '%s' does not exist"}`, r.URL.Path)
+	HandleError(w, r, http.StatusNotFound, fmt.Sprintf("Route '%s' does not exist", r.URL.Path))
 }
 
 // ReadReviews implements GET /reviews/
 func (a API) ReadReviews(w http.ResponseWriter, r *http.Request) {
-	reviews, err := a.Repo.ReadReviews()
-	if err != nil {
-		HandleError(w, r, http.StatusInternalServerError, "")
-		return
-	}
-	enc := json.NewEncoder(w)
-	enc.SetIndent("", "\t")
-	err = enc.Encode(reviews)
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	reviews, err := a.ContextRepo.ReadReviews(ctx)
 	if err != nil {
-		HandleError(w, r, http.StatusInternalServerError, err.Error())
+		handleRepoError(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	respond(w, r, http.StatusOK, reviews)
 }
 
 // CreateReview implements POST /reviews/
@@ -107,17 +400,16 @@ func (a API) CreateReview(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	id, err := a.Repo.CreateReview(review)
-	if err != nil {
-		HandleError(w, r, http.StatusInternalServerError, err.Error())
-		return
-	}
+	ctx, cancel := a.context(r)
+	defer cancel()
 
-	_, err = fmt.Fprintf(w, `{"id": %d}`, id)
+	id, err := a.ContextRepo.CreateReview(ctx, review)
 	if err != nil {
-		HandleError(w, r, http.StatusInternalServerError, err.Error())
+		handleRepoError(w, r, http.StatusInternalServerError, err)
 		return
 	}
+
+	respond(w, r, http.StatusOK, map[string]int{"id": id})
 }
 
 // ReadReview implements GET /reviews/{id}
@@ -132,23 +424,22 @@ func (a API) ReadReview(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	review, err := a.Repo.ReadReview(id)
-	if err != nil {
-		HandleError(w, r, http.StatusBadRequest, err.Error())
-		return
-	}
+	ctx, cancel := a.context(r)
+	defer cancel()
 
-	enc := json.NewEncoder(w)
-	enc.SetIndent("", "\t")
-	err = enc.Encode(review)
+	review, err := a.ContextRepo.ReadReview(ctx, id)
 	if err != nil {
-		HandleError(w, r, http.StatusInternalServerError, err.Error())
+		handleRepoError(w, r, http.StatusBadRequest, err)
 		return
 	}
+
+	respond(w, r, http.StatusOK, review)
 	return
 }
 
 // UpdateReview implements PUT /reviews/{id}
+//
+// Comments in the request are ignored, the review keeps the ones it has.
 func (a API) UpdateReview(w http.ResponseWriter, r *http.Request) {
 	var id int
 	{
@@ -171,13 +462,16 @@ func (a API) UpdateReview(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	err := a.Repo.UpdateReview(id, review)
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	err := a.ContextRepo.UpdateReview(ctx, id, review)
 	switch {
 	case err == ReviewNotFound:
 		HandleError(w, r, http.StatusBadRequest, err.Error())
 		return
 	case err != nil:
-		HandleError(w, r, http.StatusBadRequest, err.Error())
+		handleRepoError(w, r, http.StatusBadRequest, err)
 		return
 	}
 }
@@ -194,13 +488,16 @@ func (a API) DeleteReview(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	err := a.Repo.DeleteReview(id)
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	err := a.ContextRepo.DeleteReview(ctx, id)
 	switch {
 	case err == ReviewNotFound:
 		HandleError(w, r, http.StatusBadRequest, err.Error())
 		return
 	case err != nil:
-		HandleError(w, r, http.StatusInternalServerError, err.Error())
+		handleRepoError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 }
@@ -217,23 +514,20 @@ func (a API) ReadComments(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	comments, err := a.Repo.ReadComments(id)
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	comments, err := a.ContextRepo.ReadComments(ctx, id)
 	switch {
 	case err == ReviewNotFound:
 		HandleError(w, r, http.StatusBadRequest, err.Error())
 		return
 	case err != nil:
-		HandleError(w, r, http.StatusBadRequest, err.Error())
+		handleRepoError(w, r, http.StatusBadRequest, err)
 		return
 	}
 
-	enc := json.NewEncoder(w)
-	enc.SetIndent("", "\t")
-	err = enc.Encode(&comments)
-	if err != nil {
-		HandleError(w, r, http.StatusInternalServerError, err.Error())
-		return
-	}
+	respond(w, r, http.StatusOK, comments)
 }
 
 // CreateComment implements POST /reviews/{rid}/comments
@@ -248,8 +542,16 @@ func (a API) CreateComment(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Plain HTML forms can post comments too
 	var comment Comment
-	{
+	if middleware.MediaType(r) == "application/x-www-form-urlencoded" {
+		if err := r.ParseForm(); err != nil {
+			HandleError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		comment.Author = r.PostForm.Get("author")
+		comment.Body = r.PostForm.Get("body")
+	} else {
 		dec := json.NewDecoder(r.Body)
 		defer r.Body.Close()
 		err := dec.Decode(&comment)
@@ -259,17 +561,16 @@ func (a API) CreateComment(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	id, err := a.Repo.CreateComment(rid, comment)
-	if err != nil {
-		HandleError(w, r, http.StatusInternalServerError, err.Error())
-		return
-	}
+	ctx, cancel := a.context(r)
+	defer cancel()
 
-	_, err = fmt.Fprintf(w, `{"id": %d}`, id)
+	id, err := a.ContextRepo.CreateComment(ctx, rid, comment)
 	if err != nil {
-		HandleError(w, r, http.StatusInternalServerError, err.Error())
+		handleRepoError(w, r, http.StatusInternalServerError, err)
 		return
 	}
+
+	respond(w, r, http.StatusOK, map[string]int{"id": id})
 }
 
 // ReadComment implements GET /reviews/{rid}/comments/{id}
@@ -290,23 +591,20 @@ func (a API) ReadComment(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	comment, err := a.Repo.ReadComment(rid, id)
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	comment, err := a.ContextRepo.ReadComment(ctx, rid, id)
 	switch {
 	case err == ReviewNotFound || err == CommentNotFound:
 		HandleError(w, r, http.StatusBadRequest, err.Error())
 		return
 	case err != nil:
-		HandleError(w, r, http.StatusBadRequest, err.Error())
+		handleRepoError(w, r, http.StatusBadRequest, err)
 		return
 	}
 
-	enc := json.NewEncoder(w)
-	enc.SetIndent("", "\t")
-	err = enc.Encode(&comment)
-	if err != nil {
-		HandleError(w, r, http.StatusInternalServerError, err.Error())
-		return
-	}
+	respond(w, r, http.StatusOK, comment)
 }
 
 // UpdateComment implements PUT /reviews/{rid}/comments/{id}
@@ -338,13 +636,16 @@ func (a API) UpdateComment(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	err := a.Repo.UpdateComment(rid, id, comment)
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	err := a.ContextRepo.UpdateComment(ctx, rid, id, comment)
 	switch {
 	case err == ReviewNotFound || err == CommentNotFound:
 		HandleError(w, r, http.StatusBadRequest, err.Error())
 		return
 	case err != nil:
-		HandleError(w, r, http.StatusBadRequest, err.Error())
+		handleRepoError(w, r, http.StatusBadRequest, err)
 		return
 	}
 }
@@ -367,13 +668,16 @@ func (a API) DeleteComment(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	err := a.Repo.DeleteComment(rid, id)
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	err := a.ContextRepo.DeleteComment(ctx, rid, id)
 	switch {
 	case err == ReviewNotFound || err == CommentNotFound:
 		HandleError(w, r, http.StatusBadRequest, err.Error())
 		return
 	case err != nil:
-		HandleError(w, r, http.StatusBadRequest, err.Error())
+		handleRepoError(w, r, http.StatusBadRequest, err)
 		return
 	}
 }
@@ -382,6 +686,28 @@ func (a API) DeleteComment(w http.ResponseWriter, r *http.Request) {
 //
 // Pop-quiz: Why is that 'z' always there? Good question. Anyways
 // this endpoint is great for Kubernetes because you can use
-// it for liveness and readiness probes.
+// it for liveness probes. It is also served at /livez and runs the
+// liveness checks; add ?verbose for the result of each check.
 func (a API) Health(w http.ResponseWriter, r *http.Request) {
+	a.health.LiveHandler().ServeHTTP(w, r)
+}
+
+// Ready implements a readiness endpoint at /readyz.
+//
+// It runs the readiness checks as well as the liveness checks, so it
+// fails when a dependency like the repo is unavailable or once the
+// server begins to shut down.
+func (a API) Ready(w http.ResponseWriter, r *http.Request) {
+	a.health.ReadyHandler().ServeHTTP(w, r)
+}
+
+// PingRepo returns a health check for r. Repos that implement Pinger
+// are pinged, others are assumed to be fine.
+func PingRepo(r ContextRepo) health.Checker {
+	return health.CheckerFunc(func(ctx context.Context) error {
+		if p, ok := r.(Pinger); ok {
+			return p.Ping(ctx)
+		}
+		return nil
+	})
 }
@@ -1,10 +1,18 @@
 package vgraas
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/nsmith5/vgraas/pkg/health"
+	"github.com/nsmith5/vgraas/pkg/middleware"
 )
 
 type Request struct {
@@ -22,7 +30,7 @@ func TestReviewsAPI(t *testing.T) {
 		Request{"DELETE", "/reviews/0", ""},
 	}
 
-	api := NewAPI(NewRAMRepo())
+	api := NewAPI(Adapt(NewRAMRepo()))
 
 	for _, request := range requests {
 		req, err := http.NewRequest(request.verb, request.path, strings.NewReader(request.body))
@@ -50,7 +58,7 @@ func TestCommentsAPI(t *testing.T) {
 		Request{"DELETE", "/reviews/0/comments/0", ""},
 	}
 
-	api := NewAPI(NewRAMRepo())
+	api := NewAPI(Adapt(NewRAMRepo()))
 
 	for _, request := range requests {
 		req, err := http.NewRequest(request.verb, request.path, strings.NewReader(request.body))
@@ -68,7 +76,7 @@ func TestCommentsAPI(t *testing.T) {
 }
 
 func TestHealthEndpoint(t *testing.T) {
-	api := NewAPI(NewRAMRepo())
+	api := NewAPI(Adapt(NewRAMRepo()))
 	req, err := http.NewRequest("GET", "/healthz", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -83,7 +91,7 @@ func TestHealthEndpoint(t *testing.T) {
 }
 
 func Test404Endpoint(t *testing.T) {
-	api := NewAPI(NewRAMRepo())
+	api := NewAPI(Adapt(NewRAMRepo()))
 	req, err := http.NewRequest("GET", "/healthz/asdf", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -97,3 +105,245 @@ func Test404Endpoint(t *testing.T) {
 	}
 
 }
+
+func TestReadyEndpoint(t *testing.T) {
+	var err error
+	h := health.New()
+	h.AddReadiness("flag", health.CheckerFunc(func(context.Context) error { return err }))
+	api := NewAPI(Adapt(NewRAMRepo()), WithHealth(h))
+
+	for _, want := range []int{http.StatusOK, http.StatusServiceUnavailable} {
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+
+		if rr.Code != want {
+			t.Errorf("Ready endpoint responded with %d, expected %d", rr.Code, want)
+		}
+		err = errors.New("Shutting down")
+	}
+
+	// Liveness is unaffected by readiness checks
+	req, _ := http.NewRequest("GET", "/livez", nil)
+	rr := httptest.NewRecorder()
+	api.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Liveness endpoint responded with %d", rr.Code)
+	}
+}
+
+func TestErrorRequestID(t *testing.T) {
+	api := middleware.RequestID(NewAPI(Adapt(NewRAMRepo())))
+
+	// Incoming IDs are honoured and the message is escaped properly
+	req := httptest.NewRequest("GET", `/no"pe`, nil)
+	req.Header.Set("X-Request-ID", "req-42")
+	rr := httptest.NewRecorder()
+	api.ServeHTTP(rr, req)
+
+	var body struct {
+		Err       string `json:"err"`
+		RequestID string `json:"requestId"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Invalid error body %q: %s", rr.Body.String(), err)
+	}
+	if body.Err != `Route '/no"pe' does not exist` || body.RequestID != "req-42" {
+		t.Errorf("Unexpected error body %+v", body)
+	}
+	if rr.Header().Get("X-Request-ID") != "req-42" {
+		t.Errorf("Request ID not echoed, got %q", rr.Header().Get("X-Request-ID"))
+	}
+
+	// Others get a fresh one
+	req = httptest.NewRequest("GET", "/reviews/0", nil)
+	req.Header.Set("X-Request-ID", strings.Repeat("x", 500))
+	rr = httptest.NewRecorder()
+	api.ServeHTTP(rr, req)
+	if id := rr.Header().Get("X-Request-ID"); len(id) != 32 {
+		t.Errorf("Expected a generated request ID, got %q", id)
+	}
+	if !strings.Contains(rr.Body.String(), rr.Header().Get("X-Request-ID")) {
+		t.Errorf("Request ID missing from error body %s", rr.Body.String())
+	}
+}
+
+func TestRouteRateLimits(t *testing.T) {
+	policies, err := middleware.ParsePolicies("*=100:100,POST CreateReview=1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := middleware.NewPolicyRateLimiter(policies, func(r *http.Request) string { return "k" })
+	defer limiter.Close()
+	api := NewAPI(Adapt(NewRAMRepo()), WithRouteMiddleware(limiter.Route))
+
+	do := func(verb, path, body string) int {
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, httptest.NewRequest(verb, path, strings.NewReader(body)))
+		return rr.Code
+	}
+
+	review := `{"author": "me", "body": "this and that"}`
+	if code := do("POST", "/reviews/", review); code != http.StatusOK {
+		t.Fatalf("Expected the first review to be created, got %d", code)
+	}
+	if code := do("POST", "/reviews/", review); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the second review to be rate limited, got %d", code)
+	}
+	if code := do("GET", "/reviews/", ""); code != http.StatusOK {
+		t.Errorf("Expected reads to have their own limit, got %d", code)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	cors := middleware.NewCORS(middleware.CORSPolicy{
+		Origins: []string{"https://*.example.com"},
+		Methods: []string{"GET", "PUT", "DELETE"},
+		MaxAge:  time.Minute,
+	})
+	api := cors.Handler(NewAPI(Adapt(NewRAMRepo())))
+
+	preflight := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("OPTIONS", path, nil)
+		req.Header.Set("Origin", "https://blog.example.com")
+		req.Header.Set("Access-Control-Request-Method", "PUT")
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := preflight("/reviews/3")
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Allow"); got != "GET, PUT, DELETE, OPTIONS" {
+		t.Errorf("Unexpected Allow header %s", got)
+	}
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "https://blog.example.com" {
+		t.Errorf("Unexpected Access-Control-Allow-Origin %s", got)
+	}
+	if got := rr.Header().Get("Access-Control-Max-Age"); got != "60" {
+		t.Errorf("Unexpected Access-Control-Max-Age %s", got)
+	}
+
+	if rr := preflight("/reviews/3/comments/live"); rr.Header().Get("Allow") != "GET, OPTIONS" {
+		t.Errorf("Expected live comments to allow GET, got %s", rr.Header().Get("Allow"))
+	}
+	if rr := preflight("/nope"); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected preflights for missing routes to 404, got %d", rr.Code)
+	}
+}
+
+func TestNegotiation(t *testing.T) {
+	repo := Adapt(NewRAMRepo())
+	repo.CreateReview(context.Background(), Review{Author: "a", Body: "one"})
+	repo.CreateReview(context.Background(), Review{Author: "b", Body: "two"})
+	api := NewAPI(repo)
+
+	do := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("/reviews/", "")
+	if strings.Contains(rr.Body.String(), "\n\t") {
+		t.Errorf("Expected compact JSON by default, got %s", rr.Body.String())
+	}
+	if got := rr.Header().Get("Content-Type"); got != "application/json; charset=utf-8" {
+		t.Errorf("Unexpected Content-Type %s", got)
+	}
+	if rr := do("/reviews/?pretty=true", ""); !strings.Contains(rr.Body.String(), "\n\t") {
+		t.Errorf("Expected indented JSON, got %s", rr.Body.String())
+	}
+
+	rr = do("/reviews/", "application/x-ndjson")
+	if got := rr.Header().Get("Content-Type"); got != "application/x-ndjson" {
+		t.Errorf("Expected NDJSON, got %s", got)
+	}
+	if lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n"); len(lines) != 2 {
+		t.Errorf("Expected a line per review, got %q", rr.Body.String())
+	}
+
+	if rr := do("/reviews/", "text/html"); rr.Code != http.StatusNotAcceptable {
+		t.Errorf("Expected 406, got %d", rr.Code)
+	}
+	if rr := do("/healthz", "text/html"); rr.Code != http.StatusOK {
+		t.Errorf("Expected health checks to answer whatever is accepted, got %d", rr.Code)
+	}
+}
+
+func TestRequestContentType(t *testing.T) {
+	repo := Adapt(NewRAMRepo())
+	id, _ := repo.CreateReview(context.Background(), Review{Author: "a", Body: "one"})
+	api := NewAPI(repo, WithAdmins("admin"))
+
+	do := func(verb, path, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(verb, path, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("POST", "/reviews/", "text/plain", `{"author": "me"}`)
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for text/plain, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Content-Type"); got != "application/json; charset=utf-8" {
+		t.Errorf("Expected errors to be JSON, got %s", got)
+	}
+	if rr := do("POST", "/reviews/", "application/x-www-form-urlencoded", "author=me"); rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected forms to be refused for reviews, got %d", rr.Code)
+	}
+	if rr := do("POST", "/reviews/", "application/json; charset=utf-8", `{"author": "me"}`); rr.Code != http.StatusOK {
+		t.Errorf("Expected JSON to be accepted, got %d", rr.Code)
+	}
+
+	path := fmt.Sprintf("/reviews/%d/comments", id)
+	rr = do("POST", path, "application/x-www-form-urlencoded", "author=jo&body=Great+game%21")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected the form to be accepted, got %d: %s", rr.Code, rr.Body.String())
+	}
+	comments, _ := repo.ReadComments(context.Background(), id)
+	if len(comments) != 1 || comments[0].Author != "jo" || comments[0].Body != "Great game!" {
+		t.Errorf("Unexpected comments %+v", comments)
+	}
+
+	req := middleware.WithUser(httptest.NewRequest("POST", "/admin/import", strings.NewReader(`{"title": "x"}`)), "admin")
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	rr = httptest.NewRecorder()
+	api.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected NDJSON imports, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	api := NewAPI(Adapt(NewRAMRepo()), WithAdmins("root"))
+
+	for _, test := range []struct {
+		user string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"alice", http.StatusForbidden},
+		{"root", http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/admin/export", nil)
+		if test.user != "" {
+			req = middleware.WithUser(req, test.user)
+		}
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		if rr.Code != test.want {
+			t.Errorf("Expected %d exporting as '%s', got %d", test.want, test.user, rr.Code)
+		}
+	}
+}
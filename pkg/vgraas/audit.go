@@ -0,0 +1,590 @@
+package vgraas
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsmith5/vgraas/pkg/logging"
+	"github.com/nsmith5/vgraas/pkg/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	auditEntries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vgraas_audit_entries_total",
+			Help: "Changes recorded in the audit log, by action.",
+		},
+		[]string{"action"},
+	)
+	auditWriteErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vgraas_audit_write_errors_total",
+		Help: "Audit log entries that couldn't be appended to the audit file. They are still kept in memory.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(auditEntries, auditWriteErrors)
+}
+
+// Pages of the audit log served by GET /admin/audit have
+// DefaultAuditPage entries unless asked for fewer or more, up to
+// MaxAuditPage.
+const (
+	DefaultAuditPage = 1000
+	MaxAuditPage     = 10000
+)
+
+// Actions recorded in the audit log.
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// AuditEntry records a change made through the API. Resource is the
+// path of what changed, like /reviews/1 or /reviews/1/comments/2.
+// Before is missing for creates and After for deletes. Actor is "" for
+// anonymous changes.
+type AuditEntry struct {
+	ID        int             `json:"id"`
+	Time      time.Time       `json:"time"`
+	Actor     string          `json:"actor"`
+	RequestID string          `json:"requestId"`
+	IP        string          `json:"ip"`
+	Route     string          `json:"route"`
+	Action    string          `json:"action"`
+	Resource  string          `json:"resource"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+}
+
+// AuditQuery selects audit log entries. Empty fields match everything.
+type AuditQuery struct {
+	Actor string
+
+	// Resource matches the resource and everything under it, so
+	// /reviews/1 includes the comments on review 1
+	Resource string
+
+	// Since is inclusive, Until exclusive
+	Since, Until time.Time
+
+	// After skips the entries up to and including the one with this
+	// ID. Pass the last ID of a page to get the next one.
+	After int
+
+	// Limit is the most entries returned, 0 for no limit
+	Limit int
+}
+
+func (q AuditQuery) matches(e AuditEntry) bool {
+	switch {
+	case e.ID <= q.After:
+		return false
+	case q.Actor != "" && e.Actor != q.Actor:
+		return false
+	case q.Resource != "" && e.Resource != q.Resource && !strings.HasPrefix(e.Resource, strings.TrimSuffix(q.Resource, "/")+"/"):
+		return false
+	case !q.Since.IsZero() && e.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !e.Time.Before(q.Until):
+		return false
+	}
+	return true
+}
+
+// AuditConfig tunes the audit log. Zero values are replaced by the
+// defaults noted on each field.
+type AuditConfig struct {
+	// File the log is appended to as newline delimited JSON, and read
+	// back from on start. The log only lives as long as the process
+	// if empty.
+	File string
+
+	// MaxEntries is how many of the latest entries are kept in memory
+	// (10000). Older ones are read from File, where the offset of every
+	// entry is kept to find them by, or are gone for good without one.
+	MaxEntries int
+
+	// ClientIP works out the address changes came from (the peer
+	// address)
+	ClientIP *middleware.ClientIP
+
+	// Logger reports entries that couldn't be written to File (info
+	// level to stderr)
+	Logger *logging.Logger
+}
+
+func (c *AuditConfig) setDefaults() {
+	if c.MaxEntries <= 0 {
+		c.MaxEntries = 10000
+	}
+	if c.ClientIP == nil {
+		c.ClientIP = &middleware.ClientIP{}
+	}
+	if c.Logger == nil {
+		c.Logger = logging.New(os.Stderr, logging.Info)
+	}
+}
+
+// Audit is an append-only log of every review, comment and webhook
+// created, updated or deleted through the API, with who did it and
+// what it looked like before and after. See WithAudit.
+type Audit struct {
+	cfg AuditConfig
+	now func() time.Time
+
+	mtx     sync.Mutex
+	entries []AuditEntry // The latest, up to cfg.MaxEntries
+	lastID  int
+	file    *os.File
+	size    int64         // Of file, where the next entry goes
+	index   []auditOffset // Where each entry in file starts
+}
+
+// auditOffset is where the entry with id starts in the audit file.
+type auditOffset struct {
+	id     int
+	offset int64
+}
+
+// NewAudit returns an audit log, continuing the one in cfg.File if
+// there is one. Only the latest entries in the file are loaded. Call
+// Close to close the file.
+func NewAudit(cfg AuditConfig) (*Audit, error) {
+	cfg.setDefaults()
+	au := &Audit{cfg: cfg, now: time.Now}
+	if cfg.File == "" {
+		return au, nil
+	}
+
+	f, err := os.OpenFile(cfg.File, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := au.load(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", cfg.File, err)
+	}
+	au.file = f
+	return au, nil
+}
+
+// load reads the entries already in f. A last line without a newline
+// was cut short by a crash, it is cut off so that later entries start
+// on a line of their own. Other lines that aren't entries are skipped.
+func (au *Audit) load(f *os.File) error {
+	rd := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				au.cfg.Logger.Warn("Dropping incomplete audit log entry", "file", au.cfg.File, "line", n)
+				return f.Truncate(au.size)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		offset := au.size
+		au.size += int64(len(line))
+
+		var e AuditEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			au.cfg.Logger.Warn("Skipping malformed audit log entry", "file", au.cfg.File, "line", n, "err", err)
+			continue
+		}
+		au.keep(e)
+		au.index = append(au.index, auditOffset{e.ID, offset})
+	}
+}
+
+// keep adds e to the entries in memory, dropping the oldest if there
+// are too many. Must be called with mtx held.
+func (au *Audit) keep(e AuditEntry) {
+	au.entries = append(au.entries, e)
+	if len(au.entries) > au.cfg.MaxEntries {
+		au.entries = au.entries[1:]
+	}
+	au.lastID = e.ID
+}
+
+// Close closes the audit file.
+func (au *Audit) Close() error {
+	au.mtx.Lock()
+	defer au.mtx.Unlock()
+	if au.file == nil {
+		return nil
+	}
+	err := au.file.Close()
+	au.file = nil
+	return err
+}
+
+// Query returns the entries matching q, oldest first. Entries that are
+// no longer in memory are read from the file, starting at the first one
+// after q.After.
+func (au *Audit) Query(q AuditQuery) ([]AuditEntry, error) {
+	au.mtx.Lock()
+	i := sort.Search(len(au.index), func(i int) bool { return au.index[i].id > q.After })
+	inMemory := au.file == nil || len(au.entries) == 0 || au.entries[0].ID <= q.After+1 || i == len(au.index)
+	if inMemory {
+		defer au.mtx.Unlock()
+		return q.filter(au.entries), nil
+	}
+	offset := au.index[i].offset
+	au.mtx.Unlock()
+
+	// Everything is in the file, entries are only ever appended to it
+	// so it can be read while it is written
+	f, err := os.Open(au.cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	entries := []AuditEntry{}
+	rd := bufio.NewReader(f)
+	for q.Limit <= 0 || len(entries) < q.Limit {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF {
+			// An entry still being written, if anything
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var e AuditEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			// Skipped on load too
+			continue
+		}
+		if q.matches(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// filter returns the entries matching q.
+func (q AuditQuery) filter(in []AuditEntry) []AuditEntry {
+	entries := []AuditEntry{}
+	for _, e := range in {
+		if q.Limit > 0 && len(entries) == q.Limit {
+			break
+		}
+		if q.matches(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// add numbers e and appends it to the log.
+func (au *Audit) add(e AuditEntry) {
+	au.mtx.Lock()
+	defer au.mtx.Unlock()
+	e.ID = au.lastID + 1
+	au.keep(e)
+	auditEntries.WithLabelValues(e.Action).Inc()
+
+	if au.file == nil {
+		return
+	}
+	line, err := json.Marshal(e)
+	if err == nil {
+		var n int
+		n, err = au.file.Write(append(line, '\n'))
+		if err == nil {
+			au.index = append(au.index, auditOffset{e.ID, au.size})
+		}
+		au.size += int64(n)
+	}
+	if err != nil {
+		auditWriteErrors.Inc()
+		au.cfg.Logger.Error("Failed to write audit log entry", "id", e.ID, "err", err)
+	}
+}
+
+type auditKey struct{}
+
+// auditOrigin is where the changes made by a request came from.
+type auditOrigin struct {
+	route string
+	ip    string
+}
+
+// entry describes a change made on behalf of the request ctx belongs to.
+func (au *Audit) entry(ctx context.Context, action, resource string, before, after json.RawMessage) AuditEntry {
+	origin, _ := ctx.Value(auditKey{}).(auditOrigin)
+	return AuditEntry{
+		Time:      au.now().UTC(),
+		Actor:     middleware.ContextUser(ctx),
+		RequestID: middleware.RequestIDFromContext(ctx),
+		IP:        origin.ip,
+		Route:     origin.route,
+		Action:    action,
+		Resource:  resource,
+		Before:    before,
+		After:     after,
+	}
+}
+
+// record adds a change made on behalf of the request ctx belongs to.
+func (au *Audit) record(ctx context.Context, action, resource string, before, after json.RawMessage) {
+	au.add(au.entry(ctx, action, resource, before, after))
+}
+
+// snapshot is v as it goes in the log.
+func snapshot(v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// Wrap returns a ContextRepo that records every review and comment
+// created, updated or deleted in r in the log. Changes made in a batch
+// are only recorded once the batch succeeds.
+func (au *Audit) Wrap(r ContextRepo) ContextRepo {
+	return auditingRepo{r, au, au.add}
+}
+
+type auditingRepo struct {
+	ContextRepo
+	au  *Audit
+	add func(AuditEntry)
+}
+
+func (ar auditingRepo) record(ctx context.Context, action, resource string, before, after json.RawMessage) {
+	ar.add(ar.au.entry(ctx, action, resource, before, after))
+}
+
+// review is the current state of review id, nil if there isn't one.
+func (ar auditingRepo) review(ctx context.Context, id int) json.RawMessage {
+	review, err := ar.ContextRepo.ReadReview(ctx, id)
+	if err != nil {
+		return nil
+	}
+	return snapshot(review)
+}
+
+// comment is the current state of a comment, nil if there isn't one.
+func (ar auditingRepo) comment(ctx context.Context, reviewID, id int) json.RawMessage {
+	comment, err := ar.ContextRepo.ReadComment(ctx, reviewID, id)
+	if err != nil {
+		return nil
+	}
+	return snapshot(comment)
+}
+
+func reviewResource(id int) string {
+	return fmt.Sprintf("/reviews/%d", id)
+}
+
+func commentResource(reviewID, id int) string {
+	return fmt.Sprintf("/reviews/%d/comments/%d", reviewID, id)
+}
+
+func webhookResource(id int) string {
+	return fmt.Sprintf("/webhooks/%d", id)
+}
+
+func (ar auditingRepo) CreateReview(ctx context.Context, r Review) (int, error) {
+	id, err := ar.ContextRepo.CreateReview(ctx, r)
+	if err != nil {
+		return id, err
+	}
+	ar.record(ctx, AuditCreate, reviewResource(id), nil, ar.review(ctx, id))
+	return id, nil
+}
+
+func (ar auditingRepo) UpdateReview(ctx context.Context, id int, r Review) error {
+	before := ar.review(ctx, id)
+	if err := ar.ContextRepo.UpdateReview(ctx, id, r); err != nil {
+		return err
+	}
+	ar.record(ctx, AuditUpdate, reviewResource(id), before, ar.review(ctx, id))
+	return nil
+}
+
+func (ar auditingRepo) PutReview(ctx context.Context, id int, r Review) error {
+	before := ar.review(ctx, id)
+	if err := ar.ContextRepo.PutReview(ctx, id, r); err != nil {
+		return err
+	}
+	action := AuditUpdate
+	if before == nil {
+		action = AuditCreate
+	}
+	ar.record(ctx, action, reviewResource(id), before, ar.review(ctx, id))
+	return nil
+}
+
+func (ar auditingRepo) DeleteReview(ctx context.Context, id int) error {
+	before := ar.review(ctx, id)
+	if err := ar.ContextRepo.DeleteReview(ctx, id); err != nil {
+		return err
+	}
+	ar.record(ctx, AuditDelete, reviewResource(id), before, nil)
+	return nil
+}
+
+func (ar auditingRepo) CreateComment(ctx context.Context, reviewID int, c Comment) (int, error) {
+	id, err := ar.ContextRepo.CreateComment(ctx, reviewID, c)
+	if err != nil {
+		return id, err
+	}
+	ar.record(ctx, AuditCreate, commentResource(reviewID, id), nil, ar.comment(ctx, reviewID, id))
+	return id, nil
+}
+
+func (ar auditingRepo) UpdateComment(ctx context.Context, reviewID, id int, c Comment) error {
+	before := ar.comment(ctx, reviewID, id)
+	if err := ar.ContextRepo.UpdateComment(ctx, reviewID, id, c); err != nil {
+		return err
+	}
+	ar.record(ctx, AuditUpdate, commentResource(reviewID, id), before, ar.comment(ctx, reviewID, id))
+	return nil
+}
+
+func (ar auditingRepo) PutComment(ctx context.Context, reviewID, id int, c Comment) error {
+	before := ar.comment(ctx, reviewID, id)
+	if err := ar.ContextRepo.PutComment(ctx, reviewID, id, c); err != nil {
+		return err
+	}
+	action := AuditUpdate
+	if before == nil {
+		action = AuditCreate
+	}
+	ar.record(ctx, action, commentResource(reviewID, id), before, ar.comment(ctx, reviewID, id))
+	return nil
+}
+
+func (ar auditingRepo) DeleteComment(ctx context.Context, reviewID, id int) error {
+	before := ar.comment(ctx, reviewID, id)
+	if err := ar.ContextRepo.DeleteComment(ctx, reviewID, id); err != nil {
+		return err
+	}
+	ar.record(ctx, AuditDelete, commentResource(reviewID, id), before, nil)
+	return nil
+}
+
+func (ar auditingRepo) Batch(ctx context.Context, fn func(ctx context.Context, tx ContextRepo) error) error {
+	var entries []AuditEntry
+	err := ar.ContextRepo.Batch(ctx, func(ctx context.Context, tx ContextRepo) error {
+		entries = entries[:0]
+		return fn(ctx, auditingRepo{tx, ar.au, func(e AuditEntry) {
+			entries = append(entries, e)
+		}})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		ar.add(e)
+	}
+	return nil
+}
+
+// WithAudit records every change made through the API in au, and
+// enables GET /admin/audit for searching it.
+func WithAudit(au *Audit) Option {
+	return func(a *API) {
+		a.audit = au
+	}
+}
+
+// audited tells the audit log which route and address the changes
+// made by h came from. Operations in a batch are recorded under their
+// own route, from where the batch came from.
+func (a API) audited(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin, ok := r.Context().Value(auditKey{}).(auditOrigin)
+		if !ok {
+			if ip := a.audit.cfg.ClientIP.IP(r); ip != nil {
+				origin.ip = ip.String()
+			}
+		}
+		origin.route = name
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), auditKey{}, origin)))
+	})
+}
+
+// ReadAudit implements GET /admin/audit
+//
+// Entries can be filtered by ?actor=, ?resource= and a time range with
+// ?since= and ?until=, as RFC 3339 times. They come in pages of ?limit=
+// entries, up to MaxAuditPage, the next page starting ?after= the last
+// ID of the one before.
+func (a API) ReadAudit(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := AuditQuery{
+		Actor:    params.Get("actor"),
+		Resource: params.Get("resource"),
+		Limit:    DefaultAuditPage,
+	}
+	for _, n := range []struct {
+		name string
+		to   *int
+	}{
+		{"after", &q.After},
+		{"limit", &q.Limit},
+	} {
+		v := params.Get(n.name)
+		if v == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 0 {
+			HandleError(w, r, http.StatusBadRequest, fmt.Sprintf("Bad %s '%s', must be a whole number", n.name, v))
+			return
+		}
+		*n.to = parsed
+	}
+	if q.Limit == 0 || q.Limit > MaxAuditPage {
+		q.Limit = MaxAuditPage
+	}
+	for _, t := range []struct {
+		name string
+		to   *time.Time
+	}{
+		{"since", &q.Since},
+		{"until", &q.Until},
+	} {
+		v := params.Get(t.name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			HandleError(w, r, http.StatusBadRequest, fmt.Sprintf("Bad %s: %s", t.name, err))
+			return
+		}
+		*t.to = parsed
+	}
+
+	entries, err := a.audit.Query(q)
+	if err != nil {
+		HandleError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respond(w, r, http.StatusOK, entries)
+}
@@ -0,0 +1,293 @@
+package vgraas
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsmith5/vgraas/pkg/logging"
+	"github.com/nsmith5/vgraas/pkg/middleware"
+)
+
+func TestAudit(t *testing.T) {
+	audit, _ := NewAudit(AuditConfig{})
+	defer audit.Close()
+	api := middleware.RequestID(NewAPI(Adapt(NewRAMRepo()), WithAudit(audit), WithAdmins("root")))
+
+	do := func(method, path, user, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(middleware.RequestIDHeader, "req-"+user)
+		if user != "" {
+			req = middleware.WithUser(req, user)
+		}
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		return rr
+	}
+	query := func(params string) []AuditEntry {
+		var entries []AuditEntry
+		rr := do("GET", "/admin/audit?"+params, "root", "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %d querying %s: %s", rr.Code, params, rr.Body.String())
+		}
+		json.NewDecoder(rr.Body).Decode(&entries)
+		return entries
+	}
+
+	do("POST", "/reviews/", "alice", `{"author":"a","body":"one"}`)
+	do("PUT", "/reviews/0", "bob", `{"author":"a","body":"two"}`)
+	do("POST", "/reviews/0/comments", "carol", `{"author":"c","body":"hi"}`)
+	do("GET", "/reviews/0", "alice", "")
+	do("PUT", "/reviews/7", "bob", `{"author":"a","body":"nope"}`)
+	do("DELETE", "/reviews/0", "alice", "")
+
+	entries := query("")
+	if len(entries) != 4 {
+		t.Fatalf("Expected 4 entries, got %+v", entries)
+	}
+	created, updated, deleted := entries[0], entries[1], entries[3]
+	if created.ID != 1 || created.Actor != "alice" || created.RequestID != "req-alice" || created.IP != "192.0.2.1" ||
+		created.Route != "CreateReview" || created.Action != AuditCreate || created.Resource != "/reviews/0" ||
+		created.Before != nil || !strings.Contains(string(created.After), `"one"`) {
+		t.Errorf("Unexpected create entry %+v", created)
+	}
+	if updated.Route != "UpdateReview" || updated.Action != AuditUpdate ||
+		!strings.Contains(string(updated.Before), `"one"`) || !strings.Contains(string(updated.After), `"two"`) {
+		t.Errorf("Unexpected update entry %+v", updated)
+	}
+	if entries[2].Resource != "/reviews/0/comments/0" || entries[2].Route != "CreateComment" {
+		t.Errorf("Unexpected comment entry %+v", entries[2])
+	}
+	if deleted.Action != AuditDelete || deleted.After != nil || !strings.Contains(string(deleted.Before), `"hi"`) {
+		t.Errorf("Expected the deleted review with its comments, got %+v", deleted)
+	}
+
+	// Filters
+	if entries := query("actor=alice"); len(entries) != 2 {
+		t.Errorf("Expected 2 entries by alice, got %d", len(entries))
+	}
+	if entries := query("resource=/reviews/0/comments"); len(entries) != 1 {
+		t.Errorf("Expected 1 entry about comments, got %d", len(entries))
+	}
+	if entries := query("resource=/reviews/0"); len(entries) != 4 {
+		t.Errorf("Expected the review and its comment, got %d", len(entries))
+	}
+	since := url.QueryEscape(updated.Time.Format(time.RFC3339Nano))
+	until := url.QueryEscape(deleted.Time.Format(time.RFC3339Nano))
+	if entries := query("since=" + since + "&until=" + until); len(entries) != 2 || entries[0].ID != 2 {
+		t.Errorf("Expected the entries in between, got %+v", entries)
+	}
+	if rr := do("GET", "/admin/audit?since=yesterday", "root", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad time, got %d", rr.Code)
+	}
+
+	// Paging
+	if entries := query("after=1&limit=2"); len(entries) != 2 || entries[0].ID != 2 || entries[1].ID != 3 {
+		t.Errorf("Expected entries 2 and 3, got %+v", entries)
+	}
+	if rr := do("GET", "/admin/audit?limit=lots", "root", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad limit, got %d", rr.Code)
+	}
+	if rr := do("GET", "/admin/audit", "", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the log to be hidden from anonymous users, got %d", rr.Code)
+	}
+
+	// Exported a line per entry
+	req := middleware.WithUser(httptest.NewRequest("GET", "/admin/audit", nil), "root")
+	req.Header.Set("Accept", "application/x-ndjson")
+	rr := httptest.NewRecorder()
+	api.ServeHTTP(rr, req)
+	if lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n"); len(lines) != 4 || rr.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("Expected 4 lines of NDJSON, got %s:\n%s", rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+}
+
+func TestAuditBatch(t *testing.T) {
+	audit, _ := NewAudit(AuditConfig{})
+	defer audit.Close()
+	api := NewAPI(Adapt(NewRAMRepo()), WithAudit(audit), WithAdmins("root"))
+
+	batch := func(body string) {
+		req := httptest.NewRequest("POST", "/batch", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req = middleware.WithUser(req, "alice")
+		api.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	batch(`{"atomic":true,"operations":[{"method":"POST","path":"/reviews/","body":{"author":"a","body":"one"}},{"method":"DELETE","path":"/reviews/9"}]}`)
+	if entries := queryAudit(t, audit, AuditQuery{}); len(entries) != 0 {
+		t.Errorf("Expected a rolled back batch not to be recorded, got %+v", entries)
+	}
+
+	batch(`{"atomic":true,"operations":[{"method":"POST","path":"/reviews/","body":{"author":"a","body":"one"}},{"method":"PUT","path":"/reviews/0","body":{"author":"a","body":"two"}}]}`)
+	entries := queryAudit(t, audit, AuditQuery{})
+	if len(entries) != 2 {
+		t.Fatalf("Expected both operations to be recorded, got %+v", entries)
+	}
+	for i, route := range []string{"CreateReview", "UpdateReview"} {
+		if entries[i].Route != route || entries[i].Actor != "alice" || entries[i].IP != "192.0.2.1" {
+			t.Errorf("Unexpected entry %+v", entries[i])
+		}
+	}
+}
+
+func TestAuditWebhooks(t *testing.T) {
+	audit, _ := NewAudit(AuditConfig{})
+	defer audit.Close()
+	bus := NewBus()
+	hooks := NewWebhooks(bus, WebhookConfig{})
+	defer hooks.Close()
+	api := NewAPI(Adapt(NewRAMRepo()), WithBus(bus), WithWebhooks(hooks), WithAudit(audit), WithAdmins("admin"))
+
+	req := httptest.NewRequest("POST", "/webhooks", strings.NewReader(`{"url":"http://93.184.216.34/hook","events":["review.created"],"secret":"shh"}`))
+	req.Header.Set("Content-Type", "application/json")
+	api.ServeHTTP(httptest.NewRecorder(), middleware.WithUser(req, "admin"))
+	api.ServeHTTP(httptest.NewRecorder(), middleware.WithUser(httptest.NewRequest("DELETE", "/webhooks/0", nil), "admin"))
+
+	entries := queryAudit(t, audit, AuditQuery{Resource: "/webhooks"})
+	if len(entries) != 2 || entries[0].Action != AuditCreate || entries[1].Action != AuditDelete {
+		t.Fatalf("Expected the webhook to be created and deleted, got %+v", entries)
+	}
+	if entries[0].Before != nil || strings.Contains(string(entries[0].After), "shh") {
+		t.Errorf("Expected the secret to be left out, got %s", entries[0].After)
+	}
+}
+
+func TestAuditFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "audit.log")
+
+	audit, err := NewAudit(AuditConfig{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := middleware.WithUser(httptest.NewRequest("GET", "/", nil), "alice").Context()
+	audit.record(ctx, AuditCreate, "/reviews/0", nil, snapshot(Review{Body: "one"}))
+	audit.record(ctx, AuditDelete, "/reviews/0", snapshot(Review{Body: "one"}), nil)
+	audit.Close()
+
+	// A crash half way through an entry
+	f, _ := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"id":3,"act`)
+	f.Close()
+
+	audit, err = NewAudit(AuditConfig{File: file, Logger: logging.New(ioutil.Discard, logging.Info)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.record(context.Background(), AuditCreate, "/reviews/1", nil, nil)
+	audit.Close()
+
+	entries := queryAudit(t, audit, AuditQuery{})
+	if len(entries) != 3 || entries[0].Actor != "alice" || entries[1].Action != AuditDelete || entries[2].ID != 3 {
+		t.Errorf("Expected the log to carry on, got %+v", entries)
+	}
+
+	f, _ = os.Open(file)
+	defer f.Close()
+	var lines []string
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		lines = append(lines, sc.Text())
+	}
+	if len(lines) != 3 || !json.Valid([]byte(lines[2])) {
+		t.Errorf("Expected the new entry in place of the broken one, got %q", lines)
+	}
+	audit, err = NewAudit(AuditConfig{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.Close()
+	if entries := queryAudit(t, audit, AuditQuery{}); len(entries) != 3 {
+		t.Errorf("Expected the log to load again, got %+v", entries)
+	}
+
+	// Anything else that isn't an entry is skipped
+	ioutil.WriteFile(file, []byte(`{"id":1}`+"\nnonsense\n"+`{"id":2}`+"\n"), 0600)
+	var logs bytes.Buffer
+	audit, err = NewAudit(AuditConfig{File: file, Logger: logging.New(&logs, logging.Info)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	if len(audit.entries) != 2 || audit.lastID != 2 || !strings.Contains(logs.String(), `"line":2`) {
+		t.Errorf("Expected line 2 to be skipped, got %+v and logs %s", audit.entries, logs.String())
+	}
+}
+
+func TestAuditMaxEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "audit.log")
+
+	for _, file := range []string{"", file} {
+		audit, err := NewAudit(AuditConfig{File: file, MaxEntries: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			audit.record(context.Background(), AuditCreate, fmt.Sprintf("/reviews/%d", i), nil, nil)
+		}
+		if len(audit.entries) != 2 || audit.entries[0].ID != 4 {
+			t.Errorf("Expected only the 2 latest entries in memory, got %+v", audit.entries)
+		}
+
+		entries := queryAudit(t, audit, AuditQuery{})
+		if file == "" {
+			if len(entries) != 2 {
+				t.Errorf("Expected older entries to be gone without a file, got %+v", entries)
+			}
+			continue
+		}
+		if len(entries) != 5 {
+			t.Errorf("Expected older entries to be read from the file, got %+v", entries)
+		}
+		if entries := queryAudit(t, audit, AuditQuery{After: 1, Limit: 2}); len(entries) != 2 || entries[0].ID != 2 {
+			t.Errorf("Expected a page from the file, got %+v", entries)
+		}
+		if entries := queryAudit(t, audit, AuditQuery{After: 3}); len(entries) != 2 || entries[0].ID != 4 {
+			t.Errorf("Expected a page from memory, got %+v", entries)
+		}
+		audit.Close()
+
+		// Only the latest entries are loaded on start
+		audit, err = NewAudit(AuditConfig{File: file, MaxEntries: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		audit.record(context.Background(), AuditCreate, "/reviews/5", nil, nil)
+		if len(audit.entries) != 2 || audit.entries[1].ID != 6 {
+			t.Errorf("Expected the log to carry on from the file, got %+v", audit.entries)
+		}
+		if entries := queryAudit(t, audit, AuditQuery{After: 2, Limit: 1}); len(entries) != 1 || entries[0].ID != 3 {
+			t.Errorf("Expected a page from where it starts in the file, got %+v", entries)
+		}
+		audit.Close()
+	}
+}
+
+func queryAudit(t *testing.T, au *Audit, q AuditQuery) []AuditEntry {
+	entries, err := au.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
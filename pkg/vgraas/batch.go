@@ -0,0 +1,298 @@
+package vgraas
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/nsmith5/vgraas/pkg/middleware"
+)
+
+// MaxBatchOperations caps the number of operations in a single batch.
+const MaxBatchOperations = 100
+
+var errBatchFailed = errors.New("Batch operation failed")
+
+// batchRoutes are the routes operations in a batch can use, by name.
+// Batches only ever read and write reviews and comments. Nesting
+// batches, restores, reverts or admin operations are not allowed.
+var batchRoutes = map[string]bool{
+	"ReadReviews":   true,
+	"CreateReview":  true,
+	"ReadReview":    true,
+	"UpdateReview":  true,
+	"DeleteReview":  true,
+	"ReadComments":  true,
+	"CreateComment": true,
+	"ReadComment":   true,
+	"UpdateComment": true,
+	"DeleteComment": true,
+}
+
+// BatchOperation is a single request executed as part of a batch.
+type BatchOperation struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// BatchRequest is the request body of POST /batch.
+//
+// If Atomic is set the operations are run in a transaction and the
+// first one that fails rolls back all of them.
+type BatchRequest struct {
+	Atomic     bool             `json:"atomic"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchResult is the outcome of a single batch operation. Body holds
+// the JSON the operation responded with, if any.
+type BatchResult struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// BatchResponse is the response body of POST /batch.
+//
+// Results line up with the submitted operations. An atomic batch stops
+// at the first failure so it may have fewer results than operations.
+type BatchResponse struct {
+	RolledBack bool          `json:"rolledBack"`
+	Results    []BatchResult `json:"results"`
+}
+
+// Batch implements POST /batch
+//
+// Each operation is dispatched through the same router as a regular
+// request would be, just without the network round trip. Operations are
+// rate limited like requests of their own and carry the headers of the
+// batch request, see subRequest.
+//
+// An atomic batch checks every operation, route middleware and rate
+// limits included, before it starts the repo batch, so only the repo
+// calls run while it is open. If an operation is refused at that point
+// none of them run; the results stop at the refused operation and the
+// ones before it are answered with 424 Failed Dependency.
+func (a API) Batch(w http.ResponseWriter, r *http.Request) {
+	var batch BatchRequest
+	{
+		dec := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err := dec.Decode(&batch)
+		if err != nil {
+			HandleError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if len(batch.Operations) > MaxBatchOperations {
+		HandleError(w, r, http.StatusBadRequest,
+			fmt.Sprintf("Batch has %d operations, the limit is %d", len(batch.Operations), MaxBatchOperations))
+		return
+	}
+
+	var resp BatchResponse
+	status := http.StatusOK
+	if batch.Atomic {
+		ctx, cancel := a.context(r)
+		defer cancel()
+
+		ops, refused := holdBatch(&a, r.WithContext(ctx), batch.Operations)
+		if refused != nil {
+			resp.RolledBack = true
+			resp.Results = refused
+			respond(w, r, http.StatusBadRequest, resp)
+			return
+		}
+
+		err := a.ContextRepo.Batch(ctx, func(ctx context.Context, tx ContextRepo) error {
+			txAPI := a.withRepo(tx)
+			resp.Results = make([]BatchResult, 0, len(ops))
+			for _, op := range ops {
+				rec := &batchRecorder{header: make(http.Header)}
+				txAPI.handlers[op.name].ServeHTTP(rec, op.r.WithContext(opContext{ctx, op.r.Context()}))
+				result := rec.result()
+				resp.Results = append(resp.Results, result)
+				if result.Status >= 400 {
+					return errBatchFailed
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			resp.RolledBack = true
+			status = http.StatusBadRequest
+		}
+	} else {
+		resp.Results = make([]BatchResult, 0, len(batch.Operations))
+		for _, op := range batch.Operations {
+			resp.Results = append(resp.Results, runOperation(&a, r, op))
+		}
+	}
+
+	respond(w, r, status, resp)
+}
+
+// heldKey is the context key of the heldOp an operation is stopped in,
+// see held.
+type heldKey struct{}
+
+// heldOp is an operation of an atomic batch that passed its checks, with
+// the request as it reached its route's handler.
+type heldOp struct {
+	name string
+	r    *http.Request
+}
+
+// held wraps the handler of route name. When an atomic batch checks its
+// operations they stop here, past the route's middleware, and are kept
+// to run once the repo batch is open.
+func held(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if op, ok := r.Context().Value(heldKey{}).(*heldOp); ok && op.r == nil {
+			op.name, op.r = name, r
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// holdBatch runs ops through the router of a up to their handlers. If
+// one of them is refused it returns the results to answer with instead.
+func holdBatch(a *API, r *http.Request, ops []BatchOperation) ([]*heldOp, []BatchResult) {
+	held := make([]*heldOp, 0, len(ops))
+	for i, op := range ops {
+		h := new(heldOp)
+		result := runOperation(a, r.WithContext(context.WithValue(r.Context(), heldKey{}, h)), op)
+		if h.r != nil {
+			held = append(held, h)
+			continue
+		}
+
+		results := make([]BatchResult, 0, i+1)
+		for range held {
+			results = append(results, batchError(http.StatusFailedDependency,
+				fmt.Sprintf("Not run, operation %d was refused", i+1)))
+		}
+		return nil, append(results, result)
+	}
+	return held, nil
+}
+
+// opContext is the context of a repo batch with the values of a held
+// operation's request, which the batch's own values are shadowed by.
+type opContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c opContext) Value(key interface{}) interface{} {
+	if v := c.values.Value(key); v != nil {
+		return v
+	}
+	return c.Context.Value(key)
+}
+
+// batchHeaders are the headers of a batch request its operations don't
+// get. They are about the batch request's own body or make it
+// conditional.
+var batchHeaders = []string{
+	"Content-Type",
+	"Content-Length",
+	"Content-Encoding",
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+}
+
+// subRequest builds the request for op made as part of the batch request
+// r. It has the headers of r, but for batchHeaders, and a JSON body.
+func subRequest(r *http.Request, op BatchOperation) (*http.Request, error) {
+	req, err := http.NewRequest(strings.ToUpper(op.Method), op.Path, bytes.NewReader(op.Body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(middleware.SubRequest(r.Context()))
+	for name, values := range r.Header {
+		req.Header[name] = values
+	}
+	for _, name := range batchHeaders {
+		req.Header.Del(name)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = r.RemoteAddr
+	return req, nil
+}
+
+func runOperation(a *API, r *http.Request, op BatchOperation) BatchResult {
+	req, err := subRequest(r, op)
+	if err != nil {
+		return batchError(http.StatusBadRequest, err.Error())
+	}
+
+	var match mux.RouteMatch
+	if !a.Router.Match(req, &match) || match.Route == nil || !batchRoutes[match.Route.GetName()] {
+		return batchError(http.StatusBadRequest, fmt.Sprintf("%s %s can't be used in a batch", req.Method, op.Path))
+	}
+
+	rec := &batchRecorder{header: make(http.Header)}
+	a.ServeHTTP(rec, req)
+	return rec.result()
+}
+
+func batchError(status int, err string) BatchResult {
+	body, _ := json.Marshal(map[string]string{"err": err})
+	return BatchResult{Status: status, Body: body}
+}
+
+// batchRecorder is an http.ResponseWriter that buffers a response in
+// memory so it can be folded into a batch response.
+type batchRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (br *batchRecorder) Header() http.Header {
+	return br.header
+}
+
+func (br *batchRecorder) WriteHeader(code int) {
+	if br.code == 0 {
+		br.code = code
+	}
+}
+
+func (br *batchRecorder) Write(p []byte) (int, error) {
+	if br.code == 0 {
+		br.code = http.StatusOK
+	}
+	return br.body.Write(p)
+}
+
+func (br *batchRecorder) status() int {
+	if br.code == 0 {
+		return http.StatusOK
+	}
+	return br.code
+}
+
+// result is the recorded response as the result of a batch operation.
+func (br *batchRecorder) result() BatchResult {
+	result := BatchResult{Status: br.status()}
+	body := bytes.TrimSpace(br.body.Bytes())
+	switch {
+	case len(body) == 0:
+	case json.Valid(body):
+		result.Body = body
+	default:
+		result.Body, _ = json.Marshal(string(body))
+	}
+	return result
+}
@@ -0,0 +1,214 @@
+package vgraas
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsmith5/vgraas/pkg/middleware"
+)
+
+func doBatch(t *testing.T, api http.Handler, body string) (int, BatchResponse) {
+	req, err := http.NewRequest("POST", "/batch", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	api.ServeHTTP(rr, req)
+
+	var resp BatchResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return rr.Code, resp
+}
+
+func TestBatchAPI(t *testing.T) {
+	repo := NewRAMRepo()
+	id, _ := repo.CreateReview(Review{Title: "review"})
+	for i := 0; i < 3; i++ {
+		repo.CreateComment(id, Comment{Body: "spam"})
+	}
+	api := NewAPI(Adapt(repo))
+
+	code, resp := doBatch(t, api, `{"operations": [
+		{"method": "DELETE", "path": "/reviews/0/comments/0"},
+		{"method": "PUT", "path": "/reviews/0/comments/1", "body": {"body": "edited"}},
+		{"method": "DELETE", "path": "/reviews/0/comments/7"},
+		{"method": "GET", "path": "/reviews/0/comments/1"},
+		{"method": "POST", "path": "/batch", "body": {}}
+	]}`)
+	if code != http.StatusOK || len(resp.Results) != 5 {
+		t.Fatalf("Unexpected batch response: %d %+v", code, resp)
+	}
+	for i, want := range []int{200, 200, 400, 200, 400} {
+		if resp.Results[i].Status != want {
+			t.Errorf("Operation %d: expected status %d, got %d", i, want, resp.Results[i].Status)
+		}
+	}
+
+	var comment Comment
+	json.Unmarshal(resp.Results[3].Body, &comment)
+	if comment.Body != "edited" {
+		t.Errorf("Expected the batch to see its own update, got %+v", comment)
+	}
+}
+
+func TestAtomicBatchAPI(t *testing.T) {
+	repo := NewRAMRepo()
+	id, _ := repo.CreateReview(Review{Title: "review"})
+	repo.CreateComment(id, Comment{Body: "spam"})
+	api := NewAPI(Adapt(repo))
+
+	code, resp := doBatch(t, api, `{"atomic": true, "operations": [
+		{"method": "DELETE", "path": "/reviews/0/comments/0"},
+		{"method": "DELETE", "path": "/reviews/0/comments/1"},
+		{"method": "DELETE", "path": "/reviews/0"}
+	]}`)
+	if code != http.StatusBadRequest || !resp.RolledBack || len(resp.Results) != 2 {
+		t.Fatalf("Expected atomic batch to stop and roll back: %d %+v", code, resp)
+	}
+
+	if _, err := repo.ReadComment(id, 0); err != nil {
+		t.Error("Rolled back batch deleted a comment")
+	}
+}
+
+func TestBatchRoutes(t *testing.T) {
+	repo := NewRAMRepo()
+	repo.CreateReview(Review{Title: "review"})
+	trash := NewTrash(Adapt(repo), TrashConfig{Retention: time.Hour})
+	defer trash.Close()
+	api := NewAPI(Adapt(repo), WithTrash(trash), WithRevisions(NewRevisions(RevisionsConfig{})))
+
+	code, resp := doBatch(t, api, `{"operations": [
+		{"method": "GET", "path": "/reviews/0"},
+		{"method": "POST", "path": "/reviews/0/restore"},
+		{"method": "POST", "path": "/reviews/0/revisions/0/revert"},
+		{"method": "GET", "path": "/reviews/0/revisions"},
+		{"method": "GET", "path": "/reviews/0/comments/live"},
+		{"method": "GET", "path": "/admin/export"},
+		{"method": "PATCH", "path": "/reviews/0"}
+	]}`)
+	if code != http.StatusOK || len(resp.Results) != 7 {
+		t.Fatalf("Unexpected batch response: %d %+v", code, resp)
+	}
+	for i, want := range []int{200, 400, 400, 400, 400, 400, 400} {
+		if resp.Results[i].Status != want {
+			t.Errorf("Operation %d: expected status %d, got %d", i, want, resp.Results[i].Status)
+		}
+	}
+}
+
+func TestBatchRateLimits(t *testing.T) {
+	repo := NewRAMRepo()
+	repo.CreateReview(Review{Title: "review"})
+	policies, _ := middleware.ParsePolicies("*=100:100,POST CreateComment=1:2")
+	limiter := middleware.NewPolicyRateLimiter(policies, func(r *http.Request) string { return "k" })
+	defer limiter.Close()
+	api := NewAPI(Adapt(repo), WithRouteMiddleware(limiter.Route))
+
+	// Every operation takes a token from the bucket it would take one
+	// from on its own
+	_, resp := doBatch(t, api, `{"operations": [
+		{"method": "POST", "path": "/reviews/0/comments", "body": {"body": "one"}},
+		{"method": "POST", "path": "/reviews/0/comments", "body": {"body": "two"}},
+		{"method": "POST", "path": "/reviews/0/comments", "body": {"body": "three"}},
+		{"method": "GET", "path": "/reviews/0"}
+	]}`)
+	for i, want := range []int{200, 200, http.StatusTooManyRequests, 200} {
+		if resp.Results[i].Status != want {
+			t.Errorf("Operation %d: expected status %d, got %d", i, want, resp.Results[i].Status)
+		}
+	}
+	if comments, _ := repo.ReadComments(0); len(comments) != 2 {
+		t.Errorf("Expected 2 comments, got %d", len(comments))
+	}
+}
+
+func TestAtomicBatchChecks(t *testing.T) {
+	repo := &batchCounter{Repo: NewRAMRepo()}
+	repo.CreateReview(Review{Title: "review"})
+	policies, _ := middleware.ParsePolicies("*=100:100,POST CreateComment=1:2")
+	limiter := middleware.NewPolicyRateLimiter(policies, func(r *http.Request) string { return "k" })
+	defer limiter.Close()
+	api := NewAPI(Adapt(repo), WithRouteMiddleware(limiter.Route))
+
+	// The third comment is rate limited before the batch starts, so
+	// nothing runs
+	code, resp := doBatch(t, api, `{"atomic": true, "operations": [
+		{"method": "POST", "path": "/reviews/0/comments", "body": {"body": "one"}},
+		{"method": "POST", "path": "/reviews/0/comments", "body": {"body": "two"}},
+		{"method": "POST", "path": "/reviews/0/comments", "body": {"body": "three"}},
+		{"method": "GET", "path": "/reviews/0"}
+	]}`)
+	if code != http.StatusBadRequest || !resp.RolledBack || len(resp.Results) != 3 {
+		t.Fatalf("Expected atomic batch to be refused: %d %+v", code, resp)
+	}
+	for i, want := range []int{http.StatusFailedDependency, http.StatusFailedDependency, http.StatusTooManyRequests} {
+		if resp.Results[i].Status != want {
+			t.Errorf("Operation %d: expected status %d, got %d", i, want, resp.Results[i].Status)
+		}
+	}
+	if repo.batches != 0 {
+		t.Errorf("Expected no repo batch, got %d", repo.batches)
+	}
+	if comments, _ := repo.ReadComments(0); len(comments) != 0 {
+		t.Errorf("Expected no comments, got %d", len(comments))
+	}
+
+	code, resp = doBatch(t, api, `{"atomic": true, "operations": [
+		{"method": "GET", "path": "/reviews/0"},
+		{"method": "DELETE", "path": "/reviews/0"}
+	]}`)
+	if code != http.StatusOK || resp.RolledBack || len(resp.Results) != 2 || repo.batches != 1 {
+		t.Fatalf("Unexpected batch response: %d %+v, %d batches", code, resp, repo.batches)
+	}
+	if _, err := repo.ReadReview(0); err == nil {
+		t.Error("Expected the batch to delete the review")
+	}
+}
+
+func TestBatchHeaders(t *testing.T) {
+	repo := NewRAMRepo()
+	repo.CreateReview(Review{Title: "one"})
+	repo.CreateReview(Review{Title: "two"})
+	api := NewAPI(Adapt(repo), WithCache(time.Minute, 10))
+
+	get := func(header, value string) BatchResult {
+		req, _ := http.NewRequest("POST", "/batch", strings.NewReader(`{"operations": [
+			{"method": "GET", "path": "/reviews/"}
+		]}`))
+		req.Header.Set(header, value)
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+
+		var resp BatchResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Results[0]
+	}
+
+	// Operations are answered in the format the batch asks for
+	result := get("Accept", "application/x-ndjson")
+	var lines string
+	if err := json.Unmarshal(result.Body, &lines); err != nil || strings.Count(lines, "\n") != 1 {
+		t.Errorf("Expected two lines of NDJSON, got %s", result.Body)
+	}
+
+	// Conditions are about the batch request, not its operations
+	rr := httptest.NewRecorder()
+	api.ServeHTTP(rr, httptest.NewRequest("GET", "/reviews/", nil))
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected an ETag")
+	}
+	if result := get("If-None-Match", etag); result.Status != http.StatusOK || result.Body == nil {
+		t.Errorf("Expected the operation to answer in full, got %d %s", result.Status, result.Body)
+	}
+}
@@ -0,0 +1,291 @@
+package vgraas
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var cacheLookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "vgraas_response_cache_lookups_total",
+		Help: "Lookups in the in-process response cache, by result.",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(cacheLookups)
+}
+
+// WithCache lets clients and shared caches reuse reads of reviews and
+// comments for maxAge without checking back, and keeps up to size of
+// them in memory so that popular reviews aren't read from the repo for
+// every request. Cached responses are dropped as soon as a change is
+// published on the API's bus.
+//
+// Without this option, or with a maxAge of 0, clients must revalidate
+// every time, cheaply with the ETag of the previous response, and
+// nothing is kept in memory. Last-Modified is only sent for reviews that
+// changed while the API was running.
+func WithCache(maxAge time.Duration, size int) Option {
+	return func(a *API) {
+		a.maxAge = maxAge
+		a.cacheSize = size
+	}
+}
+
+// allReviews is the scope of responses that depend on every review.
+const allReviews = -1
+
+// responseCache keeps track of when reviews last changed and holds on to
+// responses about them until they do.
+type responseCache struct {
+	mtx  sync.Mutex
+	size int
+
+	// versions are bumped for a review, and allReviews, whenever it or
+	// its comments change
+	versions map[int]version
+
+	// entries are the cached responses by key, and by scope so that
+	// changes only go through the ones they make stale
+	entries map[string]*list.Element
+	scopes  map[int]map[string]*list.Element
+	lru     *list.List
+}
+
+// version is how many times a scope changed, and when it last did. The
+// time is zero for scopes that haven't changed since the cache was made,
+// as when they changed before isn't known.
+type version struct {
+	n        int64
+	modified time.Time
+}
+
+// cached is a response as it was written.
+type cached struct {
+	key         string
+	scope       int
+	contentType string
+	body        []byte
+	etag        string
+	modified    time.Time
+}
+
+// newResponseCache returns a cache of up to size responses, invalidated
+// by the events on bus.
+func newResponseCache(bus *Bus, size int) *responseCache {
+	c := &responseCache{
+		size:     size,
+		versions: make(map[int]version),
+		entries:  make(map[string]*list.Element),
+		scopes:   make(map[int]map[string]*list.Element),
+		lru:      list.New(),
+	}
+	bus.Subscribe(c.changed)
+	return c
+}
+
+// changed bumps the versions of the review in e and of the whole
+// collection, and drops the responses that are now stale.
+func (c *responseCache) changed(e Event) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, scope := range []int{e.ReviewID, allReviews} {
+		c.versions[scope] = version{n: c.versions[scope].n + 1, modified: e.Time}
+		for _, el := range c.scopes[scope] {
+			c.remove(el)
+		}
+	}
+}
+
+// version returns the current version of scope.
+func (c *responseCache) version(scope int) version {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.versions[scope]
+}
+
+// remove drops the entry in el. The caller holds c.mtx.
+func (c *responseCache) remove(el *list.Element) {
+	entry := el.Value.(*cached)
+	c.lru.Remove(el)
+	delete(c.entries, entry.key)
+	delete(c.scopes[entry.scope], entry.key)
+	if len(c.scopes[entry.scope]) == 0 {
+		delete(c.scopes, entry.scope)
+	}
+}
+
+func (c *responseCache) get(key string) (*cached, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cached), true
+}
+
+// put keeps entry if its scope is still at version v, that is if nothing
+// changed while the response was being made.
+func (c *responseCache) put(entry *cached, v version) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.size <= 0 || c.versions[entry.scope].n != v.n {
+		return
+	}
+	if el, ok := c.entries[entry.key]; ok {
+		c.remove(el)
+	}
+	el := c.lru.PushFront(entry)
+	c.entries[entry.key] = el
+	if c.scopes[entry.scope] == nil {
+		c.scopes[entry.scope] = make(map[string]*list.Element)
+	}
+	c.scopes[entry.scope][entry.key] = el
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// cached adds caching headers to successful responses from h, a read of
+// reviews or comments, and answers conditional requests for unchanged
+// responses with 304 Not Modified. Responses are served from the cache
+// when they can be.
+func (a API) cached(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope, ok := cacheScope(r)
+		if a.cache == nil || !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		key := r.URL.RequestURI()
+		if enc, ok := r.Context().Value(encoderKey{}).(Encoder); ok {
+			key = mediaType(enc) + " " + key
+		}
+
+		entry, hit := a.cache.get(key)
+		if a.cache.size > 0 {
+			result := "miss"
+			if hit {
+				result = "hit"
+			}
+			cacheLookups.WithLabelValues(result).Inc()
+		}
+		if !hit {
+			v := a.cache.version(scope)
+			rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+			h.ServeHTTP(rec, r)
+			if rec.status != http.StatusOK {
+				w.WriteHeader(rec.status)
+				w.Write(rec.body.Bytes())
+				return
+			}
+
+			sum := sha256.Sum256(rec.body.Bytes())
+			entry = &cached{
+				key:         key,
+				scope:       scope,
+				contentType: w.Header().Get("Content-Type"),
+				body:        rec.body.Bytes(),
+				etag:        `W/"` + hex.EncodeToString(sum[:16]) + `"`,
+				modified:    v.modified,
+			}
+			a.cache.put(entry, v)
+		}
+
+		header := w.Header()
+		header.Set("Cache-Control", a.cacheControl())
+		header.Set("ETag", entry.etag)
+		if !entry.modified.IsZero() {
+			header.Set("Last-Modified", entry.modified.Format(http.TimeFormat))
+		}
+		header.Add("Vary", "Accept")
+		if notModified(r, entry) {
+			header.Del("Content-Type")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		header.Set("Content-Type", entry.contentType)
+		header.Set("Content-Length", strconv.Itoa(len(entry.body)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(entry.body)
+	})
+}
+
+// cacheControl is the Cache-Control header of cached responses.
+func (a API) cacheControl() string {
+	if a.maxAge <= 0 {
+		return "no-cache"
+	}
+	return fmt.Sprintf("public, max-age=%d", int(a.maxAge/time.Second))
+}
+
+// cacheScope returns the review a read of r depends on, or allReviews.
+// ok is false for requests with an invalid review ID, which aren't
+// cached.
+func cacheScope(r *http.Request) (scope int, ok bool) {
+	vars := mux.Vars(r)
+	s, ok := vars["rid"]
+	if !ok {
+		s, ok = vars["id"]
+	}
+	if !ok {
+		return allReviews, true
+	}
+	if _, err := fmt.Sscanf(s, "%d", &scope); err != nil {
+		return 0, false
+	}
+	return scope, true
+}
+
+// notModified reports whether the client making r already has entry,
+// going by If-None-Match if it is set and If-Modified-Since otherwise.
+// If-Modified-Since is ignored for entries without a Last-Modified.
+func notModified(r *http.Request, entry *cached) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(entry.etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || entry.modified.IsZero() {
+		return false
+	}
+	return !entry.modified.Truncate(time.Second).After(since)
+}
+
+// recorder holds on to the body of a response so it can be cached. The
+// status is held back too, headers go straight to the ResponseWriter.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	rec.status = status
+}
+
+func (rec *recorder) Write(p []byte) (int, error) {
+	return rec.body.Write(p)
+}
@@ -0,0 +1,185 @@
+package vgraas
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingRepo counts the reviews read from it.
+type countingRepo struct {
+	ContextRepo
+	reads int
+}
+
+func (cr *countingRepo) ReadReview(ctx context.Context, id int) (Review, error) {
+	cr.reads++
+	return cr.ContextRepo.ReadReview(ctx, id)
+}
+
+func TestConditionalGet(t *testing.T) {
+	repo := Adapt(NewRAMRepo())
+	id, _ := repo.CreateReview(context.Background(), Review{Author: "a", Body: "one"})
+	api := NewAPI(repo)
+
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("/reviews/0")
+	etag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("Expected a weak ETag, got %d %q", rr.Code, etag)
+	}
+	if got := rr.Header().Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("Expected clients to revalidate by default, got %q", got)
+	}
+	// When the review was written is only known once it changes
+	// through the API
+	if got := rr.Header().Get("Last-Modified"); got != "" {
+		t.Errorf("Expected no Last-Modified for an unchanged review, got %q", got)
+	}
+	start := time.Now().UTC()
+
+	if rr := get("/reviews/0", "If-None-Match", etag); rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Errorf("Expected 304 without a body, got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := get("/reviews/0", "If-None-Match", `W/"other", `+etag); rr.Code != http.StatusNotModified {
+		t.Errorf("Expected any matching tag to do, got %d", rr.Code)
+	}
+	if rr := get("/reviews/0", "If-Modified-Since", start.Format(http.TimeFormat)); rr.Code != http.StatusOK {
+		t.Errorf("Expected If-Modified-Since to be ignored without Last-Modified, got %d", rr.Code)
+	}
+	if rr := get("/reviews/0?pretty=true", "If-None-Match", etag); rr.Code != http.StatusOK {
+		t.Errorf("Expected other representations to have other tags, got %d", rr.Code)
+	}
+
+	// Changes show in the tags of the review and the collection, but
+	// not other reviews
+	other, _ := repo.CreateReview(context.Background(), Review{Author: "b", Body: "two"})
+	list := get("/reviews/").Header().Get("ETag")
+	otherTag := get("/reviews/1").Header().Get("ETag")
+	time.Sleep(time.Second)
+
+	req := httptest.NewRequest("PUT", "/reviews/0", strings.NewReader(`{"author":"a","body":"changed"}`))
+	api.ServeHTTP(httptest.NewRecorder(), req)
+	if id != 0 || other != 1 {
+		t.Fatalf("Unexpected IDs %d and %d", id, other)
+	}
+
+	if rr := get("/reviews/0", "If-None-Match", etag); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "changed") {
+		t.Errorf("Expected the changed review, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := get("/reviews/0", "If-Modified-Since", start.Format(http.TimeFormat)); rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a modified review, got %d", rr.Code)
+	}
+	modified := get("/reviews/0").Header().Get("Last-Modified")
+	if _, err := http.ParseTime(modified); err != nil {
+		t.Fatalf("Bad Last-Modified for a changed review: %s", err)
+	}
+	if rr := get("/reviews/0", "If-Modified-Since", modified); rr.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for an unmodified review, got %d", rr.Code)
+	}
+	if rr := get("/reviews/", "If-None-Match", list); rr.Code != http.StatusOK {
+		t.Errorf("Expected the collection to have changed, got %d", rr.Code)
+	}
+	if rr := get("/reviews/1", "If-None-Match", otherTag); rr.Code != http.StatusNotModified {
+		t.Errorf("Expected other reviews to be unchanged, got %d", rr.Code)
+	}
+
+	if rr := get("/reviews/9"); rr.Code != http.StatusBadRequest || rr.Header().Get("ETag") != "" {
+		t.Errorf("Expected errors to be left alone, got %d with ETag %q", rr.Code, rr.Header().Get("ETag"))
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	repo := &countingRepo{ContextRepo: Adapt(NewRAMRepo())}
+	repo.CreateReview(context.Background(), Review{Author: "a", Body: "one"})
+	api := NewAPI(repo, WithCache(time.Minute, 10))
+
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", accept)
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := get("/reviews/0", "application/json")
+	if got := first.Header().Get("Cache-Control"); got != "public, max-age=60" {
+		t.Errorf("Unexpected Cache-Control %q", got)
+	}
+	second := get("/reviews/0", "application/json")
+	if repo.reads != 1 {
+		t.Errorf("Expected the second read to come from the cache, read %d times", repo.reads)
+	}
+	if second.Body.String() != first.Body.String() || second.Header().Get("ETag") != first.Header().Get("ETag") {
+		t.Errorf("Expected the same response, got %q and %q", first.Body.String(), second.Body.String())
+	}
+	if got := second.Header().Get("Content-Type"); got != "application/json; charset=utf-8" {
+		t.Errorf("Unexpected Content-Type %s", got)
+	}
+
+	if rr := get("/reviews/0", "application/x-ndjson"); rr.Header().Get("Content-Type") != "application/x-ndjson" || repo.reads != 2 {
+		t.Errorf("Expected formats to be cached apart, got %s after %d reads", rr.Header().Get("Content-Type"), repo.reads)
+	}
+
+	req := httptest.NewRequest("POST", "/reviews/0/comments", strings.NewReader(`{"author":"b","body":"hi"}`))
+	api.ServeHTTP(httptest.NewRecorder(), req)
+	reads := repo.reads
+	if rr := get("/reviews/0", "application/json"); !strings.Contains(rr.Body.String(), "hi") || repo.reads != reads+1 {
+		t.Errorf("Expected a new comment to invalidate the review, got %s", rr.Body.String())
+	}
+
+	// Reads in a batch see its uncommitted changes, which mustn't be
+	// cached
+	batch := `{"atomic":true,"operations":[
+		{"method":"PUT","path":"/reviews/0","body":{"author":"a","body":"uncommitted"}},
+		{"method":"GET","path":"/reviews/0"},
+		{"method":"DELETE","path":"/reviews/9"}]}`
+	req = httptest.NewRequest("POST", "/batch", strings.NewReader(batch))
+	rr := httptest.NewRecorder()
+	api.ServeHTTP(rr, req)
+	if !strings.Contains(rr.Body.String(), "uncommitted") {
+		t.Errorf("Expected reads in the batch to see its writes, got %s", rr.Body.String())
+	}
+	if rr := get("/reviews/0", "application/json"); strings.Contains(rr.Body.String(), "uncommitted") {
+		t.Errorf("Expected the rolled back batch to leave the cache alone, got %s", rr.Body.String())
+	}
+}
+
+func TestResponseCacheScopes(t *testing.T) {
+	c := newResponseCache(NewBus(), 10)
+	for _, entry := range []*cached{
+		{key: "/reviews/0", scope: 0},
+		{key: "/reviews/0/comments", scope: 0},
+		{key: "/reviews/1", scope: 1},
+		{key: "/reviews/", scope: allReviews},
+	} {
+		c.put(entry, c.version(entry.scope))
+	}
+
+	c.changed(Event{Type: "comment.created", ReviewID: 0, Time: time.Now()})
+	for key, want := range map[string]bool{
+		"/reviews/0":          false,
+		"/reviews/0/comments": false,
+		"/reviews/1":          true,
+		"/reviews/":           false,
+	} {
+		if _, hit := c.get(key); hit != want {
+			t.Errorf("%s: expected cached %t, got %t", key, want, hit)
+		}
+	}
+	if len(c.scopes) != 1 || len(c.scopes[1]) != 1 {
+		t.Errorf("Expected only review 1 left in the index, got %v", c.scopes)
+	}
+}
@@ -2,6 +2,7 @@ package vgraas
 
 // Comment is a comment on a video game review
 type Comment struct {
+	ID     int    `json:"id"`
 	Body   string `json:"body"`
 	Author string `json:"author"`
 }
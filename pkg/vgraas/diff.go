@@ -0,0 +1,84 @@
+package vgraas
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// maxDiffCells bounds the work done comparing two texts line by line.
+// Texts with more lines than that allows are shown as entirely replaced.
+const maxDiffCells = 1 << 16
+
+// diffLines writes the lines of a and b to w, lines only in a prefixed
+// with "-", lines only in b with "+" and lines in both with " ".
+func diffLines(w io.Writer, a, b string) {
+	la, lb := strings.Split(a, "\n"), strings.Split(b, "\n")
+
+	// Edits are usually in the middle of a text, only the part between
+	// the common start and end needs comparing
+	start := 0
+	for start < len(la) && start < len(lb) && la[start] == lb[start] {
+		start++
+	}
+	end := 0
+	for end < len(la)-start && end < len(lb)-start && la[len(la)-1-end] == lb[len(lb)-1-end] {
+		end++
+	}
+
+	for _, line := range la[:start] {
+		fmt.Fprintf(w, " %s\n", line)
+	}
+	diffMiddle(w, la[start:len(la)-end], lb[start:len(lb)-end])
+	for _, line := range la[len(la)-end:] {
+		fmt.Fprintf(w, " %s\n", line)
+	}
+}
+
+// diffMiddle writes the difference between a and b by way of their
+// longest common subsequence of lines.
+func diffMiddle(w io.Writer, a, b []string) {
+	if len(a)*len(b) > maxDiffCells {
+		for _, line := range a {
+			fmt.Fprintf(w, "-%s\n", line)
+		}
+		for _, line := range b {
+			fmt.Fprintf(w, "+%s\n", line)
+		}
+		return
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintf(w, " %s\n", a[i])
+			i, j = i+1, j+1
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(w, "-%s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(w, "+%s\n", b[j])
+			j++
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package vgraas
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/nsmith5/vgraas/pkg/logging"
+	"github.com/nsmith5/vgraas/pkg/middleware"
+)
+
+// Encoder writes API responses in a media type. The API picks one by
+// the Accept header of the request, see WithEncoder.
+type Encoder interface {
+	// ContentType is the Content-Type of responses, its media type is
+	// matched against Accept headers.
+	ContentType() string
+
+	// Encode writes v to w. pretty asks for output meant for people
+	// rather than programs, for formats where there is a difference.
+	Encode(w http.ResponseWriter, v interface{}, pretty bool) error
+}
+
+// JSON encodes responses as JSON, compact unless asked to be pretty.
+type JSON struct{}
+
+// ContentType is application/json.
+func (JSON) ContentType() string {
+	return "application/json; charset=utf-8"
+}
+
+// Encode writes v as a JSON document.
+func (JSON) Encode(w http.ResponseWriter, v interface{}, pretty bool) error {
+	enc := json.NewEncoder(w)
+	if pretty {
+		enc.SetIndent("", "\t")
+	}
+	return enc.Encode(v)
+}
+
+// NDJSON encodes lists as newline delimited JSON, flushing every line
+// so that clients can start on the first items while the rest are
+// still on their way. Anything else is a single line.
+type NDJSON struct{}
+
+// ContentType is application/x-ndjson.
+func (NDJSON) ContentType() string {
+	return "application/x-ndjson"
+}
+
+// Encode writes v, or each of its items if it is a slice, a line each.
+func (NDJSON) Encode(w http.ResponseWriter, v interface{}, pretty bool) error {
+	enc := json.NewEncoder(w)
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return enc.Encode(v)
+	}
+
+	flusher, _ := w.(http.Flusher)
+	for i := 0; i < rv.Len(); i++ {
+		if err := enc.Encode(rv.Index(i).Interface()); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	return nil
+}
+
+// WithEncoder lets clients ask for responses encoded by enc. JSON, the
+// default, and NDJSON are always available. An encoder for a media type
+// that is already available replaces it.
+func WithEncoder(enc Encoder) Option {
+	return func(a *API) {
+		a.encoders = addEncoder(a.encoders, enc)
+	}
+}
+
+// addEncoder adds enc to encoders, replacing any for the same media type.
+func addEncoder(encoders []Encoder, enc Encoder) []Encoder {
+	out := make([]Encoder, 0, len(encoders)+1)
+	for _, e := range encoders {
+		if mediaType(e) != mediaType(enc) {
+			out = append(out, e)
+		}
+	}
+	return append(out, enc)
+}
+
+// mediaType is the Content-Type of enc without parameters.
+func mediaType(enc Encoder) string {
+	return strings.TrimSpace(strings.Split(enc.ContentType(), ";")[0])
+}
+
+type encoderKey struct{}
+
+// negotiated picks the encoder for responses from h by the Accept header,
+// answering 406 Not Acceptable if there isn't one the client accepts.
+func (a API) negotiated(h http.Handler) http.Handler {
+	types := make([]string, len(a.encoders))
+	for i, enc := range a.encoders {
+		types[i] = mediaType(enc)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		picked := middleware.Negotiate(r.Header.Get("Accept"), types...)
+		for _, enc := range a.encoders {
+			if mediaType(enc) == picked {
+				h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), encoderKey{}, enc)))
+				return
+			}
+		}
+		HandleError(w, r, http.StatusNotAcceptable, fmt.Sprintf("Can't respond with any of '%s', try %s", r.Header.Get("Accept"), strings.Join(types, ", ")))
+	})
+}
+
+// respond writes v with status in the format negotiated for r, JSON if
+// there wasn't a negotiation. ?pretty=true asks for indented output.
+func respond(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	enc, ok := r.Context().Value(encoderKey{}).(Encoder)
+	if !ok {
+		enc = JSON{}
+	}
+	pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty"))
+
+	w.Header().Set("Content-Type", enc.ContentType())
+	w.WriteHeader(status)
+	if err := enc.Encode(w, v, pretty); err != nil {
+		// Headers are already out, all we can do is log it
+		logging.FromContext(r.Context()).Warn("Failed to write response", "err", err)
+	}
+}
@@ -0,0 +1,310 @@
+package vgraas
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Event types published when reviews and comments change.
+const (
+	ReviewCreated  = "review.created"
+	ReviewUpdated  = "review.updated"
+	ReviewDeleted  = "review.deleted"
+	CommentCreated = "comment.created"
+	CommentUpdated = "comment.updated"
+	CommentDeleted = "comment.deleted"
+)
+
+// EventTypes lists every event type in the order above.
+var EventTypes = []string{
+	ReviewCreated, ReviewUpdated, ReviewDeleted,
+	CommentCreated, CommentUpdated, CommentDeleted,
+}
+
+// Event describes a single change to a review or comment. Review or
+// Comment hold the state after the change and are nil for deletes.
+//
+// IDs are assigned by the Bus when the event is published and increase
+// monotonically.
+type Event struct {
+	ID        int64     `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	ReviewID  int       `json:"reviewId"`
+	CommentID *int      `json:"commentId,omitempty"`
+	Review    *Review   `json:"review,omitempty"`
+	Comment   *Comment  `json:"comment,omitempty"`
+}
+
+// DefaultBusHistory is the number of events a Bus from NewBus keeps
+// around for subscribers resuming from an earlier event.
+const DefaultBusHistory = 1024
+
+// Bus fans events out to subscribers and keeps a bounded history of
+// recent events.
+type Bus struct {
+	mtx     sync.Mutex
+	subs    map[int]func(Event)
+	next    int
+	lastID  int64
+	history []Event
+	size    int
+	done    chan struct{}
+}
+
+// NewBus returns an empty event bus with the default history size.
+func NewBus() *Bus {
+	return NewBusWithHistory(DefaultBusHistory)
+}
+
+// NewBusWithHistory returns an empty event bus that remembers the last
+// size events.
+func NewBusWithHistory(size int) *Bus {
+	return &Bus{
+		subs: make(map[int]func(Event)),
+		size: size,
+		done: make(chan struct{}),
+	}
+}
+
+// Close shuts the bus down. Later events are dropped and Done is closed
+// so long lived subscribers, like event streams, know to hang up.
+func (b *Bus) Close() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	select {
+	case <-b.done:
+	default:
+		close(b.done)
+		b.subs = make(map[int]func(Event))
+	}
+}
+
+// Done is closed when the bus is closed.
+func (b *Bus) Done() <-chan struct{} {
+	return b.done
+}
+
+// Subscribe registers fn to be called with every published event until
+// cancel is called. fn is called synchronously by Publish with the bus
+// locked so it must not block or call back into the bus; hand the event
+// off to a goroutine if there is work to do.
+func (b *Bus) Subscribe(fn func(Event)) (cancel func()) {
+	cancel, _ = b.SubscribeFrom(-1, fn)
+	return cancel
+}
+
+// SubscribeFrom is like Subscribe but first replays every event in the
+// history with an ID greater than lastID. Replayed events are delivered
+// before any newly published event. Pass -1 to skip the replay.
+//
+// complete is false if events after lastID have already fallen out of
+// the history, in which case the replay starts at the oldest event
+// still remembered.
+func (b *Bus) SubscribeFrom(lastID int64, fn func(Event)) (cancel func(), complete bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	complete = true
+	if lastID >= 0 {
+		if len(b.history) > 0 && b.history[0].ID > lastID+1 {
+			complete = false
+		}
+		for _, e := range b.history {
+			if e.ID > lastID {
+				fn(e)
+			}
+		}
+	}
+
+	id := b.next
+	b.next++
+	b.subs[id] = fn
+
+	return func() {
+		b.mtx.Lock()
+		delete(b.subs, id)
+		b.mtx.Unlock()
+	}, complete
+}
+
+// LastID returns the ID of the most recently published event, or 0 if
+// nothing has been published yet.
+func (b *Bus) LastID() int64 {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.lastID
+}
+
+// Publish assigns e the next ID, records it in the history and sends it
+// to every subscriber.
+func (b *Bus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	select {
+	case <-b.done:
+		return
+	default:
+	}
+
+	b.lastID++
+	e.ID = b.lastID
+
+	if b.size > 0 {
+		if len(b.history) == b.size {
+			copy(b.history, b.history[1:])
+			b.history = b.history[:b.size-1]
+		}
+		b.history = append(b.history, e)
+	}
+
+	for _, fn := range b.subs {
+		fn(e)
+	}
+}
+
+// Publish returns a ContextRepo that publishes an event to bus after
+// every successful write to r. Writes made in a batch are only published
+// once the batch succeeds.
+func Publish(r ContextRepo, bus *Bus) ContextRepo {
+	return &publishingRepo{r, bus.Publish}
+}
+
+type publishingRepo struct {
+	ContextRepo
+	publish func(Event)
+}
+
+func (p *publishingRepo) reviewEvent(ctx context.Context, typ string, id int) {
+	e := Event{Type: typ, ReviewID: id}
+	if typ != ReviewDeleted {
+		// The write went through, so read the review back even if the
+		// request has been given up on in the meantime
+		review, err := p.ContextRepo.ReadReview(detach(ctx), id)
+		if err != nil {
+			return
+		}
+		e.Review = &review
+	}
+	p.publish(e)
+}
+
+func (p *publishingRepo) commentEvent(typ string, rid, id int, c *Comment) {
+	if c != nil {
+		c.ID = id
+	}
+	p.publish(Event{Type: typ, ReviewID: rid, CommentID: &id, Comment: c})
+}
+
+func (p *publishingRepo) CreateReview(ctx context.Context, r Review) (int, error) {
+	id, err := p.ContextRepo.CreateReview(ctx, r)
+	if err == nil {
+		p.reviewEvent(ctx, ReviewCreated, id)
+	}
+	return id, err
+}
+
+func (p *publishingRepo) UpdateReview(ctx context.Context, id int, r Review) error {
+	err := p.ContextRepo.UpdateReview(ctx, id, r)
+	if err == nil {
+		p.reviewEvent(ctx, ReviewUpdated, id)
+	}
+	return err
+}
+
+func (p *publishingRepo) DeleteReview(ctx context.Context, id int) error {
+	err := p.ContextRepo.DeleteReview(ctx, id)
+	if err == nil {
+		p.reviewEvent(ctx, ReviewDeleted, id)
+	}
+	return err
+}
+
+func (p *publishingRepo) PutReview(ctx context.Context, id int, r Review) error {
+	typ := ReviewCreated
+	if _, err := p.ContextRepo.ReadReview(ctx, id); err == nil {
+		typ = ReviewUpdated
+	}
+
+	err := p.ContextRepo.PutReview(ctx, id, r)
+	if err == nil {
+		p.reviewEvent(ctx, typ, id)
+	}
+	return err
+}
+
+func (p *publishingRepo) CreateComment(ctx context.Context, rid int, c Comment) (int, error) {
+	id, err := p.ContextRepo.CreateComment(ctx, rid, c)
+	if err == nil {
+		p.commentEvent(CommentCreated, rid, id, &c)
+	}
+	return id, err
+}
+
+func (p *publishingRepo) UpdateComment(ctx context.Context, rid, id int, c Comment) error {
+	err := p.ContextRepo.UpdateComment(ctx, rid, id, c)
+	if err == nil {
+		p.commentEvent(CommentUpdated, rid, id, &c)
+	}
+	return err
+}
+
+func (p *publishingRepo) DeleteComment(ctx context.Context, rid, id int) error {
+	err := p.ContextRepo.DeleteComment(ctx, rid, id)
+	if err == nil {
+		p.commentEvent(CommentDeleted, rid, id, nil)
+	}
+	return err
+}
+
+func (p *publishingRepo) PutComment(ctx context.Context, rid, id int, c Comment) error {
+	typ := CommentCreated
+	if _, err := p.ContextRepo.ReadComment(ctx, rid, id); err == nil {
+		typ = CommentUpdated
+	}
+
+	err := p.ContextRepo.PutComment(ctx, rid, id, c)
+	if err == nil {
+		p.commentEvent(typ, rid, id, &c)
+	}
+	return err
+}
+
+func (p *publishingRepo) Batch(ctx context.Context, fn func(ctx context.Context, tx ContextRepo) error) error {
+	var events []Event
+	err := p.ContextRepo.Batch(ctx, func(ctx context.Context, tx ContextRepo) error {
+		events = events[:0]
+		return fn(ctx, &publishingRepo{tx, func(e Event) {
+			events = append(events, e)
+		}})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		p.publish(e)
+	}
+	return nil
+}
+
+// detached is a context that keeps the values of its parent but is never
+// done, for work that has to finish even if the request is gone.
+type detached struct {
+	context.Context
+}
+
+func detach(ctx context.Context) context.Context {
+	return detached{ctx}
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
@@ -0,0 +1,213 @@
+package vgraas
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/nsmith5/vgraas/pkg/middleware"
+)
+
+const (
+	// liveBuffer is the number of outgoing messages buffered per live
+	// connection. Clients that fall further behind are disconnected.
+	liveBuffer = 64
+
+	// liveWriteWait bounds how long a single write to a client may take.
+	liveWriteWait = 10 * time.Second
+
+	// livePongWait is how long a client may stay silent, pongs included,
+	// before it is considered gone. Pings go out a little more often.
+	livePongWait   = 60 * time.Second
+	livePingPeriod = livePongWait * 9 / 10
+
+	// liveMaxMessage is the largest message accepted from a client.
+	liveMaxMessage = 16 << 10
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// LiveComment is a comment posted by a client over a live connection.
+// Ref is echoed back in the reply so clients can match them up.
+type LiveComment struct {
+	Ref  string `json:"ref,omitempty"`
+	Body string `json:"body"`
+}
+
+// LiveReply answers a LiveComment. ID is set on success, Err otherwise.
+type LiveReply struct {
+	Type string `json:"type"`
+	Ref  string `json:"ref,omitempty"`
+	ID   *int   `json:"id,omitempty"`
+	Err  string `json:"err,omitempty"`
+}
+
+// LiveComments implements GET /reviews/{rid}/comments/live
+//
+// The connection is upgraded to a WebSocket over which every comment
+// event for the review is pushed as a JSON encoded Event. Authenticated
+// clients can post comments by sending a LiveComment; the author is the
+// authenticated user and the outcome is sent back as a LiveReply with
+// type "ack" or "error". Posted comments are rate limited and audited
+// like POST /reviews/{rid}/comments.
+func (a API) LiveComments(w http.ResponseWriter, r *http.Request) {
+	var rid int
+	{
+		vars := mux.Vars(r)
+		_, err := fmt.Sscanf(vars["rid"], "%d", &rid)
+		if err != nil {
+			HandleError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	{
+		ctx, cancel := a.context(r)
+		_, err := a.ContextRepo.ReadReview(ctx, rid)
+		cancel()
+		if err != nil {
+			handleRepoError(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied with an error
+		return
+	}
+	defer conn.Close()
+
+	// Everything sent to the client goes through out so that there is
+	// only ever one writer. Nothing here blocks on a slow client, if out
+	// fills up the client is dropped instead.
+	out := make(chan interface{}, liveBuffer)
+	slow := make(chan struct{})
+	var once sync.Once
+	send := func(msg interface{}) {
+		select {
+		case out <- msg:
+		default:
+			once.Do(func() { close(slow) })
+		}
+	}
+
+	cancel := a.bus.Subscribe(func(e Event) {
+		if e.ReviewID == rid && e.CommentID != nil {
+			send(e)
+		}
+	})
+	defer cancel()
+
+	done := make(chan struct{})
+	go a.liveRead(conn, r, rid, send, done)
+
+	ping := time.NewTicker(livePingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-a.bus.Done():
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server shutting down"),
+				time.Now().Add(liveWriteWait))
+			return
+		case <-slow:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "Too slow"),
+				time.Now().Add(liveWriteWait))
+			return
+		case <-ping.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveWriteWait))
+			if err != nil {
+				return
+			}
+		case msg := <-out:
+			conn.SetWriteDeadline(time.Now().Add(liveWriteWait))
+			if err := conn.WriteJSON(msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// liveRead handles messages from a live comments client until the
+// connection goes away, then closes done.
+func (a API) liveRead(conn *websocket.Conn, r *http.Request, rid int, send func(interface{}), done chan struct{}) {
+	defer close(done)
+
+	conn.SetReadLimit(liveMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(livePongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(livePongWait))
+		return nil
+	})
+
+	user := middleware.User(r)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(livePongWait))
+
+		var msg LiveComment
+		if err := json.Unmarshal(data, &msg); err != nil {
+			send(LiveReply{Type: "error", Err: err.Error()})
+			continue
+		}
+
+		if user == "" {
+			send(LiveReply{Type: "error", Ref: msg.Ref, Err: "Authentication required to comment"})
+			continue
+		}
+
+		id, err := a.livePost(r, rid, Comment{Body: msg.Body, Author: user})
+		if err != nil {
+			send(LiveReply{Type: "error", Ref: msg.Ref, Err: err.Error()})
+			continue
+		}
+		send(LiveReply{Type: "ack", Ref: msg.Ref, ID: &id})
+	}
+}
+
+// livePost posts c on review rid on behalf of the live client r. It goes
+// through the router like a request of its own, so that the rate limits
+// and audit log for posting comments apply.
+func (a API) livePost(r *http.Request, rid int, c Comment) (int, error) {
+	body, _ := json.Marshal(c)
+	req, err := http.NewRequest("POST", fmt.Sprintf("/reviews/%d/comments", rid), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(middleware.SubRequest(r.Context()))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = r.RemoteAddr
+
+	rec := &batchRecorder{header: make(http.Header)}
+	a.ServeHTTP(rec, req)
+
+	var reply struct {
+		ID  int    `json:"id"`
+		Err string `json:"err"`
+	}
+	json.Unmarshal(rec.body.Bytes(), &reply)
+	if rec.status() != http.StatusOK {
+		if reply.Err == "" {
+			reply.Err = http.StatusText(rec.status())
+		}
+		return 0, errors.New(reply.Err)
+	}
+	return reply.ID, nil
+}
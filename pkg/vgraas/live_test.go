@@ -0,0 +1,116 @@
+package vgraas
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nsmith5/vgraas/pkg/middleware"
+)
+
+func TestLiveComments(t *testing.T) {
+	repo := NewRAMRepo()
+	rid, _ := repo.CreateReview(Review{Title: "launch day"})
+	api := middleware.Authenticate(NewAPI(Adapt(repo)), map[string]string{"k3y": "blogger"})
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/reviews/0/comments/live"
+	reader, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	reader.SetReadDeadline(time.Now().Add(time.Second))
+
+	// Anonymous clients can listen but not post
+	reader.WriteJSON(LiveComment{Ref: "a", Body: "first!"})
+	var reply LiveReply
+	if err := reader.ReadJSON(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != "error" || reply.Ref != "a" {
+		t.Errorf("Expected anonymous comment to be refused, got %+v", reply)
+	}
+
+	writer, _, err := websocket.DefaultDialer.Dial(url+"?access_token=k3y", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	writer.SetReadDeadline(time.Now().Add(time.Second))
+
+	writer.WriteJSON(LiveComment{Ref: "b", Body: "gg"})
+
+	// The writer gets its own event and an ack, in either order
+	acked := false
+	for i := 0; i < 2; i++ {
+		var msg map[string]interface{}
+		if err := writer.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg["type"] == "ack" {
+			acked = msg["ref"] == "b"
+		}
+	}
+	if !acked {
+		t.Error("Comment was never acknowledged")
+	}
+
+	var e Event
+	if err := reader.ReadJSON(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != CommentCreated || e.Comment.Author != "blogger" || e.Comment.Body != "gg" {
+		t.Errorf("Unexpected event %+v", e)
+	}
+
+	if comments, _ := repo.ReadComments(rid); len(comments) != 1 {
+		t.Errorf("Expected 1 stored comment, got %d", len(comments))
+	}
+}
+
+func TestLiveCommentLimits(t *testing.T) {
+	repo := NewRAMRepo()
+	repo.CreateReview(Review{Title: "launch day"})
+	audit, _ := NewAudit(AuditConfig{})
+	defer audit.Close()
+	policies, _ := middleware.ParsePolicies("*=100:100,POST CreateComment=1:1")
+	limiter := middleware.NewPolicyRateLimiter(policies, middleware.UserKey(middleware.IPKey(&middleware.ClientIP{})))
+	defer limiter.Close()
+	api := NewAPI(Adapt(repo), WithAudit(audit), WithRouteMiddleware(limiter.Route))
+	srv := httptest.NewServer(middleware.Authenticate(api, map[string]string{"k3y": "blogger"}))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/reviews/0/comments/live?access_token=k3y"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	// Comments posted live share the budget of POST CreateComment
+	conn.WriteJSON(LiveComment{Ref: "a", Body: "first!"})
+	conn.WriteJSON(LiveComment{Ref: "b", Body: "second!"})
+	replies := make(map[string]LiveReply)
+	for len(replies) < 2 {
+		var reply LiveReply
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Type == "ack" || reply.Type == "error" {
+			replies[reply.Ref] = reply
+		}
+	}
+	if replies["a"].Type != "ack" || replies["b"].Type != "error" || !strings.Contains(replies["b"].Err, "Rate limit") {
+		t.Errorf("Expected the second comment to be rate limited, got %+v", replies)
+	}
+
+	entries := queryAudit(t, audit, AuditQuery{})
+	if len(entries) != 1 || entries[0].Route != "CreateComment" || entries[0].Actor != "blogger" || entries[0].IP != "127.0.0.1" {
+		t.Errorf("Expected the live comment in the audit log like any other, got %+v", entries)
+	}
+}
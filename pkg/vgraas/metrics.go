@@ -0,0 +1,184 @@
+package vgraas
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var repoDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name: "vgraas_repo_operation_duration_seconds",
+		Help: "Time taken by repository operations, by operation and result.",
+	},
+	[]string{"operation", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(repoDuration)
+}
+
+// Instrument returns a ContextRepo that records the latency and outcome
+// of every operation on r.
+func Instrument(r ContextRepo) ContextRepo {
+	return instrumentedRepo{r}
+}
+
+type instrumentedRepo struct {
+	ContextRepo
+}
+
+// observe records an operation that started at start and ended with err.
+func observe(op string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	repoDuration.WithLabelValues(op, result).Observe(time.Since(start).Seconds())
+}
+
+func (ir instrumentedRepo) ReadReviews(ctx context.Context) (reviews []Review, err error) {
+	defer func(start time.Time) { observe("ReadReviews", start, err) }(time.Now())
+	return ir.ContextRepo.ReadReviews(ctx)
+}
+
+func (ir instrumentedRepo) CreateReview(ctx context.Context, r Review) (id int, err error) {
+	defer func(start time.Time) { observe("CreateReview", start, err) }(time.Now())
+	return ir.ContextRepo.CreateReview(ctx, r)
+}
+
+func (ir instrumentedRepo) ReadReview(ctx context.Context, id int) (r Review, err error) {
+	defer func(start time.Time) { observe("ReadReview", start, err) }(time.Now())
+	return ir.ContextRepo.ReadReview(ctx, id)
+}
+
+func (ir instrumentedRepo) UpdateReview(ctx context.Context, id int, r Review) (err error) {
+	defer func(start time.Time) { observe("UpdateReview", start, err) }(time.Now())
+	return ir.ContextRepo.UpdateReview(ctx, id, r)
+}
+
+func (ir instrumentedRepo) DeleteReview(ctx context.Context, id int) (err error) {
+	defer func(start time.Time) { observe("DeleteReview", start, err) }(time.Now())
+	return ir.ContextRepo.DeleteReview(ctx, id)
+}
+
+func (ir instrumentedRepo) ReadComments(ctx context.Context, reviewID int) (comments []Comment, err error) {
+	defer func(start time.Time) { observe("ReadComments", start, err) }(time.Now())
+	return ir.ContextRepo.ReadComments(ctx, reviewID)
+}
+
+func (ir instrumentedRepo) CreateComment(ctx context.Context, reviewID int, c Comment) (id int, err error) {
+	defer func(start time.Time) { observe("CreateComment", start, err) }(time.Now())
+	return ir.ContextRepo.CreateComment(ctx, reviewID, c)
+}
+
+func (ir instrumentedRepo) ReadComment(ctx context.Context, reviewID, id int) (c Comment, err error) {
+	defer func(start time.Time) { observe("ReadComment", start, err) }(time.Now())
+	return ir.ContextRepo.ReadComment(ctx, reviewID, id)
+}
+
+func (ir instrumentedRepo) UpdateComment(ctx context.Context, reviewID, id int, c Comment) (err error) {
+	defer func(start time.Time) { observe("UpdateComment", start, err) }(time.Now())
+	return ir.ContextRepo.UpdateComment(ctx, reviewID, id, c)
+}
+
+func (ir instrumentedRepo) DeleteComment(ctx context.Context, reviewID, id int) (err error) {
+	defer func(start time.Time) { observe("DeleteComment", start, err) }(time.Now())
+	return ir.ContextRepo.DeleteComment(ctx, reviewID, id)
+}
+
+func (ir instrumentedRepo) PutReview(ctx context.Context, id int, r Review) (err error) {
+	defer func(start time.Time) { observe("PutReview", start, err) }(time.Now())
+	return ir.ContextRepo.PutReview(ctx, id, r)
+}
+
+func (ir instrumentedRepo) PutComment(ctx context.Context, reviewID, id int, c Comment) (err error) {
+	defer func(start time.Time) { observe("PutComment", start, err) }(time.Now())
+	return ir.ContextRepo.PutComment(ctx, reviewID, id, c)
+}
+
+// Batch is timed as a whole, and the operations in it individually.
+func (ir instrumentedRepo) Batch(ctx context.Context, fn func(ctx context.Context, tx ContextRepo) error) (err error) {
+	defer func(start time.Time) { observe("Batch", start, err) }(time.Now())
+	return ir.ContextRepo.Batch(ctx, func(ctx context.Context, tx ContextRepo) error {
+		return fn(ctx, instrumentedRepo{tx})
+	})
+}
+
+func (ir instrumentedRepo) TrashReview(ctx context.Context, id int, at time.Time, by string) (err error) {
+	defer func(start time.Time) { observe("TrashReview", start, err) }(time.Now())
+	return trashRepo(ir.ContextRepo).TrashReview(ctx, id, at, by)
+}
+
+func (ir instrumentedRepo) TrashComment(ctx context.Context, reviewID, id int, at time.Time, by string) (err error) {
+	defer func(start time.Time) { observe("TrashComment", start, err) }(time.Now())
+	return trashRepo(ir.ContextRepo).TrashComment(ctx, reviewID, id, at, by)
+}
+
+func (ir instrumentedRepo) ReadTrash(ctx context.Context) (items []Deleted, err error) {
+	defer func(start time.Time) { observe("ReadTrash", start, err) }(time.Now())
+	return trashRepo(ir.ContextRepo).ReadTrash(ctx)
+}
+
+func (ir instrumentedRepo) PurgeTrash(ctx context.Context, cutoff time.Time) (purged []Deleted, err error) {
+	defer func(start time.Time) { observe("PurgeTrash", start, err) }(time.Now())
+	return trashRepo(ir.ContextRepo).PurgeTrash(ctx, cutoff)
+}
+
+// Close closes the underlying Repo if it is an io.Closer.
+func (ir instrumentedRepo) Close() error {
+	if closer, ok := ir.ContextRepo.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Ping pings the underlying Repo if it is a Pinger.
+func (ir instrumentedRepo) Ping(ctx context.Context) error {
+	if p, ok := ir.ContextRepo.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+var errNoCount = errors.New("Repo can't count reviews and comments")
+
+var (
+	reviewsDesc  = prometheus.NewDesc("vgraas_reviews", "Number of stored reviews.", nil, nil)
+	commentsDesc = prometheus.NewDesc("vgraas_comments", "Number of stored comments.", nil, nil)
+)
+
+// RepoCollector returns a prometheus.Collector reporting the number of
+// reviews and comments in r, counted whenever metrics are scraped. r has
+// to be a Counter, or adapt one, for them to be reported.
+func RepoCollector(r ContextRepo) prometheus.Collector {
+	return repoCollector{r}
+}
+
+type repoCollector struct {
+	repo ContextRepo
+}
+
+// Describe implements prometheus.Collector.
+func (rc repoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- reviewsDesc
+	ch <- commentsDesc
+}
+
+// Collect implements prometheus.Collector. Nothing is collected if the
+// repo can't count, leaving the gauges absent rather than wrong.
+func (rc repoCollector) Collect(ch chan<- prometheus.Metric) {
+	c, ok := rc.repo.(Counter)
+	if !ok {
+		return
+	}
+	reviews, comments, err := c.Count(context.Background())
+	if err != nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(reviewsDesc, prometheus.GaugeValue, float64(reviews))
+	ch <- prometheus.MustNewConstMetric(commentsDesc, prometheus.GaugeValue, float64(comments))
+}
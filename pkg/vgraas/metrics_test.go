@@ -0,0 +1,47 @@
+package vgraas
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nsmith5/vgraas/pkg/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestMetrics(t *testing.T) {
+	repo := NewRAMRepo()
+	rid, _ := repo.CreateReview(Review{Title: "t", Body: "b", Author: "a"})
+	cid, _ := repo.CreateComment(rid, Comment{Body: "c", Author: "a"})
+	repo.CreateComment(rid, Comment{Body: "c", Author: "a"})
+
+	api := middleware.Metrics(NewAPI(Instrument(Adapt(repo))))
+	review := fmt.Sprintf("/reviews/%d", rid)
+	comment := fmt.Sprintf("/reviews/%d/comments/%d", rid, cid)
+	for _, path := range []string{review, review, comment, "/nope"} {
+		api.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(RepoCollector(Adapt(repo)))
+	rr := httptest.NewRecorder()
+	promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, reg}, promhttp.HandlerOpts{}).
+		ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	got := rr.Body.String()
+
+	for _, line := range []string{
+		`http_requests_total{code="200",method="GET",route="ReadReview"} 2`,
+		`http_requests_total{code="200",method="GET",route="ReadComment"} 1`,
+		`http_requests_total{code="404",method="GET",route="NotFound"} 1`,
+		`http_request_duration_seconds_count{method="GET",route="ReadReview"} 2`,
+		`vgraas_repo_operation_duration_seconds_count{operation="ReadReview",result="ok"} 2`,
+		"vgraas_reviews 1",
+		"vgraas_comments 2",
+	} {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("Missing %q in:\n%s", line, got)
+		}
+	}
+}
@@ -1,21 +1,67 @@
 package vgraas
 
-import "sync"
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
 
 type ramRepo struct {
 	sync.RWMutex
-	Reviews []Review
+	reviews map[int]*ramReview
+	trash   map[int]*ramReview
+	nextID  int
 }
 
-// NewRAMRepo returns an in-memory implementation of a Repo.
+// ramReview is a stored review. Comments are kept in their own map so
+// that ids stay stable when other comments are deleted.
+type ramReview struct {
+	review   Review
+	comments map[int]Comment
+	nextID   int
+
+	// deleted is when and by whom the review was moved to the trash,
+	// trash holds its comments that were moved there
+	deleted deletion
+	trash   map[int]trashedComment
+}
+
+// deletion records when and by whom something was moved to the trash.
+type deletion struct {
+	at time.Time
+	by string
+}
+
+type trashedComment struct {
+	comment Comment
+	deletion
+}
+
+// NewRAMRepo returns an in-memory implementation of a Repo. It is a
+// Batcher and a Trasher too.
 func NewRAMRepo() Repo {
-	return &ramRepo{}
+	return &ramRepo{
+		reviews: make(map[int]*ramReview),
+		trash:   make(map[int]*ramReview),
+	}
 }
 
 func (rr *ramRepo) ReadReviews() ([]Review, error) {
 	rr.RLock()
 	defer rr.RUnlock()
-	return rr.Reviews, nil
+
+	ids := make([]int, 0, len(rr.reviews))
+	for id := range rr.reviews {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	reviews := make([]Review, 0, len(ids))
+	for _, id := range ids {
+		reviews = append(reviews, rr.reviews[id].read())
+	}
+	return reviews, nil
 }
 
 /* Review CRUD */
@@ -24,28 +70,39 @@ func (rr *ramRepo) CreateReview(r Review) (id int, err error) {
 	rr.Lock()
 	defer rr.Unlock()
 
-	rr.Reviews = append(rr.Reviews, r)
-	return len(rr.Reviews) - 1, nil
+	id = rr.nextID
+	rr.nextID++
+
+	stored := &ramReview{comments: make(map[int]Comment)}
+	stored.set(r)
+	stored.review.ID = id
+	for _, c := range r.Comments {
+		stored.put(stored.nextID, c)
+	}
+	rr.reviews[id] = stored
+	return id, nil
 }
 
 func (rr *ramRepo) ReadReview(id int) (Review, error) {
 	rr.RLock()
 	defer rr.RUnlock()
 
-	if id > len(rr.Reviews)-1 {
+	stored, ok := rr.reviews[id]
+	if !ok {
 		return Review{}, ReviewNotFound
 	}
-	return rr.Reviews[id], nil
+	return stored.read(), nil
 }
 
 func (rr *ramRepo) UpdateReview(id int, r Review) error {
 	rr.Lock()
 	defer rr.Unlock()
 
-	if id > len(rr.Reviews)-1 {
+	stored, ok := rr.reviews[id]
+	if !ok {
 		return ReviewNotFound
 	}
-	rr.Reviews[id] = r
+	stored.set(r)
 	return nil
 }
 
@@ -53,11 +110,47 @@ func (rr *ramRepo) DeleteReview(id int) error {
 	rr.Lock()
 	defer rr.Unlock()
 
-	if id > len(rr.Reviews)-1 {
+	if _, ok := rr.reviews[id]; !ok {
+		return ReviewNotFound
+	}
+	delete(rr.reviews, id)
+	return nil
+}
+
+func (rr *ramRepo) PutReview(id int, r Review) error {
+	rr.Lock()
+	defer rr.Unlock()
+
+	if id < 0 {
 		return ReviewNotFound
 	}
 
-	rr.Reviews = append(rr.Reviews[:id], rr.Reviews[id+1:]...)
+	stored := &ramReview{comments: make(map[int]Comment)}
+	stored.set(r)
+	stored.review.ID = id
+	for _, c := range r.Comments {
+		stored.put(c.ID, c)
+	}
+
+	// A review in the trash is replaced too, but comments in the trash
+	// stay there unless r brings them back
+	old, ok := rr.reviews[id]
+	if !ok {
+		old, ok = rr.trash[id]
+	}
+	if ok {
+		for cid, tc := range old.trash {
+			if _, back := stored.comments[cid]; !back {
+				stored.keep(cid, tc)
+			}
+		}
+	}
+	delete(rr.trash, id)
+
+	rr.reviews[id] = stored
+	if id >= rr.nextID {
+		rr.nextID = id + 1
+	}
 	return nil
 }
 
@@ -65,10 +158,11 @@ func (rr *ramRepo) ReadComments(reviewID int) ([]Comment, error) {
 	rr.RLock()
 	defer rr.RUnlock()
 
-	if reviewID > len(rr.Reviews)-1 {
+	stored, ok := rr.reviews[reviewID]
+	if !ok {
 		return nil, ReviewNotFound
 	}
-	return rr.Reviews[reviewID].Comments, nil
+	return stored.readComments(), nil
 }
 
 /* Comment CRUD */
@@ -76,42 +170,45 @@ func (rr *ramRepo) CreateComment(reviewID int, c Comment) (id int, err error) {
 	rr.Lock()
 	defer rr.Unlock()
 
-	if reviewID > len(rr.Reviews)-1 {
+	stored, ok := rr.reviews[reviewID]
+	if !ok {
 		return 0, ReviewNotFound
 	}
 
-	rr.Reviews[reviewID].Comments = append(rr.Reviews[reviewID].Comments, c)
-	return len(rr.Reviews[reviewID].Comments) - 1, nil
+	id = stored.nextID
+	stored.put(id, c)
+	return id, nil
 }
 
 func (rr *ramRepo) ReadComment(reviewID, id int) (Comment, error) {
 	rr.RLock()
 	defer rr.RUnlock()
 
-	if reviewID > len(rr.Reviews)-1 {
+	stored, ok := rr.reviews[reviewID]
+	if !ok {
 		return Comment{}, ReviewNotFound
 	}
 
-	if id > len(rr.Reviews[reviewID].Comments)-1 {
+	c, ok := stored.comments[id]
+	if !ok {
 		return Comment{}, CommentNotFound
 	}
-
-	return rr.Reviews[reviewID].Comments[id], nil
+	return c, nil
 }
 
 func (rr *ramRepo) UpdateComment(reviewID, id int, c Comment) error {
 	rr.Lock()
 	defer rr.Unlock()
 
-	if reviewID > len(rr.Reviews)-1 {
+	stored, ok := rr.reviews[reviewID]
+	if !ok {
 		return ReviewNotFound
 	}
 
-	if id > len(rr.Reviews[reviewID].Comments)-1 {
+	if _, ok := stored.comments[id]; !ok {
 		return CommentNotFound
 	}
-
-	rr.Reviews[reviewID].Comments[id] = c
+	stored.put(id, c)
 	return nil
 }
 
@@ -119,15 +216,238 @@ func (rr *ramRepo) DeleteComment(reviewID, id int) error {
 	rr.Lock()
 	defer rr.Unlock()
 
-	if reviewID > len(rr.Reviews)-1 {
+	stored, ok := rr.reviews[reviewID]
+	if !ok {
 		return ReviewNotFound
 	}
 
-	if id > len(rr.Reviews[reviewID].Comments)-1 {
+	if _, ok := stored.comments[id]; !ok {
 		return CommentNotFound
 	}
+	delete(stored.comments, id)
+	return nil
+}
+
+func (rr *ramRepo) PutComment(reviewID, id int, c Comment) error {
+	rr.Lock()
+	defer rr.Unlock()
+
+	stored, ok := rr.reviews[reviewID]
+	if !ok {
+		return ReviewNotFound
+	}
 
-	rr.Reviews[reviewID].Comments =
-		append(rr.Reviews[reviewID].Comments[:id], rr.Reviews[reviewID].Comments[id+1:]...)
+	if id < 0 {
+		return CommentNotFound
+	}
+	stored.put(id, c)
+	delete(stored.trash, id)
 	return nil
 }
+
+// Count counts reviews and comments without copying them.
+func (rr *ramRepo) Count(ctx context.Context) (reviews, comments int, err error) {
+	rr.RLock()
+	defer rr.RUnlock()
+	for _, s := range rr.reviews {
+		comments += len(s.comments)
+	}
+	return len(rr.reviews), comments, nil
+}
+
+// Ping always succeeds, memory is never out of reach.
+func (rr *ramRepo) Ping(ctx context.Context) error {
+	return nil
+}
+
+/* Trash, see Trasher */
+
+func (rr *ramRepo) TrashReview(id int, at time.Time, by string) error {
+	rr.Lock()
+	defer rr.Unlock()
+
+	stored, ok := rr.reviews[id]
+	if !ok {
+		return ReviewNotFound
+	}
+	delete(rr.reviews, id)
+	stored.deleted = deletion{at, by}
+	rr.trash[id] = stored
+	return nil
+}
+
+func (rr *ramRepo) TrashComment(reviewID, id int, at time.Time, by string) error {
+	rr.Lock()
+	defer rr.Unlock()
+
+	stored, ok := rr.reviews[reviewID]
+	if !ok {
+		return ReviewNotFound
+	}
+
+	c, ok := stored.comments[id]
+	if !ok {
+		return CommentNotFound
+	}
+	delete(stored.comments, id)
+	stored.keep(id, trashedComment{c, deletion{at, by}})
+	return nil
+}
+
+func (rr *ramRepo) ReadTrash() ([]Deleted, error) {
+	rr.RLock()
+	defer rr.RUnlock()
+	return rr.trashed(func(time.Time) bool { return true }), nil
+}
+
+func (rr *ramRepo) PurgeTrash(cutoff time.Time) ([]Deleted, error) {
+	rr.Lock()
+	defer rr.Unlock()
+
+	purged := rr.trashed(func(at time.Time) bool { return !at.After(cutoff) })
+	for _, d := range purged {
+		if d.CommentID == nil {
+			delete(rr.trash, d.ReviewID)
+		} else if stored, ok := rr.reviews[d.ReviewID]; ok {
+			delete(stored.trash, *d.CommentID)
+		} else if stored, ok := rr.trash[d.ReviewID]; ok {
+			delete(stored.trash, *d.CommentID)
+		}
+	}
+	return purged, nil
+}
+
+// trashed returns the reviews and comments in the trash that were moved
+// there at a time match accepts, oldest first. The caller must hold at
+// least a read lock.
+func (rr *ramRepo) trashed(match func(at time.Time) bool) []Deleted {
+	var items []Deleted
+	for id, stored := range rr.trash {
+		if match(stored.deleted.at) {
+			review := stored.read()
+			items = append(items, Deleted{ReviewID: id, Review: &review, DeletedAt: stored.deleted.at, DeletedBy: stored.deleted.by})
+		}
+	}
+	for _, reviews := range []map[int]*ramReview{rr.reviews, rr.trash} {
+		for id, stored := range reviews {
+			for cid, tc := range stored.trash {
+				if match(tc.at) {
+					cid, c := cid, tc.comment
+					items = append(items, Deleted{ReviewID: id, CommentID: &cid, Comment: &c, DeletedAt: tc.at, DeletedBy: tc.by})
+				}
+			}
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		switch {
+		case !a.DeletedAt.Equal(b.DeletedAt):
+			return a.DeletedAt.Before(b.DeletedAt)
+		case a.ReviewID != b.ReviewID:
+			return a.ReviewID < b.ReviewID
+		case a.CommentID == nil || b.CommentID == nil:
+			return a.CommentID == nil && b.CommentID != nil
+		default:
+			return *a.CommentID < *b.CommentID
+		}
+	})
+	return items
+}
+
+/* Batch writes */
+
+// Batch applies fn to a copy of the repository and swaps the copy in
+// only if fn succeeds. The write lock is held throughout so batches are
+// serialized with every other write.
+func (rr *ramRepo) Batch(fn func(tx Repo) error) error {
+	rr.Lock()
+	defer rr.Unlock()
+
+	tx := rr.clone()
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	rr.reviews, rr.trash, rr.nextID = tx.reviews, tx.trash, tx.nextID
+	return nil
+}
+
+// clone returns a deep copy of the repository. The caller must hold at
+// least a read lock.
+func (rr *ramRepo) clone() *ramRepo {
+	cp := &ramRepo{
+		reviews: make(map[int]*ramReview, len(rr.reviews)),
+		trash:   make(map[int]*ramReview, len(rr.trash)),
+		nextID:  rr.nextID,
+	}
+	for id, stored := range rr.reviews {
+		cp.reviews[id] = stored.clone()
+	}
+	for id, stored := range rr.trash {
+		cp.trash[id] = stored.clone()
+	}
+	return cp
+}
+
+func (s *ramReview) clone() *ramReview {
+	cp := *s
+	cp.comments = make(map[int]Comment, len(s.comments))
+	for id, c := range s.comments {
+		cp.comments[id] = c
+	}
+	cp.trash = nil
+	for id, tc := range s.trash {
+		cp.keep(id, tc)
+	}
+	return &cp
+}
+
+// set replaces the review fields of a stored review. Comments are
+// managed separately and are left untouched.
+func (s *ramReview) set(r Review) {
+	id := s.review.ID
+	s.review = r
+	s.review.ID = id
+	s.review.Comments = nil
+}
+
+// put stores a comment under id and bumps the next comment id past it.
+func (s *ramReview) put(id int, c Comment) {
+	c.ID = id
+	s.comments[id] = c
+	if id >= s.nextID {
+		s.nextID = id + 1
+	}
+}
+
+// keep stores a comment in the trash of the review.
+func (s *ramReview) keep(id int, tc trashedComment) {
+	if s.trash == nil {
+		s.trash = make(map[int]trashedComment)
+	}
+	s.trash[id] = tc
+	if id >= s.nextID {
+		s.nextID = id + 1
+	}
+}
+
+func (s *ramReview) read() Review {
+	r := s.review
+	r.Comments = s.readComments()
+	return r
+}
+
+func (s *ramReview) readComments() []Comment {
+	ids := make([]int, 0, len(s.comments))
+	for id := range s.comments {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var comments []Comment
+	for _, id := range ids {
+		comments = append(comments, s.comments[id])
+	}
+	return comments
+}
@@ -59,6 +59,25 @@ func TestReviewCRUD(t *testing.T) {
 	}
 }
 
+func TestUpdateReviewKeepsComments(t *testing.T) {
+	rr := NewRAMRepo()
+	id, _ := rr.CreateReview(Review{Title: "title", Comments: []Comment{{Body: "first"}}})
+	rr.CreateComment(id, Comment{Body: "second"})
+
+	err := rr.UpdateReview(id, Review{Title: "new title", Comments: []Comment{{Body: "replacement"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	review, _ := rr.ReadReview(id)
+	if review.Title != "new title" {
+		t.Errorf("Expected the title to be updated, got %q", review.Title)
+	}
+	if len(review.Comments) != 2 || review.Comments[0].Body != "first" || review.Comments[1].Body != "second" {
+		t.Errorf("Expected the comments to be left alone, got %+v", review.Comments)
+	}
+}
+
 func TestCommentCRUD(t *testing.T) {
 	rr := NewRAMRepo()
 	{
@@ -120,3 +139,60 @@ func TestCommentCRUD(t *testing.T) {
 		}
 	}
 }
+
+func TestStableIDs(t *testing.T) {
+	rr := NewRAMRepo()
+
+	first, _ := rr.CreateReview(Review{Title: "first"})
+	second, _ := rr.CreateReview(Review{Title: "second"})
+	if err := rr.DeleteReview(first); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := rr.ReadReview(second)
+	if err != nil || read.Title != "second" || read.ID != second {
+		t.Error("Deleting a review changed the id of another")
+	}
+
+	c0, _ := rr.CreateComment(second, Comment{Body: "zero"})
+	c1, _ := rr.CreateComment(second, Comment{Body: "one"})
+	rr.DeleteComment(second, c0)
+	c, err := rr.ReadComment(second, c1)
+	if err != nil || c.Body != "one" || c.ID != c1 {
+		t.Error("Deleting a comment changed the id of another")
+	}
+
+	if _, err := rr.ReadReview(-1); err != ReviewNotFound {
+		t.Error("Read review with negative id")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	rr := NewRAMRepo()
+	rr.CreateReview(Review{Title: "keep"})
+
+	err := rr.(Batcher).Batch(func(tx Repo) error {
+		tx.CreateReview(Review{Title: "discard"})
+		tx.DeleteReview(0)
+		return ReviewNotFound
+	})
+	if err != ReviewNotFound {
+		t.Error("Batch didn't return the error from fn")
+	}
+
+	reviews, _ := rr.ReadReviews()
+	if len(reviews) != 1 || reviews[0].Title != "keep" {
+		t.Errorf("Failed batch was applied: %+v", reviews)
+	}
+
+	err = rr.(Batcher).Batch(func(tx Repo) error {
+		_, err := tx.CreateReview(Review{Title: "kept"})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reviews, _ := rr.ReadReviews(); len(reviews) != 2 {
+		t.Error("Successful batch wasn't applied")
+	}
+}
@@ -1,6 +1,10 @@
 package vgraas
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"time"
+)
 
 // These two domain specific errors should be used when
 // implementing the Repo interface.
@@ -11,11 +15,23 @@ var (
 
 // Repo is an interface that an storage mechanism for reviews
 // should obey.
+//
+// Repo predates ContextRepo, which the API is built on. Repos are used
+// through Adapt; backends that can make use of a context should
+// implement ContextRepo instead.
+//
+// Repos that buffer writes or hold resources should also implement
+// io.Closer, which is called once the server has shut down.
+//
+// Ids are assigned by the Repo and must stay stable for the lifetime
+// of a review or comment. Reads fill in the ID fields of the returned
+// values; writes ignore them.
 type Repo interface {
 	// All Reviews
 	ReadReviews() ([]Review, error)
 
-	// Review CRUD
+	// Review CRUD. UpdateReview replaces the title, body and author of
+	// a review and leaves its comments alone.
 	CreateReview(r Review) (id int, err error)
 	ReadReview(id int) (Review, error)
 	UpdateReview(id int, r Review) error
@@ -29,4 +45,100 @@ type Repo interface {
 	ReadComment(reviewID, id int) (Comment, error)
 	UpdateComment(reviewID, id int, c Comment) error
 	DeleteComment(reviewID, id int) error
+
+	// PutReview stores a review, along with its comments and their ids,
+	// under a caller chosen id, replacing anything already there.
+	// PutComment does the same for a single comment. These are used to
+	// restore data exported from another Repo.
+	PutReview(id int, r Review) error
+	PutComment(reviewID, id int, c Comment) error
+}
+
+// Batcher can be implemented by Repos that offer transactions. Batch
+// runs fn against a transactional view of the Repo. If fn returns an
+// error none of the writes it made are kept. Repos that don't implement
+// it run batches write by write, so failed batches may be partially
+// applied.
+type Batcher interface {
+	Batch(fn func(tx Repo) error) error
+}
+
+// Trasher can be implemented by Repos that keep deleted reviews and
+// comments for a while, see Trash. What is moved to the trash stays in
+// the Repo, with when and by whom it was deleted, but every other
+// method acts as if it was gone. PutReview and PutComment replace what
+// is in the trash, which takes it out again, except that comments in
+// the trash stay there when their review is put without them.
+type Trasher interface {
+	// TrashReview moves a review, along with its comments, to the
+	// trash. TrashComment moves a single comment.
+	TrashReview(id int, at time.Time, by string) error
+	TrashComment(reviewID, id int, at time.Time, by string) error
+
+	// ReadTrash returns what is in the trash, oldest deletion first.
+	ReadTrash() ([]Deleted, error)
+
+	// PurgeTrash deletes what was moved to the trash at or before
+	// cutoff for good and returns it, oldest deletion first.
+	PurgeTrash(cutoff time.Time) ([]Deleted, error)
+}
+
+// Counter can be implemented by Repos that can count what they store
+// without reading all of it. It backs the vgraas_reviews and
+// vgraas_comments gauges, see RepoCollector.
+type Counter interface {
+	Count(ctx context.Context) (reviews, comments int, err error)
+}
+
+// Pinger can be implemented by Repos to report whether their backend is
+// reachable. It backs the "repo" readiness check.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// ContextRepo is the context aware version of Repo and what the API is
+// built on. Every method takes the context of the request it serves, so
+// backends can give up on work nobody is waiting for any more, honour
+// deadlines and pick up request scoped data such as trace spans.
+//
+// Implementations should return ctx.Err() once ctx is done. Old-style
+// Repos can be used through Adapt. The same notes on ids, io.Closer,
+// Counter and Pinger apply as for Repo.
+type ContextRepo interface {
+	// All Reviews
+	ReadReviews(ctx context.Context) ([]Review, error)
+
+	// Review CRUD. UpdateReview leaves comments alone, see Repo.
+	CreateReview(ctx context.Context, r Review) (id int, err error)
+	ReadReview(ctx context.Context, id int) (Review, error)
+	UpdateReview(ctx context.Context, id int, r Review) error
+	DeleteReview(ctx context.Context, id int) error
+
+	// All Comments
+	ReadComments(ctx context.Context, reviewID int) ([]Comment, error)
+
+	// Comment CRUD
+	CreateComment(ctx context.Context, reviewID int, c Comment) (id int, err error)
+	ReadComment(ctx context.Context, reviewID, id int) (Comment, error)
+	UpdateComment(ctx context.Context, reviewID, id int, c Comment) error
+	DeleteComment(ctx context.Context, reviewID, id int) error
+
+	// Restoring exported data
+	PutReview(ctx context.Context, id int, r Review) error
+	PutComment(ctx context.Context, reviewID, id int, c Comment) error
+
+	// Batch runs fn against a transactional view of the Repo, see
+	// Batcher. The view must only be used with the context passed to
+	// fn or one derived from it.
+	Batch(ctx context.Context, fn func(ctx context.Context, tx ContextRepo) error) error
+}
+
+// TrashRepo is the context aware version of Trasher. Adapt, and the
+// ContextRepos in this package that wrap another, implement it for
+// repos that do.
+type TrashRepo interface {
+	TrashReview(ctx context.Context, id int, at time.Time, by string) error
+	TrashComment(ctx context.Context, reviewID, id int, at time.Time, by string) error
+	ReadTrash(ctx context.Context) ([]Deleted, error)
+	PurgeTrash(ctx context.Context, cutoff time.Time) ([]Deleted, error)
 }
@@ -0,0 +1,345 @@
+package vgraas
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	repoCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vgraas_repo_cache_lookups_total",
+			Help: "Reviews looked up in the repo cache, by result. Shared lookups waited on a read another request had started.",
+		},
+		[]string{"result"},
+	)
+	repoCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "vgraas_repo_cache_entries",
+		Help: "Number of reviews in the repo cache.",
+	})
+	repoCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "vgraas_repo_cache_bytes",
+		Help: "Approximate size of the reviews in the repo cache.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(repoCacheLookups, repoCacheEntries, repoCacheBytes)
+}
+
+// CacheOptions limits the reviews kept by Cache. A limit of 0 is no
+// limit.
+type CacheOptions struct {
+	// MaxEntries is the number of reviews kept.
+	MaxEntries int
+
+	// MaxBytes is the approximate size of the reviews kept, counting
+	// their text and a little overhead per review and comment.
+	MaxBytes int64
+
+	// TTL is how long a review is kept before it is read from the repo
+	// again. It bounds how stale reviews can get when something other
+	// than this process writes to the repo, another replica for
+	// instance.
+	TTL time.Duration
+}
+
+// Cache returns a ContextRepo that keeps the reviews read from r in
+// memory, least recently used first out, and answers reads of reviews
+// and their comments from there. Writes go straight to r and drop the
+// reviews they touch. Concurrent reads of a review that isn't cached
+// share a single read from r.
+//
+// Reads inside a batch aren't cached, they may see writes that are
+// never committed.
+func Cache(r ContextRepo, opts CacheOptions) ContextRepo {
+	c := &cachingRepo{
+		opts:    opts,
+		now:     time.Now,
+		entries: make(map[int]*list.Element),
+		lru:     list.New(),
+		flights: make(map[int]*flight),
+	}
+	c.invalidatingRepo = invalidatingRepo{r, c.invalidate}
+	return c
+}
+
+type cachingRepo struct {
+	invalidatingRepo
+	opts CacheOptions
+	now  func() time.Time
+
+	mtx     sync.Mutex
+	entries map[int]*list.Element
+	lru     *list.List
+	bytes   int64
+	flights map[int]*flight
+}
+
+type cacheEntry struct {
+	id      int
+	review  Review
+	size    int64
+	expires time.Time
+}
+
+// flight is a read of a review from the repo that others can wait on.
+// A stale read was overtaken by a write and isn't cached.
+type flight struct {
+	done   chan struct{}
+	review Review
+	err    error
+	stale  bool
+}
+
+// review returns review id, from the cache if it can.
+func (c *cachingRepo) review(ctx context.Context, id int) (Review, error) {
+	for {
+		c.mtx.Lock()
+		if el, ok := c.entries[id]; ok {
+			e := el.Value.(*cacheEntry)
+			if e.expires.IsZero() || c.now().Before(e.expires) {
+				c.lru.MoveToFront(el)
+				c.mtx.Unlock()
+				repoCacheLookups.WithLabelValues("hit").Inc()
+				return e.review, nil
+			}
+			c.remove(el)
+		}
+		f, shared := c.flights[id]
+		if !shared {
+			f = &flight{done: make(chan struct{})}
+			c.flights[id] = f
+		}
+		c.mtx.Unlock()
+
+		if !shared {
+			repoCacheLookups.WithLabelValues("miss").Inc()
+			f.review, f.err = c.ContextRepo.ReadReview(ctx, id)
+
+			c.mtx.Lock()
+			if c.flights[id] == f {
+				delete(c.flights, id)
+			}
+			if f.err == nil && !f.stale {
+				c.add(id, f.review)
+			}
+			c.mtx.Unlock()
+			close(f.done)
+			return f.review, f.err
+		}
+
+		repoCacheLookups.WithLabelValues("shared").Inc()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return Review{}, ctx.Err()
+		}
+		// The read was made with the context of whoever started it. If
+		// they gave up, that's no reason for us to
+		if (f.err == context.Canceled || f.err == context.DeadlineExceeded) && ctx.Err() == nil {
+			continue
+		}
+		return f.review, f.err
+	}
+}
+
+// add caches r as review id and evicts the least recently used reviews
+// until the cache is within its limits. Reviews bigger than the whole
+// cache aren't kept. c.mtx must be held.
+func (c *cachingRepo) add(id int, r Review) {
+	e := &cacheEntry{id: id, review: r, size: reviewSize(r)}
+	if c.opts.MaxBytes > 0 && e.size > c.opts.MaxBytes {
+		return
+	}
+	if c.opts.TTL > 0 {
+		e.expires = c.now().Add(c.opts.TTL)
+	}
+	if el, ok := c.entries[id]; ok {
+		c.remove(el)
+	}
+	c.entries[id] = c.lru.PushFront(e)
+	c.bytes += e.size
+	repoCacheEntries.Add(1)
+	repoCacheBytes.Add(float64(e.size))
+
+	for (c.opts.MaxEntries > 0 && c.lru.Len() > c.opts.MaxEntries) ||
+		(c.opts.MaxBytes > 0 && c.bytes > c.opts.MaxBytes) {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops a cached review. c.mtx must be held.
+func (c *cachingRepo) remove(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, e.id)
+	c.bytes -= e.size
+	repoCacheEntries.Add(-1)
+	repoCacheBytes.Add(-float64(e.size))
+}
+
+// invalidate drops review id, and makes sure a read of it that is under
+// way isn't cached or shared with reads that start from now on.
+func (c *cachingRepo) invalidate(id int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if el, ok := c.entries[id]; ok {
+		c.remove(el)
+	}
+	if f, ok := c.flights[id]; ok {
+		f.stale = true
+		delete(c.flights, id)
+	}
+}
+
+// reviewSize estimates the memory taken up by r.
+func reviewSize(r Review) int64 {
+	size := 64 + len(r.Title) + len(r.Body) + len(r.Author)
+	for _, comment := range r.Comments {
+		size += 32 + len(comment.Body) + len(comment.Author)
+	}
+	return int64(size)
+}
+
+// copyComments copies comments so callers can't change what is cached.
+func copyComments(comments []Comment) []Comment {
+	if comments == nil {
+		return nil
+	}
+	return append([]Comment(nil), comments...)
+}
+
+func (c *cachingRepo) ReadReview(ctx context.Context, id int) (Review, error) {
+	r, err := c.review(ctx, id)
+	r.Comments = copyComments(r.Comments)
+	return r, err
+}
+
+func (c *cachingRepo) ReadComments(ctx context.Context, reviewID int) ([]Comment, error) {
+	r, err := c.review(ctx, reviewID)
+	if err != nil {
+		return nil, err
+	}
+	return copyComments(r.Comments), nil
+}
+
+func (c *cachingRepo) ReadComment(ctx context.Context, reviewID, id int) (Comment, error) {
+	r, err := c.review(ctx, reviewID)
+	if err != nil {
+		return Comment{}, err
+	}
+	for _, comment := range r.Comments {
+		if comment.ID == id {
+			return comment, nil
+		}
+	}
+	return Comment{}, CommentNotFound
+}
+
+// Batch drops the reviews touched by the batch once it is over, whether
+// it succeeded or not.
+func (c *cachingRepo) Batch(ctx context.Context, fn func(ctx context.Context, tx ContextRepo) error) error {
+	var mtx sync.Mutex
+	var touched []int
+	err := c.ContextRepo.Batch(ctx, func(ctx context.Context, tx ContextRepo) error {
+		return fn(ctx, invalidatingRepo{tx, func(id int) {
+			mtx.Lock()
+			touched = append(touched, id)
+			mtx.Unlock()
+		}})
+	})
+	for _, id := range touched {
+		c.invalidate(id)
+	}
+	return err
+}
+
+// Close closes the underlying Repo if it is an io.Closer.
+func (c *cachingRepo) Close() error {
+	if closer, ok := c.ContextRepo.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Ping pings the underlying Repo if it is a Pinger.
+func (c *cachingRepo) Ping(ctx context.Context) error {
+	if p, ok := c.ContextRepo.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// invalidatingRepo calls touch with the review every write to it
+// touches, once the write is over.
+type invalidatingRepo struct {
+	ContextRepo
+	touch func(reviewID int)
+}
+
+func (ir invalidatingRepo) UpdateReview(ctx context.Context, id int, r Review) error {
+	defer ir.touch(id)
+	return ir.ContextRepo.UpdateReview(ctx, id, r)
+}
+
+func (ir invalidatingRepo) DeleteReview(ctx context.Context, id int) error {
+	defer ir.touch(id)
+	return ir.ContextRepo.DeleteReview(ctx, id)
+}
+
+func (ir invalidatingRepo) PutReview(ctx context.Context, id int, r Review) error {
+	defer ir.touch(id)
+	return ir.ContextRepo.PutReview(ctx, id, r)
+}
+
+func (ir invalidatingRepo) CreateComment(ctx context.Context, reviewID int, c Comment) (int, error) {
+	defer ir.touch(reviewID)
+	return ir.ContextRepo.CreateComment(ctx, reviewID, c)
+}
+
+func (ir invalidatingRepo) UpdateComment(ctx context.Context, reviewID, id int, c Comment) error {
+	defer ir.touch(reviewID)
+	return ir.ContextRepo.UpdateComment(ctx, reviewID, id, c)
+}
+
+func (ir invalidatingRepo) DeleteComment(ctx context.Context, reviewID, id int) error {
+	defer ir.touch(reviewID)
+	return ir.ContextRepo.DeleteComment(ctx, reviewID, id)
+}
+
+func (ir invalidatingRepo) PutComment(ctx context.Context, reviewID, id int, c Comment) error {
+	defer ir.touch(reviewID)
+	return ir.ContextRepo.PutComment(ctx, reviewID, id, c)
+}
+
+func (ir invalidatingRepo) TrashReview(ctx context.Context, id int, at time.Time, by string) error {
+	defer ir.touch(id)
+	return trashRepo(ir.ContextRepo).TrashReview(ctx, id, at, by)
+}
+
+func (ir invalidatingRepo) TrashComment(ctx context.Context, reviewID, id int, at time.Time, by string) error {
+	defer ir.touch(reviewID)
+	return trashRepo(ir.ContextRepo).TrashComment(ctx, reviewID, id, at, by)
+}
+
+// ReadTrash and PurgeTrash don't touch anything cached, what is in the
+// trash never is.
+func (ir invalidatingRepo) ReadTrash(ctx context.Context) ([]Deleted, error) {
+	return trashRepo(ir.ContextRepo).ReadTrash(ctx)
+}
+
+func (ir invalidatingRepo) PurgeTrash(ctx context.Context, cutoff time.Time) ([]Deleted, error) {
+	return trashRepo(ir.ContextRepo).PurgeTrash(ctx, cutoff)
+}
+
+func (ir invalidatingRepo) Batch(ctx context.Context, fn func(ctx context.Context, tx ContextRepo) error) error {
+	return ir.ContextRepo.Batch(ctx, func(ctx context.Context, tx ContextRepo) error {
+		return fn(ctx, invalidatingRepo{tx, ir.touch})
+	})
+}
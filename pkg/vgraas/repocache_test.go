@@ -0,0 +1,226 @@
+package vgraas
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingRepo holds reads of reviews until release is closed and counts
+// them.
+type blockingRepo struct {
+	ContextRepo
+	reads   int32
+	release chan struct{}
+}
+
+func (br *blockingRepo) ReadReview(ctx context.Context, id int) (Review, error) {
+	atomic.AddInt32(&br.reads, 1)
+	select {
+	case <-br.release:
+	case <-ctx.Done():
+		return Review{}, ctx.Err()
+	}
+	return br.ContextRepo.ReadReview(ctx, id)
+}
+
+func TestRepoCache(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingRepo{ContextRepo: Adapt(NewRAMRepo())}
+	repo := Cache(backend, CacheOptions{MaxEntries: 2, TTL: time.Minute})
+	cr := repo.(*cachingRepo)
+	now := time.Now()
+	cr.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		repo.CreateReview(ctx, Review{Author: "a", Body: "review"})
+	}
+	repo.CreateComment(ctx, 0, Comment{Author: "b", Body: "first"})
+
+	r, _ := repo.ReadReview(ctx, 0)
+	repo.ReadReview(ctx, 0)
+	comments, _ := repo.ReadComments(ctx, 0)
+	c, err := repo.ReadComment(ctx, 0, 0)
+	if backend.reads != 1 {
+		t.Errorf("Expected one read from the backend, got %d", backend.reads)
+	}
+	if len(r.Comments) != 1 || len(comments) != 1 || c.Body != "first" || err != nil {
+		t.Errorf("Unexpected reads %v, %v and %v (%v)", r, comments, c, err)
+	}
+	if _, err := repo.ReadComment(ctx, 0, 7); err != CommentNotFound {
+		t.Errorf("Expected CommentNotFound, got %v", err)
+	}
+	if _, err := repo.ReadReview(ctx, 9); err != ReviewNotFound {
+		t.Errorf("Expected ReviewNotFound, got %v", err)
+	}
+
+	// Changing what was read doesn't change the cache
+	r.Comments[0].Body = "changed"
+	comments[0].Body = "changed"
+	if r, _ := repo.ReadReview(ctx, 0); r.Comments[0].Body != "first" {
+		t.Errorf("Expected the cached review to be untouched, got %v", r)
+	}
+
+	// Writes go through and drop the review
+	repo.CreateComment(ctx, 0, Comment{Author: "b", Body: "second"})
+	if comments, _ := repo.ReadComments(ctx, 0); len(comments) != 2 {
+		t.Errorf("Expected the new comment, got %v", comments)
+	}
+	repo.UpdateReview(ctx, 0, Review{Author: "a", Body: "updated"})
+	if r, _ := repo.ReadReview(ctx, 0); r.Body != "updated" {
+		t.Errorf("Expected the update, got %v", r)
+	}
+	repo.DeleteReview(ctx, 0)
+	if _, err := repo.ReadReview(ctx, 0); err != ReviewNotFound {
+		t.Errorf("Expected the review to be gone, got %v", err)
+	}
+
+	// Least recently used out
+	backend.reads = 0
+	repo.ReadReview(ctx, 1)
+	repo.ReadReview(ctx, 2)
+	repo.ReadReview(ctx, 1)
+	if len(cr.entries) != 2 || backend.reads != 2 {
+		t.Errorf("Expected 2 entries after 2 reads, got %d after %d", len(cr.entries), backend.reads)
+	}
+	now = now.Add(30 * time.Second)
+	repo.CreateReview(ctx, Review{Author: "a", Body: "review"})
+	repo.ReadReview(ctx, 3)
+	repo.ReadReview(ctx, 1)
+	if backend.reads != 3 {
+		t.Errorf("Expected review 1 to still be cached, read %d times", backend.reads)
+	}
+	repo.ReadReview(ctx, 2)
+	if backend.reads != 4 {
+		t.Errorf("Expected review 2 to have been evicted, read %d times", backend.reads)
+	}
+
+	// Reviews expire
+	now = now.Add(45 * time.Second)
+	repo.ReadReview(ctx, 1)
+	repo.ReadReview(ctx, 2)
+	if backend.reads != 5 {
+		t.Errorf("Expected only review 1 to have expired, read %d times", backend.reads)
+	}
+}
+
+func TestRepoCacheBytes(t *testing.T) {
+	ctx := context.Background()
+	backend := Adapt(NewRAMRepo())
+	repo := Cache(backend, CacheOptions{MaxBytes: 200})
+	cr := repo.(*cachingRepo)
+
+	repo.CreateReview(ctx, Review{Author: "a", Body: string(make([]byte, 500))})
+	repo.CreateReview(ctx, Review{Author: "a", Body: string(make([]byte, 100))})
+	repo.CreateReview(ctx, Review{Author: "a", Body: string(make([]byte, 100))})
+	for id := 0; id < 3; id++ {
+		repo.ReadReview(ctx, id)
+	}
+	if _, ok := cr.entries[0]; ok {
+		t.Error("Expected a review bigger than the cache not to be kept")
+	}
+	if len(cr.entries) != 1 || cr.bytes > 200 {
+		t.Errorf("Expected a single review within the limit, got %d taking %d bytes", len(cr.entries), cr.bytes)
+	}
+}
+
+func TestRepoCacheStampede(t *testing.T) {
+	ctx := context.Background()
+	backend := &blockingRepo{ContextRepo: Adapt(NewRAMRepo()), release: make(chan struct{})}
+	backend.CreateReview(ctx, Review{Author: "a", Body: "popular"})
+	repo := Cache(backend, CacheOptions{MaxEntries: 10})
+	cr := repo.(*cachingRepo)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r, err := repo.ReadReview(ctx, 0); err != nil || r.Body != "popular" {
+				t.Errorf("Unexpected read %v (%v)", r, err)
+			}
+		}()
+	}
+	for {
+		cr.mtx.Lock()
+		_, started := cr.flights[0]
+		cr.mtx.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+	if backend.reads != 1 {
+		t.Errorf("Expected concurrent misses to share a read, got %d", backend.reads)
+	}
+
+	// Waiting on someone else's read stops when our context is done,
+	// and their giving up doesn't make us give up
+	backend.release = make(chan struct{})
+	repo.UpdateReview(ctx, 0, Review{Author: "a", Body: "updated"})
+	first, cancelFirst := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		_, err := repo.ReadReview(first, 0)
+		done <- err
+	}()
+	for atomic.LoadInt32(&backend.reads) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	second, cancelSecond := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelSecond()
+	if _, err := repo.ReadReview(second, 0); err != context.DeadlineExceeded {
+		t.Errorf("Expected the wait to time out, got %v", err)
+	}
+
+	third := make(chan Review)
+	go func() {
+		r, _ := repo.ReadReview(ctx, 0)
+		third <- r
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancelFirst()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected the first read to be canceled, got %v", err)
+	}
+	close(backend.release)
+	if r := <-third; r.Body != "updated" {
+		t.Errorf("Expected the third read to try again, got %v", r)
+	}
+}
+
+func TestRepoCacheBatch(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingRepo{ContextRepo: Adapt(NewRAMRepo())}
+	repo := Cache(backend, CacheOptions{MaxEntries: 10})
+	repo.CreateReview(ctx, Review{Author: "a", Body: "original"})
+	repo.ReadReview(ctx, 0)
+
+	failed := errors.New("failed")
+	err := repo.Batch(ctx, func(ctx context.Context, tx ContextRepo) error {
+		tx.UpdateReview(ctx, 0, Review{Author: "a", Body: "uncommitted"})
+		if r, _ := tx.ReadReview(ctx, 0); r.Body != "uncommitted" {
+			t.Errorf("Expected the batch to read its own write, got %v", r)
+		}
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("Expected the batch to fail, got %v", err)
+	}
+	if r, _ := repo.ReadReview(ctx, 0); r.Body != "original" {
+		t.Errorf("Expected the rolled back review, got %v", r)
+	}
+
+	repo.Batch(ctx, func(ctx context.Context, tx ContextRepo) error {
+		return tx.UpdateReview(ctx, 0, Review{Author: "a", Body: "committed"})
+	})
+	if r, _ := repo.ReadReview(ctx, 0); r.Body != "committed" {
+		t.Errorf("Expected the committed review, got %v", r)
+	}
+}
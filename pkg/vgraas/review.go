@@ -2,6 +2,7 @@ package vgraas
 
 // Review is a video game review
 type Review struct {
+	ID       int       `json:"id"`
 	Title    string    `json:"title"`
 	Body     string    `json:"body"`
 	Author   string    `json:"author"`
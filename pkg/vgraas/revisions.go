@@ -0,0 +1,484 @@
+package vgraas
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nsmith5/vgraas/pkg/middleware"
+)
+
+// Revision is a version of a review or comment. Comments don't have a
+// title. Revisions are numbered from 1, SavedBy is "" for anonymous
+// changes.
+type Revision struct {
+	Number  int       `json:"number"`
+	Title   string    `json:"title,omitempty"`
+	Body    string    `json:"body"`
+	Author  string    `json:"author"`
+	SavedAt time.Time `json:"savedAt"`
+	SavedBy string    `json:"savedBy"`
+}
+
+// revisionKey identifies a review, with a comment of -1, or a comment.
+type revisionKey struct {
+	review, comment int
+}
+
+// RevisionsConfig tunes the history. Zero values are replaced by the
+// defaults noted on each field.
+type RevisionsConfig struct {
+	// Max is how many of the latest revisions of each review and
+	// comment are kept (100)
+	Max int
+}
+
+func (c *RevisionsConfig) setDefaults() {
+	if c.Max <= 0 {
+		c.Max = 100
+	}
+}
+
+// Revisions keeps the latest versions of reviews and comments. Reviews
+// and comments that were around before it, imported ones for instance,
+// get their first revision when they are first changed or looked up.
+// The history of a review or comment goes when it is deleted, or purged
+// from the trash. It is kept in memory rather than in the repo, so it
+// is lost on restart, and replicas sharing a repo each only know the
+// changes made through them. See WithRevisions.
+type Revisions struct {
+	cfg RevisionsConfig
+	now func() time.Time
+
+	mtx     sync.Mutex
+	history map[revisionKey][]Revision
+}
+
+// NewRevisions returns an empty history.
+func NewRevisions(cfg RevisionsConfig) *Revisions {
+	cfg.setDefaults()
+	return &Revisions{
+		cfg:     cfg,
+		now:     time.Now,
+		history: make(map[revisionKey][]Revision),
+	}
+}
+
+// add appends rev to the history of k, dropping the oldest revision
+// past the maximum. Revision numbers carry on from the last one. A base
+// revision, the state of k before its first recorded change, is only
+// added if k has no history.
+func (rv *Revisions) add(k revisionKey, rev Revision, base bool) {
+	rv.mtx.Lock()
+	defer rv.mtx.Unlock()
+	revisions := rv.history[k]
+	if base && len(revisions) > 0 {
+		return
+	}
+	rev.Number = 1
+	if len(revisions) > 0 {
+		rev.Number = revisions[len(revisions)-1].Number + 1
+	}
+	rev.SavedAt = rv.now().UTC()
+	if len(revisions) >= rv.cfg.Max {
+		revisions = append(revisions[:0], revisions[len(revisions)-rv.cfg.Max+1:]...)
+	}
+	rv.history[k] = append(revisions, rev)
+}
+
+// forget drops the history of a review and its comments, or of a
+// comment if commentID isn't nil.
+func (rv *Revisions) forget(reviewID int, commentID *int) {
+	rv.mtx.Lock()
+	defer rv.mtx.Unlock()
+	if commentID != nil {
+		delete(rv.history, revisionKey{reviewID, *commentID})
+		return
+	}
+	for k := range rv.history {
+		if k.review == reviewID {
+			delete(rv.history, k)
+		}
+	}
+}
+
+// purged drops the history of d once it is purged from the trash.
+func (rv *Revisions) purged(d Deleted) {
+	rv.forget(d.ReviewID, d.CommentID)
+}
+
+func (rv *Revisions) has(k revisionKey) bool {
+	rv.mtx.Lock()
+	defer rv.mtx.Unlock()
+	return len(rv.history[k]) > 0
+}
+
+func (rv *Revisions) list(k revisionKey) []Revision {
+	rv.mtx.Lock()
+	defer rv.mtx.Unlock()
+	return append([]Revision{}, rv.history[k]...)
+}
+
+// Wrap returns a ContextRepo that records a revision for every review
+// and comment created, updated or put in r, along with the user that
+// made the change, and drops the history of those deleted. Changes made
+// in a batch are only recorded once the batch succeeds.
+func (rv *Revisions) Wrap(r ContextRepo) ContextRepo {
+	return revisionsRepo{r, rv, rv.add, rv.forget}
+}
+
+// wrapTrashed is Wrap for a repo that moves deletes to t. The history
+// of deleted reviews and comments is kept, for when they are restored,
+// until they are purged from t.
+func (rv *Revisions) wrapTrashed(r ContextRepo, t *Trash) ContextRepo {
+	t.onPurge(rv.purged)
+	return revisionsRepo{r, rv, rv.add, func(int, *int) {}}
+}
+
+type revisionsRepo struct {
+	ContextRepo
+	rv     *Revisions
+	add    func(k revisionKey, rev Revision, base bool)
+	forget func(reviewID int, commentID *int)
+}
+
+func reviewRevision(ctx context.Context, r Review) Revision {
+	return Revision{Title: r.Title, Body: r.Body, Author: r.Author, SavedBy: middleware.ContextUser(ctx)}
+}
+
+func commentRevision(ctx context.Context, c Comment) Revision {
+	return Revision{Body: c.Body, Author: c.Author, SavedBy: middleware.ContextUser(ctx)}
+}
+
+// base records the state of k before it is changed if k has no history
+// yet.
+func (rr revisionsRepo) base(ctx context.Context, k revisionKey) {
+	if rr.rv.has(k) {
+		return
+	}
+	if k.comment < 0 {
+		if review, err := rr.ContextRepo.ReadReview(ctx, k.review); err == nil {
+			rev := reviewRevision(ctx, review)
+			rev.SavedBy = ""
+			rr.add(k, rev, true)
+		}
+		return
+	}
+	if comment, err := rr.ContextRepo.ReadComment(ctx, k.review, k.comment); err == nil {
+		rev := commentRevision(ctx, comment)
+		rev.SavedBy = ""
+		rr.add(k, rev, true)
+	}
+}
+
+func (rr revisionsRepo) CreateReview(ctx context.Context, r Review) (int, error) {
+	id, err := rr.ContextRepo.CreateReview(ctx, r)
+	if err == nil {
+		rr.add(revisionKey{id, -1}, reviewRevision(ctx, r), false)
+	}
+	return id, err
+}
+
+func (rr revisionsRepo) UpdateReview(ctx context.Context, id int, r Review) error {
+	rr.base(ctx, revisionKey{id, -1})
+	err := rr.ContextRepo.UpdateReview(ctx, id, r)
+	if err == nil {
+		rr.add(revisionKey{id, -1}, reviewRevision(ctx, r), false)
+	}
+	return err
+}
+
+func (rr revisionsRepo) PutReview(ctx context.Context, id int, r Review) error {
+	err := rr.ContextRepo.PutReview(ctx, id, r)
+	if err == nil {
+		rr.add(revisionKey{id, -1}, reviewRevision(ctx, r), false)
+	}
+	return err
+}
+
+func (rr revisionsRepo) CreateComment(ctx context.Context, reviewID int, c Comment) (int, error) {
+	id, err := rr.ContextRepo.CreateComment(ctx, reviewID, c)
+	if err == nil {
+		rr.add(revisionKey{reviewID, id}, commentRevision(ctx, c), false)
+	}
+	return id, err
+}
+
+func (rr revisionsRepo) UpdateComment(ctx context.Context, reviewID, id int, c Comment) error {
+	rr.base(ctx, revisionKey{reviewID, id})
+	err := rr.ContextRepo.UpdateComment(ctx, reviewID, id, c)
+	if err == nil {
+		rr.add(revisionKey{reviewID, id}, commentRevision(ctx, c), false)
+	}
+	return err
+}
+
+func (rr revisionsRepo) PutComment(ctx context.Context, reviewID, id int, c Comment) error {
+	err := rr.ContextRepo.PutComment(ctx, reviewID, id, c)
+	if err == nil {
+		rr.add(revisionKey{reviewID, id}, commentRevision(ctx, c), false)
+	}
+	return err
+}
+
+func (rr revisionsRepo) DeleteReview(ctx context.Context, id int) error {
+	err := rr.ContextRepo.DeleteReview(ctx, id)
+	if err == nil {
+		rr.forget(id, nil)
+	}
+	return err
+}
+
+func (rr revisionsRepo) DeleteComment(ctx context.Context, reviewID, id int) error {
+	err := rr.ContextRepo.DeleteComment(ctx, reviewID, id)
+	if err == nil {
+		rr.forget(reviewID, &id)
+	}
+	return err
+}
+
+func (rr revisionsRepo) Batch(ctx context.Context, fn func(ctx context.Context, tx ContextRepo) error) error {
+	var pending []func()
+	err := rr.ContextRepo.Batch(ctx, func(ctx context.Context, tx ContextRepo) error {
+		pending = pending[:0]
+		return fn(ctx, revisionsRepo{tx, rr.rv, func(k revisionKey, rev Revision, base bool) {
+			pending = append(pending, func() { rr.add(k, rev, base) })
+		}, func(reviewID int, commentID *int) {
+			pending = append(pending, func() { rr.forget(reviewID, commentID) })
+		}})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pending {
+		p()
+	}
+	return nil
+}
+
+// WithRevisions records every version of reviews and comments in rv and
+// enables the endpoints for looking through them, comparing them and
+// reverting to them.
+func WithRevisions(rv *Revisions) Option {
+	return func(a *API) {
+		a.revisions = rv
+	}
+}
+
+// revisionTarget returns the review, or comment, the revisions asked
+// for by r are about and the revision number in the path, if any.
+func revisionTarget(r *http.Request) (k revisionKey, n int, err error) {
+	vars := mux.Vars(r)
+	k.comment = -1
+	if rid, ok := vars["rid"]; ok {
+		if _, err = fmt.Sscanf(rid, "%d", &k.review); err != nil {
+			return
+		}
+		if _, err = fmt.Sscanf(vars["id"], "%d", &k.comment); err != nil {
+			return
+		}
+	} else if _, err = fmt.Sscanf(vars["id"], "%d", &k.review); err != nil {
+		return
+	}
+	if s, ok := vars["n"]; ok {
+		_, err = fmt.Sscanf(s, "%d", &n)
+	}
+	return
+}
+
+// history returns the revisions of k, which must still exist. Its
+// current state becomes the first revision if it has no history yet.
+func (a API) history(ctx context.Context, k revisionKey) ([]Revision, error) {
+	var current Revision
+	if k.comment < 0 {
+		review, err := a.ContextRepo.ReadReview(ctx, k.review)
+		if err != nil {
+			return nil, err
+		}
+		current = Revision{Title: review.Title, Body: review.Body, Author: review.Author}
+	} else {
+		comment, err := a.ContextRepo.ReadComment(ctx, k.review, k.comment)
+		if err != nil {
+			return nil, err
+		}
+		current = Revision{Body: comment.Body, Author: comment.Author}
+	}
+
+	a.revisions.add(k, current, true)
+	return a.revisions.list(k), nil
+}
+
+// revision looks up revision n in revisions, answering 404 Not Found if
+// there is no such revision or it has been dropped. revisions can be
+// empty if the history was dropped by a delete after it was read.
+func revision(w http.ResponseWriter, r *http.Request, revisions []Revision, n int) (Revision, bool) {
+	if len(revisions) == 0 {
+		HandleError(w, r, http.StatusNotFound, fmt.Sprintf("Revision %d not found, there are none", n))
+		return Revision{}, false
+	}
+	first, last := revisions[0].Number, revisions[len(revisions)-1].Number
+	if n < first || n > last {
+		HandleError(w, r, http.StatusNotFound, fmt.Sprintf("Revision %d not found, there are revisions %d to %d", n, first, last))
+		return Revision{}, false
+	}
+	return revisions[n-first], true
+}
+
+// handleHistoryError reports errors looking up the history of a review
+// or comment.
+func handleHistoryError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case ReviewNotFound, CommentNotFound:
+		HandleError(w, r, http.StatusBadRequest, err.Error())
+	default:
+		handleRepoError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+// ReadRevisions implements GET /reviews/{id}/revisions and
+// GET /reviews/{rid}/comments/{id}/revisions
+func (a API) ReadRevisions(w http.ResponseWriter, r *http.Request) {
+	k, _, err := revisionTarget(r)
+	if err != nil {
+		HandleError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	revisions, err := a.history(ctx, k)
+	if err != nil {
+		handleHistoryError(w, r, err)
+		return
+	}
+	respond(w, r, http.StatusOK, revisions)
+}
+
+// ReadRevision implements GET /reviews/{id}/revisions/{n} and
+// GET /reviews/{rid}/comments/{id}/revisions/{n}
+func (a API) ReadRevision(w http.ResponseWriter, r *http.Request) {
+	k, n, err := revisionTarget(r)
+	if err != nil {
+		HandleError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	revisions, err := a.history(ctx, k)
+	if err != nil {
+		handleHistoryError(w, r, err)
+		return
+	}
+	if rev, ok := revision(w, r, revisions, n); ok {
+		respond(w, r, http.StatusOK, rev)
+	}
+}
+
+// DiffRevisions implements GET /reviews/{id}/revisions/{n}/diff and
+// GET /reviews/{rid}/comments/{id}/revisions/{n}/diff
+//
+// The diff is from the revision in ?from, the one before n by default,
+// to n. From revision 0, the diff is from nothing.
+func (a API) DiffRevisions(w http.ResponseWriter, r *http.Request) {
+	k, n, err := revisionTarget(r)
+	if err != nil {
+		HandleError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	from := n - 1
+	if s := r.URL.Query().Get("from"); s != "" {
+		if from, err = strconv.Atoi(s); err != nil {
+			HandleError(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid revision '%s' in ?from", s))
+			return
+		}
+	}
+
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	revisions, err := a.history(ctx, k)
+	if err != nil {
+		handleHistoryError(w, r, err)
+		return
+	}
+	to, ok := revision(w, r, revisions, n)
+	if !ok {
+		return
+	}
+	var old Revision
+	if from != 0 {
+		if old, ok = revision(w, r, revisions, from); !ok {
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "--- revision %d\n+++ revision %d\n", old.Number, to.Number)
+	fields := []struct {
+		name     string
+		old, new string
+	}{
+		{"title", old.Title, to.Title},
+		{"author", old.Author, to.Author},
+		{"body", old.Body, to.Body},
+	}
+	for _, f := range fields {
+		if f.old == f.new {
+			continue
+		}
+		fmt.Fprintf(w, "@@ %s @@\n", f.name)
+		diffLines(w, f.old, f.new)
+	}
+}
+
+// RevertRevision implements POST /reviews/{id}/revisions/{n}/revert and
+// POST /reviews/{rid}/comments/{id}/revisions/{n}/revert
+//
+// Reverting saves revision n again as the latest revision, which is
+// returned.
+func (a API) RevertRevision(w http.ResponseWriter, r *http.Request) {
+	k, n, err := revisionTarget(r)
+	if err != nil {
+		HandleError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	revisions, err := a.history(ctx, k)
+	if err != nil {
+		handleHistoryError(w, r, err)
+		return
+	}
+	rev, ok := revision(w, r, revisions, n)
+	if !ok {
+		return
+	}
+
+	if k.comment < 0 {
+		err = a.ContextRepo.UpdateReview(ctx, k.review, Review{Title: rev.Title, Body: rev.Body, Author: rev.Author})
+	} else {
+		err = a.ContextRepo.UpdateComment(ctx, k.review, k.comment, Comment{Body: rev.Body, Author: rev.Author})
+	}
+	if err != nil {
+		handleHistoryError(w, r, err)
+		return
+	}
+
+	revisions = a.revisions.list(k)
+	if len(revisions) == 0 {
+		// Deleted right after the revert
+		HandleError(w, r, http.StatusNotFound, "The revision was dropped along with its history")
+		return
+	}
+	respond(w, r, http.StatusOK, revisions[len(revisions)-1])
+}
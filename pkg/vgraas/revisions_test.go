@@ -0,0 +1,196 @@
+package vgraas
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsmith5/vgraas/pkg/middleware"
+)
+
+func TestRevisions(t *testing.T) {
+	repo := Adapt(NewRAMRepo())
+	// Around before the history, its first revision is taken later
+	repo.CreateReview(context.Background(), Review{Author: "a", Body: "old"})
+	api := NewAPI(repo, WithRevisions(NewRevisions(RevisionsConfig{})))
+
+	do := func(method, path, user, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if user != "" {
+			req = middleware.WithUser(req, user)
+		}
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		return rr
+	}
+	revisions := func(path string) []Revision {
+		var revs []Revision
+		json.NewDecoder(do("GET", path, "", "").Body).Decode(&revs)
+		return revs
+	}
+
+	do("POST", "/reviews/", "alice", `{"title":"Doom","author":"a","body":"one\ntwo\nthree"}`)
+	do("PUT", "/reviews/1", "bob", `{"title":"Doom","author":"a","body":"one\n2\nthree\nfour"}`)
+	do("PUT", "/reviews/1", "alice", `{"title":"Doom II","author":"a","body":"one\n2\nthree\nfour"}`)
+
+	revs := revisions("/reviews/1/revisions")
+	if len(revs) != 3 {
+		t.Fatalf("Expected 3 revisions, got %v", revs)
+	}
+	if revs[0].Number != 1 || revs[0].SavedBy != "alice" || revs[1].SavedBy != "bob" || revs[2].Title != "Doom II" {
+		t.Errorf("Unexpected revisions %+v", revs)
+	}
+
+	var rev Revision
+	json.NewDecoder(do("GET", "/reviews/1/revisions/2", "", "").Body).Decode(&rev)
+	if rev.Number != 2 || rev.Body != "one\n2\nthree\nfour" {
+		t.Errorf("Unexpected revision %+v", rev)
+	}
+	if rr := do("GET", "/reviews/1/revisions/4", "", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing revision, got %d", rr.Code)
+	}
+	if rr := do("GET", "/reviews/7/revisions", "", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a missing review, got %d", rr.Code)
+	}
+
+	rr := do("GET", "/reviews/1/revisions/3/diff?from=1", "", "")
+	want := "--- revision 1\n+++ revision 3\n@@ title @@\n-Doom\n+Doom II\n@@ body @@\n one\n-two\n+2\n three\n+four\n"
+	if rr.Body.String() != want || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Unexpected diff %s:\n%s", rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+	if rr := do("GET", "/reviews/1/revisions/3/diff", "", ""); !strings.Contains(rr.Body.String(), "--- revision 2\n") || strings.Contains(rr.Body.String(), "body") {
+		t.Errorf("Expected a diff from the previous revision, got\n%s", rr.Body.String())
+	}
+
+	// Reverting saves an old revision as a new one
+	rr = do("POST", "/reviews/1/revisions/1/revert", "carol", "")
+	json.NewDecoder(rr.Body).Decode(&rev)
+	if rev.Number != 4 || rev.Body != "one\ntwo\nthree" || rev.SavedBy != "carol" {
+		t.Errorf("Unexpected revision after revert %d %+v", rr.Code, rev)
+	}
+	if review, _ := repo.ReadReview(context.Background(), 1); review.Title != "Doom" || review.Body != "one\ntwo\nthree" {
+		t.Errorf("Expected the review to be reverted, got %v", review)
+	}
+
+	// Reviews from before get their current state as a first revision
+	if revs := revisions("/reviews/0/revisions"); len(revs) != 1 || revs[0].Body != "old" {
+		t.Errorf("Expected the current state as the first revision, got %v", revs)
+	}
+	do("PUT", "/reviews/0", "", `{"author":"a","body":"new"}`)
+	if revs := revisions("/reviews/0/revisions"); len(revs) != 2 || revs[0].Body != "old" {
+		t.Errorf("Expected both versions, got %v", revs)
+	}
+
+	// Comments too
+	do("POST", "/reviews/1/comments", "dave", `{"author":"d","body":"nice"}`)
+	do("PUT", "/reviews/1/comments/0", "dave", `{"author":"d","body":"very nice"}`)
+	if revs := revisions("/reviews/1/comments/0/revisions"); len(revs) != 2 || revs[1].Body != "very nice" || revs[1].Title != "" {
+		t.Errorf("Unexpected comment revisions %v", revs)
+	}
+	do("POST", "/reviews/1/comments/0/revisions/1/revert", "", "")
+	if c, _ := repo.ReadComment(context.Background(), 1, 0); c.Body != "nice" {
+		t.Errorf("Expected the comment to be reverted, got %v", c)
+	}
+	if revs := revisions("/reviews/1/revisions"); len(revs) != 4 {
+		t.Errorf("Expected comments not to add review revisions, got %d", len(revs))
+	}
+
+	// Nothing is recorded for batches that are rolled back
+	do("POST", "/batch", "", `{"atomic":true,"operations":[{"method":"PUT","path":"/reviews/1","body":{"author":"a","body":"gone"}},{"method":"DELETE","path":"/reviews/9"}]}`)
+	if revs := revisions("/reviews/1/revisions"); len(revs) != 4 {
+		t.Errorf("Expected the rolled back update to be left out, got %d revisions", len(revs))
+	}
+}
+
+func TestRevisionsLimits(t *testing.T) {
+	repo := Adapt(NewRAMRepo())
+	revisions := NewRevisions(RevisionsConfig{Max: 3})
+	trash := NewTrash(repo, TrashConfig{Retention: time.Hour})
+	defer trash.Close()
+	now := time.Now()
+	trash.now = func() time.Time { return now }
+	api := NewAPI(repo, WithRevisions(revisions), WithTrash(trash), WithAdmins("root"))
+	plain := NewAPI(repo, WithRevisions(revisions))
+
+	do := func(api http.Handler, method, path, body string) *httptest.ResponseRecorder {
+		req := middleware.WithUser(httptest.NewRequest(method, path, strings.NewReader(body)), "root")
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Only the latest revisions are kept, still numbered from the first
+	do(api, "POST", "/reviews/", `{"author":"a","body":"1"}`)
+	for i := 2; i <= 5; i++ {
+		do(api, "PUT", "/reviews/0", fmt.Sprintf(`{"author":"a","body":"%d"}`, i))
+	}
+	var revs []Revision
+	json.NewDecoder(do(api, "GET", "/reviews/0/revisions", "").Body).Decode(&revs)
+	if len(revs) != 3 || revs[0].Number != 3 || revs[0].Body != "3" || revs[2].Number != 5 {
+		t.Errorf("Expected revisions 3 to 5, got %+v", revs)
+	}
+	if rr := do(api, "GET", "/reviews/0/revisions/2", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a dropped revision, got %d", rr.Code)
+	}
+	var rev Revision
+	json.NewDecoder(do(api, "GET", "/reviews/0/revisions/4", "").Body).Decode(&rev)
+	if rev.Number != 4 || rev.Body != "4" {
+		t.Errorf("Unexpected revision %+v", rev)
+	}
+
+	// Histories of trashed reviews are kept until they are purged
+	do(api, "POST", "/reviews/0/comments", `{"author":"b","body":"hi"}`)
+	do(api, "DELETE", "/reviews/0", "")
+	if len(revisions.list(revisionKey{0, -1})) != 3 || len(revisions.list(revisionKey{0, 0})) != 1 {
+		t.Errorf("Expected the history of the trashed review to be kept")
+	}
+	do(api, "POST", "/reviews/0/restore", "")
+	do(api, "DELETE", "/reviews/0", "")
+	now = now.Add(2 * time.Hour)
+	trash.Purge(context.Background())
+	if len(revisions.list(revisionKey{0, -1})) != 0 || len(revisions.list(revisionKey{0, 0})) != 0 {
+		t.Errorf("Expected the history of the purged review and its comments to be dropped")
+	}
+
+	// Without a trash histories go with the delete
+	do(plain, "POST", "/reviews/", `{"author":"a","body":"x"}`)
+	do(plain, "POST", "/reviews/1/comments", `{"author":"b","body":"hi"}`)
+	do(plain, "DELETE", "/reviews/1/comments/0", "")
+	if len(revisions.list(revisionKey{1, 0})) != 0 || len(revisions.list(revisionKey{1, -1})) != 1 {
+		t.Errorf("Expected only the history of the deleted comment to be dropped")
+	}
+}
+
+func TestRevisionDropped(t *testing.T) {
+	// The history can go between being read and being looked in
+	rr := httptest.NewRecorder()
+	if _, ok := revision(rr, httptest.NewRequest("GET", "/reviews/0/revisions/1", nil), nil, 1); ok || rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an empty history, got %d", rr.Code)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a, b, want string
+	}{
+		{"same", "same", " same\n"},
+		{"", "new", "-\n+new\n"},
+		{"a\nb\nc", "a\nc", " a\n-b\n c\n"},
+		{"a\nb\nc\nd", "x\nb\ny\nd", "-a\n+x\n b\n-c\n+y\n d\n"},
+		// Too long to compare, shown as replaced
+		{strings.Repeat("a\n", 300) + "a", strings.Repeat("b\n", 300) + "b", strings.Repeat("-a\n", 301) + strings.Repeat("+b\n", 301)},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		diffLines(&buf, test.a, test.b)
+		if buf.String() != test.want {
+			t.Errorf("diff %q %q: expected\n%s\ngot\n%s", test.a, test.b, test.want, buf.String())
+		}
+	}
+}
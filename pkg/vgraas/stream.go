@@ -0,0 +1,122 @@
+package vgraas
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// streamBuffer is the number of live events buffered per stream, on
+	// top of room for a full history replay. A client that falls further
+	// behind than this is disconnected and can resume with Last-Event-ID.
+	streamBuffer = 256
+
+	// streamKeepAlive is how often an idle stream sends a comment to
+	// keep proxies from timing out the connection.
+	streamKeepAlive = 15 * time.Second
+)
+
+// Events implements GET /events
+//
+// Changes to reviews and comments are streamed as Server-Sent Events.
+// Each event has the event type as its name, the bus event ID as its id
+// and the JSON encoded Event as its data. Clients reconnecting with a
+// Last-Event-ID header (or lastEventId query parameter) are sent the
+// events they missed, as far as the bus history goes back. One or more
+// 'review' query parameters restrict the stream to those reviews.
+func (a API) Events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		HandleError(w, r, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+
+	reviews := make(map[int]bool)
+	for _, v := range r.URL.Query()["review"] {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			HandleError(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid review id '%s'", v))
+			return
+		}
+		reviews[id] = true
+	}
+
+	lastID := int64(-1)
+	resume := r.Header.Get("Last-Event-ID")
+	if resume == "" {
+		resume = r.URL.Query().Get("lastEventId")
+	}
+	if resume != "" {
+		id, err := strconv.ParseInt(resume, 10, 64)
+		if err != nil || id < 0 {
+			HandleError(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid event id '%s'", resume))
+			return
+		}
+		lastID = id
+	}
+
+	events := make(chan Event, streamBuffer+a.bus.size)
+	overflow := make(chan struct{})
+	cancel, complete := a.bus.SubscribeFrom(lastID, func(e Event) {
+		if len(reviews) > 0 && !reviews[e.ReviewID] {
+			return
+		}
+		select {
+		case events <- e:
+		default:
+			// Too slow to keep up. Closing overflow is done at most
+			// once since the subscription is cancelled right after.
+			select {
+			case <-overflow:
+			default:
+				close(overflow)
+			}
+		}
+	})
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Tell clients how long to wait before reconnecting and whether
+	// they missed events that are no longer available
+	fmt.Fprintf(w, "retry: %d\n\n", 3000)
+	if !complete {
+		fmt.Fprintf(w, "event: reset\ndata: {}\n\n")
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-a.bus.Done():
+			return
+		case <-overflow:
+			return
+		case <-ticker.C:
+			if _, err := fmt.Fprintf(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case e := <-events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
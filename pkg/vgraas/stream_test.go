@@ -0,0 +1,145 @@
+package vgraas
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvents reads n events from an SSE stream
+func readEvents(t *testing.T, resp *http.Response, n int) []Event {
+	var events []Event
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() && len(events) < n {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") || line == "data: {}" {
+				continue
+			}
+			var e Event
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+				t.Error(err)
+				return
+			}
+			events = append(events, e)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		resp.Body.Close()
+		<-done
+		t.Fatalf("Timed out reading events, got %d of %d", len(events), n)
+	}
+	return events
+}
+
+func TestEventStream(t *testing.T) {
+	repo := NewRAMRepo()
+	bus := NewBus()
+	srv := httptest.NewServer(NewAPI(Adapt(repo), WithBus(bus)))
+	defer srv.Close()
+
+	post := func(path, body string) {
+		resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// Two reviews, only the second is watched
+	post("/reviews/", `{"title": "zero"}`)
+	post("/reviews/", `{"title": "one"}`)
+
+	resp, err := http.Get(srv.URL + "/events?review=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Unexpected content type %s", ct)
+	}
+
+	post("/reviews/0/comments", `{"body": "ignored"}`)
+	post("/reviews/1/comments", `{"body": "watched"}`)
+	req, _ := http.NewRequest("DELETE", srv.URL+"/reviews/1/comments/0", nil)
+	http.DefaultClient.Do(req)
+
+	events := readEvents(t, resp, 2)
+	if events[0].Type != CommentCreated || events[0].Comment.Body != "watched" {
+		t.Errorf("Unexpected first event %+v", events[0])
+	}
+	if events[1].Type != CommentDeleted || events[1].ID <= events[0].ID {
+		t.Errorf("Unexpected second event %+v", events[1])
+	}
+
+	// Resume from the first event, expecting the rest of the history
+	req, _ = http.NewRequest("GET", srv.URL+"/events", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resumed, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Body.Close()
+
+	events = readEvents(t, resumed, 4)
+	for i, e := range events {
+		if e.ID != int64(i+2) {
+			t.Errorf("Expected replayed event %d to have id %d, got %d", i, i+2, e.ID)
+		}
+	}
+}
+
+func TestBusHistory(t *testing.T) {
+	bus := NewBusWithHistory(2)
+	for i := 0; i < 3; i++ {
+		bus.Publish(Event{Type: ReviewCreated})
+	}
+
+	var replayed []int64
+	cancel, complete := bus.SubscribeFrom(0, func(e Event) {
+		replayed = append(replayed, e.ID)
+	})
+	defer cancel()
+
+	if complete {
+		t.Error("Replay from an evicted event should be incomplete")
+	}
+	if len(replayed) != 2 || replayed[0] != 2 || replayed[1] != 3 {
+		t.Errorf("Unexpected replay %v", replayed)
+	}
+}
+
+func TestEventStreamShutdown(t *testing.T) {
+	bus := NewBus()
+	srv := httptest.NewServer(NewAPI(Adapt(NewRAMRepo()), WithBus(bus)))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	bus.Close()
+
+	done := make(chan struct{})
+	go func() {
+		ioutil.ReadAll(resp.Body)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Event stream stayed open after the bus was closed")
+	}
+}
@@ -0,0 +1,159 @@
+package vgraas
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/nsmith5/vgraas/pkg/tracing"
+)
+
+// Trace returns a ContextRepo that records a span for every operation
+// on r, as a child of the span in the context of the operation.
+func Trace(r ContextRepo) ContextRepo {
+	return tracedRepo{r}
+}
+
+type tracedRepo struct {
+	ContextRepo
+}
+
+// startSpan starts a span for op, tagged with the ids it works on.
+func startSpan(ctx context.Context, op string, ids ...int) (context.Context, *tracing.Span) {
+	ctx, span := tracing.Start(ctx, "repo."+op)
+	if len(ids) > 0 {
+		span.SetAttribute("vgraas.review_id", ids[0])
+	}
+	if len(ids) > 1 {
+		span.SetAttribute("vgraas.comment_id", ids[1])
+	}
+	return ctx, span
+}
+
+// finish ends span, recording err if there was one.
+func finish(span *tracing.Span, err error) {
+	span.SetError(err)
+	span.End()
+}
+
+func (tr tracedRepo) ReadReviews(ctx context.Context) (reviews []Review, err error) {
+	ctx, span := startSpan(ctx, "ReadReviews")
+	defer func() { finish(span, err) }()
+	return tr.ContextRepo.ReadReviews(ctx)
+}
+
+func (tr tracedRepo) CreateReview(ctx context.Context, r Review) (id int, err error) {
+	ctx, span := startSpan(ctx, "CreateReview")
+	defer func() { finish(span, err) }()
+	return tr.ContextRepo.CreateReview(ctx, r)
+}
+
+func (tr tracedRepo) ReadReview(ctx context.Context, id int) (r Review, err error) {
+	ctx, span := startSpan(ctx, "ReadReview", id)
+	defer func() { finish(span, err) }()
+	return tr.ContextRepo.ReadReview(ctx, id)
+}
+
+func (tr tracedRepo) UpdateReview(ctx context.Context, id int, r Review) (err error) {
+	ctx, span := startSpan(ctx, "UpdateReview", id)
+	defer func() { finish(span, err) }()
+	return tr.ContextRepo.UpdateReview(ctx, id, r)
+}
+
+func (tr tracedRepo) DeleteReview(ctx context.Context, id int) (err error) {
+	ctx, span := startSpan(ctx, "DeleteReview", id)
+	defer func() { finish(span, err) }()
+	return tr.ContextRepo.DeleteReview(ctx, id)
+}
+
+func (tr tracedRepo) ReadComments(ctx context.Context, reviewID int) (comments []Comment, err error) {
+	ctx, span := startSpan(ctx, "ReadComments", reviewID)
+	defer func() { finish(span, err) }()
+	return tr.ContextRepo.ReadComments(ctx, reviewID)
+}
+
+func (tr tracedRepo) CreateComment(ctx context.Context, reviewID int, c Comment) (id int, err error) {
+	ctx, span := startSpan(ctx, "CreateComment", reviewID)
+	defer func() { finish(span, err) }()
+	return tr.ContextRepo.CreateComment(ctx, reviewID, c)
+}
+
+func (tr tracedRepo) ReadComment(ctx context.Context, reviewID, id int) (c Comment, err error) {
+	ctx, span := startSpan(ctx, "ReadComment", reviewID, id)
+	defer func() { finish(span, err) }()
+	return tr.ContextRepo.ReadComment(ctx, reviewID, id)
+}
+
+func (tr tracedRepo) UpdateComment(ctx context.Context, reviewID, id int, c Comment) (err error) {
+	ctx, span := startSpan(ctx, "UpdateComment", reviewID, id)
+	defer func() { finish(span, err) }()
+	return tr.ContextRepo.UpdateComment(ctx, reviewID, id, c)
+}
+
+func (tr tracedRepo) DeleteComment(ctx context.Context, reviewID, id int) (err error) {
+	ctx, span := startSpan(ctx, "DeleteComment", reviewID, id)
+	defer func() { finish(span, err) }()
+	return tr.ContextRepo.DeleteComment(ctx, reviewID, id)
+}
+
+func (tr tracedRepo) PutReview(ctx context.Context, id int, r Review) (err error) {
+	ctx, span := startSpan(ctx, "PutReview", id)
+	defer func() { finish(span, err) }()
+	return tr.ContextRepo.PutReview(ctx, id, r)
+}
+
+func (tr tracedRepo) PutComment(ctx context.Context, reviewID, id int, c Comment) (err error) {
+	ctx, span := startSpan(ctx, "PutComment", reviewID, id)
+	defer func() { finish(span, err) }()
+	return tr.ContextRepo.PutComment(ctx, reviewID, id, c)
+}
+
+// Batch records a span for the whole batch, with the operations in it
+// as its children.
+func (tr tracedRepo) Batch(ctx context.Context, fn func(ctx context.Context, tx ContextRepo) error) (err error) {
+	ctx, span := startSpan(ctx, "Batch")
+	defer func() { finish(span, err) }()
+	return tr.ContextRepo.Batch(ctx, func(ctx context.Context, tx ContextRepo) error {
+		return fn(ctx, tracedRepo{tx})
+	})
+}
+
+func (tr tracedRepo) TrashReview(ctx context.Context, id int, at time.Time, by string) (err error) {
+	ctx, span := startSpan(ctx, "TrashReview", id)
+	defer func() { finish(span, err) }()
+	return trashRepo(tr.ContextRepo).TrashReview(ctx, id, at, by)
+}
+
+func (tr tracedRepo) TrashComment(ctx context.Context, reviewID, id int, at time.Time, by string) (err error) {
+	ctx, span := startSpan(ctx, "TrashComment", reviewID, id)
+	defer func() { finish(span, err) }()
+	return trashRepo(tr.ContextRepo).TrashComment(ctx, reviewID, id, at, by)
+}
+
+func (tr tracedRepo) ReadTrash(ctx context.Context) (items []Deleted, err error) {
+	ctx, span := startSpan(ctx, "ReadTrash")
+	defer func() { finish(span, err) }()
+	return trashRepo(tr.ContextRepo).ReadTrash(ctx)
+}
+
+func (tr tracedRepo) PurgeTrash(ctx context.Context, cutoff time.Time) (purged []Deleted, err error) {
+	ctx, span := startSpan(ctx, "PurgeTrash")
+	defer func() { finish(span, err) }()
+	return trashRepo(tr.ContextRepo).PurgeTrash(ctx, cutoff)
+}
+
+// Close closes the underlying Repo if it is an io.Closer.
+func (tr tracedRepo) Close() error {
+	if closer, ok := tr.ContextRepo.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Ping pings the underlying Repo if it is a Pinger.
+func (tr tracedRepo) Ping(ctx context.Context) error {
+	if p, ok := tr.ContextRepo.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
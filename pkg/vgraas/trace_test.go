@@ -0,0 +1,63 @@
+package vgraas
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/nsmith5/vgraas/pkg/middleware"
+	"github.com/nsmith5/vgraas/pkg/tracing"
+)
+
+type spanRecorder struct {
+	sync.Mutex
+	spans []tracing.SpanData
+}
+
+func (sr *spanRecorder) Export(s tracing.SpanData) {
+	sr.Lock()
+	defer sr.Unlock()
+	sr.spans = append(sr.spans, s)
+}
+
+func TestTracing(t *testing.T) {
+	repo := NewRAMRepo()
+	rid, _ := repo.CreateReview(Review{Title: "t", Body: "b", Author: "a"})
+
+	rec := &spanRecorder{}
+	api := middleware.Tracing(NewAPI(Trace(Adapt(repo))), tracing.NewTracer(rec))
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/reviews/%d?pretty=true&access_token=secret", rid), nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("Unexpected status %d", w.Code)
+	}
+
+	if len(rec.spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(rec.spans))
+	}
+	repoSpan, reqSpan := rec.spans[0], rec.spans[1]
+
+	if reqSpan.Name != "ReadReview" {
+		t.Errorf("Request span named '%s', expected the route name", reqSpan.Name)
+	}
+	if reqSpan.Context.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Error("Request span didn't join the caller's trace")
+	}
+	if reqSpan.Attributes["http.status_code"] != 200 || reqSpan.Attributes["http.target"] != fmt.Sprintf("/reviews/%d?pretty=true", rid) {
+		t.Errorf("Unexpected attributes %v", reqSpan.Attributes)
+	}
+
+	if repoSpan.Name != "repo.ReadReview" {
+		t.Errorf("Unexpected repo span '%s'", repoSpan.Name)
+	}
+	if repoSpan.Parent != reqSpan.Context.SpanID {
+		t.Error("Repo span isn't a child of the request span")
+	}
+	if repoSpan.Attributes["vgraas.review_id"] != rid {
+		t.Errorf("Unexpected attributes %v", repoSpan.Attributes)
+	}
+}
@@ -0,0 +1,264 @@
+package vgraas
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Import modes select what happens when a record can't be imported.
+const (
+	// ImportAtomic imports every record or none of them.
+	ImportAtomic = "atomic"
+
+	// ImportBestEffort imports every record it can and reports the
+	// ones that failed.
+	ImportBestEffort = "best-effort"
+)
+
+// Id handling for imported records.
+const (
+	// IDsRemap gives every imported review and comment a fresh id.
+	IDsRemap = "remap"
+
+	// IDsPreserve keeps the ids found in the import. Records whose id
+	// is already taken fail.
+	IDsPreserve = "preserve"
+)
+
+var errImportFailed = errors.New("Import failed, no records were imported")
+
+// ImportResult describes the fate of a single imported record.
+type ImportResult struct {
+	// Line is the position of the record in the import, starting at 1.
+	Line int `json:"line"`
+
+	// OldID is the id the record had in the import and ID the id it
+	// was stored under.
+	OldID int  `json:"oldId"`
+	ID    *int `json:"id,omitempty"`
+
+	Err string `json:"err,omitempty"`
+}
+
+// ImportReport is the response body of POST /admin/import.
+type ImportReport struct {
+	Mode       string         `json:"mode"`
+	IDs        string         `json:"ids"`
+	Imported   int            `json:"imported"`
+	Failed     int            `json:"failed"`
+	RolledBack bool           `json:"rolledBack"`
+	Results    []ImportResult `json:"results"`
+}
+
+// Import implements POST /admin/import
+//
+// The request body is newline delimited JSON with one review, comments
+// included, per line; the format written by Export. The 'mode' query
+// parameter is either "atomic" (default) or "best-effort" and 'ids' is
+// either "remap" (default) or "preserve".
+func (a API) Import(w http.ResponseWriter, r *http.Request) {
+	report := ImportReport{
+		Mode: r.URL.Query().Get("mode"),
+		IDs:  r.URL.Query().Get("ids"),
+	}
+	if report.Mode == "" {
+		report.Mode = ImportAtomic
+	}
+	if report.IDs == "" {
+		report.IDs = IDsRemap
+	}
+
+	switch {
+	case report.Mode != ImportAtomic && report.Mode != ImportBestEffort:
+		HandleError(w, r, http.StatusBadRequest, fmt.Sprintf("Unknown import mode '%s'", report.Mode))
+		return
+	case report.IDs != IDsRemap && report.IDs != IDsPreserve:
+		HandleError(w, r, http.StatusBadRequest, fmt.Sprintf("Unknown id handling '%s'", report.IDs))
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	status := http.StatusOK
+	switch report.Mode {
+	case ImportAtomic:
+		if !importAtomic(ctx, a.ContextRepo, dec, &report) {
+			report.Imported = 0
+			report.RolledBack = true
+			status = http.StatusBadRequest
+		}
+	case ImportBestEffort:
+		importRecords(ctx, a.ContextRepo, dec, &report)
+	}
+
+	respond(w, r, status, report)
+}
+
+// importAtomic reads and checks every record from dec before storing
+// them all in a single batch, recording the outcome in report. The
+// batch can lock the repo, the RAM repo holds its write lock, so it
+// isn't opened until the whole upload is in. It reports whether every
+// record was imported.
+func importAtomic(ctx context.Context, repo ContextRepo, dec *json.Decoder, report *ImportReport) bool {
+	var reviews []Review
+	for line := 1; ; line++ {
+		var review Review
+		err := dec.Decode(&review)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = checkRecord(review, report.IDs)
+		}
+		if err != nil {
+			report.Failed++
+			report.Results = append(report.Results, ImportResult{Line: line, OldID: review.ID, Err: err.Error()})
+			return false
+		}
+		reviews = append(reviews, review)
+	}
+
+	err := repo.Batch(ctx, func(ctx context.Context, tx ContextRepo) error {
+		report.Imported, report.Failed, report.Results = 0, 0, report.Results[:0]
+		for i, review := range reviews {
+			result := ImportResult{Line: i + 1, OldID: review.ID}
+			id, err := importRecord(ctx, tx, review, report.IDs)
+			if err != nil {
+				report.Failed++
+				result.Err = err.Error()
+				report.Results = append(report.Results, result)
+				return errImportFailed
+			}
+			report.Imported++
+			result.ID = &id
+			report.Results = append(report.Results, result)
+		}
+		return nil
+	})
+	return err == nil
+}
+
+// importRecords reads records from dec until it is exhausted, storing
+// them in repo one by one and recording the outcome in report.
+func importRecords(ctx context.Context, repo ContextRepo, dec *json.Decoder, report *ImportReport) {
+	for line := 1; ; line++ {
+		var review Review
+		err := dec.Decode(&review)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			// A malformed record leaves the decoder unable to find the
+			// next one, so this always ends the import.
+			report.Failed++
+			report.Results = append(report.Results, ImportResult{Line: line, Err: err.Error()})
+			return
+		}
+
+		result := ImportResult{Line: line, OldID: review.ID}
+		id, err := importAlone(ctx, repo, review, report.IDs)
+		if err != nil {
+			report.Failed++
+			result.Err = err.Error()
+		} else {
+			report.Imported++
+			result.ID = &id
+		}
+		report.Results = append(report.Results, result)
+	}
+}
+
+// importAlone stores a single review and its comments in repo outside
+// of any batch. A preserved id is checked and written in a batch of its
+// own so that a review created meanwhile isn't overwritten. Batches can
+// be costly, the RAM repo copies itself for one, so they are only used
+// where needed.
+func importAlone(ctx context.Context, repo ContextRepo, review Review, ids string) (id int, err error) {
+	if err := checkRecord(review, ids); err != nil {
+		return 0, err
+	}
+	if ids == IDsRemap {
+		return importRecord(ctx, repo, review, ids)
+	}
+	err = repo.Batch(ctx, func(ctx context.Context, tx ContextRepo) error {
+		id, err = importRecord(ctx, tx, review, ids)
+		return err
+	})
+	return id, err
+}
+
+// checkRecord checks the ids of a review to be imported, the ones that
+// can be checked without looking at the repo.
+func checkRecord(review Review, ids string) error {
+	if ids == IDsRemap {
+		return nil
+	}
+
+	if review.ID < 0 {
+		return fmt.Errorf("Invalid review id %d", review.ID)
+	}
+	seen := make(map[int]bool, len(review.Comments))
+	for _, c := range review.Comments {
+		if c.ID < 0 {
+			return fmt.Errorf("Invalid comment id %d", c.ID)
+		}
+		if seen[c.ID] {
+			return fmt.Errorf("Duplicate comment id %d", c.ID)
+		}
+		seen[c.ID] = true
+	}
+	return nil
+}
+
+// importRecord stores a single review and its comments, already
+// checked by checkRecord, in repo.
+func importRecord(ctx context.Context, repo ContextRepo, review Review, ids string) (int, error) {
+	if ids == IDsRemap {
+		return repo.CreateReview(ctx, review)
+	}
+
+	_, err := repo.ReadReview(ctx, review.ID)
+	switch {
+	case err == nil:
+		return 0, fmt.Errorf("Review %d already exists", review.ID)
+	case err != ReviewNotFound:
+		return 0, err
+	}
+	return review.ID, repo.PutReview(ctx, review.ID, review)
+}
+
+// Export implements GET /admin/export
+//
+// Every review, comments included, is streamed as newline delimited
+// JSON suitable for feeding back into Import.
+func (a API) Export(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	reviews, err := a.ContextRepo.ReadReviews(ctx)
+	if err != nil {
+		handleRepoError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for _, review := range reviews {
+		if err := enc.Encode(review); err != nil {
+			// Headers are already out, all we can do is stop.
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
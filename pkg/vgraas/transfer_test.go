@@ -0,0 +1,164 @@
+package vgraas
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nsmith5/vgraas/pkg/middleware"
+)
+
+func doImport(t *testing.T, api http.Handler, query, body string) (int, ImportReport) {
+	req, err := http.NewRequest("POST", "/admin/import"+query, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = middleware.WithUser(req, "admin")
+
+	rr := httptest.NewRecorder()
+	api.ServeHTTP(rr, req)
+
+	var report ImportReport
+	if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return rr.Code, report
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	src := NewRAMRepo()
+	for _, title := range []string{"a", "b", "c"} {
+		id, _ := src.CreateReview(Review{Title: title})
+		src.CreateComment(id, Comment{Body: "first"})
+		src.CreateComment(id, Comment{Body: "second"})
+	}
+	src.DeleteReview(1)
+	src.DeleteComment(2, 0)
+
+	req, err := http.NewRequest("GET", "/admin/export", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = middleware.WithUser(req, "admin")
+	rr := httptest.NewRecorder()
+	NewAPI(Adapt(src), WithAdmins("admin")).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Export failed with status %d", rr.Code)
+	}
+	if lines := strings.Count(rr.Body.String(), "\n"); lines != 2 {
+		t.Fatalf("Expected 2 exported records, got %d", lines)
+	}
+
+	dst := NewRAMRepo()
+	code, report := doImport(t, NewAPI(Adapt(dst), WithAdmins("admin")), "?ids=preserve", rr.Body.String())
+	if code != http.StatusOK || report.Imported != 2 || report.Failed != 0 {
+		t.Fatalf("Import failed: %d %+v", code, report)
+	}
+
+	want, _ := src.ReadReviews()
+	got, _ := dst.ReadReviews()
+	wantJSON, _ := json.Marshal(want)
+	gotJSON, _ := json.Marshal(got)
+	if string(wantJSON) != string(gotJSON) {
+		t.Errorf("Imported reviews differ from exported\nwant %s\ngot  %s", wantJSON, gotJSON)
+	}
+
+	// New records must not collide with preserved ids
+	id, _ := dst.CreateReview(Review{})
+	if id != 3 {
+		t.Errorf("Expected next review id 3, got %d", id)
+	}
+	cid, _ := dst.CreateComment(2, Comment{})
+	if cid != 2 {
+		t.Errorf("Expected next comment id 2, got %d", cid)
+	}
+}
+
+func TestImportModes(t *testing.T) {
+	body := `{"id": 4, "title": "ok"}
+{"id": 4, "title": "duplicate"}
+{"id": 9, "title": "also ok"}
+`
+	{
+		repo := NewRAMRepo()
+		code, report := doImport(t, NewAPI(Adapt(repo), WithAdmins("admin")), "?ids=preserve", body)
+		if code != http.StatusBadRequest || !report.RolledBack {
+			t.Errorf("Atomic import with a bad record should be rolled back: %d %+v", code, report)
+		}
+		if reviews, _ := repo.ReadReviews(); len(reviews) != 0 {
+			t.Errorf("Rolled back import left %d reviews behind", len(reviews))
+		}
+	}
+	{
+		repo := NewRAMRepo()
+		code, report := doImport(t, NewAPI(Adapt(repo), WithAdmins("admin")), "?ids=preserve&mode=best-effort", body)
+		if code != http.StatusOK || report.Imported != 2 || report.Failed != 1 {
+			t.Errorf("Unexpected best-effort result: %d %+v", code, report)
+		}
+		if report.Results[1].Err == "" || report.Results[1].Line != 2 {
+			t.Errorf("Expected line 2 to be reported as failed: %+v", report.Results)
+		}
+		if _, err := repo.ReadReview(9); err != nil {
+			t.Errorf("Preserved id not found: %v", err)
+		}
+	}
+	{
+		repo := NewRAMRepo()
+		code, report := doImport(t, NewAPI(Adapt(repo), WithAdmins("admin")), "", body)
+		if code != http.StatusOK || report.Imported != 3 {
+			t.Errorf("Unexpected remap result: %d %+v", code, report)
+		}
+		if *report.Results[2].ID != 2 || report.Results[2].OldID != 9 {
+			t.Errorf("Expected id 9 to be remapped to 2: %+v", report.Results[2])
+		}
+	}
+}
+
+// batchCounter counts the batches run against a Repo.
+type batchCounter struct {
+	Repo
+	batches int
+}
+
+func (bc *batchCounter) Batch(fn func(tx Repo) error) error {
+	bc.batches++
+	return bc.Repo.(Batcher).Batch(fn)
+}
+
+func TestImportBatches(t *testing.T) {
+	body := `{"id": 4, "title": "a"}
+{"id": 7, "title": "b"}
+{"id": 9, "title": "c"}
+`
+	tests := []struct {
+		query   string
+		batches int
+	}{
+		// The whole import is one batch, records aren't batched again
+		{"?ids=preserve", 1},
+		{"", 1},
+		// Preserved ids are checked and written in a batch each
+		{"?ids=preserve&mode=best-effort", 3},
+		{"?mode=best-effort", 0},
+	}
+	for _, test := range tests {
+		repo := &batchCounter{Repo: NewRAMRepo()}
+		code, report := doImport(t, NewAPI(Adapt(repo), WithAdmins("admin")), test.query, body)
+		if code != http.StatusOK || report.Imported != 3 {
+			t.Errorf("Import %s failed: %d %+v", test.query, code, report)
+		}
+		if repo.batches != test.batches {
+			t.Errorf("Expected %d batches for import %s, got %d", test.batches, test.query, repo.batches)
+		}
+	}
+	// Bad records are found before the batch is opened
+	for _, bad := range []string{`{"id": -1}`, `{"id": `} {
+		repo := &batchCounter{Repo: NewRAMRepo()}
+		code, report := doImport(t, NewAPI(Adapt(repo), WithAdmins("admin")), "?ids=preserve", body+bad)
+		if code != http.StatusBadRequest || report.Results[0].Line != 4 || repo.batches != 0 {
+			t.Errorf("Expected import of %s to fail on line 4 without a batch: %d %+v, %d batches", bad, code, report, repo.batches)
+		}
+	}
+}
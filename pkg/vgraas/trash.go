@@ -0,0 +1,345 @@
+package vgraas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nsmith5/vgraas/pkg/logging"
+	"github.com/nsmith5/vgraas/pkg/middleware"
+)
+
+// Errors using the trash.
+var (
+	NotInTrash = errors.New("Not in the trash")
+	IDTaken    = errors.New("The ID has been taken since, it can't be restored")
+	NoTrash    = errors.New("The repo can't keep deleted reviews and comments")
+)
+
+// Deleted is a review or comment in the trash, as it was when it was
+// deleted. CommentID and Comment are set for comments, Review for
+// reviews. DeletedBy is "" for anonymous deletes.
+type Deleted struct {
+	ReviewID  int       `json:"reviewId"`
+	CommentID *int      `json:"commentId,omitempty"`
+	Review    *Review   `json:"review,omitempty"`
+	Comment   *Comment  `json:"comment,omitempty"`
+	DeletedAt time.Time `json:"deletedAt"`
+	DeletedBy string    `json:"deletedBy"`
+}
+
+// TrashConfig tunes the trash. Zero values are replaced by the defaults
+// noted on each field.
+type TrashConfig struct {
+	// Retention is how long deleted reviews and comments are kept
+	// before they are purged for good (30 days)
+	Retention time.Duration
+
+	// PurgeInterval is how often the trash is checked for items past
+	// their retention (1h)
+	PurgeInterval time.Duration
+
+	// Logger reports purges (info level to stderr)
+	Logger *logging.Logger
+}
+
+func (c *TrashConfig) setDefaults() {
+	if c.Retention <= 0 {
+		c.Retention = 30 * 24 * time.Hour
+	}
+	if c.PurgeInterval <= 0 {
+		c.PurgeInterval = time.Hour
+	}
+	if c.Logger == nil {
+		c.Logger = logging.New(os.Stderr, logging.Info)
+	}
+}
+
+// Trash keeps deleted reviews and comments so that they can be restored
+// until they are purged. They are kept in the repo, which has to be a
+// TrashRepo, so they last as long as the rest of the data and every
+// replica sharing the repo sees the same trash. See WithTrash.
+type Trash struct {
+	cfg  TrashConfig
+	repo TrashRepo
+	now  func() time.Time
+
+	mtx    sync.Mutex
+	purged []func(Deleted)
+
+	quit      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewTrash returns the trash of r and starts purging it in the
+// background. Call Close to stop.
+func NewTrash(r ContextRepo, cfg TrashConfig) *Trash {
+	cfg.setDefaults()
+	t := &Trash{
+		cfg:  cfg,
+		repo: trashRepo(r),
+		now:  time.Now,
+		quit: make(chan struct{}),
+	}
+
+	t.wg.Add(1)
+	go t.purger()
+	return t
+}
+
+// trashRepo returns r as a TrashRepo, or one that fails with NoTrash if
+// r isn't one.
+func trashRepo(r ContextRepo) TrashRepo {
+	if t, ok := r.(TrashRepo); ok {
+		return t
+	}
+	return noTrash{}
+}
+
+type noTrash struct{}
+
+func (noTrash) TrashReview(context.Context, int, time.Time, string) error       { return NoTrash }
+func (noTrash) TrashComment(context.Context, int, int, time.Time, string) error { return NoTrash }
+func (noTrash) ReadTrash(context.Context) ([]Deleted, error)                    { return nil, NoTrash }
+func (noTrash) PurgeTrash(context.Context, time.Time) ([]Deleted, error)        { return nil, NoTrash }
+
+// Close stops purging.
+func (t *Trash) Close() {
+	t.closeOnce.Do(func() {
+		close(t.quit)
+		t.wg.Wait()
+	})
+}
+
+func (t *Trash) purger() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(t.cfg.PurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.quit:
+			return
+		case <-ticker.C:
+			n, err := t.Purge(context.Background())
+			if err != nil {
+				t.cfg.Logger.Error("Purging the trash failed", "err", err)
+			} else if n > 0 {
+				t.cfg.Logger.Info("Purged trash", "items", n)
+			}
+		}
+	}
+}
+
+// List returns what is in the trash, oldest deletion first.
+func (t *Trash) List(ctx context.Context) ([]Deleted, error) {
+	return t.repo.ReadTrash(ctx)
+}
+
+// Purge drops everything deleted longer than the retention ago and
+// returns how many items that was.
+func (t *Trash) Purge(ctx context.Context) (int, error) {
+	purged, err := t.repo.PurgeTrash(ctx, t.now().Add(-t.cfg.Retention))
+	if err != nil {
+		return 0, err
+	}
+
+	t.mtx.Lock()
+	hooks := t.purged
+	t.mtx.Unlock()
+	for _, d := range purged {
+		for _, hook := range hooks {
+			hook(d)
+		}
+	}
+	return len(purged), nil
+}
+
+// onPurge calls fn with every item purged from now on.
+func (t *Trash) onPurge(fn func(Deleted)) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.purged = append(t.purged, fn)
+}
+
+// find returns the latest deletion of a review, or of a comment if
+// commentID isn't nil, in the trash.
+func (t *Trash) find(ctx context.Context, reviewID int, commentID *int) (Deleted, error) {
+	items, err := t.repo.ReadTrash(ctx)
+	if err != nil {
+		return Deleted{}, err
+	}
+	for i := len(items) - 1; i >= 0; i-- {
+		d := items[i]
+		if d.ReviewID != reviewID || (d.CommentID == nil) != (commentID == nil) {
+			continue
+		}
+		if commentID != nil && *d.CommentID != *commentID {
+			continue
+		}
+		return d, nil
+	}
+	return Deleted{}, NotInTrash
+}
+
+// RestoreReview puts the review with id in the trash back into r, with
+// the comments it had when it was deleted, which takes it out of the
+// trash. r has to be backed by the repo of the trash. It fails with
+// IDTaken if the review has been put back since.
+func (t *Trash) RestoreReview(ctx context.Context, r ContextRepo, id int) (Review, error) {
+	d, err := t.find(ctx, id, nil)
+	if err != nil {
+		return Review{}, err
+	}
+
+	_, err = r.ReadReview(ctx, id)
+	switch {
+	case err == nil:
+		err = IDTaken
+	case err == ReviewNotFound:
+		err = r.PutReview(ctx, id, *d.Review)
+	}
+	if err != nil {
+		return Review{}, err
+	}
+	return *d.Review, nil
+}
+
+// RestoreComment puts the comment with id on review reviewID in the
+// trash back into r. The review has to exist, and the comment mustn't
+// have been put back since.
+func (t *Trash) RestoreComment(ctx context.Context, r ContextRepo, reviewID, id int) (Comment, error) {
+	d, err := t.find(ctx, reviewID, &id)
+	if err != nil {
+		return Comment{}, err
+	}
+
+	_, err = r.ReadComment(ctx, reviewID, id)
+	switch {
+	case err == nil:
+		err = IDTaken
+	case err == CommentNotFound:
+		err = r.PutComment(ctx, reviewID, id, *d.Comment)
+	}
+	if err != nil {
+		return Comment{}, err
+	}
+	return *d.Comment, nil
+}
+
+// Wrap returns a ContextRepo that moves reviews and comments deleted
+// from r to the trash, along with the user that deleted them. r has to
+// be a TrashRepo, deletes fail with NoTrash otherwise.
+func (t *Trash) Wrap(r ContextRepo) ContextRepo {
+	return trashingRepo{r, t.now}
+}
+
+type trashingRepo struct {
+	ContextRepo
+	now func() time.Time
+}
+
+func (tr trashingRepo) DeleteReview(ctx context.Context, id int) error {
+	return trashRepo(tr.ContextRepo).TrashReview(ctx, id, tr.now().UTC(), middleware.ContextUser(ctx))
+}
+
+func (tr trashingRepo) DeleteComment(ctx context.Context, reviewID, id int) error {
+	return trashRepo(tr.ContextRepo).TrashComment(ctx, reviewID, id, tr.now().UTC(), middleware.ContextUser(ctx))
+}
+
+func (tr trashingRepo) Batch(ctx context.Context, fn func(ctx context.Context, tx ContextRepo) error) error {
+	return tr.ContextRepo.Batch(ctx, func(ctx context.Context, tx ContextRepo) error {
+		return fn(ctx, trashingRepo{tx, tr.now})
+	})
+}
+
+// WithTrash moves deleted reviews and comments to t rather than
+// deleting them for good, and enables the endpoints for looking through
+// the trash and restoring from it.
+func WithTrash(t *Trash) Option {
+	return func(a *API) {
+		a.trash = t
+	}
+}
+
+// ReadTrash implements GET /admin/trash
+func (a API) ReadTrash(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	items, err := a.trash.List(ctx)
+	if err != nil {
+		handleRepoError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	respond(w, r, http.StatusOK, items)
+}
+
+// RestoreReview implements POST /reviews/{id}/restore
+func (a API) RestoreReview(w http.ResponseWriter, r *http.Request) {
+	var id int
+	{
+		vars := mux.Vars(r)
+		_, err := fmt.Sscanf(vars["id"], "%d", &id)
+		if err != nil {
+			HandleError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	review, err := a.trash.RestoreReview(ctx, a.ContextRepo, id)
+	if err != nil {
+		handleRestoreError(w, r, err)
+		return
+	}
+	respond(w, r, http.StatusOK, review)
+}
+
+// RestoreComment implements POST /reviews/{rid}/comments/{id}/restore
+func (a API) RestoreComment(w http.ResponseWriter, r *http.Request) {
+	var rid, id int
+	{
+		vars := mux.Vars(r)
+		_, err := fmt.Sscanf(vars["rid"], "%d", &rid)
+		if err != nil {
+			HandleError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		_, err = fmt.Sscanf(vars["id"], "%d", &id)
+		if err != nil {
+			HandleError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	ctx, cancel := a.context(r)
+	defer cancel()
+
+	comment, err := a.trash.RestoreComment(ctx, a.ContextRepo, rid, id)
+	if err != nil {
+		handleRestoreError(w, r, err)
+		return
+	}
+	respond(w, r, http.StatusOK, comment)
+}
+
+func handleRestoreError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case NotInTrash:
+		HandleError(w, r, http.StatusNotFound, err.Error())
+	case IDTaken:
+		HandleError(w, r, http.StatusConflict, err.Error())
+	case ReviewNotFound:
+		HandleError(w, r, http.StatusBadRequest, err.Error())
+	default:
+		handleRepoError(w, r, http.StatusInternalServerError, err)
+	}
+}
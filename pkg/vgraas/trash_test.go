@@ -0,0 +1,218 @@
+package vgraas
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsmith5/vgraas/pkg/middleware"
+)
+
+func TestTrash(t *testing.T) {
+	repo := Adapt(NewRAMRepo())
+	repo.CreateReview(context.Background(), Review{Author: "a", Body: "one"})
+	repo.CreateReview(context.Background(), Review{Author: "b", Body: "two"})
+	repo.CreateComment(context.Background(), 0, Comment{Author: "c", Body: "first"})
+	repo.CreateComment(context.Background(), 0, Comment{Author: "c", Body: "second"})
+
+	trash := NewTrash(repo, TrashConfig{Retention: time.Hour})
+	defer trash.Close()
+	api := NewAPI(repo, WithTrash(trash), WithAdmins("root"))
+	list := func() []Deleted {
+		items, err := trash.List(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+
+	do := func(method, path, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if user != "" {
+			req = middleware.WithUser(req, user)
+		}
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do("DELETE", "/reviews/0/comments/1", "alice"); rr.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d deleting a comment", rr.Code)
+	}
+	if rr := do("DELETE", "/reviews/0", "bob"); rr.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d deleting a review", rr.Code)
+	}
+	if rr := do("GET", "/reviews/0", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected the deleted review to be hidden, got %d", rr.Code)
+	}
+	if rr := do("DELETE", "/reviews/7", "bob"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected deleting a missing review to fail as before, got %d", rr.Code)
+	}
+
+	var items []Deleted
+	json.NewDecoder(do("GET", "/admin/trash", "root").Body).Decode(&items)
+	if len(items) != 2 {
+		t.Fatalf("Expected 2 items in the trash, got %v", items)
+	}
+	if items[0].CommentID == nil || *items[0].CommentID != 1 || items[0].DeletedBy != "alice" || items[0].Comment.Body != "second" {
+		t.Errorf("Unexpected deleted comment %+v", items[0])
+	}
+	if items[1].Review == nil || items[1].DeletedBy != "bob" || len(items[1].Review.Comments) != 1 || items[1].DeletedAt.IsZero() {
+		t.Errorf("Unexpected deleted review %+v", items[1])
+	}
+
+	// Only admins restore
+	if rr := do("POST", "/reviews/0/restore", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected anonymous restores to be refused, got %d", rr.Code)
+	}
+	if rr := do("POST", "/reviews/0/comments/1/restore", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected anonymous restores to be refused, got %d", rr.Code)
+	}
+
+	// Comments are restored to their review, which has to be back first
+	if rr := do("POST", "/reviews/0/comments/1/restore", "root"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected restoring onto a deleted review to fail, got %d", rr.Code)
+	}
+	if rr := do("POST", "/reviews/0/restore", "root"); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "first") {
+		t.Errorf("Expected the restored review, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := do("POST", "/reviews/0/comments/1/restore", "root"); rr.Code != http.StatusOK {
+		t.Errorf("Expected the comment to be restored, got %d %s", rr.Code, rr.Body.String())
+	}
+	if comments, _ := repo.ReadComments(context.Background(), 0); len(comments) != 2 {
+		t.Errorf("Expected both comments back, got %v", comments)
+	}
+	if rr := do("POST", "/reviews/0/restore", "root"); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for what isn't in the trash, got %d", rr.Code)
+	}
+	if items := list(); len(items) != 0 {
+		t.Errorf("Expected an empty trash, got %v", items)
+	}
+
+	// Putting a review over one in the trash replaces it
+	do("DELETE", "/reviews/1", "")
+	repo.PutReview(context.Background(), 1, Review{Author: "d", Body: "new"})
+	if rr := do("POST", "/reviews/1/restore", "root"); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a replaced review, got %d", rr.Code)
+	}
+	if items := list(); len(items) != 0 {
+		t.Errorf("Expected the review to be gone from the trash, got %v", items)
+	}
+}
+
+func TestTrashInRepo(t *testing.T) {
+	rr := NewRAMRepo()
+	repo := Adapt(rr)
+	repo.CreateReview(context.Background(), Review{Author: "a", Body: "one"})
+	repo.CreateComment(context.Background(), 0, Comment{Author: "c", Body: "first"})
+	repo.CreateComment(context.Background(), 0, Comment{Author: "c", Body: "second"})
+	trash := NewTrash(repo, TrashConfig{Retention: time.Hour})
+	defer trash.Close()
+	deletes := trash.Wrap(repo)
+
+	// Deleted comments and reviews are marked in the repo and left out
+	// of reads
+	deletes.DeleteComment(context.Background(), 0, 1)
+	if _, err := rr.ReadComment(0, 1); err != CommentNotFound {
+		t.Errorf("Expected the deleted comment to be left out, got %v", err)
+	}
+	if _, err := rr.CreateComment(0, Comment{Body: "third"}); err != nil {
+		t.Fatal(err)
+	}
+	deletes.DeleteReview(context.Background(), 0)
+	if reviews, _ := rr.ReadReviews(); len(reviews) != 0 {
+		t.Errorf("Expected the deleted review to be left out, got %v", reviews)
+	}
+	if err := rr.UpdateReview(0, Review{Body: "changed"}); err != ReviewNotFound {
+		t.Errorf("Expected the deleted review not to be found for updates, got %v", err)
+	}
+	items, _ := rr.(Trasher).ReadTrash()
+	if len(items) != 2 || *items[0].CommentID != 1 || len(items[1].Review.Comments) != 2 {
+		t.Errorf("Unexpected trash %+v", items)
+	}
+
+	// A new comment doesn't take the ID of one in the trash
+	repo.PutReview(context.Background(), 0, *items[1].Review)
+	if id, _ := rr.CreateComment(0, Comment{Body: "fourth"}); id != 3 {
+		t.Errorf("Expected comment ID 3, got %d", id)
+	}
+
+	// Another trash on the same repo, a replica say, sees it too
+	other := NewTrash(repo, TrashConfig{})
+	defer other.Close()
+	if items, _ := other.List(context.Background()); len(items) != 1 || *items[0].CommentID != 1 {
+		t.Errorf("Expected the comment still in the trash, got %+v", items)
+	}
+
+	// Repos that can't keep deleted reviews refuse deletes
+	plain := NewTrash(Adapt(plainRepo{NewRAMRepo()}), TrashConfig{}).Wrap(Adapt(plainRepo{NewRAMRepo()}))
+	if err := plain.DeleteReview(context.Background(), 0); err != NoTrash {
+		t.Errorf("Expected NoTrash, got %v", err)
+	}
+}
+
+func TestTrashBatch(t *testing.T) {
+	repo := Adapt(NewRAMRepo())
+	repo.CreateReview(context.Background(), Review{Author: "a", Body: "one"})
+	trash := NewTrash(repo, TrashConfig{})
+	defer trash.Close()
+	api := NewAPI(repo, WithTrash(trash))
+	list := func() []Deleted {
+		items, _ := trash.List(context.Background())
+		return items
+	}
+
+	batch := func(body string) {
+		req := httptest.NewRequest("POST", "/batch", strings.NewReader(body))
+		api.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	batch(`{"atomic":true,"operations":[{"method":"DELETE","path":"/reviews/0"},{"method":"DELETE","path":"/reviews/9"}]}`)
+	if items := list(); len(items) != 0 {
+		t.Errorf("Expected a rolled back delete to leave the trash alone, got %v", items)
+	}
+	batch(`{"atomic":true,"operations":[{"method":"DELETE","path":"/reviews/0"},{"method":"POST","path":"/reviews/0/restore"}]}`)
+	if items := list(); len(items) != 0 {
+		t.Errorf("Expected restores not to be allowed in a batch, got %v", items)
+	}
+	batch(`{"atomic":true,"operations":[{"method":"DELETE","path":"/reviews/0"}]}`)
+	if items := list(); len(items) != 1 {
+		t.Errorf("Expected the committed delete in the trash, got %v", items)
+	}
+}
+
+func TestTrashPurge(t *testing.T) {
+	repo := Adapt(NewRAMRepo())
+	trash := NewTrash(repo, TrashConfig{Retention: time.Hour})
+	defer trash.Close()
+	now := time.Now()
+	trash.now = func() time.Time { return now }
+	deletes := trash.Wrap(repo)
+
+	var purged []Deleted
+	trash.onPurge(func(d Deleted) { purged = append(purged, d) })
+
+	for i := 0; i < 3; i++ {
+		repo.CreateReview(context.Background(), Review{Body: "review"})
+		deletes.DeleteReview(context.Background(), i)
+		now = now.Add(20 * time.Minute)
+	}
+	now = now.Add(-10 * time.Minute)
+	if n, err := trash.Purge(context.Background()); n != 0 || err != nil {
+		t.Errorf("Expected nothing to be purged yet, purged %d: %v", n, err)
+	}
+	now = now.Add(30 * time.Minute)
+	if n, _ := trash.Purge(context.Background()); n != 2 || len(purged) != 2 || purged[1].ReviewID != 1 {
+		t.Errorf("Expected the 2 oldest items to be purged, purged %d %v", n, purged)
+	}
+	if items, _ := trash.List(context.Background()); len(items) != 1 || items[0].ReviewID != 2 {
+		t.Errorf("Unexpected items left %v", items)
+	}
+	if err := repo.PutComment(context.Background(), 0, 0, Comment{}); err != ReviewNotFound {
+		t.Errorf("Expected purged reviews to be gone for good, got %v", err)
+	}
+}
@@ -0,0 +1,733 @@
+package vgraas
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nsmith5/vgraas/pkg/health"
+	"github.com/nsmith5/vgraas/pkg/logging"
+	"github.com/nsmith5/vgraas/pkg/middleware"
+)
+
+// WebhookNotFound is returned when a webhook id doesn't exist.
+var WebhookNotFound = errors.New("Webhook not found")
+
+// Webhook is a subscription to events. Matching events are POSTed to
+// URL as JSON, signed with Secret. They are sent in order, but a retried
+// delivery can arrive after later events; receivers that care should go
+// by the event ID.
+type Webhook struct {
+	ID     int      `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+
+	// Secret is write only and never shows up in responses
+	Secret string `json:"secret,omitempty"`
+
+	// Disabled is set once Failures reaches the configured limit. No
+	// more events are sent until the webhook is enabled again.
+	Disabled bool      `json:"disabled"`
+	Failures int       `json:"failures"`
+	Created  time.Time `json:"created"`
+}
+
+// Delivery records a single attempt to deliver an event to a webhook.
+type Delivery struct {
+	ID        int       `json:"id"`
+	WebhookID int       `json:"webhookId"`
+	Event     Event     `json:"event"`
+	Attempt   int       `json:"attempt"`
+	Time      time.Time `json:"time"`
+	Duration  float64   `json:"duration"`
+	Status    int       `json:"status,omitempty"`
+	Err       string    `json:"err,omitempty"`
+}
+
+// WebhookConfig tunes delivery of webhooks. Zero values are replaced by
+// the defaults noted on each field.
+type WebhookConfig struct {
+	// Workers is the number of concurrent deliveries (4). Each webhook
+	// is delivered to by one of them, so its events are sent one at a
+	// time in the order they happened
+	Workers int
+
+	// QueueSize bounds the number of pending deliveries, split evenly
+	// between the workers. Events that don't fit are dropped and
+	// logged (1024)
+	QueueSize int
+
+	// MaxAttempts is how many times an event is tried before giving up
+	// on it (5)
+	MaxAttempts int
+
+	// Retries back off exponentially starting at MinBackoff, capped at
+	// MaxBackoff (1s, 5m)
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// DisableAfter is the number of consecutive failed attempts after
+	// which a webhook is disabled (20)
+	DisableAfter int
+
+	// Timeout bounds a single delivery attempt (10s)
+	Timeout time.Duration
+
+	// LogSize is the number of deliveries kept per webhook (50)
+	LogSize int
+
+	// AllowPrivate allows webhooks to loopback, link-local and private
+	// addresses, for receivers inside the deployment. Otherwise they
+	// are refused when webhooks are created and again when connecting,
+	// so that names resolving to them later don't slip through (false)
+	AllowPrivate bool
+
+	// Logger reports dropped deliveries and disabled webhooks (info
+	// level to stderr)
+	Logger *logging.Logger
+}
+
+func (c *WebhookConfig) setDefaults() {
+	if c.Workers <= 0 {
+		c.Workers = 4
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 1024
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = 5
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = time.Second
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = 5 * time.Minute
+	}
+	if c.DisableAfter <= 0 {
+		c.DisableAfter = 20
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if c.LogSize <= 0 {
+		c.LogSize = 50
+	}
+	if c.Logger == nil {
+		c.Logger = logging.New(os.Stderr, logging.Info)
+	}
+}
+
+type delivery struct {
+	hook    int
+	event   Event
+	attempt int
+}
+
+type webhookState struct {
+	Webhook
+	log []Delivery
+}
+
+// Webhooks manages webhook subscriptions and delivers events from a Bus
+// to them in the background.
+type Webhooks struct {
+	cfg    WebhookConfig
+	client *http.Client
+
+	mtx          sync.Mutex
+	hooks        map[int]*webhookState
+	nextID       int
+	nextDelivery int
+	closed       bool
+	retries      map[*time.Timer]struct{}
+
+	queues []chan delivery // One per worker, see enqueue
+	quit   chan struct{}
+	wg     sync.WaitGroup
+	cancel func()
+}
+
+// NewWebhooks starts delivering events published on bus to webhook
+// subscribers. Call Close to stop.
+func NewWebhooks(bus *Bus, cfg WebhookConfig) *Webhooks {
+	cfg.setDefaults()
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	if !cfg.AllowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, _ := net.SplitHostPort(address)
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("Webhook address %s isn't public", host)
+			}
+			return nil
+		}
+	}
+	wh := &Webhooks{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: cfg.Timeout,
+			// Straight to the receiver, a proxy would dial for us
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: cfg.Timeout,
+				MaxIdleConns:        100,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+		hooks:   make(map[int]*webhookState),
+		retries: make(map[*time.Timer]struct{}),
+		queues:  make([]chan delivery, cfg.Workers),
+		quit:    make(chan struct{}),
+	}
+
+	size := (cfg.QueueSize + cfg.Workers - 1) / cfg.Workers
+	for i := range wh.queues {
+		wh.queues[i] = make(chan delivery, size)
+		wh.wg.Add(1)
+		go wh.worker(wh.queues[i])
+	}
+	wh.cancel = bus.Subscribe(wh.dispatch)
+	return wh
+}
+
+// Close stops delivering events. Deliveries in flight are allowed to
+// finish, queued and pending retries are dropped.
+func (wh *Webhooks) Close() {
+	wh.mtx.Lock()
+	if wh.closed {
+		wh.mtx.Unlock()
+		return
+	}
+	wh.closed = true
+	for t := range wh.retries {
+		t.Stop()
+	}
+	wh.mtx.Unlock()
+
+	wh.cancel()
+	close(wh.quit)
+	wh.wg.Wait()
+}
+
+// QueueLen returns the number of deliveries waiting for a worker.
+func (wh *Webhooks) QueueLen() int {
+	n := 0
+	for _, q := range wh.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// QueueChecker returns a health check that fails once more than max
+// deliveries are waiting, a sign that receivers can't keep up.
+func (wh *Webhooks) QueueChecker(max int) health.Checker {
+	return health.CheckerFunc(func(ctx context.Context) error {
+		if n := wh.QueueLen(); n > max {
+			return fmt.Errorf("%d webhook deliveries queued, limit is %d", n, max)
+		}
+		return nil
+	})
+}
+
+// Create validates and adds a new webhook, returning its id. Webhooks
+// without a secret are given a random one, see Secret.
+func (wh *Webhooks) Create(h Webhook) (int, error) {
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return 0, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return 0, fmt.Errorf("Webhook url must be an absolute http(s) url")
+	}
+	if !wh.cfg.AllowPrivate {
+		if err := checkPublic(u.Hostname()); err != nil {
+			return 0, err
+		}
+	}
+	if len(h.Events) == 0 {
+		return 0, fmt.Errorf("Webhook must subscribe to at least one event")
+	}
+	for _, typ := range h.Events {
+		if !knownEvent(typ) {
+			return 0, fmt.Errorf("Unknown event type '%s'", typ)
+		}
+	}
+
+	wh.mtx.Lock()
+	defer wh.mtx.Unlock()
+
+	if h.Secret == "" {
+		h.Secret = newSecret()
+	}
+	h.ID = wh.nextID
+	h.Disabled = false
+	h.Failures = 0
+	h.Created = time.Now().UTC()
+	wh.nextID++
+	wh.hooks[h.ID] = &webhookState{Webhook: h}
+	return h.ID, nil
+}
+
+// Secret returns the secret webhook id is signed with, so that a
+// generated one can be handed out once.
+func (wh *Webhooks) Secret(id int) (string, error) {
+	wh.mtx.Lock()
+	defer wh.mtx.Unlock()
+
+	s, ok := wh.hooks[id]
+	if !ok {
+		return "", WebhookNotFound
+	}
+	return s.Secret, nil
+}
+
+// List returns every webhook, secrets removed.
+func (wh *Webhooks) List() []Webhook {
+	wh.mtx.Lock()
+	defer wh.mtx.Unlock()
+
+	hooks := make([]Webhook, 0, len(wh.hooks))
+	for _, s := range wh.hooks {
+		h := s.Webhook
+		h.Secret = ""
+		hooks = append(hooks, h)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID < hooks[j].ID })
+	return hooks
+}
+
+// Read returns a single webhook, secret removed.
+func (wh *Webhooks) Read(id int) (Webhook, error) {
+	wh.mtx.Lock()
+	defer wh.mtx.Unlock()
+
+	s, ok := wh.hooks[id]
+	if !ok {
+		return Webhook{}, WebhookNotFound
+	}
+	h := s.Webhook
+	h.Secret = ""
+	return h, nil
+}
+
+// Delete removes a webhook. Deliveries already queued for it are dropped.
+func (wh *Webhooks) Delete(id int) error {
+	wh.mtx.Lock()
+	defer wh.mtx.Unlock()
+
+	if _, ok := wh.hooks[id]; !ok {
+		return WebhookNotFound
+	}
+	delete(wh.hooks, id)
+	return nil
+}
+
+// Enable re-enables a disabled webhook and resets its failure count.
+func (wh *Webhooks) Enable(id int) error {
+	wh.mtx.Lock()
+	defer wh.mtx.Unlock()
+
+	s, ok := wh.hooks[id]
+	if !ok {
+		return WebhookNotFound
+	}
+	s.Disabled = false
+	s.Failures = 0
+	return nil
+}
+
+// Deliveries returns the most recent delivery attempts for a webhook,
+// newest first.
+func (wh *Webhooks) Deliveries(id int) ([]Delivery, error) {
+	wh.mtx.Lock()
+	defer wh.mtx.Unlock()
+
+	s, ok := wh.hooks[id]
+	if !ok {
+		return nil, WebhookNotFound
+	}
+
+	deliveries := make([]Delivery, len(s.log))
+	for i, d := range s.log {
+		deliveries[len(s.log)-1-i] = d
+	}
+	return deliveries, nil
+}
+
+// dispatch queues e for every enabled webhook subscribed to it.
+func (wh *Webhooks) dispatch(e Event) {
+	wh.mtx.Lock()
+	defer wh.mtx.Unlock()
+
+	for id, s := range wh.hooks {
+		if s.Disabled || !s.subscribed(e.Type) {
+			continue
+		}
+		wh.enqueue(delivery{id, e, 1})
+	}
+}
+
+// enqueue adds d to the queue of its webhook's worker without blocking.
+// The caller must hold the lock.
+func (wh *Webhooks) enqueue(d delivery) {
+	if wh.closed {
+		return
+	}
+	select {
+	case wh.queues[d.hook%len(wh.queues)] <- d:
+	default:
+		wh.cfg.Logger.Warn("Webhook queue full, dropping delivery", "event", d.event.Type, "webhook", d.hook)
+	}
+}
+
+func (wh *Webhooks) worker(queue chan delivery) {
+	defer wh.wg.Done()
+	for {
+		select {
+		case <-wh.quit:
+			return
+		case d := <-queue:
+			wh.deliver(d)
+		}
+	}
+}
+
+func (wh *Webhooks) deliver(d delivery) {
+	wh.mtx.Lock()
+	s, ok := wh.hooks[d.hook]
+	if !ok || s.Disabled {
+		wh.mtx.Unlock()
+		return
+	}
+	target, secret := s.URL, s.Secret
+	record := Delivery{
+		ID:        wh.nextDelivery,
+		WebhookID: d.hook,
+		Event:     d.event,
+		Attempt:   d.attempt,
+		Time:      time.Now().UTC(),
+	}
+	wh.nextDelivery++
+	wh.mtx.Unlock()
+
+	status, err := wh.post(target, secret, record)
+	record.Duration = time.Since(record.Time).Seconds()
+	record.Status = status
+	if err == nil && (status < 200 || status > 299) {
+		err = fmt.Errorf("Unexpected status %d", status)
+	}
+	if err != nil {
+		record.Err = err.Error()
+	}
+
+	wh.mtx.Lock()
+	defer wh.mtx.Unlock()
+
+	s, ok = wh.hooks[d.hook]
+	if !ok {
+		return
+	}
+	s.log = append(s.log, record)
+	if len(s.log) > wh.cfg.LogSize {
+		s.log = s.log[len(s.log)-wh.cfg.LogSize:]
+	}
+
+	if err == nil {
+		s.Failures = 0
+		return
+	}
+
+	s.Failures++
+	if s.Failures >= wh.cfg.DisableAfter {
+		s.Disabled = true
+		wh.cfg.Logger.Warn("Disabling webhook after consecutive failures", "webhook", s.ID, "failures", s.Failures)
+		return
+	}
+
+	if d.attempt < wh.cfg.MaxAttempts && !wh.closed {
+		d.attempt++
+		var t *time.Timer
+		t = time.AfterFunc(wh.backoff(d.attempt), func() {
+			wh.mtx.Lock()
+			defer wh.mtx.Unlock()
+			delete(wh.retries, t)
+			wh.enqueue(d)
+		})
+		wh.retries[t] = struct{}{}
+	}
+}
+
+// backoff returns how long to wait before the given attempt.
+func (wh *Webhooks) backoff(attempt int) time.Duration {
+	b := wh.cfg.MinBackoff
+	for i := 2; i < attempt && b < wh.cfg.MaxBackoff; i++ {
+		b *= 2
+	}
+	if b > wh.cfg.MaxBackoff {
+		b = wh.cfg.MaxBackoff
+	}
+	return b
+}
+
+// post sends a delivery and returns the response status.
+//
+// The body is the JSON encoded event. The time of the attempt goes in
+// the X-Vgraas-Timestamp header, as Unix seconds, and both are signed
+// with the webhook secret, see Sign. The signature goes in the
+// X-Vgraas-Signature header as "sha256=<digest>".
+func (wh *Webhooks) post(target, secret string, d Delivery) (int, error) {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "vgraas-webhooks")
+	req.Header.Set("X-Vgraas-Event", d.Event.Type)
+	req.Header.Set("X-Vgraas-Delivery", fmt.Sprintf("%d", d.ID))
+	req.Header.Set("X-Vgraas-Timestamp", strconv.FormatInt(d.Time.Unix(), 10))
+	req.Header.Set("X-Vgraas-Signature", "sha256="+Sign(secret, d.Time.Unix(), body))
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of timestamp, a ".", and body
+// using secret. Webhook receivers can use it to check the
+// X-Vgraas-Signature header against X-Vgraas-Timestamp and the body.
+// They should also refuse timestamps more than a few minutes away from
+// their own clock, so that captured deliveries can't be replayed later.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// privateNets are the address ranges webhooks can't be sent to, on top
+// of loopback, link-local, multicast and unspecified addresses.
+var privateNets, _ = middleware.ParseCIDRs([]string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+})
+
+// publicIP reports whether ip is an address webhooks can be sent to.
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkPublic refuses webhook hosts that are, or resolve to, addresses
+// that aren't public. Names that can't be resolved yet are let through,
+// they are checked again on every delivery.
+func checkPublic(host string) error {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+			return fmt.Errorf("Webhook host %s isn't public", host)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		addrs, _ := net.DefaultResolver.LookupIPAddr(ctx, host)
+		ips = ips[:0]
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, ip := range ips {
+		if !publicIP(ip) {
+			return fmt.Errorf("Webhook host %s isn't public", host)
+		}
+	}
+	return nil
+}
+
+// newSecret returns a random webhook secret.
+func newSecret() string {
+	var b [32]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func (s *webhookState) subscribed(typ string) bool {
+	for _, t := range s.Events {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func knownEvent(typ string) bool {
+	for _, t := range EventTypes {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateWebhook implements POST /webhooks
+func (a API) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var hook Webhook
+	{
+		dec := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		err := dec.Decode(&hook)
+		if err != nil {
+			HandleError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	id, err := a.webhooks.Create(hook)
+	if err != nil {
+		HandleError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if a.audit != nil {
+		created, _ := a.webhooks.Read(id)
+		a.audit.record(r.Context(), AuditCreate, webhookResource(id), nil, snapshot(created))
+	}
+
+	// A generated secret is only ever shown here
+	resp := struct {
+		ID     int    `json:"id"`
+		Secret string `json:"secret,omitempty"`
+	}{ID: id}
+	if hook.Secret == "" {
+		resp.Secret, _ = a.webhooks.Secret(id)
+	}
+
+	respond(w, r, http.StatusOK, resp)
+}
+
+// ReadWebhooks implements GET /webhooks
+func (a API) ReadWebhooks(w http.ResponseWriter, r *http.Request) {
+	respond(w, r, http.StatusOK, a.webhooks.List())
+}
+
+// ReadWebhook implements GET /webhooks/{id}
+func (a API) ReadWebhook(w http.ResponseWriter, r *http.Request) {
+	var id int
+	{
+		vars := mux.Vars(r)
+		_, err := fmt.Sscanf(vars["id"], "%d", &id)
+		if err != nil {
+			HandleError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	hook, err := a.webhooks.Read(id)
+	if err != nil {
+		HandleError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	respond(w, r, http.StatusOK, hook)
+}
+
+// DeleteWebhook implements DELETE /webhooks/{id}
+func (a API) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	var id int
+	{
+		vars := mux.Vars(r)
+		_, err := fmt.Sscanf(vars["id"], "%d", &id)
+		if err != nil {
+			HandleError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	before, _ := a.webhooks.Read(id)
+	err := a.webhooks.Delete(id)
+	if err != nil {
+		HandleError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if a.audit != nil {
+		a.audit.record(r.Context(), AuditDelete, webhookResource(id), snapshot(before), nil)
+	}
+}
+
+// EnableWebhook implements POST /webhooks/{id}/enable
+func (a API) EnableWebhook(w http.ResponseWriter, r *http.Request) {
+	var id int
+	{
+		vars := mux.Vars(r)
+		_, err := fmt.Sscanf(vars["id"], "%d", &id)
+		if err != nil {
+			HandleError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	before, _ := a.webhooks.Read(id)
+	err := a.webhooks.Enable(id)
+	if err != nil {
+		HandleError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if a.audit != nil {
+		after, _ := a.webhooks.Read(id)
+		a.audit.record(r.Context(), AuditUpdate, webhookResource(id), snapshot(before), snapshot(after))
+	}
+}
+
+// ReadDeliveries implements GET /webhooks/{id}/deliveries
+func (a API) ReadDeliveries(w http.ResponseWriter, r *http.Request) {
+	var id int
+	{
+		vars := mux.Vars(r)
+		_, err := fmt.Sscanf(vars["id"], "%d", &id)
+		if err != nil {
+			HandleError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	deliveries, err := a.webhooks.Deliveries(id)
+	if err != nil {
+		HandleError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	respond(w, r, http.StatusOK, deliveries)
+}
@@ -0,0 +1,236 @@
+package vgraas
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsmith5/vgraas/pkg/middleware"
+)
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	received := make(chan Event, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		ts, err := strconv.ParseInt(r.Header.Get("X-Vgraas-Timestamp"), 10, 64)
+		if err != nil || time.Since(time.Unix(ts, 0)) > time.Minute {
+			t.Errorf("Bad webhook timestamp %q", r.Header.Get("X-Vgraas-Timestamp"))
+		}
+		if r.Header.Get("X-Vgraas-Signature") != "sha256="+Sign("s3cret", ts, body) {
+			t.Error("Webhook signature doesn't match")
+		}
+
+		var e Event
+		json.Unmarshal(body, &e)
+		if r.Header.Get("X-Vgraas-Event") != e.Type {
+			t.Error("Event header doesn't match body")
+		}
+		received <- e
+	}))
+	defer receiver.Close()
+
+	bus := NewBus()
+	wh := NewWebhooks(bus, WebhookConfig{AllowPrivate: true})
+	defer wh.Close()
+	api := NewAPI(Adapt(NewRAMRepo()), WithBus(bus), WithWebhooks(wh), WithAdmins("admin"))
+
+	requests := []Request{
+		Request{"POST", "/webhooks", `{"url": "` + receiver.URL + `", "events": ["comment.created"], "secret": "s3cret"}`},
+		Request{"POST", "/reviews/", `{"author": "me", "body": "great"}`},
+		Request{"POST", "/reviews/0/comments", `{"author": "you", "body": "nope"}`},
+	}
+	for _, request := range requests {
+		req, _ := http.NewRequest(request.verb, request.path, strings.NewReader(request.body))
+		req = middleware.WithUser(req, "admin")
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Request %v failed with status %d", request, rr.Code)
+		}
+	}
+
+	select {
+	case e := <-received:
+		if e.Type != CommentCreated || e.ReviewID != 0 || e.Comment == nil || e.Comment.Body != "nope" {
+			t.Errorf("Unexpected event %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Webhook was never delivered")
+	}
+
+	select {
+	case e := <-received:
+		t.Errorf("Received unsubscribed event %s", e.Type)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	req, _ := http.NewRequest("GET", "/webhooks/0", nil)
+	req = middleware.WithUser(req, "admin")
+	rr := httptest.NewRecorder()
+	api.ServeHTTP(rr, req)
+	if strings.Contains(rr.Body.String(), "s3cret") {
+		t.Error("Webhook secret leaked in response")
+	}
+}
+
+func TestWebhookRetryAndDisable(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	bus := NewBus()
+	wh := NewWebhooks(bus, WebhookConfig{
+		AllowPrivate: true,
+		MaxAttempts:  3,
+		MinBackoff:   time.Millisecond,
+		DisableAfter: 5,
+	})
+	defer wh.Close()
+
+	id, err := wh.Create(Webhook{URL: receiver.URL, Events: []string{ReviewCreated}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bus.Publish(Event{Type: ReviewCreated})
+	waitFor(t, "retries", func() bool {
+		deliveries, _ := wh.Deliveries(id)
+		return len(deliveries) == 3
+	})
+
+	deliveries, _ := wh.Deliveries(id)
+	if deliveries[0].Attempt != 3 || deliveries[0].Status != 500 || deliveries[0].Err == "" {
+		t.Errorf("Unexpected latest delivery %+v", deliveries[0])
+	}
+
+	bus.Publish(Event{Type: ReviewCreated})
+	waitFor(t, "webhook to be disabled", func() bool {
+		hook, _ := wh.Read(id)
+		return hook.Disabled
+	})
+
+	if deliveries, _ := wh.Deliveries(id); len(deliveries) != 5 {
+		t.Errorf("Expected delivery to stop once disabled, got %d attempts", len(deliveries))
+	}
+}
+
+func TestWebhookOrder(t *testing.T) {
+	received := make(chan int64, 20)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		json.NewDecoder(r.Body).Decode(&e)
+		// Later events would overtake this one if they were sent at
+		// the same time
+		if e.ID%2 == 1 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		received <- e.ID
+	}))
+	defer receiver.Close()
+
+	bus := NewBus()
+	wh := NewWebhooks(bus, WebhookConfig{AllowPrivate: true, Workers: 4})
+	defer wh.Close()
+	if _, err := wh.Create(Webhook{URL: receiver.URL, Events: []string{ReviewCreated}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < cap(received); i++ {
+		bus.Publish(Event{Type: ReviewCreated})
+	}
+	for want := int64(1); want <= int64(cap(received)); want++ {
+		select {
+		case id := <-received:
+			if id != want {
+				t.Fatalf("Expected event %d, got %d", want, id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for event %d", want)
+		}
+	}
+}
+
+func TestWebhookTargets(t *testing.T) {
+	received := make(chan struct{}, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer receiver.Close()
+
+	bus := NewBus()
+	wh := NewWebhooks(bus, WebhookConfig{MaxAttempts: 1})
+	defer wh.Close()
+
+	for _, target := range []string{
+		receiver.URL,
+		"http://localhost:8080/hook",
+		"http://10.1.2.3/hook",
+		"http://[::1]/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"https://[fd00::1]/hook",
+	} {
+		if _, err := wh.Create(Webhook{URL: target, Events: []string{ReviewCreated}}); err == nil {
+			t.Errorf("Expected %s to be refused", target)
+		}
+	}
+
+	// Secrets are generated when there isn't one, and handed out once
+	api := NewAPI(Adapt(NewRAMRepo()), WithBus(bus), WithWebhooks(wh), WithAdmins("admin"))
+	req := httptest.NewRequest("POST", "/webhooks", strings.NewReader(`{"url":"http://93.184.216.34/hook","events":["review.created"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	api.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected anonymous users to be refused, got %d", rr.Code)
+	}
+	req = middleware.WithUser(httptest.NewRequest("POST", "/webhooks", strings.NewReader(`{"url":"http://93.184.216.34/hook","events":["review.created"]}`)), "admin")
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	api.ServeHTTP(rr, req)
+	var created struct {
+		ID     int    `json:"id"`
+		Secret string `json:"secret"`
+	}
+	json.NewDecoder(rr.Body).Decode(&created)
+	if secret, _ := wh.Secret(created.ID); rr.Code != http.StatusOK || len(created.Secret) != 64 || created.Secret != secret {
+		t.Errorf("Expected a generated secret, got %d %+v", rr.Code, created)
+	}
+	wh.Delete(created.ID)
+
+	// Names that come to resolve to private addresses are refused
+	// when connecting
+	wh.mtx.Lock()
+	wh.hooks[99] = &webhookState{Webhook: Webhook{ID: 99, URL: receiver.URL, Events: []string{ReviewCreated}, Secret: "s"}}
+	wh.mtx.Unlock()
+	bus.Publish(Event{Type: ReviewCreated})
+
+	waitFor(t, "the delivery", func() bool {
+		deliveries, _ := wh.Deliveries(99)
+		return len(deliveries) == 1
+	})
+	if deliveries, _ := wh.Deliveries(99); !strings.Contains(deliveries[0].Err, "isn't public") {
+		t.Errorf("Expected the delivery to be refused, got %+v", deliveries[0])
+	}
+	select {
+	case <-received:
+		t.Error("Expected nothing to reach the receiver")
+	default:
+	}
+}